@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"github.com/niioka/dnsbox/dns"
 	log "github.com/sirupsen/logrus"
 	"net/http"
@@ -34,7 +35,7 @@ type CheckDomainResponse struct {
 }
 
 type DNSClient interface {
-	Resolve(name string, resourceType dns.ResourceType) (*dns.Packet, error)
+	ResolveContext(ctx context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error)
 }
 
 type CheckDomainHandler struct {
@@ -51,7 +52,7 @@ func (h *CheckDomainHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	received, err := h.Client.Resolve(domain, dns.ResourceTypeTXT)
+	received, err := h.Client.ResolveContext(r.Context(), domain, dns.ResourceTypeTXT)
 	if err != nil {
 		log.Errorf("failed to resolve DNS record: %v", err)
 		sendResponse(w, http.StatusInternalServerError, ErrorResponse{
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/google/go-cmp/cmp"
@@ -14,7 +15,7 @@ type StubDNSClient struct {
 	ResolveFunc func(name string, resourceType dns.ResourceType) (*dns.Packet, error)
 }
 
-func (c StubDNSClient) Resolve(name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+func (c StubDNSClient) ResolveContext(_ context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error) {
 	if c.ResolveFunc == nil {
 		return nil, errors.New("ResolveFunc should not be nil")
 	}
@@ -2,47 +2,87 @@ package api
 
 import (
 	"context"
+	"errors"
 	"github.com/niioka/dnsbox/dns/client"
+	"net"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrServerStarted is returned by Start when the server was started before.
+var ErrServerStarted = errors.New("api: server already started")
+
 type Server struct {
 	httpServer http.Server
+	ready      chan struct{}
+	started    atomic.Bool
+}
+
+type Config struct {
+	Addr   string
+	Client DNSClient
 }
 
-func New() *Server {
+func New(config Config) *Server {
+	if config.Addr == "" {
+		config.Addr = ":8080"
+	}
+	if config.Client == nil {
+		config.Client = client.New(client.Config{
+			Verbose: true,
+		})
+	}
+
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
-	client := client.New(client.Config{
-		Server:  "8.8.8.8",
-		Verbose: true,
-	})
-
 	testDomainHandler := CheckDomainHandler{
-		Client: client,
+		Client: config.Client,
 	}
 
 	r.Get("/api/check", testDomainHandler.Handle)
 
 	return &Server{
 		httpServer: http.Server{
-			Addr:    ":8080",
+			Addr:    config.Addr,
 			Handler: r,
 		},
+		ready: make(chan struct{}),
+	}
+}
+
+// Start - API サーバーを起動し、止まるまで待つ
+//
+// Start returns http.ErrServerClosed once the server was shut down.
+// Cancelling ctx closes the server at once; use Shutdown to finish the
+// requests in progress first. A server is started only once.
+func (s *Server) Start(ctx context.Context) error {
+	if !s.started.CompareAndSwap(false, true) {
+		return ErrServerStarted
+	}
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
 	}
+	log.Infof("Start API server on %s...", ln.Addr())
+	close(s.ready)
+
+	stop := context.AfterFunc(ctx, func() { _ = s.httpServer.Close() })
+	defer stop()
+	return s.httpServer.Serve(ln)
 }
 
-func (s *Server) Start() error {
-	log.Infof("Start API server on %s...", s.httpServer.Addr)
-	return s.httpServer.ListenAndServe()
+// Ready - Start がリスナーを開き終えると閉じるチャネルを返す
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
 }
 
-func (s *Server) Stop() error {
-	log.Infof("Stutting down API server on %s...", s.httpServer.Addr)
-	return s.httpServer.Shutdown(context.Background())
+// Shutdown - 処理中のリクエストを ctx が終わるまで待って止める
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Infof("Shutting down API server on %s...", s.httpServer.Addr)
+	return s.httpServer.Shutdown(ctx)
 }
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_Start_twice(t *testing.T) {
+	// ARRANGE
+	s := New(Config{Addr: "127.0.0.1:0", Client: StubDNSClient{}})
+	errs := make(chan error, 1)
+	go func() { errs <- s.Start(context.Background()) }()
+	select {
+	case <-s.Ready():
+	case err := <-errs:
+		t.Fatalf("Start: unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Start: not ready")
+	}
+
+	// ACT
+	err := s.Start(context.Background())
+
+	// ASSERT
+	if !errors.Is(err, ErrServerStarted) {
+		t.Errorf("Start: want ErrServerStarted, got %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: unexpected error: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Start: want http.ErrServerClosed, got %v", err)
+	}
+}
@@ -1,16 +1,41 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/niioka/dnsbox/dns"
 	"github.com/niioka/dnsbox/dns/client"
+	"github.com/niioka/dnsbox/dns/dnssec"
+	"github.com/niioka/dnsbox/dns/resolver"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
 )
 
 type Args struct {
-	DNSServer string
-	Name      string
-	RRType    dns.ResourceType
+	DNSServer     string
+	TCP           bool
+	Transport     client.Transport
+	TLSServerName string
+	TLSCAFile     string
+	TLSPins       string
+	DoHMethod     string
+	Recursive     bool
+	DNSSEC        bool
+	ClientSubnet  netip.Prefix
+	Timeout       time.Duration
+	Retries       int
+	BatchFile     string
+	Workers       int
+	RateLimit     float64
+	Name          string
+	RRType        dns.ResourceType
 }
 
 func main() {
@@ -21,28 +46,224 @@ func main() {
 		return
 	}
 
-	dnsClient := client.New(client.Config{
-		Server: args.DNSServer,
-	})
+	tlsConfig, err := newTLSConfig(args)
+	if err != nil {
+		fmt.Printf("failed to configure TLS: %v", err)
+		return
+	}
 
-	received, err := dnsClient.Resolve(args.Name, args.RRType)
+	config, err := newClientConfig(args)
+	if err != nil {
+		fmt.Printf("failed to read the system resolver settings: %v", err)
+		return
+	}
+	config.Transport = args.Transport
+	config.ForceTCP = args.TCP
+	config.TLSConfig = tlsConfig
+	config.DoHMethod = args.DoHMethod
+	config.ClientSubnet = args.ClientSubnet
+	dnsClient := client.New(config)
+	defer func() { _ = dnsClient.Close() }()
+
+	if args.BatchFile != "" {
+		if err := runBatch(args, dnsClient); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if args.DNSSEC {
+		result, err := dnssec.New(dnssec.Config{Client: dnsClient}).ValidateContext(context.Background(), args.Name, args.RRType)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(";; ANSWER SECTION:")
+		for _, answer := range result.Packet.Answers {
+			fmt.Println(answer)
+		}
+		fmt.Println()
+		fmt.Printf(";; DNSSEC: %v\n", result.Status)
+		if result.Err != nil {
+			fmt.Printf(";; REASON: %v\n", result.Err)
+		}
+		return
+	}
+
+	if args.Recursive {
+		received, err := resolver.New(resolver.Config{Client: dnsClient}).ResolveContext(context.Background(), args.Name, args.RRType)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(";; ANSWER SECTION:")
+		for _, answer := range received.Answers {
+			fmt.Println(answer)
+		}
+		return
+	}
+
+	// relative names are expanded with the search list of resolv.conf
+	received, err := dnsClient.LookupContext(context.Background(), args.Name, args.RRType)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
 	fmt.Println(";; ANSWER SECTION:")
-	for _, answer := range received.Answers {
+	for _, answer := range received.Packet.Answers {
 		fmt.Println(answer)
 	}
+	fmt.Println()
+	fmt.Printf(";; Query time: %d msec\n", received.RTT.Milliseconds())
+	fmt.Printf(";; SERVER: %s (%s)\n", received.Upstream, received.Network)
+	if edns := received.Packet.EDNS(); edns != nil {
+		if subnet, err := edns.ClientSubnet(); err == nil && subnet != nil {
+			fmt.Printf(";; CLIENT-SUBNET: %v scope /%d\n", subnet.Prefix, subnet.Scope)
+		}
+	}
+}
+
+// runBatch - ファイルか標準入力から 1 行 1 クエリを読み込み、並行して解決する
+//
+// Each line is a name optionally followed by a type, such as "example.com MX".
+// Results are printed as they complete.
+func runBatch(args *Args, dnsClient *client.Client) error {
+	var input io.Reader = os.Stdin
+	if args.BatchFile != "-" {
+		f, err := os.Open(args.BatchFile)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		input = f
+	}
+
+	queries := make(chan client.BatchQuery)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(queries)
+		scanner := bufio.NewScanner(input)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			query := client.BatchQuery{Name: fields[0], Type: args.RRType}
+			if len(fields) >= 2 {
+				rrType, ok := dns.ResourceTypeFromName(fields[1])
+				if !ok {
+					fmt.Printf("%s\t%s\terror: unsupported RRType\n", fields[0], fields[1])
+					continue
+				}
+				query.Type = rrType
+			}
+			queries <- query
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	batch := client.NewBatch(client.BatchConfig{
+		Client:    dnsClient,
+		Workers:   args.Workers,
+		RateLimit: args.RateLimit,
+	})
+	for result := range batch.Stream(context.Background(), queries) {
+		if result.Err != nil {
+			fmt.Printf("%s\t%v\terror: %v\n", result.Query.Name, result.Query.Type, result.Err)
+			continue
+		}
+		var answers []string
+		for _, answer := range result.Response.Packet.Answers {
+			answers = append(answers, answer.RData.String())
+		}
+		fmt.Printf("%s\t%v\trcode=%d\t%s\n", result.Query.Name, result.Query.Type, result.Response.Packet.RCode, strings.Join(answers, ","))
+	}
+	return <-scanErr
+}
+
+// newClientConfig - -dns-server がなければ resolv.conf と hosts の設定を使う
+//
+// Flags given on the command line take precedence over the system settings.
+func newClientConfig(args *Args) (client.Config, error) {
+	config := client.Config{Servers: []string{"8.8.8.8"}, Timeout: args.Timeout, Retries: args.Retries}
+	if args.DNSServer != "" {
+		config.Servers = strings.Split(args.DNSServer, ",")
+		return config, nil
+	}
+	system, err := client.SystemConfig()
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return client.Config{}, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "timeout":
+			system.Timeout = args.Timeout
+		case "retries":
+			system.Retries = args.Retries
+		}
+	})
+	return system, nil
+}
+
+func newTLSConfig(args *Args) (*client.TLSConfig, error) {
+	config := &client.TLSConfig{
+		ServerName: args.TLSServerName,
+	}
+	if args.TLSPins != "" {
+		config.SPKIPins = strings.Split(args.TLSPins, ",")
+	}
+	if args.TLSCAFile != "" {
+		pem, err := os.ReadFile(args.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", args.TLSCAFile)
+		}
+	}
+	return config, nil
 }
 
 func parseArgs() (*Args, error) {
 	result := Args{}
-	flag.StringVar(&result.DNSServer, "dns-server", "8.8.8.8", "DNS Server")
+	var transport, subnet string
+	flag.StringVar(&result.DNSServer, "dns-server", "", "Comma separated list of DNS servers (defaults to "+client.DefaultResolvConfPath+")")
+	flag.BoolVar(&result.Recursive, "recursive", false, "Resolve iteratively from the root servers instead of asking -dns-server")
+	flag.BoolVar(&result.DNSSEC, "dnssec", false, "Validate the answer with DNSSEC from the root trust anchor")
+	flag.StringVar(&subnet, "subnet", "", "Client subnet to send as EDNS Client Subnet, such as 192.0.2.0/24")
+	flag.BoolVar(&result.TCP, "tcp", false, "Use TCP instead of UDP")
+	flag.StringVar(&transport, "transport", "udp", "Transport (udp, tcp, tls, https, quic)")
+	flag.StringVar(&result.TLSServerName, "tls-server-name", "", "Server name to verify the certificate against")
+	flag.StringVar(&result.TLSCAFile, "tls-ca", "", "PEM file of the root CAs")
+	flag.StringVar(&result.DoHMethod, "doh-method", "POST", "HTTP method of DNS-over-HTTPS (POST, GET)")
+	flag.StringVar(&result.TLSPins, "tls-pin", "", "Comma separated list of base64 SHA-256 SPKI pins")
+	flag.DurationVar(&result.Timeout, "timeout", 5*time.Second, "Timeout of each attempt")
+	flag.IntVar(&result.Retries, "retries", 2, "Number of retries")
+	flag.StringVar(&result.BatchFile, "batch", "", "File of queries, one \"name [type]\" per line (- for stdin)")
+	flag.IntVar(&result.Workers, "workers", 16, "Number of concurrent queries of -batch")
+	flag.Float64Var(&result.RateLimit, "rate", 0, "Maximum queries per second of -batch (0 for no limit)")
 	flag.Parse()
 	args := flag.Args()
+	var ok bool
+	if result.Transport, ok = client.TransportFromName(transport); !ok {
+		return nil, fmt.Errorf("unsupported transport: %s", transport)
+	}
+	if subnet != "" {
+		prefix, err := parseSubnet(subnet)
+		if err != nil {
+			return nil, err
+		}
+		result.ClientSubnet = prefix
+	}
 	if len(args) == 0 {
+		if result.BatchFile != "" {
+			result.RRType = dns.ResourceTypeA
+			return &result, nil
+		}
 		return nil, fmt.Errorf("domain is required")
 	}
 
@@ -58,3 +279,15 @@ func parseArgs() (*Args, error) {
 	}
 	return &result, nil
 }
+
+// parseSubnet - "アドレス/プレフィックス長" を解析する。長さがなければアドレス全体を使う
+func parseSubnet(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid subnet: %s", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
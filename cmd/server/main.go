@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
 	"github.com/niioka/dnsbox/dns/server"
+	"github.com/niioka/dnsbox/supervisor"
+	log "github.com/sirupsen/logrus"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	server := server.NewServer(server.ServerConfig{})
-	server.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	sv := supervisor.New(supervisor.Config{})
+	sv.Add("DNS server", server.NewServer(server.ServerConfig{}))
+	if err := sv.Run(ctx); err != nil {
+		log.Fatalf("%v", err)
+	}
 }
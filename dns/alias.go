@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrAliasLoop is returned when a CNAME or DNAME chain leads back to a name it already visited.
+	ErrAliasLoop = errors.New("alias loop")
+	// ErrChainTooLong is returned when a CNAME or DNAME chain exceeds its limit.
+	ErrChainTooLong = errors.New("alias chain too long")
+)
+
+// DefaultMaxChain は別名をたどる回数の既定の上限
+const DefaultMaxChain = 8
+
+// AliasChain は問い合わせ名からたどった CNAME と DNAME を記録する
+type AliasChain struct {
+	// Max is the maximum number of aliases to follow. Defaults to DefaultMaxChain.
+	Max int
+	// Records holds the CNAME and DNAME records in the order they were followed.
+	// A DNAME is followed by the CNAME synthesised from it (RFC 6672 3.3).
+	Records []*ResourceRecord
+
+	seen    map[string]struct{}
+	aliases int
+}
+
+// Follow - records の中で name から別名をたどり、たどり着いた名前と qtype の RRset を返す
+//
+// When records do not hold the RRset of the last name, rrset is nil and the
+// caller has to look target up elsewhere.
+func (c *AliasChain) Follow(records []*ResourceRecord, name string, qtype ResourceType) (target string, rrset []*ResourceRecord, err error) {
+	if c.seen == nil {
+		c.seen = map[string]struct{}{CanonicalName(name): {}}
+	}
+	maxChain := c.Max
+	if maxChain == 0 {
+		maxChain = DefaultMaxChain
+	}
+
+	target = Fqdn(name)
+	for {
+		rrset = RRset(records, target, qtype)
+		if len(rrset) > 0 {
+			return target, rrset, nil
+		}
+
+		var next string
+		if cname := RRset(records, target, ResourceTypeCNAME); len(cname) > 0 {
+			c.Records = append(c.Records, cname[0])
+			next = Fqdn(cname[0].RData.(*CNAMEData).Target)
+		} else if dname := findDNAME(records, target); dname != nil {
+			next = substituteDNAME(target, dname)
+			c.Records = append(c.Records, dname, &ResourceRecord{
+				Name:  target,
+				Class: dname.Class,
+				TTL:   dname.TTL,
+				RData: &CNAMEData{Target: next},
+			})
+		} else {
+			return target, nil, nil
+		}
+
+		c.aliases++
+		if c.aliases > maxChain {
+			return "", nil, fmt.Errorf("%w: %s (limit=%d)", ErrChainTooLong, name, maxChain)
+		}
+		if _, ok := c.seen[CanonicalName(next)]; ok {
+			return "", nil, fmt.Errorf("%w: %s -> %s", ErrAliasLoop, target, next)
+		}
+		c.seen[CanonicalName(next)] = struct{}{}
+		target = next
+	}
+}
+
+// RRset - records から name と rrType に一致するレコードを返す
+func RRset(records []*ResourceRecord, name string, rrType ResourceType) []*ResourceRecord {
+	var rrset []*ResourceRecord
+	name = CanonicalName(name)
+	for _, rr := range records {
+		if rr.RData.ResourceType() == rrType && CanonicalName(rr.Name) == name {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset
+}
+
+// findDNAME - name の祖先にある DNAME を返す
+func findDNAME(records []*ResourceRecord, name string) *ResourceRecord {
+	var found *ResourceRecord
+	for _, rr := range records {
+		if rr.RData.ResourceType() != ResourceTypeDNAME {
+			continue
+		}
+		owner := CanonicalName(rr.Name)
+		// the DNAME only applies below its owner, never to the owner itself
+		if owner == CanonicalName(name) || !IsSubDomain(name, owner) {
+			continue
+		}
+		if found == nil || len(owner) > len(CanonicalName(found.Name)) {
+			found = rr
+		}
+	}
+	return found
+}
+
+// substituteDNAME - name のうち DNAME の所有者名の部分を DNAME の対象に置き換える
+func substituteDNAME(name string, dname *ResourceRecord) string {
+	name = Fqdn(name)
+	prefix := name[:len(name)-len(Fqdn(dname.Name))]
+	target := Fqdn(dname.RData.(*DNAMEData).Target)
+	if target == "." {
+		return prefix
+	}
+	return strings.TrimSuffix(prefix, ".") + "." + target
+}
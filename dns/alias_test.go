@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestAliasChain_Follow(t *testing.T) {
+	cname := func(owner, target string) *ResourceRecord {
+		return &ResourceRecord{Name: owner, Class: ClassIN, TTL: 60, RData: &CNAMEData{Target: target}}
+	}
+	dname := func(owner, target string) *ResourceRecord {
+		return &ResourceRecord{Name: owner, Class: ClassIN, TTL: 60, RData: &DNAMEData{Target: target}}
+	}
+	a := func(owner string) *ResourceRecord {
+		return &ResourceRecord{Name: owner, Class: ClassIN, TTL: 60, RData: &AData{Address: []byte{192, 0, 2, 1}}}
+	}
+
+	cases := []struct {
+		label      string
+		records    []*ResourceRecord
+		name       string
+		max        int
+		wantTarget string
+		wantRRset  []*ResourceRecord
+		wantChain  []*ResourceRecord
+		wantErr    error
+	}{
+		{
+			label:      "ok/no-alias",
+			records:    []*ResourceRecord{a("www.example.com.")},
+			name:       "WWW.example.com",
+			wantTarget: "WWW.example.com.",
+			wantRRset:  []*ResourceRecord{a("www.example.com.")},
+		},
+		{
+			label:      "ok/cname-chain",
+			records:    []*ResourceRecord{cname("www.example.com.", "web.example.com."), cname("web.example.com.", "cdn.example.net."), a("cdn.example.net.")},
+			name:       "www.example.com.",
+			wantTarget: "cdn.example.net.",
+			wantRRset:  []*ResourceRecord{a("cdn.example.net.")},
+			wantChain:  []*ResourceRecord{cname("www.example.com.", "web.example.com."), cname("web.example.com.", "cdn.example.net.")},
+		},
+		{
+			label:      "ok/incomplete-chain",
+			records:    []*ResourceRecord{cname("www.example.com.", "web.example.com.")},
+			name:       "www.example.com.",
+			wantTarget: "web.example.com.",
+			wantChain:  []*ResourceRecord{cname("www.example.com.", "web.example.com.")},
+		},
+		{
+			label:      "ok/dname",
+			records:    []*ResourceRecord{dname("example.com.", "example.net."), a("www.example.net.")},
+			name:       "www.example.com.",
+			wantTarget: "www.example.net.",
+			wantRRset:  []*ResourceRecord{a("www.example.net.")},
+			wantChain:  []*ResourceRecord{dname("example.com.", "example.net."), cname("www.example.com.", "www.example.net.")},
+		},
+		{
+			label:   "Err/loop",
+			records: []*ResourceRecord{cname("a.example.com.", "b.example.com."), cname("b.example.com.", "a.example.com.")},
+			name:    "a.example.com.",
+			wantErr: ErrAliasLoop,
+		},
+		{
+			label:   "Err/too-long",
+			records: []*ResourceRecord{cname("a.example.com.", "b.example.com."), cname("b.example.com.", "c.example.com."), cname("c.example.com.", "d.example.com.")},
+			name:    "a.example.com.",
+			max:     2,
+			wantErr: ErrChainTooLong,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			chain := &AliasChain{Max: tc.max}
+
+			// ACT
+			target, rrset, err := chain.Follow(tc.records, tc.name, ResourceTypeA)
+
+			// ASSERT
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("err: want %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if target != tc.wantTarget {
+				t.Errorf("target: want %q, got %q", tc.wantTarget, target)
+			}
+			if diff := cmp.Diff(tc.wantRRset, rrset); diff != "" {
+				t.Errorf("rrset: mismatch(-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantChain, chain.Records); diff != "" {
+				t.Errorf("chain: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+// Package cache keeps upstream responses for as long as their TTLs allow.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	log "github.com/sirupsen/logrus"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// NetworkCache is the Response.Network of answers served from the cache.
+const NetworkCache = "cache"
+
+const (
+	defaultSize   = 10000
+	defaultShards = 16
+	defaultMaxTTL = 24 * time.Hour
+	// defaultMaxNegativeTTL follows the upper bound suggested by RFC 2308 section 5.
+	defaultMaxNegativeTTL = 3 * time.Hour
+	// defaultStaleAnswerTTL is the TTL recommended by RFC 8767 section 4.
+	defaultStaleAnswerTTL = 30 * time.Second
+	defaultPrefetchRatio  = 0.1
+	defaultPrefetchHits   = 2
+)
+
+// Cache - upstream の応答を TTL に従って保持する Exchanger
+type Cache struct {
+	client         client.Exchanger
+	shards         *shards
+	minTTL         time.Duration
+	maxTTL         time.Duration
+	maxNegativeTTL time.Duration
+	staleTTL       time.Duration
+	staleAnswerTTL time.Duration
+	prefetch       bool
+	prefetchRatio  float64
+	prefetchHits   int64
+	now            func() time.Time
+
+	// scopes records the ECS scopes stored so far.
+	scopes scopeSet
+	// prefetches tracks the background refreshes. They run on baseCtx, which
+	// Close cancels once its ctx is done.
+	prefetches sync.WaitGroup
+	baseCtx    context.Context
+	cancel     context.CancelFunc
+	// mu guards closed, so that no refresh is added while Close waits.
+	mu     sync.Mutex
+	closed bool
+}
+
+type Config struct {
+	// Client answers the queries that miss the cache.
+	Client client.Exchanger
+	// Size is the maximum number of cached responses.
+	Size int
+	// Shards is the number of independently locked parts of the cache.
+	Shards int
+	// MinTTL and MaxTTL clamp the TTLs of positive answers.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// MaxNegativeTTL caps how long NXDOMAIN and NODATA answers are kept.
+	MaxNegativeTTL time.Duration
+	// StaleTTL is how long expired answers are kept to be served while the
+	// upstream is unreachable (RFC 8767). Zero disables serve-stale.
+	StaleTTL time.Duration
+	// StaleAnswerTTL is the TTL of the records in stale answers.
+	StaleAnswerTTL time.Duration
+	// Prefetch refreshes popular entries in the background shortly before
+	// they expire.
+	Prefetch bool
+	// PrefetchRatio is the part of the original TTL left when an entry is
+	// refreshed. Defaults to 0.1.
+	PrefetchRatio float64
+	// PrefetchHits is how many hits make an entry popular. Defaults to 2.
+	PrefetchHits int
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func New(config Config) *Cache {
+	if config.Client == nil {
+		config.Client = client.New(client.Config{})
+	}
+	if config.Size <= 0 {
+		config.Size = defaultSize
+	}
+	if config.Shards <= 0 {
+		config.Shards = defaultShards
+	}
+	if config.Shards > config.Size {
+		config.Shards = config.Size
+	}
+	if config.MaxTTL == 0 {
+		config.MaxTTL = defaultMaxTTL
+	}
+	if config.MaxNegativeTTL == 0 {
+		config.MaxNegativeTTL = defaultMaxNegativeTTL
+	}
+	if config.StaleAnswerTTL == 0 {
+		config.StaleAnswerTTL = defaultStaleAnswerTTL
+	}
+	if config.PrefetchRatio <= 0 {
+		config.PrefetchRatio = defaultPrefetchRatio
+	}
+	if config.PrefetchHits <= 0 {
+		config.PrefetchHits = defaultPrefetchHits
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	baseCtx, cancel := context.WithCancel(context.Background())
+	return &Cache{
+		client:         config.Client,
+		shards:         newShards(config.Shards, config.Size),
+		minTTL:         config.MinTTL,
+		maxTTL:         config.MaxTTL,
+		maxNegativeTTL: config.MaxNegativeTTL,
+		staleTTL:       config.StaleTTL,
+		staleAnswerTTL: config.StaleAnswerTTL,
+		prefetch:       config.Prefetch,
+		prefetchRatio:  config.PrefetchRatio,
+		prefetchHits:   int64(config.PrefetchHits),
+		now:            config.Now,
+		baseCtx:        baseCtx,
+		cancel:         cancel,
+	}
+}
+
+// Close - 新しいプリフェッチを止め、実行中のものが終わるのを待つ
+//
+// The refreshes still running when ctx is done are cancelled, and ctx.Err()
+// is returned. The cache keeps answering from what it holds.
+func (c *Cache) Close(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.prefetches.Wait()
+		close(done)
+	}()
+	defer c.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len - キャッシュされている応答の数
+func (c *Cache) Len() int {
+	n := 0
+	for _, s := range c.shards.list {
+		n += s.len()
+	}
+	return n
+}
+
+func (c *Cache) ResolveContext(ctx context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+	received, err := c.ExchangeContext(ctx, &dns.Packet{
+		QR:     dns.QRQuery,
+		Opcode: dns.OpcodeQuery,
+		RD:     true,
+		Questions: []*dns.Question{
+			{
+				Qname:  name,
+				Qtype:  resourceType,
+				Qclass: dns.ClassIN,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resolve name=%v resourceType=%v: %w", name, resourceType, err)
+	}
+	return received.Packet, nil
+}
+
+// ExchangeContext - キャッシュにあれば TTL を減らした応答を返し、なければ upstream に問い合わせる
+//
+// When the upstream fails and an expired answer is still kept, the expired
+// answer is returned with StaleAnswerTTL.
+func (c *Cache) ExchangeContext(ctx context.Context, query *dns.Packet) (*client.Response, error) {
+	k, ok := cacheKey(query)
+	subnet, valid := querySubnet(query)
+	if !ok || !valid {
+		return c.client.ExchangeContext(ctx, query)
+	}
+	now := c.now()
+	e := c.lookup(k, subnet, now)
+	if e != nil && now.Before(e.expires) {
+		log.Debugf("Cache hit: %s %v", k.name, k.qtype)
+		c.maybePrefetch(e, query, now)
+		return &client.Response{
+			Packet:   e.response(query, now),
+			Upstream: e.upstream,
+			Network:  NetworkCache,
+		}, nil
+	}
+
+	received, err := c.client.ExchangeContext(ctx, query)
+	if e != nil && ctx.Err() == nil && upstreamFailed(received, err) {
+		log.Warnf("Serving stale answer of %s %v: %v", k.name, k.qtype, upstreamError(received, err))
+		return &client.Response{
+			Packet:   e.staleResponse(query, c.staleAnswerTTL),
+			Upstream: e.upstream,
+			Network:  NetworkCache,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e := c.storeScoped(k, subnet, received, now); e != nil {
+		// hand out the clamped TTLs from the first answer on
+		received.Packet = e.response(query, now)
+	}
+	return received, nil
+}
+
+// cacheKey - キャッシュできるクエリであればキーを返す
+func cacheKey(query *dns.Packet) (key, bool) {
+	if query.Opcode != dns.OpcodeQuery || len(query.Questions) != 1 {
+		return key{}, false
+	}
+	q := query.Questions[0]
+	qclass := q.Qclass
+	if qclass == 0 {
+		qclass = dns.ClassIN
+	}
+	k := key{name: dns.CanonicalName(q.Qname), qtype: q.Qtype, qclass: qclass}
+	if edns := query.EDNS(); edns != nil {
+		k.do = edns.DO
+	}
+	return k, true
+}
+
+// storeScoped - 応答の ECS スコープのキーで保存する
+func (c *Cache) storeScoped(k key, subnet *dns.ClientSubnet, received *client.Response, now time.Time) *entry {
+	scoped, ok := scopedKey(k, subnet, received.Packet)
+	if !ok {
+		log.Debugf("Not caching %s %v: client subnet mismatch", k.name, k.qtype)
+		return nil
+	}
+	e := c.store(scoped, received, now)
+	if e != nil && scoped.subnet.IsValid() {
+		c.scopes.add(scoped.subnet)
+	}
+	return e
+}
+
+// store - キャッシュしてよい応答であれば、TTL を丸めて保存する
+func (c *Cache) store(k key, received *client.Response, now time.Time) *entry {
+	res := received.Packet
+	ttl, ok := c.ttl(res)
+	if !ok || ttl <= 0 {
+		return nil
+	}
+	// no record may expire before the entry does, or it would be served with TTL 0
+	packet := *res
+	packet.Answers = clampTTL(res.Answers, ttl, c.maxTTL)
+	packet.Authorities = clampTTL(res.Authorities, ttl, c.maxTTL)
+	packet.Additions = clampTTL(res.Additions, ttl, c.maxTTL)
+	if isNegative(res) {
+		// the TTL of the SOA tells downstream caches how long to keep the
+		// negative answer (RFC 2308 section 3)
+		packet.Authorities = clampTTL(res.Authorities, ttl, ttl)
+	}
+	e := &entry{
+		key:      k,
+		packet:   &packet,
+		upstream: received.Upstream,
+		stored:   now,
+		expires:  now.Add(ttl),
+		evicts:   now.Add(ttl + c.staleTTL),
+	}
+	c.shards.get(k).set(e)
+	return e
+}
+
+// ttl - 応答をキャッシュしておく期間を返す
+//
+// Positive answers live as long as their shortest TTL. NXDOMAIN and NODATA
+// answers live for the smaller of the SOA TTL and its MINIMUM field
+// (RFC 2308 section 5), and are not cached at all without a SOA.
+func (c *Cache) ttl(res *dns.Packet) (time.Duration, bool) {
+	if res.TC || (res.RCode != dns.RCodeNoError && res.RCode != dns.RCodeNameError) {
+		return 0, false
+	}
+	var ttl time.Duration = -1
+	for _, rr := range res.Answers {
+		if d := seconds(rr.TTL); ttl < 0 || d < ttl {
+			ttl = d
+		}
+	}
+	if !isNegative(res) {
+		return clamp(ttl, c.minTTL, c.maxTTL), true
+	}
+
+	soa := negativeTTL(res.Authorities)
+	if soa < 0 {
+		return 0, false
+	}
+	if ttl < 0 || soa < ttl {
+		ttl = soa
+	}
+	return clamp(ttl, c.minTTL, c.maxNegativeTTL), true
+}
+
+// isNegative - NXDOMAIN か NODATA の応答かどうか
+func isNegative(res *dns.Packet) bool {
+	return res.RCode == dns.RCodeNameError || len(res.Answers) == 0
+}
+
+// negativeTTL - authority セクションの SOA から否定応答の TTL を求める。SOA がなければ -1
+func negativeTTL(authorities []*dns.ResourceRecord) time.Duration {
+	for _, rr := range authorities {
+		soa, ok := rr.RData.(*dns.SOAData)
+		if !ok {
+			continue
+		}
+		return seconds(min(rr.TTL, soa.Minttl))
+	}
+	return -1
+}
+
+// response - 経過時間だけ TTL を減らした応答を組み立てる
+func (e *entry) response(query *dns.Packet, now time.Time) *dns.Packet {
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	packet := *e.packet
+	packet.Id = query.Id
+	packet.Answers = decrementTTL(e.packet.Answers, elapsed)
+	packet.Authorities = decrementTTL(e.packet.Authorities, elapsed)
+	packet.Additions = decrementTTL(e.packet.Additions, elapsed)
+	e.echoClientSubnet(&packet, query)
+	return &packet
+}
+
+// staleResponse - 期限切れの応答を ttl 付きで組み立てる
+func (e *entry) staleResponse(query *dns.Packet, ttl time.Duration) *dns.Packet {
+	packet := *e.packet
+	packet.Id = query.Id
+	packet.Answers = clampTTL(e.packet.Answers, ttl, ttl)
+	packet.Authorities = clampTTL(e.packet.Authorities, ttl, ttl)
+	packet.Additions = clampTTL(e.packet.Additions, ttl, ttl)
+	e.echoClientSubnet(&packet, query)
+	return &packet
+}
+
+// upstreamFailed - upstream から使える応答を得られなかったかどうか
+func upstreamFailed(received *client.Response, err error) bool {
+	return err != nil || received.Packet.RCode == dns.RCodeServerFailure
+}
+
+func upstreamError(received *client.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("upstream %s answered SERVFAIL", received.Upstream)
+}
+
+// maybePrefetch - 人気のあるエントリが期限切れ間近であれば、バックグラウンドで更新する
+//
+// Only one refresh runs per entry; the refreshed answer replaces the entry
+// so that later hits never wait for the upstream.
+func (c *Cache) maybePrefetch(e *entry, query *dns.Packet, now time.Time) {
+	hits := e.hits.Add(1)
+	if !c.prefetch || hits < c.prefetchHits {
+		return
+	}
+	ttl := e.expires.Sub(e.stored)
+	if e.expires.Sub(now) > time.Duration(float64(ttl)*c.prefetchRatio) {
+		return
+	}
+	if !e.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	refresh := *query
+	c.prefetches.Add(1)
+	go func() {
+		defer c.prefetches.Done()
+		log.Debugf("Prefetching %s %v", e.key.name, e.key.qtype)
+		received, err := c.client.ExchangeContext(c.baseCtx, &refresh)
+		if err != nil {
+			log.Warnf("Failed to prefetch %s %v: %v", e.key.name, e.key.qtype, err)
+			// let a later hit try again
+			e.prefetching.Store(false)
+			return
+		}
+		// the refreshed answer may come with another scope
+		k := e.key
+		k.subnet = netip.Prefix{}
+		subnet, _ := querySubnet(&refresh)
+		c.storeScoped(k, subnet, received, c.now())
+	}()
+}
+
+// clampTTL - TTL を [lower, upper] に収めたレコードのコピーを返す
+func clampTTL(records []*dns.ResourceRecord, lower, upper time.Duration) []*dns.ResourceRecord {
+	return copyRecords(records, func(ttl uint32) uint32 {
+		return uint32(clamp(seconds(ttl), lower, upper) / time.Second)
+	})
+}
+
+// decrementTTL - TTL から elapsed 秒を引いたレコードのコピーを返す
+func decrementTTL(records []*dns.ResourceRecord, elapsed uint32) []*dns.ResourceRecord {
+	return copyRecords(records, func(ttl uint32) uint32 {
+		if ttl < elapsed {
+			return 0
+		}
+		return ttl - elapsed
+	})
+}
+
+func copyRecords(records []*dns.ResourceRecord, ttl func(uint32) uint32) []*dns.ResourceRecord {
+	if records == nil {
+		return nil
+	}
+	result := make([]*dns.ResourceRecord, len(records))
+	for i, rr := range records {
+		copied := *rr
+		// the TTL of an OPT record holds flags, not a lifetime
+		if rr.RData.ResourceType() != dns.ResourceTypeOPT {
+			copied.TTL = ttl(rr.TTL)
+		}
+		result[i] = &copied
+	}
+	return result
+}
+
+func seconds(ttl uint32) time.Duration {
+	return time.Duration(ttl) * time.Second
+}
+
+func clamp(d, lower, upper time.Duration) time.Duration {
+	return max(lower, min(d, upper))
+}
@@ -0,0 +1,496 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubExchanger は問い合わせの回数を数え、決まった応答を返す
+type stubExchanger struct {
+	calls    atomic.Int32
+	fail     atomic.Bool
+	response func(query *dns.Packet) *dns.Packet
+}
+
+func (s *stubExchanger) ExchangeContext(_ context.Context, query *dns.Packet) (*client.Response, error) {
+	s.calls.Add(1)
+	if s.fail.Load() {
+		return nil, fmt.Errorf("exchange with 192.0.2.53:53: %w", client.ErrTimeout)
+	}
+	res := s.response(query)
+	res.Id = query.Id
+	res.QR = dns.QRResponse
+	res.Questions = query.Questions
+	return &client.Response{Packet: res, Upstream: "192.0.2.53:53", Network: "udp"}, nil
+}
+
+// fakeClock はテストから進められる時計
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func aRecord(name string, ttl uint32) *dns.ResourceRecord {
+	return &dns.ResourceRecord{Name: name, Class: dns.ClassIN, TTL: ttl, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}}
+}
+
+func soaRecord(ttl, minttl uint32) *dns.ResourceRecord {
+	return &dns.ResourceRecord{Name: "example.com.", Class: dns.ClassIN, TTL: ttl, RData: &dns.SOAData{
+		MName: "ns.example.com.", RName: "admin.example.com.", Serial: 1, Minttl: minttl,
+	}}
+}
+
+func query(name string) *dns.Packet {
+	return &dns.Packet{
+		Id:        42,
+		QR:        dns.QRQuery,
+		RD:        true,
+		Questions: []*dns.Question{{Qname: name, Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+	}
+}
+
+func TestCache_ExchangeContext(t *testing.T) {
+	cases := []struct {
+		label    string
+		config   Config
+		response *dns.Packet
+		// advance is how long to wait before the second query
+		advance   time.Duration
+		wantCalls int32
+		// wantTTLs are the TTLs of the answers and authorities of the second response
+		wantTTLs []uint32
+	}{
+		{
+			label:     "ok/hit-decrements-ttl",
+			response:  &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 300)}},
+			advance:   100 * time.Second,
+			wantCalls: 1,
+			wantTTLs:  []uint32{200},
+		},
+		{
+			label:     "ok/expired",
+			response:  &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 300)}},
+			advance:   300 * time.Second,
+			wantCalls: 2,
+			wantTTLs:  []uint32{300},
+		},
+		{
+			label:     "ok/min-ttl",
+			config:    Config{MinTTL: time.Minute},
+			response:  &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 5)}},
+			advance:   30 * time.Second,
+			wantCalls: 1,
+			wantTTLs:  []uint32{30},
+		},
+		{
+			label:     "ok/max-ttl",
+			config:    Config{MaxTTL: time.Hour},
+			response:  &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 86400)}},
+			advance:   time.Hour,
+			wantCalls: 2,
+			wantTTLs:  []uint32{3600},
+		},
+		{
+			label: "ok/nxdomain-uses-soa-minimum",
+			response: &dns.Packet{
+				RCode:       dns.RCodeNameError,
+				Authorities: []*dns.ResourceRecord{soaRecord(3600, 60)},
+			},
+			advance:   59 * time.Second,
+			wantCalls: 1,
+			wantTTLs:  []uint32{1},
+		},
+		{
+			label: "ok/nodata-expired",
+			response: &dns.Packet{
+				Authorities: []*dns.ResourceRecord{soaRecord(30, 600)},
+			},
+			advance:   30 * time.Second,
+			wantCalls: 2,
+			wantTTLs:  []uint32{30},
+		},
+		{
+			label:     "ok/negative-without-soa-is-not-cached",
+			response:  &dns.Packet{RCode: dns.RCodeNameError},
+			wantCalls: 2,
+		},
+		{
+			label:     "ok/servfail-is-not-cached",
+			response:  &dns.Packet{RCode: dns.RCodeServerFailure},
+			wantCalls: 2,
+		},
+		{
+			label: "ok/truncated-is-not-cached",
+			response: &dns.Packet{
+				TC:      true,
+				Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 300)},
+			},
+			wantCalls: 2,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			upstream := &stubExchanger{response: func(*dns.Packet) *dns.Packet {
+				res := *tc.response
+				return &res
+			}}
+			clock := &fakeClock{now: time.Unix(1700000000, 0)}
+			config := tc.config
+			config.Client = upstream
+			config.Now = clock.Now
+			c := New(config)
+			if _, err := c.ExchangeContext(context.Background(), query("www.example.com.")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			clock.Advance(tc.advance)
+
+			// ACT
+			second := query("WWW.Example.com")
+			second.Id = 4321
+			received, err := c.ExchangeContext(context.Background(), second)
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := upstream.calls.Load(); got != tc.wantCalls {
+				t.Errorf("calls: want %d, got %d", tc.wantCalls, got)
+			}
+			if received.Packet.Id != 4321 {
+				t.Errorf("Id: want 4321, got %d", received.Packet.Id)
+			}
+			if tc.wantTTLs == nil {
+				return
+			}
+			var ttls []uint32
+			for _, rr := range append(received.Packet.Answers, received.Packet.Authorities...) {
+				ttls = append(ttls, rr.TTL)
+			}
+			if diff := cmp.Diff(tc.wantTTLs, ttls); diff != "" {
+				t.Errorf("TTLs: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCache_ExchangeContext_doesNotModifyStoredEntry(t *testing.T) {
+	// ARRANGE
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := New(Config{
+		Client: &stubExchanger{response: func(*dns.Packet) *dns.Packet {
+			return &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 300)}}
+		}},
+		Now: clock.Now,
+	})
+	_, _ = c.ExchangeContext(context.Background(), query("www.example.com."))
+	clock.Advance(10 * time.Second)
+	first, _ := c.ExchangeContext(context.Background(), query("www.example.com."))
+	first.Packet.Answers[0].TTL = 0
+
+	// ACT
+	clock.Advance(10 * time.Second)
+	second, _ := c.ExchangeContext(context.Background(), query("www.example.com."))
+
+	// ASSERT
+	if got := second.Packet.Answers[0].TTL; got != 280 {
+		t.Errorf("TTL: want 280, got %d", got)
+	}
+	if second.Network != NetworkCache {
+		t.Errorf("Network: want %q, got %q", NetworkCache, second.Network)
+	}
+}
+
+func TestCache_evictsLeastRecentlyUsed(t *testing.T) {
+	// ARRANGE
+	upstream := &stubExchanger{response: func(q *dns.Packet) *dns.Packet {
+		return &dns.Packet{Answers: []*dns.ResourceRecord{aRecord(q.Questions[0].Qname, 300)}}
+	}}
+	c := New(Config{Client: upstream, Size: 2, Shards: 1})
+	ctx := context.Background()
+	_, _ = c.ExchangeContext(ctx, query("a.example.com."))
+	_, _ = c.ExchangeContext(ctx, query("b.example.com."))
+	_, _ = c.ExchangeContext(ctx, query("a.example.com."))
+
+	// ACT
+	_, _ = c.ExchangeContext(ctx, query("c.example.com."))
+
+	// ASSERT
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len: want 2, got %d", got)
+	}
+	before := upstream.calls.Load()
+	_, _ = c.ExchangeContext(ctx, query("a.example.com."))
+	if upstream.calls.Load() != before {
+		t.Errorf("a.example.com. should still be cached")
+	}
+	_, _ = c.ExchangeContext(ctx, query("b.example.com."))
+	if upstream.calls.Load() != before+1 {
+		t.Errorf("b.example.com. should have been evicted")
+	}
+}
+
+func TestCache_concurrentAccess(t *testing.T) {
+	// ARRANGE
+	upstream := &stubExchanger{response: func(q *dns.Packet) *dns.Packet {
+		return &dns.Packet{Answers: []*dns.ResourceRecord{aRecord(q.Questions[0].Qname, 300)}}
+	}}
+	c := New(Config{Client: upstream, Size: 64})
+
+	// ACT
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				name := fmt.Sprintf("host%d.example.com.", (i*j)%100)
+				received, err := c.ExchangeContext(context.Background(), query(name))
+				if err != nil || received.Packet.Answers[0].Name != name {
+					t.Errorf("unexpected response for %s: %v", name, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// ASSERT
+	if got := c.Len(); got > 64+defaultShards {
+		t.Errorf("Len: want at most %d, got %d", 64+defaultShards, got)
+	}
+}
+
+func TestCache_ExchangeContext_serveStale(t *testing.T) {
+	cases := []struct {
+		label    string
+		staleTTL time.Duration
+		advance  time.Duration
+		// servfail makes the upstream answer SERVFAIL instead of timing out
+		servfail bool
+		wantTTL  uint32
+		wantErr  error
+	}{
+		{
+			label:    "ok/timeout",
+			staleTTL: time.Hour,
+			advance:  90 * time.Second,
+			wantTTL:  30,
+		},
+		{
+			label:    "ok/servfail",
+			staleTTL: time.Hour,
+			advance:  90 * time.Second,
+			servfail: true,
+			wantTTL:  30,
+		},
+		{
+			label:   "Err/disabled",
+			advance: 90 * time.Second,
+			wantErr: client.ErrTimeout,
+		},
+		{
+			label:    "Err/stale-window-passed",
+			staleTTL: time.Hour,
+			advance:  time.Hour + time.Minute,
+			wantErr:  client.ErrTimeout,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			servfail := atomic.Bool{}
+			upstream := &stubExchanger{response: func(*dns.Packet) *dns.Packet {
+				if servfail.Load() {
+					return &dns.Packet{RCode: dns.RCodeServerFailure}
+				}
+				return &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 60)}}
+			}}
+			clock := &fakeClock{now: time.Unix(1700000000, 0)}
+			c := New(Config{Client: upstream, StaleTTL: tc.staleTTL, Now: clock.Now})
+			_, _ = c.ExchangeContext(context.Background(), query("www.example.com."))
+			clock.Advance(tc.advance)
+			if tc.servfail {
+				servfail.Store(true)
+			} else {
+				upstream.fail.Store(true)
+			}
+
+			// ACT
+			received, err := c.ExchangeContext(context.Background(), query("www.example.com."))
+
+			// ASSERT
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("err: want %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if received.Network != NetworkCache {
+				t.Errorf("Network: want %q, got %q", NetworkCache, received.Network)
+			}
+			if got := received.Packet.Answers[0].TTL; got != tc.wantTTL {
+				t.Errorf("TTL: want %d, got %d", tc.wantTTL, got)
+			}
+		})
+	}
+}
+
+func TestCache_ExchangeContext_prefetch(t *testing.T) {
+	// ARRANGE
+	upstream := &stubExchanger{response: func(*dns.Packet) *dns.Packet {
+		return &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 100)}}
+	}}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := New(Config{Client: upstream, Prefetch: true, Now: clock.Now})
+	ctx := context.Background()
+	_, _ = c.ExchangeContext(ctx, query("www.example.com."))
+	_, _ = c.ExchangeContext(ctx, query("www.example.com."))
+	clock.Advance(95 * time.Second)
+
+	// ACT
+	_, _ = c.ExchangeContext(ctx, query("www.example.com."))
+	_, _ = c.ExchangeContext(ctx, query("www.example.com."))
+	c.prefetches.Wait()
+
+	// ASSERT
+	if got := upstream.calls.Load(); got != 2 {
+		t.Errorf("calls after prefetch: want 2, got %d", got)
+	}
+	clock.Advance(10 * time.Second)
+	received, _ := c.ExchangeContext(ctx, query("www.example.com."))
+	if got := upstream.calls.Load(); got != 2 {
+		t.Errorf("calls after expiry: want 2, got %d", got)
+	}
+	if received.Network != NetworkCache || received.Packet.Answers[0].TTL != 90 {
+		t.Errorf("response: want a cache hit with TTL 90, got %s with TTL %d", received.Network, received.Packet.Answers[0].TTL)
+	}
+}
+
+// blockingExchanger は最初の呼び出しに答え、それ以降は ctx が終わるまで待つ Exchanger
+type blockingExchanger struct {
+	stubExchanger
+	entered chan struct{}
+}
+
+func (b *blockingExchanger) ExchangeContext(ctx context.Context, query *dns.Packet) (*client.Response, error) {
+	if b.calls.Load() == 0 {
+		return b.stubExchanger.ExchangeContext(ctx, query)
+	}
+	b.calls.Add(1)
+	b.entered <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCache_Close(t *testing.T) {
+	// ARRANGE
+	upstream := &blockingExchanger{entered: make(chan struct{}, 2)}
+	upstream.response = func(*dns.Packet) *dns.Packet {
+		return &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 100)}}
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	c := New(Config{Client: upstream, Prefetch: true, Now: clock.Now})
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, _ = c.ExchangeContext(ctx, query("www.example.com."))
+		if i == 1 {
+			clock.Advance(95 * time.Second)
+		}
+	}
+	<-upstream.entered
+	closeCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	// ACT
+	err := c.Close(closeCtx)
+
+	// ASSERT
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close: want DeadlineExceeded, got %v", err)
+	}
+	// the refresh in progress was cancelled
+	c.prefetches.Wait()
+	// no refresh is started after Close
+	_, _ = c.ExchangeContext(ctx, query("www.example.com."))
+	c.prefetches.Wait()
+	if got := upstream.calls.Load(); got != 2 {
+		t.Errorf("calls: want 2, got %d", got)
+	}
+}
+
+// gatedExchanger は release が閉じるまで答えない Exchanger。呼ばれると entered に知らせる
+type gatedExchanger struct {
+	stubExchanger
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedExchanger) ExchangeContext(ctx context.Context, query *dns.Packet) (*client.Response, error) {
+	g.entered <- struct{}{}
+	<-g.release
+	return g.stubExchanger.ExchangeContext(ctx, query)
+}
+
+func TestCache_ExchangeContext_coalescedMisses(t *testing.T) {
+	// ARRANGE
+	const n = 10
+	upstream := &gatedExchanger{entered: make(chan struct{}, n), release: make(chan struct{})}
+	upstream.response = func(*dns.Packet) *dns.Packet {
+		return &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 100)}}
+	}
+	c := New(Config{Client: client.NewCoalescer(upstream)})
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+
+	// ACT
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := query("www.example.com.")
+			q.Id = uint16(i)
+			received, err := c.ExchangeContext(context.Background(), q)
+			if err == nil && received.Packet.Id != q.Id {
+				err = fmt.Errorf("Id: want %d, got %d", q.Id, received.Packet.Id)
+			}
+			errs <- err
+		}()
+	}
+	<-upstream.entered
+	// give the other misses time to join the exchange in flight
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+	close(errs)
+
+	// ASSERT
+	for err := range errs {
+		if err != nil {
+			t.Errorf("ExchangeContext: unexpected error: %v", err)
+		}
+	}
+	if got := upstream.calls.Load(); got != 1 {
+		t.Errorf("upstream calls: want 1, got %d", got)
+	}
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"github.com/niioka/dnsbox/dns"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// scopeSet は保存した応答の ECS スコープ長を記録し、検索するキーを絞る
+type scopeSet struct {
+	v4 [33]atomic.Bool
+	v6 [129]atomic.Bool
+}
+
+func (s *scopeSet) lengths(addr netip.Addr) []atomic.Bool {
+	if addr.Is4() {
+		return s.v4[:]
+	}
+	return s.v6[:]
+}
+
+func (s *scopeSet) add(prefix netip.Prefix) {
+	s.lengths(prefix.Addr())[prefix.Bits()].Store(true)
+}
+
+// querySubnet - クエリの ECS を返す。ok が false なら不正なオプションでキャッシュできない
+func querySubnet(query *dns.Packet) (*dns.ClientSubnet, bool) {
+	edns := query.EDNS()
+	if edns == nil {
+		return nil, true
+	}
+	subnet, err := edns.ClientSubnet()
+	if err != nil {
+		return nil, false
+	}
+	return subnet, true
+}
+
+// lookup - k に一致し、ECS があればそのサブネットを含むスコープのエントリを探す
+//
+// The longest scope wins. An expired entry is only returned when no fresh
+// one exists, so that it can still be served stale.
+func (c *Cache) lookup(k key, subnet *dns.ClientSubnet, now time.Time) *entry {
+	if subnet == nil {
+		return c.shards.get(k).get(k, now)
+	}
+	addr := subnet.Prefix.Addr()
+	scopes := c.scopes.lengths(addr)
+	var stale *entry
+	for bits := subnet.Prefix.Bits(); bits >= 0; bits-- {
+		if !scopes[bits].Load() {
+			continue
+		}
+		k.subnet = netip.PrefixFrom(addr, bits).Masked()
+		e := c.shards.get(k).get(k, now)
+		if e == nil {
+			continue
+		}
+		if now.Before(e.expires) {
+			return e
+		}
+		if stale == nil {
+			stale = e
+		}
+	}
+	return stale
+}
+
+// scopedKey - 応答の ECS スコープから保存するキーを決める (RFC 7871 section 7.3.1)
+//
+// A response without ECS counts as scope 0, valid for every client of the
+// family. ok is false for a response whose ECS does not match the query.
+func scopedKey(k key, subnet *dns.ClientSubnet, res *dns.Packet) (key, bool) {
+	if subnet == nil {
+		return k, true
+	}
+	scope := 0
+	if edns := res.EDNS(); edns != nil {
+		received, err := edns.ClientSubnet()
+		if err != nil || (received != nil && received.Prefix != subnet.Prefix) {
+			return key{}, false
+		}
+		if received != nil {
+			scope = int(received.Scope)
+		}
+	}
+	// a scope longer than the source only covers the source
+	scope = min(scope, subnet.Prefix.Bits())
+	k.subnet = netip.PrefixFrom(subnet.Prefix.Addr(), scope).Masked()
+	return k, true
+}
+
+// echoClientSubnet - 応答の ECS をクエリのサブネットと保存したスコープに合わせる
+//
+// An entry is shared by every subnet within its scope, so the ECS stored
+// with it may name another client's subnet.
+func (e *entry) echoClientSubnet(packet *dns.Packet, query *dns.Packet) {
+	if !e.key.subnet.IsValid() {
+		return
+	}
+	edns := packet.EDNS()
+	if edns == nil || edns.Option(dns.EDNSOptionClientSubnet) == nil {
+		return
+	}
+	subnet, ok := querySubnet(query)
+	if !ok || subnet == nil {
+		return
+	}
+	echo := *subnet
+	echo.Scope = uint8(e.key.subnet.Bits())
+	edns.SetClientSubnet(&echo)
+	packet.SetEDNS(edns)
+}
@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"net/netip"
+	"testing"
+)
+
+// subnetQuery は ECS 付きのクエリを作る。prefix が空なら EDNS だけ付ける
+func subnetQuery(name, prefix string) *dns.Packet {
+	q := query(name)
+	edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+	if prefix != "" {
+		edns.SetClientSubnet(dns.NewClientSubnet(netip.MustParsePrefix(prefix)))
+	}
+	q.SetEDNS(edns)
+	return q
+}
+
+func TestCache_ExchangeContext_clientSubnet(t *testing.T) {
+	cases := []struct {
+		label string
+		// first is the ECS of the query that fills the cache, scope is the
+		// scope the upstream answers it with; -1 answers without ECS
+		first  string
+		scope  int
+		second string
+		// wantHit is whether the second query is answered from the cache
+		wantHit   bool
+		wantScope int
+	}{
+		{
+			label:     "ok/same-subnet",
+			first:     "192.0.2.0/24",
+			scope:     24,
+			second:    "192.0.2.0/24",
+			wantHit:   true,
+			wantScope: 24,
+		},
+		{
+			label:     "ok/within-scope",
+			first:     "192.0.2.0/24",
+			scope:     16,
+			second:    "192.0.99.0/24",
+			wantHit:   true,
+			wantScope: 16,
+		},
+		{
+			label:     "ok/scope-zero",
+			first:     "192.0.2.0/24",
+			scope:     0,
+			second:    "198.51.100.0/24",
+			wantHit:   true,
+			wantScope: 0,
+		},
+		{
+			label:     "ok/scope-clamped-to-source",
+			first:     "192.0.2.0/24",
+			scope:     32,
+			second:    "192.0.2.0/24",
+			wantHit:   true,
+			wantScope: 24,
+		},
+		{
+			label:   "ok/no-ecs-in-response",
+			first:   "192.0.2.0/24",
+			scope:   -1,
+			second:  "198.51.100.0/24",
+			wantHit: true,
+			// the answer carries no ECS, so there is nothing to echo
+			wantScope: -1,
+		},
+		{
+			label:   "miss/outside-scope",
+			first:   "192.0.2.0/24",
+			scope:   24,
+			second:  "192.0.3.0/24",
+			wantHit: false,
+		},
+		{
+			label:   "miss/other-family",
+			first:   "192.0.2.0/24",
+			scope:   0,
+			second:  "2001:db8::/56",
+			wantHit: false,
+		},
+		{
+			label:   "miss/scoped-answer-not-for-plain-query",
+			first:   "192.0.2.0/24",
+			scope:   0,
+			second:  "",
+			wantHit: false,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			upstream := &stubExchanger{response: func(q *dns.Packet) *dns.Packet {
+				res := &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 60)}}
+				edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+				if subnet, _ := q.EDNS().ClientSubnet(); subnet != nil && tc.scope >= 0 {
+					echo := *subnet
+					echo.Scope = uint8(tc.scope)
+					edns.SetClientSubnet(&echo)
+				}
+				res.SetEDNS(edns)
+				return res
+			}}
+			c := New(Config{Client: upstream})
+			if _, err := c.ExchangeContext(context.Background(), subnetQuery("www.example.com.", tc.first)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// ACT
+			received, err := c.ExchangeContext(context.Background(), subnetQuery("www.example.com.", tc.second))
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := received.Network == NetworkCache; got != tc.wantHit {
+				t.Fatalf("hit: want %v, got %v", tc.wantHit, got)
+			}
+			if !tc.wantHit {
+				return
+			}
+			got, err := received.Packet.EDNS().ClientSubnet()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var want *dns.ClientSubnet
+			if tc.wantScope >= 0 {
+				want = &dns.ClientSubnet{Prefix: netip.MustParsePrefix(tc.second), Scope: uint8(tc.wantScope)}
+			}
+			if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })); diff != "" {
+				t.Errorf("ClientSubnet: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCache_ExchangeContext_clientSubnetPrefersLongestScope(t *testing.T) {
+	// ARRANGE
+	scopes := map[string]uint8{"192.0.2.0/24": 0, "198.51.100.0/24": 24}
+	upstream := &stubExchanger{response: func(q *dns.Packet) *dns.Packet {
+		subnet, _ := q.EDNS().ClientSubnet()
+		echo := *subnet
+		echo.Scope = scopes[subnet.Prefix.String()]
+		// tell the answers apart by TTL
+		res := &dns.Packet{Answers: []*dns.ResourceRecord{aRecord("www.example.com.", 60+uint32(echo.Scope))}}
+		edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+		edns.SetClientSubnet(&echo)
+		res.SetEDNS(edns)
+		return res
+	}}
+	c := New(Config{Client: upstream})
+	for _, prefix := range []string{"198.51.100.0/24", "192.0.2.0/24"} {
+		if _, err := c.ExchangeContext(context.Background(), subnetQuery("www.example.com.", prefix)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// ACT
+	received, err := c.ExchangeContext(context.Background(), subnetQuery("www.example.com.", "198.51.100.0/24"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := upstream.calls.Load(); got != 2 {
+		t.Errorf("calls: want 2, got %d", got)
+	}
+	if got := received.Packet.Answers[0].TTL; got != 84 {
+		t.Errorf("TTL: want the /24 answer (84), got %d", got)
+	}
+}
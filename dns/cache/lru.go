@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/niioka/dnsbox/dns"
+	"hash/maphash"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// key identifies a cached response.
+type key struct {
+	name   string
+	qtype  dns.ResourceType
+	qclass dns.Class
+	// do keeps the answers with DNSSEC records apart from those without
+	do bool
+	// subnet is the ECS scope an answer applies to (RFC 7871 section 7.3.1).
+	// It is the zero Prefix for queries without ECS.
+	subnet netip.Prefix
+}
+
+// entry is a cached response. Apart from the counters, it is never
+// modified once stored.
+type entry struct {
+	key      key
+	packet   *dns.Packet
+	upstream string
+	stored   time.Time
+	expires  time.Time
+	// evicts is when the entry is dropped. It is later than expires while
+	// the entry may still be served stale.
+	evicts time.Time
+
+	hits        atomic.Int64
+	prefetching atomic.Bool
+}
+
+// shard - 排他制御の単位となる LRU
+type shard struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[key]*list.Element
+	lru      list.List
+}
+
+func newShard(capacity int) *shard {
+	return &shard{
+		capacity: capacity,
+		items:    make(map[key]*list.Element),
+	}
+}
+
+// get - 破棄されていないエントリを返し、最近使われたものとして記録する
+func (s *shard) get(k key, now time.Time) *entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[k]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*entry)
+	if !now.Before(e.evicts) {
+		s.lru.Remove(elem)
+		delete(s.items, k)
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return e
+}
+
+// set - エントリを保存し、容量を超えた分を古いものから捨てる
+func (s *shard) set(e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[e.key]; ok {
+		elem.Value = e
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.items[e.key] = s.lru.PushFront(e)
+	for s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.items, oldest.Value.(*entry).key)
+	}
+}
+
+func (s *shard) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// shards - キーのハッシュでシャードに振り分ける LRU
+type shards struct {
+	seed maphash.Seed
+	list []*shard
+}
+
+func newShards(count, size int) *shards {
+	capacity := (size + count - 1) / count
+	s := &shards{seed: maphash.MakeSeed()}
+	for i := 0; i < count; i++ {
+		s.list = append(s.list, newShard(capacity))
+	}
+	return s
+}
+
+func (s *shards) get(k key) *shard {
+	return s.list[maphash.String(s.seed, k.name)%uint64(len(s.list))]
+}
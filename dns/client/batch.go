@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	"sync"
+	"time"
+)
+
+const defaultBatchWorkers = 16
+
+// BatchQuery is a single question of a batch.
+type BatchQuery struct {
+	Name string
+	Type dns.ResourceType
+}
+
+// BatchResult is the outcome of one BatchQuery.
+type BatchResult struct {
+	// Index is the position of the query in the batch.
+	Index    int
+	Query    BatchQuery
+	Response *Response
+	Err      error
+}
+
+// Batch - 多数のクエリを並行して解決する
+type Batch struct {
+	client  Exchanger
+	workers int
+	// interval is the minimum gap between two queries. Zero means no limit.
+	interval time.Duration
+}
+
+// lookuper は検索リストで相対名を展開できる Exchanger。*Client が満たす
+type lookuper interface {
+	LookupContext(ctx context.Context, name string, resourceType dns.ResourceType) (*Response, error)
+}
+
+type BatchConfig struct {
+	// Client sends the queries. It may be a *Client, which expands relative
+	// names with its search list, or a layer wrapping one.
+	Client Exchanger
+	// Workers is the number of queries in flight at once. Defaults to 16.
+	Workers int
+	// RateLimit is the maximum number of queries per second over all
+	// workers. Zero means no limit.
+	RateLimit float64
+}
+
+func NewBatch(config BatchConfig) *Batch {
+	if config.Client == nil {
+		config.Client = New(Config{})
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultBatchWorkers
+	}
+	var interval time.Duration
+	if config.RateLimit > 0 {
+		interval = time.Duration(float64(time.Second) / config.RateLimit)
+	}
+	return &Batch{
+		client:   config.Client,
+		workers:  config.Workers,
+		interval: interval,
+	}
+}
+
+// Stream - queries から読んだクエリを解決し、終わった順に結果を返す
+//
+// The returned channel is closed once queries is closed and every result
+// has been sent. After ctx is done, the remaining queries get a result
+// carrying the context error without being sent.
+func (b *Batch) Stream(ctx context.Context, queries <-chan BatchQuery) <-chan *BatchResult {
+	type job struct {
+		index int
+		query BatchQuery
+	}
+	jobs := make(chan job)
+	results := make(chan *BatchResult, b.workers)
+	limiter := newRateLimiter(b.interval)
+
+	go func() {
+		defer close(jobs)
+		index := 0
+		for query := range queries {
+			select {
+			case jobs <- job{index: index, query: query}:
+			case <-ctx.Done():
+				results <- &BatchResult{Index: index, Query: query, Err: ctx.Err()}
+			}
+			index++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < b.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				result := &BatchResult{Index: j.index, Query: j.query}
+				if result.Err = limiter.wait(ctx); result.Err == nil {
+					result.Response, result.Err = b.exchange(ctx, j.query)
+				}
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		limiter.stop()
+		close(results)
+	}()
+	return results
+}
+
+// Resolve - すべてのクエリを解決し、クエリと同じ順で結果を返す
+func (b *Batch) Resolve(ctx context.Context, queries []BatchQuery) []*BatchResult {
+	ch := make(chan BatchQuery)
+	go func() {
+		defer close(ch)
+		for _, query := range queries {
+			ch <- query
+		}
+	}()
+	results := make([]*BatchResult, len(queries))
+	for result := range b.Stream(ctx, ch) {
+		results[result.Index] = result
+	}
+	return results
+}
+
+func (b *Batch) exchange(ctx context.Context, query BatchQuery) (*Response, error) {
+	if l, ok := b.client.(lookuper); ok {
+		return l.LookupContext(ctx, query.Name, query.Type)
+	}
+	return b.client.ExchangeContext(ctx, &dns.Packet{
+		QR:     dns.QRQuery,
+		Opcode: dns.OpcodeQuery,
+		RD:     true,
+		Questions: []*dns.Question{
+			{
+				Qname:  query.Name,
+				Qtype:  query.Type,
+				Qclass: dns.ClassIN,
+			},
+		},
+	})
+}
+
+// rateLimiter - すべてのワーカーで共有する、クエリの間隔を空けるためのリミッター
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	if interval <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{ticker: time.NewTicker(interval)}
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l.ticker == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *rateLimiter) stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
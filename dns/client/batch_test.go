@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingExchanger は同時実行数の最大値を記録する
+type countingExchanger struct {
+	inflight atomic.Int32
+	peak     atomic.Int32
+	delay    time.Duration
+}
+
+func (e *countingExchanger) ExchangeContext(_ context.Context, query *dns.Packet) (*Response, error) {
+	n := e.inflight.Add(1)
+	defer e.inflight.Add(-1)
+	for {
+		peak := e.peak.Load()
+		if n <= peak || e.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(e.delay)
+	if query.Questions[0].Qname == "fail.example.com." {
+		return nil, fmt.Errorf("exchange: %w", ErrTimeout)
+	}
+	return &Response{Packet: &dns.Packet{Id: query.Id, QR: dns.QRResponse, Questions: query.Questions}}, nil
+}
+
+func TestBatch_Resolve(t *testing.T) {
+	// ARRANGE
+	upstream := &countingExchanger{delay: 5 * time.Millisecond}
+	batch := NewBatch(BatchConfig{Client: upstream, Workers: 4})
+	var queries []BatchQuery
+	for i := 0; i < 20; i++ {
+		queries = append(queries, BatchQuery{Name: fmt.Sprintf("host%d.example.com.", i), Type: dns.ResourceTypeA})
+	}
+	queries[7].Name = "fail.example.com."
+
+	// ACT
+	results := batch.Resolve(context.Background(), queries)
+
+	// ASSERT
+	if got := upstream.peak.Load(); got > 4 {
+		t.Errorf("peak concurrency: want at most 4, got %d", got)
+	}
+	for i, result := range results {
+		if result.Index != i || result.Query != queries[i] {
+			t.Errorf("result %d: want query %+v, got %+v", i, queries[i], result.Query)
+		}
+		if i == 7 {
+			if !errors.Is(result.Err, ErrTimeout) {
+				t.Errorf("result %d: want %v, got %v", i, ErrTimeout, result.Err)
+			}
+			continue
+		}
+		if result.Err != nil || result.Response.Packet.Questions[0].Qname != queries[i].Name {
+			t.Errorf("result %d: unexpected result %+v", i, result)
+		}
+	}
+}
+
+func TestBatch_Stream_rateLimit(t *testing.T) {
+	// ARRANGE
+	batch := NewBatch(BatchConfig{Client: &countingExchanger{}, Workers: 8, RateLimit: 100})
+	queries := make(chan BatchQuery)
+	go func() {
+		defer close(queries)
+		for i := 0; i < 10; i++ {
+			queries <- BatchQuery{Name: fmt.Sprintf("host%d.example.com.", i), Type: dns.ResourceTypeA}
+		}
+	}()
+
+	// ACT
+	start := time.Now()
+	n := 0
+	for range batch.Stream(context.Background(), queries) {
+		n++
+	}
+
+	// ASSERT
+	if n != 10 {
+		t.Errorf("results: want 10, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("elapsed: want at least 90ms at 100 queries/s, got %v", elapsed)
+	}
+}
+
+func TestBatch_Stream_canceled(t *testing.T) {
+	// ARRANGE
+	batch := NewBatch(BatchConfig{Client: &countingExchanger{}, Workers: 2, RateLimit: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// ACT
+	results := batch.Resolve(ctx, []BatchQuery{
+		{Name: "a.example.com.", Type: dns.ResourceTypeA},
+		{Name: "b.example.com.", Type: dns.ResourceTypeA},
+		{Name: "c.example.com.", Type: dns.ResourceTypeA},
+	})
+
+	// ASSERT
+	for i, result := range results {
+		if !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("result %d: want %v, got %v", i, context.Canceled, result.Err)
+		}
+	}
+}
+
+func TestBatch_Resolve_search(t *testing.T) {
+	// ARRANGE
+	address, _ := startUDPServer(t, func(query *dns.Packet) *dns.Packet {
+		q := query.Questions[0]
+		if q.Qname != "db.example.com." {
+			return &dns.Packet{RCode: dns.RCodeNameError}
+		}
+		return &dns.Packet{Answers: []*dns.ResourceRecord{
+			{Name: q.Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 10}}},
+		}}
+	})
+	c := New(Config{Servers: []string{address}, Search: []string{"corp.example.com", "example.com"}, NDots: 1})
+	batch := NewBatch(BatchConfig{Client: c})
+
+	// ACT
+	results := batch.Resolve(context.Background(), []BatchQuery{{Name: "db", Type: dns.ResourceTypeA}})
+
+	// ASSERT
+	if err := results[0].Err; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answers := results[0].Response.Packet.Answers; len(answers) != 1 || answers[0].Name != "db.example.com." {
+		t.Errorf("answers: want db.example.com., got %v", answers)
+	}
+}
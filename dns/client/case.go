@@ -0,0 +1,134 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	// caseMismatchThreshold 回連続で大文字小文字を保たなかった upstream には 0x20 を使わない
+	caseMismatchThreshold = 3
+	// caseProbeInterval is how often an upstream that did not preserve the
+	// case is given another randomised query, in case it was replaced or the
+	// mismatches were forged.
+	caseProbeInterval = 10 * time.Minute
+)
+
+// ErrCaseMismatch is returned when a response does not echo the exact case
+// of a randomised query name. It is also an ErrUnexpectedResponse.
+var ErrCaseMismatch = errors.New("query name case mismatch")
+
+// randomizeCase - 質問名の英字の大文字小文字を無作為に入れ替えたクエリを返す (0x20)
+//
+// See draft-vixie-dnsext-dns0x20. Every letter adds a bit that an off-path
+// attacker has to guess besides the transaction ID and the port.
+func randomizeCase(query *dns.Packet) *dns.Packet {
+	randomized := *query
+	randomized.Questions = make([]*dns.Question, len(query.Questions))
+	for i, q := range query.Questions {
+		copied := *q
+		copied.Qname = randomizeName(q.Qname)
+		randomized.Questions[i] = &copied
+	}
+	return &randomized
+}
+
+func randomizeName(name string) string {
+	bits := make([]byte, (len(name)+7)/8)
+	_, _ = rand.Read(bits)
+	b := []byte(name)
+	for i, c := range b {
+		if !isLetter(c) || bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		// flipping 0x20 swaps the case of an ASCII letter
+		b[i] = c ^ 0x20
+	}
+	return string(b)
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// checkCase - 応答の質問名が送信した大文字小文字のままか確認する
+func checkCase(sent *dns.Packet, response *dns.Packet) error {
+	for i, q := range sent.Questions {
+		if got := response.Questions[i].Qname; dns.Fqdn(got) != dns.Fqdn(q.Qname) {
+			return fmt.Errorf("%w: %w (want=%s got=%s)", ErrUnexpectedResponse, ErrCaseMismatch, q.Qname, got)
+		}
+	}
+	return nil
+}
+
+// restoreCase - 無作為にした名前を呼び出し元のクエリの大文字小文字に戻す
+//
+// Servers copy the query name into the owner names of the records they
+// answer with, so those are restored as well.
+func restoreCase(response *dns.Packet, query *dns.Packet, sent *dns.Packet) {
+	names := make(map[string]string, len(sent.Questions))
+	for i, q := range sent.Questions {
+		names[dns.Fqdn(q.Qname)] = dns.Fqdn(query.Questions[i].Qname)
+	}
+	response.Questions = query.Questions
+	response.Answers = restoreNames(response.Answers, names)
+	response.Authorities = restoreNames(response.Authorities, names)
+	response.Additions = restoreNames(response.Additions, names)
+}
+
+func restoreNames(records []*dns.ResourceRecord, names map[string]string) []*dns.ResourceRecord {
+	for i, rr := range records {
+		original, ok := names[dns.Fqdn(rr.Name)]
+		if !ok {
+			continue
+		}
+		copied := *rr
+		copied.Name = original
+		records[i] = &copied
+	}
+	return records
+}
+
+// preservesCase - 0x20 を使ってよい upstream かどうか
+//
+// An upstream that was given up on gets one probe per caseProbeInterval.
+func (u *Upstream) preservesCase() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.caseMismatches < caseMismatchThreshold {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(u.caseProbed) < caseProbeInterval {
+		return false
+	}
+	u.caseProbed = now
+	return true
+}
+
+// recordCase - 応答が大文字小文字を保っていたかを記録する
+//
+// A response with the wrong case may as well be forged, so an upstream is
+// only given up on after several in a row without a single echo between.
+// One echo enables 0x20 again.
+func (u *Upstream) recordCase(preserved bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if preserved {
+		if u.caseMismatches >= caseMismatchThreshold {
+			log.Infof("upstream=%s preserves the case of query names again, enabling 0x20 for it", u.Address)
+		}
+		u.caseMismatches = 0
+		return
+	}
+	u.caseMismatches++
+	if u.caseMismatches == caseMismatchThreshold {
+		log.Warnf("upstream=%s does not preserve the case of query names, disabling 0x20 for it", u.Address)
+		// the next probe is due after a full interval
+		u.caseProbed = time.Now()
+	}
+}
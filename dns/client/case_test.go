@@ -0,0 +1,217 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRandomizeName(t *testing.T) {
+	// ARRANGE
+	name := "www-01.subdomain.example.com."
+	changed := false
+
+	for i := 0; i < 10; i++ {
+		// ACT
+		got := randomizeName(name)
+
+		// ASSERT
+		if !strings.EqualFold(got, name) {
+			t.Fatalf("randomizeName: want a case variant of %q, got %q", name, got)
+		}
+		changed = changed || got != name
+	}
+	if !changed {
+		t.Errorf("randomizeName: the case never changed")
+	}
+}
+
+func TestCheckCase(t *testing.T) {
+	sent := &dns.Packet{Questions: []*dns.Question{{Qname: "wWw.ExaMple.cOm.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}}}
+	cases := []struct {
+		label   string
+		qname   string
+		wantErr error
+	}{
+		{
+			label: "ok",
+			qname: "wWw.ExaMple.cOm.",
+		},
+		{
+			label:   "Err/lowercased",
+			qname:   "www.example.com.",
+			wantErr: ErrCaseMismatch,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			response := &dns.Packet{Questions: []*dns.Question{{Qname: tc.qname, Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}}}
+
+			// ACT
+			err := checkCase(sent, response)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("checkCase: want %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil && !errors.Is(err, ErrUnexpectedResponse) {
+				t.Errorf("checkCase: want an ErrUnexpectedResponse, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_ExchangeContext_randomizeCase(t *testing.T) {
+	const qname = "www.subdomain.Example.com."
+	cases := []struct {
+		label string
+		// lowercase makes the upstream answer with a lowercased name
+		lowercase   bool
+		wantQueries int
+		// wantQname is the name handed back to the caller
+		wantQname         string
+		wantPreservesCase bool
+	}{
+		{
+			label:             "ok/echoed",
+			wantQueries:       1,
+			wantQname:         qname,
+			wantPreservesCase: true,
+		},
+		{
+			label:     "ok/upstream-ignores-case",
+			lowercase: true,
+			// the mismatched answers are discarded until the timeout, in a row,
+			// then the query without 0x20 is answered as it is
+			wantQueries:       caseMismatchThreshold + 1,
+			wantQname:         strings.ToLower(qname),
+			wantPreservesCase: false,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			address, names := startUDPServer(t, func(query *dns.Packet) *dns.Packet {
+				q := query.Questions[0]
+				if tc.lowercase {
+					q.Qname = strings.ToLower(q.Qname)
+				}
+				return &dns.Packet{Answers: []*dns.ResourceRecord{
+					{Name: q.Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}},
+				}}
+			})
+			c := New(Config{Servers: []string{address}, RandomizeCase: true, Retries: caseMismatchThreshold, RetryBackoff: time.Millisecond, Timeout: 50 * time.Millisecond})
+
+			// ACT
+			received, err := c.ExchangeContext(context.Background(), &dns.Packet{
+				QR:        dns.QRQuery,
+				RD:        true,
+				Questions: []*dns.Question{{Qname: qname, Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+			})
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := received.Packet.Questions[0].Qname; got != tc.wantQname {
+				t.Errorf("Qname: want %q, got %q", tc.wantQname, got)
+			}
+			if got := received.Packet.Answers[0].Name; got != tc.wantQname {
+				t.Errorf("owner name: want %q, got %q", tc.wantQname, got)
+			}
+			sent := names()
+			if len(sent) != tc.wantQueries {
+				t.Fatalf("queries: want %d, got %v", tc.wantQueries, sent)
+			}
+			if !tc.lowercase && sent[0] == qname {
+				t.Errorf("query name: want a randomised case, got %q", sent[0])
+			}
+			if last := sent[len(sent)-1]; tc.lowercase && last != qname {
+				t.Errorf("query name without 0x20: want %q, got %q", qname, last)
+			}
+			if got := c.Upstreams()[0].Stats().PreservesCase; got != tc.wantPreservesCase {
+				t.Errorf("PreservesCase: want %v, got %v", tc.wantPreservesCase, got)
+			}
+		})
+	}
+}
+
+func TestClient_ExchangeContext_randomizeCase_forged(t *testing.T) {
+	// ARRANGE
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query, err := dns.DecodePacket(buf[:n])
+		if err != nil {
+			return
+		}
+		// a forged answer with the right ID but the lowercased name comes first
+		forged := *query.Questions[0]
+		forged.Qname = strings.ToLower(forged.Qname)
+		for _, q := range []*dns.Question{&forged, query.Questions[0]} {
+			res := &dns.Packet{Id: query.Id, QR: dns.QRResponse, Questions: []*dns.Question{q}}
+			sendBuf, _ := res.Encode()
+			_, _ = conn.WriteTo(sendBuf, addr)
+		}
+	}()
+	c := New(Config{Servers: []string{conn.LocalAddr().String()}, RandomizeCase: true})
+
+	// ACT
+	received, err := c.ExchangeContext(context.Background(), &dns.Packet{
+		QR:        dns.QRQuery,
+		Questions: []*dns.Question{{Qname: "www.subdomain.example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+	})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := received.Packet.Questions[0].Qname; got != "www.subdomain.example.com." {
+		t.Errorf("Qname: want the name of the query, got %q", got)
+	}
+	if !c.Upstreams()[0].Stats().PreservesCase {
+		t.Errorf("PreservesCase: want true after the real answer")
+	}
+}
+
+func TestUpstream_preservesCase_probe(t *testing.T) {
+	// ARRANGE
+	u := &Upstream{Address: "192.0.2.53:53"}
+	for i := 0; i < caseMismatchThreshold; i++ {
+		u.recordCase(false)
+	}
+	if u.preservesCase() {
+		t.Fatalf("preservesCase: want false after %d mismatches", caseMismatchThreshold)
+	}
+
+	// ACT
+	u.caseProbed = u.caseProbed.Add(-caseProbeInterval)
+	probe, again := u.preservesCase(), u.preservesCase()
+	u.recordCase(true)
+
+	// ASSERT
+	if !probe {
+		t.Errorf("preservesCase: want a probe after the interval")
+	}
+	if again {
+		t.Errorf("preservesCase: want only one probe per interval")
+	}
+	if !u.preservesCase() {
+		t.Errorf("preservesCase: want true after a preserved case")
+	}
+}
@@ -1,52 +1,286 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/niioka/dnsbox/dns"
 	"github.com/niioka/dnsbox/util"
 	log "github.com/sirupsen/logrus"
 	"math"
-	"math/rand"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// maxUDPMessageLength は UDP で受信できる最大のメッセージ長
+const maxUDPMessageLength = math.MaxUint16
+
+const (
+	defaultTimeout      = 5 * time.Second
+	defaultRetryBackoff = 100 * time.Millisecond
 )
 
 type Client struct {
-	server   string
-	port     int
-	verbose  bool
-	dialFunc func(string, string) (net.Conn, error)
+	upstreams    *upstreamSet
+	verbose      bool
+	transport    Transport
+	tlsConfig    *TLSConfig
+	tlsPool      tlsPool
+	quicPool     quicPool
+	dohMethod    string
+	httpClient   *http.Client
+	timeout      time.Duration
+	retries      int
+	retryBackoff time.Duration
+	search       []string
+	ndots        int
+	edns0        bool
+	clientSubnet netip.Prefix
+	randomCase   bool
+	hosts        *Hosts
+	dialContext  func(context.Context, string, string) (net.Conn, error)
 }
 
 type Config struct {
-	Server   string
-	Port     int
+	// Server and Port name a single upstream. Server is ignored when Servers
+	// is set. Port defaults to the well-known port of the transport.
+	Server string
+	Port   int
+	// Servers is the list of upstreams as host:port. IPv6 literals may be
+	// bracketed, and a missing port defaults to Port.
+	Servers []string
+	// Strategy decides which upstream is tried first for each query.
+	Strategy Strategy
 	Verbose  bool
+	// Transport selects how queries are sent. Defaults to UDP.
+	Transport Transport
+	// ForceTCP sends every query over TCP instead of trying UDP first.
+	// It is a shorthand for Transport: TransportTCP.
+	ForceTCP bool
+	// TLSConfig configures the encrypted transports.
+	TLSConfig *TLSConfig
+	// DoHMethod is the HTTP method of TransportHTTPS: http.MethodPost (default) or http.MethodGet.
+	DoHMethod string
+	// Timeout bounds a single attempt, including the TCP fallback.
+	Timeout time.Duration
+	// Retries is the number of extra rounds over all upstreams after a
+	// timeout or network error.
+	Retries int
+	// RetryBackoff is the wait before the first retry. It doubles on every retry.
+	RetryBackoff time.Duration
+	// Search is the search list that ResolveContext applies to relative
+	// names, and NDots is the number of dots for a name to be tried as is
+	// first. See SearchNames.
+	Search []string
+	NDots  int
+	// EDNS0 adds an OPT record to queries that have none.
+	EDNS0 bool
+	// ClientSubnet is sent as the EDNS Client Subnet option (RFC 7871) of
+	// queries that do not carry one. A /0 prefix asks the servers not to use
+	// the address of the client at all.
+	ClientSubnet netip.Prefix
+	// RandomizeCase randomises the case of query names and rejects the
+	// responses that do not echo it (the 0x20 technique). Upstreams that
+	// turn out not to preserve the case are queried without it.
+	RandomizeCase bool
+	// Hosts answers A and AAAA queries before any upstream is asked.
+	Hosts    *Hosts
 	DialFunc func(string, string) (net.Conn, error)
 }
 
+// Exchanger - クエリを送信して応答を返すもの
+//
+// *Client implements it, and so do the layers wrapping it such as a cache.
+type Exchanger interface {
+	ExchangeContext(ctx context.Context, query *dns.Packet) (*Response, error)
+}
+
+// Response is a decoded answer together with where it came from.
+type Response struct {
+	Packet *dns.Packet
+	// Upstream is the address of the upstream that answered.
+	Upstream string
+	// Network is the transport the answer was received on.
+	Network string
+	RTT     time.Duration
+}
+
 func New(config Config) *Client {
 	if config.Server == "" {
 		config.Server = "8.8.8.8"
 	}
+	if config.ForceTCP && config.Transport == TransportUDP {
+		config.Transport = TransportTCP
+	}
 	if config.Port == 0 {
-		config.Port = 53
+		config.Port = config.Transport.defaultPort()
+	}
+	if config.TLSConfig == nil {
+		config.TLSConfig = &TLSConfig{}
+	}
+	if config.DoHMethod == "" {
+		config.DoHMethod = http.MethodPost
+	}
+	if len(config.Servers) == 0 {
+		config.Servers = []string{config.Server}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	dialContext := (&net.Dialer{}).DialContext
+	if config.DialFunc != nil {
+		dialFunc := config.DialFunc
+		dialContext = func(_ context.Context, network string, address string) (net.Conn, error) {
+			return dialFunc(network, address)
+		}
+	}
+
+	upstreams := &upstreamSet{strategy: config.Strategy}
+	parseUpstream := ParseUpstream
+	if config.Transport == TransportHTTPS {
+		parseUpstream = DoHTemplate
+	}
+	for _, server := range config.Servers {
+		address, err := parseUpstream(server, config.Port)
+		if err != nil {
+			// keep the address as is and let the dial report the error
+			log.Warnf("upstream=%q: %v", server, err)
+			address = server
+		}
+		upstreams.upstreams = append(upstreams.upstreams, &Upstream{Address: address})
+	}
+
+	c := &Client{
+		upstreams:    upstreams,
+		verbose:      config.Verbose,
+		transport:    config.Transport,
+		tlsConfig:    config.TLSConfig,
+		dohMethod:    config.DoHMethod,
+		timeout:      config.Timeout,
+		retries:      max(config.Retries, 0),
+		retryBackoff: config.RetryBackoff,
+		search:       config.Search,
+		ndots:        config.NDots,
+		edns0:        config.EDNS0,
+		clientSubnet: config.ClientSubnet,
+		randomCase:   config.RandomizeCase,
+		hosts:        config.Hosts,
+		dialContext:  dialContext,
+	}
+	if config.Transport == TransportHTTPS {
+		c.httpClient = c.newHTTPClient()
+	}
+	return c
+}
+
+// SystemConfig - /etc/resolv.conf と /etc/hosts から Config を組み立てる
+//
+// A missing hosts file is not an error; the hosts stage is simply left out.
+func SystemConfig() (Config, error) {
+	conf, err := LoadResolvConf(DefaultResolvConfPath)
+	if err != nil {
+		return Config{}, err
 	}
-	if config.DialFunc == nil {
-		config.DialFunc = net.Dial
+	config := conf.Config()
+	hosts, err := LoadHosts(DefaultHostsPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Config{}, err
 	}
+	config.Hosts = hosts
+	return config, nil
+}
 
-	return &Client{
-		server:   config.Server,
-		port:     config.Port,
-		verbose:  config.Verbose,
-		dialFunc: config.DialFunc,
+// Close - 使い回している接続を閉じる
+func (c *Client) Close() error {
+	if c.httpClient != nil {
+		c.httpClient.CloseIdleConnections()
 	}
+	return errors.Join(c.tlsPool.close(), c.quicPool.close())
+}
+
+// Upstreams - 設定された upstream の一覧を返す
+func (c *Client) Upstreams() []*Upstream {
+	return c.upstreams.upstreams
 }
 
 func (c *Client) Resolve(name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+	return c.ResolveContext(context.Background(), name, resourceType)
+}
+
+// ResolveContext - ctx がキャンセルされるまで名前解決を試みる
+//
+// A relative name is expanded with the search list; see LookupContext.
+func (c *Client) ResolveContext(ctx context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error) {
 	log.Info("Resolving DNS records...")
-	received, err := c.question(&dns.Packet{
-		Id:     uint16(rand.Int() % math.MaxUint16),
+	received, err := c.LookupContext(ctx, name, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	return received.Packet, nil
+}
+
+// LookupContext - 相対名を検索リストで展開して解決し、応答と応答元を返す
+//
+// The candidates are tried in order until one has records. A candidate that
+// fails with SERVFAIL or an error does not stop the search, as with glibc.
+// When none has records, the first NODATA answer is returned, or else the
+// first failure, or else the last answer.
+func (c *Client) LookupContext(ctx context.Context, name string, resourceType dns.ResourceType) (*Response, error) {
+	if len(c.search) == 0 {
+		return c.resolveName(ctx, name, resourceType)
+	}
+
+	var last, nodata, failed *Response
+	var failedErr error
+	for _, candidate := range SearchNames(name, c.search, c.ndots) {
+		received, err := c.resolveName(ctx, candidate, resourceType)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if failed == nil && failedErr == nil {
+				failedErr = err
+			}
+			continue
+		}
+		switch rcode := received.Packet.RCode; {
+		case rcode == dns.RCodeNoError && len(received.Packet.Answers) > 0:
+			return received, nil
+		case rcode == dns.RCodeNoError:
+			if nodata == nil {
+				nodata = received
+			}
+		case rcode == dns.RCodeServerFailure:
+			if failed == nil && failedErr == nil {
+				failed = received
+			}
+			continue
+		case rcode != dns.RCodeNameError:
+			// only a name that does not exist or a failure moves on to the
+			// next candidate
+			return received, nil
+		}
+		last = received
+	}
+	switch {
+	case nodata != nil:
+		return nodata, nil
+	case failedErr != nil:
+		return nil, failedErr
+	case failed != nil:
+		return failed, nil
+	}
+	return last, nil
+}
+
+func (c *Client) resolveName(ctx context.Context, name string, resourceType dns.ResourceType) (*Response, error) {
+	received, err := c.ExchangeContext(ctx, &dns.Packet{
 		QR:     dns.QRQuery,
 		Opcode: dns.OpcodeQuery,
 		RD:     true,
@@ -65,16 +299,155 @@ func (c *Client) Resolve(name string, resourceType dns.ResourceType) (*dns.Packe
 	return received, nil
 }
 
-func (c *Client) question(sendPacket *dns.Packet) (*dns.Packet, error) {
+// ExchangeContext - クエリを upstream に送信し、応答と応答元を返す
+//
+// The transaction ID of query is replaced with a random one.
+func (c *Client) ExchangeContext(ctx context.Context, query *dns.Packet) (*Response, error) {
+	if c.hosts != nil {
+		if res := c.hosts.answer(query); res != nil {
+			return &Response{Packet: res, Network: NetworkHosts}, nil
+		}
+	}
+
+	sendPacket := *query
+	sendPacket.Id = newID()
+	if c.edns0 && sendPacket.EDNS() == nil {
+		sendPacket.SetEDNS(&dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize})
+	}
+	if c.clientSubnet.IsValid() {
+		edns := sendPacket.EDNS()
+		if edns == nil {
+			edns = &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+		}
+		if edns.Option(dns.EDNSOptionClientSubnet) == nil {
+			edns.SetClientSubnet(dns.NewClientSubnet(c.clientSubnet))
+			sendPacket.SetEDNS(edns)
+		}
+	}
+
+	var err error
+	for round := 0; round <= c.retries; round++ {
+		if round > 0 {
+			backoff := c.retryBackoff << (round - 1)
+			log.Debugf("retrying in %v (round=%d): %v", backoff, round+1, err)
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w (last error: %w)", ctx.Err(), err)
+			case <-time.After(backoff):
+			}
+		}
+
+		for _, upstream := range c.upstreams.order() {
+			var res *Response
+			res, err = c.attempt(ctx, upstream, &sendPacket)
+			if err == nil {
+				return res, nil
+			}
+			if !isRetryable(err) || ctx.Err() != nil {
+				return nil, err
+			}
+			log.Debugf("upstream=%s failed: %v", upstream.Address, err)
+		}
+	}
+	return nil, err
+}
+
+// ExchangeServer - upstream ではなく address のサーバーに直接クエリを送信する
+//
+// It makes a single attempt and does not record health, which suits
+// iterative resolution where the caller picks the servers.
+func (c *Client) ExchangeServer(ctx context.Context, address string, query *dns.Packet) (*Response, error) {
+	sendPacket := *query
+	sendPacket.Id = newID()
+	return c.attempt(ctx, &Upstream{Address: address}, &sendPacket)
+}
+
+func (c *Client) attempt(ctx context.Context, upstream *Upstream, sendPacket *dns.Packet) (*Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	query := sendPacket
+	randomized := c.randomCase && upstream.preservesCase()
+	if randomized {
+		query = randomizeCase(sendPacket)
+	}
+
+	start := time.Now()
+	recvPacket, network, err := c.attemptNetworks(ctx, upstream.Address, query, randomized)
+	rtt := time.Since(start)
+	if err != nil {
+		if randomized && errors.Is(err, ErrCaseMismatch) {
+			// only answers with the wrong case arrived before the timeout
+			upstream.recordCase(false)
+		}
+		upstream.recordFailure(rtt, err)
+		return nil, fmt.Errorf("upstream=%s: %w", upstream.Address, err)
+	}
+	if randomized {
+		// datagrams were checked while receiving, the streams are checked here
+		err := checkCase(query, recvPacket)
+		upstream.recordCase(err == nil)
+		if err != nil {
+			return nil, fmt.Errorf("upstream=%s: %w", upstream.Address, err)
+		}
+		restoreCase(recvPacket, sendPacket, query)
+	}
+	upstream.recordSuccess(rtt)
+	return &Response{
+		Packet:   recvPacket,
+		Upstream: upstream.Address,
+		Network:  network,
+		RTT:      rtt,
+	}, nil
+}
+
+// attemptNetworks - 設定されたトランスポートでクエリを送る。randomized なら 0x20 の名前を送っている
+func (c *Client) attemptNetworks(ctx context.Context, address string, sendPacket *dns.Packet, randomized bool) (*dns.Packet, string, error) {
+	switch c.transport {
+	case TransportTCP:
+		recvPacket, err := c.exchange(ctx, "tcp", address, sendPacket, randomized)
+		return recvPacket, "tcp", err
+	case TransportTLS:
+		recvPacket, err := c.exchangeTLS(ctx, address, sendPacket)
+		return recvPacket, "tls", err
+	case TransportHTTPS:
+		recvPacket, err := c.exchangeHTTPS(ctx, address, sendPacket)
+		return recvPacket, "https", err
+	case TransportQUIC:
+		recvPacket, err := c.exchangeQUIC(ctx, address, sendPacket)
+		return recvPacket, "quic", err
+	}
+
+	recvPacket, err := c.exchange(ctx, "udp", address, sendPacket, randomized)
+	if err != nil {
+		return nil, "udp", err
+	}
+	if recvPacket.TC {
+		// the answer did not fit in a datagram, so ask again over TCP
+		log.Debugf("truncated response from server=%s, retrying over TCP", address)
+		recvPacket, err = c.exchange(ctx, "tcp", address, sendPacket, randomized)
+		return recvPacket, "tcp", err
+	}
+	return recvPacket, "udp", nil
+}
+
+func (c *Client) exchange(ctx context.Context, network string, address string, sendPacket *dns.Packet, randomized bool) (*dns.Packet, error) {
 	// connect to the DNS server
 	var err error
-	conn, err := c.dialFunc("udp", fmt.Sprintf("%s:%d", c.server, c.port))
+	conn, err := c.dialContext(ctx, network, address)
 	if err != nil {
-		log.Errorf("dial server=%s: %v", c.server, err)
-		return nil, err
+		log.Errorf("dial server=%s network=%s: %v", address, network, err)
+		return nil, netError(ctx, "dial", err)
 	}
 	defer func() { _ = conn.Close() }()
 
+	// unblock the read or write as soon as the context is done
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
 	// send a packet to the DNS server
 	sendBuf, err := sendPacket.Encode()
 	if err != nil {
@@ -82,30 +455,101 @@ func (c *Client) question(sendPacket *dns.Packet) (*dns.Packet, error) {
 	}
 
 	if c.verbose {
-		fmt.Println("[SEND PACKET]")
+		fmt.Printf("[SEND PACKET] (%s)\n", network)
 		util.PrintHex(sendBuf)
 	}
-	_, err = conn.Write(sendBuf)
+	if network == "tcp" {
+		err = dns.WriteStreamMessage(conn, sendBuf)
+	} else {
+		_, err = conn.Write(sendBuf)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("write send packet: %w", err)
+		return nil, netError(ctx, "write send packet", err)
+	}
+
+	// receive a packet from the DNS server, discarding anything that does not
+	// answer our query until the deadline
+	var rejected error
+	for {
+		recvPacket, err := c.receive(ctx, network, conn, sendPacket, randomized)
+		if err == nil {
+			return recvPacket, nil
+		}
+		if !errors.Is(err, ErrUnexpectedResponse) {
+			if rejected != nil {
+				return nil, fmt.Errorf("%w (last rejected: %w)", err, rejected)
+			}
+			return nil, err
+		}
+		log.Debugf("rejected response from server=%s network=%s: %v", address, network, err)
+		rejected = err
 	}
+}
 
-	// receive a packet from the DNS server
-	recvBuf := make([]byte, 1024)
-	recvLen, err := conn.Read(recvBuf)
+func (c *Client) receive(ctx context.Context, network string, conn net.Conn, sendPacket *dns.Packet, randomized bool) (*dns.Packet, error) {
+	var recvBuf []byte
+	var err error
+	if network == "tcp" {
+		recvBuf, err = dns.ReadStreamMessage(conn)
+	} else {
+		recvBuf = make([]byte, maxUDPMessageLength)
+		var recvLen int
+		recvLen, err = conn.Read(recvBuf)
+		recvBuf = recvBuf[:recvLen]
+	}
 	if err != nil {
-		return nil, fmt.Errorf("read receive packet: %w", err)
+		return nil, netError(ctx, "read receive packet", err)
 	}
 
 	if c.verbose {
-		fmt.Println("[RECV PACKET]")
-		util.PrintHex(recvBuf[:recvLen])
+		fmt.Printf("[RECV PACKET] (%s)\n", network)
+		util.PrintHex(recvBuf)
 	}
 
+	if err := checkResponseID(sendPacket, recvBuf); err != nil {
+		return nil, err
+	}
 	recvPacket, err := dns.DecodePacket(recvBuf)
 	if err != nil {
-		return nil, fmt.Errorf("decode receive packet: %w", err)
+		if network != "tcp" {
+			// anyone can send a datagram with a guessed ID, so keep waiting
+			return nil, fmt.Errorf("%w: %w: %w", ErrUnexpectedResponse, ErrDecode, err)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if err := validateResponse(sendPacket, recvPacket); err != nil {
+		return nil, err
+	}
+	if randomized && network != "tcp" {
+		// a forged datagram is unlikely to guess the case, so keep waiting for
+		// the real answer
+		if err := checkCase(sendPacket, recvPacket); err != nil {
+			return nil, err
+		}
 	}
 
 	return recvPacket, nil
 }
+
+// netError - ソケット操作のエラーを ErrTimeout か ErrNetwork でラップする
+func netError(ctx context.Context, op string, err error) error {
+	// closing the socket on cancellation surfaces as a closed-connection
+	// error, so report the context error instead
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return fmt.Errorf("%s: %w: %w", op, classifyNetError(err), err)
+}
+
+func (c *Client) exchangeTLS(ctx context.Context, address string, sendPacket *dns.Packet) (*dns.Packet, error) {
+	conn, err := c.tlsPool.get(ctx, address, func(ctx context.Context) (net.Conn, error) {
+		return c.dialTLS(ctx, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn.exchange(ctx, sendPacket)
+}
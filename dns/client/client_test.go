@@ -1,11 +1,14 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/niioka/dnsbox/dns"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestClient_Resolve(t *testing.T) {
@@ -107,3 +110,327 @@ func mockServer(t *testing.T, serverConn net.Conn) {
 	_, _ = serverConn.Write(writeBuf)
 
 }
+
+func TestClient_Resolve_truncated(t *testing.T) {
+	// ARRANGE
+	udpClientConn, udpServerConn := net.Pipe()
+	tcpClientConn, tcpServerConn := net.Pipe()
+	defer udpClientConn.Close()
+	defer tcpClientConn.Close()
+
+	go func() {
+		defer udpServerConn.Close()
+		var readBuf [1024]byte
+		n, err := udpServerConn.Read(readBuf[:])
+		if err != nil {
+			t.Errorf("failed to read the packet: %v", err)
+			return
+		}
+		readPacket, err := dns.DecodePacket(readBuf[:n])
+		if err != nil {
+			t.Errorf("failed to decode the packet: %v", err)
+			return
+		}
+		writeBuf, err := (&dns.Packet{
+			Id:        readPacket.Id,
+			QR:        dns.QRResponse,
+			TC:        true,
+			RD:        readPacket.RD,
+			Questions: readPacket.Questions,
+		}).Encode()
+		if err != nil {
+			t.Errorf("failed to encode the packet: %v", err)
+			return
+		}
+		_, _ = udpServerConn.Write(writeBuf)
+	}()
+	go mockTCPServer(t, tcpServerConn)
+
+	var networks []string
+	c := New(Config{
+		DialFunc: func(network string, address string) (net.Conn, error) {
+			networks = append(networks, network)
+			if network == "tcp" {
+				return tcpClientConn, nil
+			}
+			return udpClientConn, nil
+		},
+	})
+
+	// ACT
+	received, err := c.Resolve("google.com", dns.ResourceTypeA)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"udp", "tcp"}, networks); diff != "" {
+		t.Errorf("networks: mismatch(-want, +got):\n%s", diff)
+	}
+	if received.TC {
+		t.Errorf("TC: want false, got true")
+	}
+	if len(received.Answers) != 1 {
+		t.Errorf("answers: want 1, got %d", len(received.Answers))
+	}
+}
+
+func TestClient_Resolve_forceTCP(t *testing.T) {
+	// ARRANGE
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go mockTCPServer(t, serverConn)
+
+	var networks []string
+	c := New(Config{
+		ForceTCP: true,
+		DialFunc: func(network string, address string) (net.Conn, error) {
+			networks = append(networks, network)
+			return clientConn, nil
+		},
+	})
+
+	// ACT
+	received, err := c.Resolve("google.com", dns.ResourceTypeA)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"tcp"}, networks); diff != "" {
+		t.Errorf("networks: mismatch(-want, +got):\n%s", diff)
+	}
+	if len(received.Answers) != 1 {
+		t.Errorf("answers: want 1, got %d", len(received.Answers))
+	}
+}
+
+func mockTCPServer(t *testing.T, serverConn net.Conn) {
+	defer serverConn.Close()
+
+	readBuf, err := dns.ReadStreamMessage(serverConn)
+	if err != nil {
+		t.Errorf("failed to read the packet: %v", err)
+		return
+	}
+	readPacket, err := dns.DecodePacket(readBuf)
+	if err != nil {
+		t.Errorf("failed to decode the packet: %v", err)
+		return
+	}
+	writeBuf, err := (&dns.Packet{
+		Id:        readPacket.Id,
+		QR:        dns.QRResponse,
+		RD:        readPacket.RD,
+		Questions: readPacket.Questions,
+		Answers: []*dns.ResourceRecord{
+			{
+				Name:  "google.com.",
+				Class: dns.ClassIN,
+				TTL:   3600,
+				RData: &dns.AData{
+					Address: []byte{192, 168, 1, 1},
+				},
+			},
+		},
+	}).Encode()
+	if err != nil {
+		t.Errorf("failed to encode the packet: %v", err)
+		return
+	}
+	if err := dns.WriteStreamMessage(serverConn, writeBuf); err != nil {
+		t.Errorf("failed to write the packet: %v", err)
+	}
+}
+
+func TestClient_ResolveContext_errors(t *testing.T) {
+	cases := []struct {
+		label     string
+		config    Config
+		timeout   time.Duration
+		cancel    time.Duration
+		reply     []byte
+		wantErr   error
+		wantDials int
+	}{
+		{
+			label:     "timeout is retried",
+			config:    Config{Timeout: 20 * time.Millisecond, Retries: 2, RetryBackoff: time.Millisecond},
+			wantErr:   ErrTimeout,
+			wantDials: 3,
+		},
+		{
+			label:     "cancellation stops the attempt",
+			config:    Config{Timeout: time.Minute, Retries: 2},
+			cancel:    20 * time.Millisecond,
+			wantErr:   context.Canceled,
+			wantDials: 1,
+		},
+		{
+			label:     "undecodable datagram is discarded until the timeout",
+			config:    Config{Timeout: 20 * time.Millisecond},
+			reply:     []byte{3},
+			wantErr:   ErrTimeout,
+			wantDials: 1,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			dials := 0
+			tc.config.DialFunc = func(network string, address string) (net.Conn, error) {
+				dials++
+				clientConn, serverConn := net.Pipe()
+				go func() {
+					defer serverConn.Close()
+					var readBuf [1024]byte
+					if _, err := serverConn.Read(readBuf[:]); err != nil {
+						return
+					}
+					if tc.reply != nil {
+						// echo the transaction ID so the reply is not discarded by it
+						_, _ = serverConn.Write(append(readBuf[:2:2], tc.reply...))
+					}
+					// never answer properly; wait for the client to give up
+					_, _ = serverConn.Read(readBuf[:])
+				}()
+				return clientConn, nil
+			}
+			c := New(tc.config)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel > 0 {
+				time.AfterFunc(tc.cancel, cancel)
+			}
+
+			// ACT
+			_, err := c.ResolveContext(ctx, "google.com", dns.ResourceTypeA)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("err: want %v, got %v", tc.wantErr, err)
+			}
+			if dials != tc.wantDials {
+				t.Errorf("dials: want %d, got %d", tc.wantDials, dials)
+			}
+		})
+	}
+}
+
+func TestClient_Resolve_discardsUnexpectedResponses(t *testing.T) {
+	// ARRANGE
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		defer serverConn.Close()
+		var readBuf [1024]byte
+		n, err := serverConn.Read(readBuf[:])
+		if err != nil {
+			t.Errorf("failed to read the packet: %v", err)
+			return
+		}
+		readPacket, err := dns.DecodePacket(readBuf[:n])
+		if err != nil {
+			t.Errorf("failed to decode the packet: %v", err)
+			return
+		}
+		answers := []*dns.ResourceRecord{
+			{
+				Name:  "google.com.",
+				Class: dns.ClassIN,
+				TTL:   3600,
+				RData: &dns.AData{Address: []byte{10, 0, 0, 1}},
+			},
+		}
+		responses := []*dns.Packet{
+			// wrong transaction ID
+			{Id: readPacket.Id + 1, QR: dns.QRResponse, Questions: readPacket.Questions, Answers: answers},
+			// not a response
+			{Id: readPacket.Id, QR: dns.QRQuery, Questions: readPacket.Questions, Answers: answers},
+			// different question
+			{
+				Id: readPacket.Id,
+				QR: dns.QRResponse,
+				Questions: []*dns.Question{
+					{Qname: "example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN},
+				},
+				Answers: answers,
+			},
+			// the genuine answer arrives last
+			{Id: readPacket.Id, QR: dns.QRResponse, Questions: readPacket.Questions, Answers: answers},
+		}
+		// right transaction ID, but not a DNS message
+		_, _ = serverConn.Write(append(readBuf[:2:2], 3))
+		for _, p := range responses {
+			writeBuf, err := p.Encode()
+			if err != nil {
+				t.Errorf("failed to encode the packet: %v", err)
+				return
+			}
+			_, _ = serverConn.Write(writeBuf)
+		}
+	}()
+
+	c := New(Config{
+		Timeout: 100 * time.Millisecond,
+		DialFunc: func(network string, address string) (net.Conn, error) {
+			return clientConn, nil
+		},
+	})
+
+	// ACT
+	received, err := c.Resolve("google.com", dns.ResourceTypeA)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if received.QR != dns.QRResponse || received.Questions[0].Qname != "google.com." {
+		t.Errorf("got an unexpected packet: %+v", received)
+	}
+}
+
+func TestClient_ExchangeContext_failover(t *testing.T) {
+	// ARRANGE
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go mockServer(t, serverConn)
+
+	c := New(Config{
+		Servers: []string{"192.0.2.1", "[2001:db8::1]:5353"},
+		DialFunc: func(network string, address string) (net.Conn, error) {
+			if address == "192.0.2.1:53" {
+				return nil, errors.New("connection refused")
+			}
+			return clientConn, nil
+		},
+	})
+
+	// ACT
+	received, err := c.ExchangeContext(context.Background(), &dns.Packet{
+		QR: dns.QRQuery,
+		RD: true,
+		Questions: []*dns.Question{
+			{Qname: "google.com", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN},
+		},
+	})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if received.Upstream != "[2001:db8::1]:5353" {
+		t.Errorf("Upstream: want %q, got %q", "[2001:db8::1]:5353", received.Upstream)
+	}
+	if received.Network != "udp" {
+		t.Errorf("Network: want %q, got %q", "udp", received.Network)
+	}
+	stats := c.Upstreams()[0].Stats()
+	if stats.Failures != 1 || stats.LastError == nil {
+		t.Errorf("stats of the failed upstream: got %+v", stats)
+	}
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	log "github.com/sirupsen/logrus"
+	"net/netip"
+	"sync"
+)
+
+// coalesceKey identifies queries that can share one upstream exchange.
+type coalesceKey struct {
+	name   string
+	qtype  dns.ResourceType
+	qclass dns.Class
+	do     bool
+	// subnet keeps queries on behalf of different client subnets apart
+	subnet netip.Prefix
+}
+
+// call is an upstream exchange in flight.
+type call struct {
+	done     chan struct{}
+	response *Response
+	err      error
+	// shared is the number of callers waiting besides the first one.
+	shared int
+}
+
+// Coalescer - 同一のクエリが同時に来たとき、upstream への問い合わせを 1 回にまとめる Exchanger
+type Coalescer struct {
+	client Exchanger
+
+	mu    sync.Mutex
+	calls map[coalesceKey]*call
+}
+
+func NewCoalescer(client Exchanger) *Coalescer {
+	return &Coalescer{
+		client: client,
+		calls:  make(map[coalesceKey]*call),
+	}
+}
+
+// ExchangeContext - 同じ問い合わせが進行中ならその結果を待ち、なければ upstream に問い合わせる
+//
+// Every caller receives its own copy of the response carrying the
+// transaction ID of its query. The shared exchange is not canceled when
+// one of the callers gives up.
+func (c *Coalescer) ExchangeContext(ctx context.Context, query *dns.Packet) (*Response, error) {
+	k, ok := newCoalesceKey(query)
+	if !ok {
+		return c.client.ExchangeContext(ctx, query)
+	}
+
+	c.mu.Lock()
+	inflight, ok := c.calls[k]
+	if ok {
+		inflight.shared++
+		log.Debugf("Joining in-flight query: %s %v", k.name, k.qtype)
+	} else {
+		inflight = &call{done: make(chan struct{})}
+		c.calls[k] = inflight
+		go c.exchange(context.WithoutCancel(ctx), k, inflight, query)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-inflight.done:
+	case <-ctx.Done():
+		return nil, netError(ctx, "exchange", ctx.Err())
+	}
+	if inflight.err != nil {
+		return nil, inflight.err
+	}
+	response := *inflight.response
+	packet := *response.Packet
+	packet.Id = query.Id
+	response.Packet = &packet
+	return &response, nil
+}
+
+func (c *Coalescer) exchange(ctx context.Context, k coalesceKey, inflight *call, query *dns.Packet) {
+	inflight.response, inflight.err = c.client.ExchangeContext(ctx, query)
+
+	c.mu.Lock()
+	delete(c.calls, k)
+	if inflight.shared > 0 {
+		log.Debugf("Coalesced %d queries: %s %v", inflight.shared, k.name, k.qtype)
+	}
+	c.mu.Unlock()
+	close(inflight.done)
+}
+
+// newCoalesceKey - まとめてよいクエリであればキーを返す
+func newCoalesceKey(query *dns.Packet) (coalesceKey, bool) {
+	if query.Opcode != dns.OpcodeQuery || len(query.Questions) != 1 {
+		return coalesceKey{}, false
+	}
+	q := query.Questions[0]
+	qclass := q.Qclass
+	if qclass == 0 {
+		qclass = dns.ClassIN
+	}
+	k := coalesceKey{name: dns.CanonicalName(q.Qname), qtype: q.Qtype, qclass: qclass}
+	if edns := query.EDNS(); edns != nil {
+		k.do = edns.DO
+		subnet, err := edns.ClientSubnet()
+		if err != nil {
+			return coalesceKey{}, false
+		}
+		if subnet != nil {
+			k.subnet = subnet.Prefix
+		}
+	}
+	return k, true
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingExchanger は release が閉じられるまで応答を返さない
+type blockingExchanger struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (e *blockingExchanger) ExchangeContext(ctx context.Context, query *dns.Packet) (*Response, error) {
+	e.calls.Add(1)
+	select {
+	case <-e.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &Response{
+		Packet: &dns.Packet{
+			Id:        query.Id,
+			QR:        dns.QRResponse,
+			Questions: query.Questions,
+			Answers: []*dns.ResourceRecord{
+				{Name: query.Questions[0].Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}},
+			},
+		},
+		Upstream: "192.0.2.53:53",
+	}, nil
+}
+
+func newQuery(id uint16, name string, do bool) *dns.Packet {
+	query := &dns.Packet{
+		Id:        id,
+		QR:        dns.QRQuery,
+		RD:        true,
+		Questions: []*dns.Question{{Qname: name, Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+	}
+	if do {
+		query.SetEDNS(&dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize, DO: true})
+	}
+	return query
+}
+
+// waitShared は k の問い合わせに n 件の呼び出しが合流するまで待つ
+func waitShared(t *testing.T, c *Coalescer, k coalesceKey, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		inflight, ok := c.calls[k]
+		joined := ok && inflight.shared == n
+		c.mu.Unlock()
+		if joined {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("callers did not join the in-flight query")
+}
+
+func TestCoalescer_ExchangeContext(t *testing.T) {
+	// ARRANGE
+	upstream := &blockingExchanger{release: make(chan struct{})}
+	c := NewCoalescer(upstream)
+	const callers = 10
+	ids := make([]uint16, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// the case of the name does not matter
+			name := "www.example.com."
+			if i%2 == 0 {
+				name = "WWW.example.com"
+			}
+			received, err := c.ExchangeContext(context.Background(), newQuery(uint16(1000+i), name, false))
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			ids[i] = received.Packet.Id
+		}(i)
+	}
+	waitShared(t, c, coalesceKey{name: "www.example.com.", qtype: dns.ResourceTypeA, qclass: dns.ClassIN}, callers-1)
+
+	// ACT
+	close(upstream.release)
+	wg.Wait()
+
+	// ASSERT
+	if got := upstream.calls.Load(); got != 1 {
+		t.Errorf("calls: want 1, got %d", got)
+	}
+	for i, id := range ids {
+		if id != uint16(1000+i) {
+			t.Errorf("Id of caller %d: want %d, got %d", i, 1000+i, id)
+		}
+	}
+}
+
+func TestCoalescer_ExchangeContext_keysOnDO(t *testing.T) {
+	// ARRANGE
+	upstream := &blockingExchanger{release: make(chan struct{})}
+	c := NewCoalescer(upstream)
+	var wg sync.WaitGroup
+	for _, do := range []bool{false, true} {
+		wg.Add(1)
+		go func(do bool) {
+			defer wg.Done()
+			_, _ = c.ExchangeContext(context.Background(), newQuery(1, "www.example.com.", do))
+		}(do)
+	}
+	waitShared(t, c, coalesceKey{name: "www.example.com.", qtype: dns.ResourceTypeA, qclass: dns.ClassIN, do: true}, 0)
+	waitShared(t, c, coalesceKey{name: "www.example.com.", qtype: dns.ResourceTypeA, qclass: dns.ClassIN}, 0)
+
+	// ACT
+	close(upstream.release)
+	wg.Wait()
+
+	// ASSERT
+	if got := upstream.calls.Load(); got != 2 {
+		t.Errorf("calls: want 2, got %d", got)
+	}
+}
+
+func TestCoalescer_ExchangeContext_keysOnClientSubnet(t *testing.T) {
+	// ARRANGE
+	upstream := &blockingExchanger{release: make(chan struct{})}
+	c := NewCoalescer(upstream)
+	prefixes := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("198.51.100.0/24")}
+	var wg sync.WaitGroup
+	for _, prefix := range prefixes {
+		query := newQuery(1, "www.example.com.", false)
+		edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+		edns.SetClientSubnet(dns.NewClientSubnet(prefix))
+		query.SetEDNS(edns)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = c.ExchangeContext(context.Background(), query)
+		}()
+	}
+	for _, prefix := range prefixes {
+		waitShared(t, c, coalesceKey{name: "www.example.com.", qtype: dns.ResourceTypeA, qclass: dns.ClassIN, subnet: prefix}, 0)
+	}
+
+	// ACT
+	close(upstream.release)
+	wg.Wait()
+
+	// ASSERT
+	if got := upstream.calls.Load(); got != 2 {
+		t.Errorf("calls: want 2, got %d", got)
+	}
+}
+
+func TestCoalescer_ExchangeContext_cancelDoesNotAffectOthers(t *testing.T) {
+	// ARRANGE
+	upstream := &blockingExchanger{release: make(chan struct{})}
+	c := NewCoalescer(upstream)
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.ExchangeContext(ctx, newQuery(1, "www.example.com.", false))
+		first <- err
+	}()
+	second := make(chan *Response, 1)
+	go func() {
+		received, _ := c.ExchangeContext(context.Background(), newQuery(2, "www.example.com.", false))
+		second <- received
+	}()
+	waitShared(t, c, coalesceKey{name: "www.example.com.", qtype: dns.ResourceTypeA, qclass: dns.ClassIN}, 1)
+
+	// ACT
+	cancel()
+	err := <-first
+	close(upstream.release)
+
+	// ASSERT
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err: want %v, got %v", context.Canceled, err)
+	}
+	if received := <-second; received == nil || received.Packet.Id != 2 {
+		t.Errorf("second caller: want a response with Id 2, got %+v", received)
+	}
+}
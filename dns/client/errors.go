@@ -0,0 +1,33 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var (
+	// ErrTimeout is returned when the server did not answer before the deadline.
+	ErrTimeout = errors.New("timeout")
+	// ErrNetwork is returned when dialing, writing or reading failed.
+	ErrNetwork = errors.New("network error")
+	// ErrDecode is returned when the response could not be decoded.
+	ErrDecode = errors.New("decode error")
+)
+
+// classifyNetError - ネットワークエラーをタイムアウトかそれ以外に分類する
+func classifyNetError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrTimeout) {
+		return ErrTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrTimeout
+	}
+	return ErrNetwork
+}
+
+// isRetryable - 再試行で回復する可能性のあるエラーかどうか
+func isRetryable(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrNetwork) || errors.Is(err, ErrCaseMismatch)
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultHostsPath は hosts ファイルの既定の場所
+	DefaultHostsPath = "/etc/hosts"
+
+	// NetworkHosts is the Network of a response answered from the hosts file.
+	NetworkHosts = "hosts"
+)
+
+// Hosts は hosts(5) ファイルの名前とアドレスの対応
+type Hosts struct {
+	addrs map[string][]netip.Addr
+}
+
+// LoadHosts - path の hosts ファイルを読み込む
+func LoadHosts(path string) (*Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return ParseHosts(f)
+}
+
+// ParseHosts - hosts ファイルの形式を解析する
+//
+// Each line is an address followed by its canonical name and aliases.
+// Lines with an invalid address are skipped.
+func ParseHosts(r io.Reader) (*Hosts, error) {
+	hosts := &Hosts{addrs: make(map[string][]netip.Addr)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			key := dns.CanonicalName(name)
+			hosts.addrs[key] = append(hosts.addrs[key], addr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read hosts: %w", err)
+	}
+	return hosts, nil
+}
+
+// Lookup - name の qtype (A か AAAA) のアドレスを返す
+func (h *Hosts) Lookup(name string, qtype dns.ResourceType) []netip.Addr {
+	var dest []netip.Addr
+	for _, addr := range h.addrs[dns.CanonicalName(name)] {
+		switch {
+		case qtype == dns.ResourceTypeA && addr.Is4():
+			dest = append(dest, addr)
+		case qtype == dns.ResourceTypeAAAA && addr.Is6() && !addr.Is4In6():
+			dest = append(dest, addr)
+		}
+	}
+	return dest
+}
+
+// answer - hosts ファイルで答えられるクエリなら応答を組み立てる
+func (h *Hosts) answer(query *dns.Packet) *dns.Packet {
+	if len(query.Questions) != 1 {
+		return nil
+	}
+	q := query.Questions[0]
+	if q.Qclass != dns.ClassIN && q.Qclass != 0 {
+		return nil
+	}
+	addrs := h.Lookup(q.Qname, q.Qtype)
+	if len(addrs) == 0 {
+		// like nsswitch, a name without an address of the family falls
+		// through to DNS
+		return nil
+	}
+	res := &dns.Packet{
+		Id:        query.Id,
+		QR:        dns.QRResponse,
+		Opcode:    query.Opcode,
+		RD:        query.RD,
+		RA:        true,
+		Questions: query.Questions,
+	}
+	for _, addr := range addrs {
+		var rdata dns.RData
+		if addr.Is4() {
+			rdata = &dns.AData{Address: addr.AsSlice()}
+		} else {
+			rdata = &dns.AAAAData{Address: addr.AsSlice()}
+		}
+		res.Answers = append(res.Answers, &dns.ResourceRecord{
+			Name:  dns.Fqdn(q.Qname),
+			Class: dns.ClassIN,
+			RData: rdata,
+		})
+	}
+	return res
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testHosts = `# static table
+127.0.0.1	localhost
+::1		localhost ip6-localhost
+192.0.2.5	db.internal db   # primary
+192.0.2.6	DB.internal
+not-an-address	broken.internal
+`
+
+func TestHosts_Lookup(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(testHosts))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cases := []struct {
+		label string
+		name  string
+		qtype dns.ResourceType
+		want  []netip.Addr
+	}{
+		{label: "A", name: "localhost", qtype: dns.ResourceTypeA, want: []netip.Addr{netip.MustParseAddr("127.0.0.1")}},
+		{label: "AAAA", name: "localhost.", qtype: dns.ResourceTypeAAAA, want: []netip.Addr{netip.MustParseAddr("::1")}},
+		{label: "case-insensitive", name: "Db.Internal", qtype: dns.ResourceTypeA, want: []netip.Addr{netip.MustParseAddr("192.0.2.5"), netip.MustParseAddr("192.0.2.6")}},
+		{label: "alias", name: "db", qtype: dns.ResourceTypeA, want: []netip.Addr{netip.MustParseAddr("192.0.2.5")}},
+		{label: "no-family", name: "db", qtype: dns.ResourceTypeAAAA},
+		{label: "invalid-address", name: "broken.internal", qtype: dns.ResourceTypeA},
+		{label: "other-type", name: "localhost", qtype: dns.ResourceTypeTXT},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			got := hosts.Lookup(tc.name, tc.qtype)
+			if diff := cmp.Diff(tc.want, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+				t.Errorf("Lookup(%q, %v): mismatch(-want, +got):\n%s", tc.name, tc.qtype, diff)
+			}
+		})
+	}
+}
+
+func TestClient_ExchangeContext_hosts(t *testing.T) {
+	// ARRANGE
+	hosts, err := ParseHosts(strings.NewReader(testHosts))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dialed := 0
+	c := New(Config{
+		Hosts: hosts,
+		DialFunc: func(network string, address string) (net.Conn, error) {
+			dialed++
+			return nil, &net.OpError{Op: "dial", Err: net.UnknownNetworkError("test")}
+		},
+	})
+
+	// ACT
+	received, err := c.ExchangeContext(context.Background(), &dns.Packet{
+		Id: 7,
+		RD: true,
+		Questions: []*dns.Question{
+			{Qname: "db.internal", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN},
+		},
+	})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dialed != 0 {
+		t.Errorf("dialed %d times, want no network query", dialed)
+	}
+	if received.Network != NetworkHosts {
+		t.Errorf("Network: want %q, got %q", NetworkHosts, received.Network)
+	}
+	want := []*dns.ResourceRecord{
+		{Name: "db.internal.", Class: dns.ClassIN, RData: &dns.AData{Address: []byte{192, 0, 2, 5}}},
+		{Name: "db.internal.", Class: dns.ClassIN, RData: &dns.AData{Address: []byte{192, 0, 2, 6}}},
+	}
+	if diff := cmp.Diff(want, received.Packet.Answers); diff != "" {
+		t.Errorf("Answers: mismatch(-want, +got):\n%s", diff)
+	}
+	if received.Packet.Id != 7 || received.Packet.QR != dns.QRResponse {
+		t.Errorf("header: got Id=%d QR=%v", received.Packet.Id, received.Packet.QR)
+	}
+}
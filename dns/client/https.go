@@ -0,0 +1,120 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// dnsMessageContentType は RFC 8484 で定められたメディアタイプ
+const dnsMessageContentType = "application/dns-message"
+
+// dohTemplateVariable は URI テンプレート中の dns パラメータ (RFC 6570)
+const dohTemplateVariable = "{?dns}"
+
+// DoHTemplate - upstream のアドレスから DoH の URL テンプレートを作る
+//
+// An address that is already a URL is returned as is, so
+// "https://dns.google/dns-query{?dns}" and "8.8.8.8" are both accepted.
+func DoHTemplate(server string, defaultPort int) (string, error) {
+	if strings.Contains(server, "://") {
+		return server, nil
+	}
+	address, err := ParseUpstream(server, defaultPort)
+	if err != nil {
+		return "", err
+	}
+	host, port, _ := net.SplitHostPort(address)
+	if port == strconv.Itoa(443) {
+		address = host
+		if strings.Contains(host, ":") {
+			address = "[" + host + "]"
+		}
+	}
+	return "https://" + address + "/dns-query" + dohTemplateVariable, nil
+}
+
+// expandDoHTemplate - テンプレートを展開してリクエスト URL を作る
+func expandDoHTemplate(template string, msg []byte) string {
+	if msg == nil {
+		return strings.Replace(template, dohTemplateVariable, "", 1)
+	}
+	param := "dns=" + base64.RawURLEncoding.EncodeToString(msg)
+	if strings.Contains(template, dohTemplateVariable) {
+		return strings.Replace(template, dohTemplateVariable, "?"+param, 1)
+	}
+	if strings.Contains(template, "?") {
+		return template + "&" + param
+	}
+	return template + "?" + param
+}
+
+func (c *Client) newHTTPClient() *http.Client {
+	transport := &http.Transport{
+		DialContext:       c.dialContext,
+		TLSClientConfig:   c.tlsConfig.tlsClientConfig("", nil),
+		ForceAttemptHTTP2: true,
+		MaxIdleConns:      10,
+	}
+	return &http.Client{Transport: transport}
+}
+
+func (c *Client) exchangeHTTPS(ctx context.Context, template string, sendPacket *dns.Packet) (*dns.Packet, error) {
+	// RFC 8484 4.1: the ID should be 0 so that responses are cache friendly
+	query := *sendPacket
+	query.Id = 0
+	sendBuf, err := query.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("encode send packet: %w", err)
+	}
+
+	var req *http.Request
+	if c.dohMethod == http.MethodGet {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, expandDoHTemplate(template, sendBuf), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, expandDoHTemplate(template, nil), bytes.NewReader(sendBuf))
+		if req != nil {
+			req.Header.Set("Content-Type", dnsMessageContentType)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, netError(ctx, "http request", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http request: %w: status=%d", ErrNetwork, res.StatusCode)
+	}
+	// parameters such as charset are allowed but carry no meaning
+	contentType := res.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != dnsMessageContentType {
+		return nil, fmt.Errorf("http request: %w: content type=%q", ErrUnexpectedResponse, contentType)
+	}
+	recvBuf, err := io.ReadAll(io.LimitReader(res.Body, dns.MaxMessageLength))
+	if err != nil {
+		return nil, netError(ctx, "read receive packet", err)
+	}
+
+	recvPacket, err := dns.DecodePacket(recvBuf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if err := validateResponse(&query, recvPacket); err != nil {
+		return nil, err
+	}
+	return recvPacket, nil
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDoHTemplate(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{input: "https://dns.google/dns-query{?dns}", want: "https://dns.google/dns-query{?dns}"},
+		{input: "8.8.8.8", want: "https://8.8.8.8/dns-query{?dns}"},
+		{input: "dns.google:8443", want: "https://dns.google:8443/dns-query{?dns}"},
+		{input: "2001:4860:4860::8888", want: "https://[2001:4860:4860::8888]/dns-query{?dns}"},
+	}
+	for _, tc := range cases {
+		got, err := DoHTemplate(tc.input, 443)
+		if err != nil {
+			t.Errorf("DoHTemplate(%q): unexpected error: %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("DoHTemplate(%q): want %q, got %q", tc.input, tc.want, got)
+		}
+	}
+}
+
+func TestExpandDoHTemplate(t *testing.T) {
+	msg := []byte{0, 0, 1, 0, 0xff}
+	cases := []struct {
+		template string
+		msg      []byte
+		want     string
+	}{
+		{template: "https://dns.test/dns-query{?dns}", msg: msg, want: "https://dns.test/dns-query?dns=AAABAP8"},
+		{template: "https://dns.test/dns-query{?dns}", want: "https://dns.test/dns-query"},
+		{template: "https://dns.test/resolve", msg: msg, want: "https://dns.test/resolve?dns=AAABAP8"},
+		{template: "https://dns.test/resolve?ct", msg: msg, want: "https://dns.test/resolve?ct&dns=AAABAP8"},
+	}
+	for _, tc := range cases {
+		if got := expandDoHTemplate(tc.template, tc.msg); got != tc.want {
+			t.Errorf("expandDoHTemplate(%q): want %q, got %q", tc.template, tc.want, got)
+		}
+	}
+}
+
+func TestClient_Resolve_HTTPS(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		method := method
+		t.Run(method, func(t *testing.T) {
+			// ARRANGE
+			var connections atomic.Int32
+			var protos []string
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				protos = append(protos, r.Proto)
+				if r.Method != method {
+					t.Errorf("method: want %s, got %s", method, r.Method)
+				}
+				var buf []byte
+				var err error
+				if r.Method == http.MethodGet {
+					buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+				} else {
+					if ct := r.Header.Get("Content-Type"); ct != dnsMessageContentType {
+						t.Errorf("Content-Type: want %s, got %s", dnsMessageContentType, ct)
+					}
+					buf, err = io.ReadAll(r.Body)
+				}
+				if err != nil {
+					t.Errorf("failed to read the query: %v", err)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				query, err := dns.DecodePacket(buf)
+				if err != nil {
+					t.Errorf("failed to decode the packet: %v", err)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if query.Id != 0 {
+					t.Errorf("Id: want 0, got %d", query.Id)
+				}
+				res, err := answerFor(query).Encode()
+				if err != nil {
+					t.Errorf("failed to encode the packet: %v", err)
+					return
+				}
+				w.Header().Set("Content-Type", dnsMessageContentType)
+				_, _ = w.Write(res)
+			}))
+			ts.EnableHTTP2 = true
+			ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					connections.Add(1)
+				}
+			}
+			ts.StartTLS()
+			defer ts.Close()
+
+			pool := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+			c := New(Config{
+				Servers:   []string{ts.URL + "/dns-query{?dns}"},
+				Transport: TransportHTTPS,
+				DoHMethod: method,
+				TLSConfig: &TLSConfig{RootCAs: pool},
+			})
+			defer c.Close()
+
+			// ACT
+			var answers []*dns.ResourceRecord
+			for _, name := range []string{"a.test.", "b.test."} {
+				received, err := c.ResolveContext(context.Background(), name, dns.ResourceTypeA)
+				if err != nil {
+					t.Fatalf("ResolveContext(%s): unexpected error: %v", name, err)
+				}
+				answers = append(answers, received.Answers...)
+			}
+
+			// ASSERT
+			if len(answers) != 2 || answers[0].Name != "a.test." || answers[1].Name != "b.test." {
+				t.Errorf("answers: got %v", answers)
+			}
+			for _, proto := range protos {
+				if proto != "HTTP/2.0" {
+					t.Errorf("proto: want HTTP/2.0, got %s", proto)
+				}
+			}
+			if n := connections.Load(); n != 1 {
+				t.Errorf("connections: want 1, got %d", n)
+			}
+		})
+	}
+}
+
+func TestClient_exchangeHTTPS_contentType(t *testing.T) {
+	cases := []struct {
+		label       string
+		contentType string
+		wantErr     error
+	}{
+		{label: "ok/plain", contentType: "application/dns-message"},
+		{label: "ok/parameter", contentType: "application/dns-message; charset=utf-8"},
+		{label: "ok/upper-case", contentType: "Application/DNS-Message"},
+		{label: "Err/other", contentType: "text/html", wantErr: ErrUnexpectedResponse},
+		{label: "Err/malformed", contentType: "application/dns-message; =", wantErr: ErrUnexpectedResponse},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				buf, err := io.ReadAll(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				query, err := dns.DecodePacket(buf)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				res, _ := answerFor(query).Encode()
+				w.Header().Set("Content-Type", tc.contentType)
+				_, _ = w.Write(res)
+			}))
+			defer ts.Close()
+			pool := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+			c := New(Config{
+				Servers:   []string{ts.URL + "/dns-query{?dns}"},
+				Transport: TransportHTTPS,
+				TLSConfig: &TLSConfig{RootCAs: pool},
+			})
+			defer c.Close()
+			query := &dns.Packet{
+				RD:        true,
+				Questions: []*dns.Question{{Qname: "a.test.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+			}
+
+			// ACT
+			received, err := c.exchangeHTTPS(context.Background(), ts.URL+"/dns-query{?dns}", query)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("exchangeHTTPS: want %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr == nil && len(received.Answers) != 1 {
+				t.Errorf("answers: want 1, got %v", received.Answers)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/internal/msgconn"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// NewNetResolver - exchanger で名前解決する net.Resolver を返す
+//
+// Code written against net.Resolver then goes through the transports and
+// layers of dnsbox, such as DNS-over-TLS and the cache.
+func NewNetResolver(exchanger Exchanger) *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: ResolverDial(exchanger)}
+}
+
+// ResolverDial - net.Resolver の Dial に渡す関数を返す
+//
+// The returned connections speak DNS like a server would: datagrams for
+// "udp" and length-prefixed messages for "tcp". The address the resolver
+// picked from its own configuration is ignored and every query is answered
+// through exchanger.
+func ResolverDial(exchanger Exchanger) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		stream := msgconn.IsStream(network)
+		conn := msgconn.New(context.WithoutCancel(ctx), msgconn.Config{
+			Network:      network,
+			Address:      address,
+			LocalAddress: "dnsbox",
+			Buffer:       8,
+			Respond: func(ctx context.Context, msg []byte, reply func([]byte)) error {
+				go resolverRespond(ctx, exchanger, msg, stream, reply)
+				return nil
+			},
+		})
+		if stream {
+			return conn, nil
+		}
+		return &msgconn.PacketConn{Conn: conn}, nil
+	}
+}
+
+// resolverRespond - クエリを解決して応答を返す
+func resolverRespond(ctx context.Context, exchanger Exchanger, msg []byte, stream bool, reply func([]byte)) {
+	query, err := dns.DecodePacket(msg)
+	if err != nil {
+		// like a server, drop what can not be parsed and let the reader time out
+		log.Debugf("resolver conn: drop malformed query: %v", err)
+		return
+	}
+	res := resolverExchange(ctx, exchanger, query)
+	buf, err := res.Encode()
+	if err != nil {
+		log.Warnf("resolver conn: encode response: %v", err)
+		return
+	}
+	if !stream && len(buf) > udpLimit(query) {
+		// let the resolver retry over TCP
+		buf, err = (&dns.Packet{
+			Id:        query.Id,
+			QR:        dns.QRResponse,
+			Opcode:    query.Opcode,
+			TC:        true,
+			RD:        query.RD,
+			RA:        res.RA,
+			RCode:     res.RCode,
+			Questions: query.Questions,
+		}).Encode()
+		if err != nil {
+			log.Warnf("resolver conn: encode truncated response: %v", err)
+			return
+		}
+	}
+	reply(buf)
+}
+
+// resolverExchange - クエリを解決する。失敗したときは SERVFAIL を返す
+func resolverExchange(ctx context.Context, exchanger Exchanger, query *dns.Packet) *dns.Packet {
+	received, err := exchanger.ExchangeContext(ctx, query)
+	if err != nil {
+		log.Debugf("resolver conn: %v", err)
+		return &dns.Packet{
+			Id:        query.Id,
+			QR:        dns.QRResponse,
+			Opcode:    query.Opcode,
+			RD:        query.RD,
+			RCode:     dns.RCodeServerFailure,
+			Questions: query.Questions,
+		}
+	}
+	res := *received.Packet
+	res.Id = query.Id
+	return &res
+}
+
+// udpLimit - クエリが受け取れる UDP の応答の大きさ
+func udpLimit(query *dns.Packet) int {
+	if edns := query.EDNS(); edns != nil && int(edns.UDPSize) > dns.MinEDNSUDPSize {
+		return int(edns.UDPSize)
+	}
+	return dns.MinEDNSUDPSize
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// exchangerFunc は関数を Exchanger として使う
+type exchangerFunc func(query *dns.Packet) (*dns.Packet, error)
+
+func (f exchangerFunc) ExchangeContext(_ context.Context, query *dns.Packet) (*Response, error) {
+	res, err := f(query)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Packet: res}, nil
+}
+
+// zoneExchanger は名前ごとのレコードで答え、ダイヤルされたネットワークを記録する
+func zoneExchanger(records map[string][]*dns.ResourceRecord) exchangerFunc {
+	return func(query *dns.Packet) (*dns.Packet, error) {
+		q := query.Questions[0]
+		res := &dns.Packet{
+			Id:        0xbeef, // an upstream answers with its own ID
+			QR:        dns.QRResponse,
+			RD:        true,
+			RA:        true,
+			Questions: query.Questions,
+		}
+		answers, ok := records[dns.CanonicalName(q.Qname)]
+		if !ok {
+			res.RCode = dns.RCodeNameError
+			return res, nil
+		}
+		for _, rr := range answers {
+			if rr.RData.ResourceType() == q.Qtype {
+				res.Answers = append(res.Answers, rr)
+			}
+		}
+		return res, nil
+	}
+}
+
+func TestNewNetResolver(t *testing.T) {
+	longText := strings.Repeat("x", 200)
+	records := map[string][]*dns.ResourceRecord{
+		"host.example.com.": {
+			{Name: "host.example.com.", Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}},
+			{Name: "host.example.com.", Class: dns.ClassIN, TTL: 60, RData: &dns.AAAAData{Address: netip.MustParseAddr("2001:db8::1").AsSlice()}},
+		},
+		"big.example.com.": {},
+	}
+	for i := 0; i < 10; i++ {
+		records["big.example.com."] = append(records["big.example.com."],
+			&dns.ResourceRecord{Name: "big.example.com.", Class: dns.ClassIN, TTL: 60, RData: &dns.TXTData{Text: longText + string(rune('a'+i))}})
+	}
+
+	var mu sync.Mutex
+	var networks []string
+	dial := ResolverDial(zoneExchanger(records))
+	r := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		networks = append(networks, network)
+		mu.Unlock()
+		return dial(ctx, network, address)
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("ok/LookupNetIP", func(t *testing.T) {
+		// ACT
+		got, err := r.LookupNetIP(ctx, "ip", "host.example.com.")
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := map[netip.Addr]bool{netip.MustParseAddr("192.0.2.1"): true, netip.MustParseAddr("2001:db8::1"): true}
+		if len(got) != len(want) {
+			t.Fatalf("LookupNetIP: want %v, got %v", want, got)
+		}
+		for _, addr := range got {
+			if !want[addr.Unmap()] {
+				t.Errorf("LookupNetIP: unexpected address %v", addr)
+			}
+		}
+	})
+
+	t.Run("ok/truncated-retries-over-tcp", func(t *testing.T) {
+		// ARRANGE
+		mu.Lock()
+		networks = nil
+		mu.Unlock()
+
+		// ACT
+		got, err := r.LookupTXT(ctx, "big.example.com.")
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != 10 {
+			t.Errorf("LookupTXT: want 10 records, got %d", len(got))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if diff := cmp.Diff([]string{"udp", "tcp"}, networks); diff != "" {
+			t.Errorf("networks: mismatch(-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Err/not-found", func(t *testing.T) {
+		// ACT
+		_, err := r.LookupNetIP(ctx, "ip4", "missing.example.com.")
+
+		// ASSERT
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("err: want a not-found DNSError, got %v", err)
+		}
+	})
+}
+
+func TestResolverDial_serverFailure(t *testing.T) {
+	// ARRANGE
+	r := NewNetResolver(exchangerFunc(func(query *dns.Packet) (*dns.Packet, error) {
+		return nil, ErrTimeout
+	}))
+
+	// ACT
+	_, err := r.LookupNetIP(context.Background(), "ip4", "host.example.com.")
+
+	// ASSERT
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		t.Errorf("err: want a server failure, got %v", err)
+	}
+}
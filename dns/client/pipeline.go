@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// pipelineConn は 1 本のストリーム接続で複数のクエリを並行して送受信する
+//
+// Responses may arrive in any order and are matched to their query by ID.
+type pipelineConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	err     error
+	done    chan struct{}
+}
+
+func newPipelineConn(conn net.Conn) *pipelineConn {
+	p := &pipelineConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+	}
+	go p.readLoop()
+	return p
+}
+
+func (p *pipelineConn) readLoop() {
+	for {
+		msg, err := dns.ReadStreamMessage(p.conn)
+		if err != nil {
+			_ = p.close(err)
+			return
+		}
+		if len(msg) < 2 {
+			log.Debugf("discarded short message from server=%s", p.conn.RemoteAddr())
+			continue
+		}
+		id := binary.BigEndian.Uint16(msg)
+		p.mu.Lock()
+		ch, ok := p.pending[id]
+		delete(p.pending, id)
+		p.mu.Unlock()
+		if !ok {
+			log.Debugf("discarded unsolicited message id=%d from server=%s", id, p.conn.RemoteAddr())
+			continue
+		}
+		ch <- msg
+	}
+}
+
+// close - 接続を閉じ、待機中のクエリに err を返す
+func (p *pipelineConn) close(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil
+	}
+	p.err = err
+	close(p.done)
+	return p.conn.Close()
+}
+
+func (p *pipelineConn) closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
+
+// exchange - クエリを送信し、同じ ID の応答を待つ
+//
+// The ID is replaced when another in-flight query on the connection uses it.
+func (p *pipelineConn) exchange(ctx context.Context, query *dns.Packet) (*dns.Packet, error) {
+	sendPacket := *query
+	ch := make(chan []byte, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		err := p.err
+		p.mu.Unlock()
+		return nil, netError(ctx, "write send packet", err)
+	}
+	for {
+		if _, inUse := p.pending[sendPacket.Id]; !inUse {
+			break
+		}
+		sendPacket.Id = newID()
+	}
+	p.pending[sendPacket.Id] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, sendPacket.Id)
+		p.mu.Unlock()
+	}()
+
+	sendBuf, err := sendPacket.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("encode send packet: %w", err)
+	}
+	p.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = p.conn.SetWriteDeadline(deadline)
+	}
+	err = dns.WriteStreamMessage(p.conn, sendBuf)
+	_ = p.conn.SetWriteDeadline(time.Time{})
+	p.writeMu.Unlock()
+	if err != nil {
+		// a partial write breaks the framing for everyone
+		_ = p.close(err)
+		return nil, netError(ctx, "write send packet", err)
+	}
+
+	select {
+	case recvBuf := <-ch:
+		recvPacket, err := dns.DecodePacket(recvBuf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+		}
+		if err := validateResponse(&sendPacket, recvPacket); err != nil {
+			return nil, err
+		}
+		return recvPacket, nil
+	case <-p.done:
+		return nil, netError(ctx, "read receive packet", p.err)
+	case <-ctx.Done():
+		return nil, netError(ctx, "read receive packet", ctx.Err())
+	}
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"context"
+)
+
+// dialCall は upstream への進行中の接続。同じ upstream を待つ呼び出しで共有する
+//
+// The pools dial without holding their lock, so that a slow upstream does not
+// hold up the connections to the others, and register the call instead so
+// that concurrent queries to the same upstream share one connection.
+type dialCall[T any] struct {
+	done chan struct{}
+	conn T
+	err  error
+}
+
+func newDialCall[T any]() *dialCall[T] {
+	return &dialCall[T]{done: make(chan struct{})}
+}
+
+// finish - 接続の結果を待っている呼び出しに知らせる
+func (c *dialCall[T]) finish(conn T, err error) {
+	c.conn, c.err = conn, err
+	close(c.done)
+}
+
+// wait - 接続が終わるか ctx が終わるまで待つ
+func (c *dialCall[T]) wait(ctx context.Context) (T, error) {
+	select {
+	case <-c.done:
+		return c.conn, c.err
+	case <-ctx.Done():
+		var zero T
+		return zero, netError(ctx, "dial", ctx.Err())
+	}
+}
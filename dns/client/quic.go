@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/quic-go/quic-go"
+	"sync"
+)
+
+// doqALPN は RFC 9250 で定められた ALPN の識別子
+const doqALPN = "doq"
+
+// doqNoError はクエリ完了後に接続を閉じるときのエラーコード (RFC 9250 4.3)
+const doqNoError quic.ApplicationErrorCode = 0
+
+// quicPool は upstream ごとに QUIC 接続を使い回す
+type quicPool struct {
+	mu           sync.Mutex
+	conns        map[string]*quic.Conn
+	dialing      map[string]*dialCall[*quic.Conn]
+	sessionCache tls.ClientSessionCache
+}
+
+// get - 利用可能な接続を返す。なければ新しく接続する
+//
+// The connection is returned before the handshake completes so that the
+// first query can be sent as 0-RTT data when a session ticket is cached.
+func (p *quicPool) get(ctx context.Context, address string, tlsConfig *TLSConfig) (*quic.Conn, error) {
+	p.mu.Lock()
+	if conn, ok := p.conns[address]; ok && conn.Context().Err() == nil {
+		p.mu.Unlock()
+		return conn, nil
+	}
+	if call, ok := p.dialing[address]; ok {
+		p.mu.Unlock()
+		return call.wait(ctx)
+	}
+	call := newDialCall[*quic.Conn]()
+	if p.dialing == nil {
+		p.dialing = make(map[string]*dialCall[*quic.Conn])
+	}
+	p.dialing[address] = call
+	if p.sessionCache == nil {
+		p.sessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	config := tlsConfig.tlsClientConfig(address, []string{doqALPN})
+	config.ClientSessionCache = p.sessionCache
+	config.MinVersion = tls.VersionTLS13
+	p.mu.Unlock()
+
+	conn, err := quic.DialAddrEarly(ctx, address, config, &quic.Config{})
+	if err != nil {
+		if errors.Is(err, ErrPinMismatch) {
+			err = fmt.Errorf("quic handshake: %w", err)
+		} else {
+			err = netError(ctx, "dial", err)
+		}
+		conn = nil
+	}
+	p.mu.Lock()
+	delete(p.dialing, address)
+	if err == nil {
+		if p.conns == nil {
+			p.conns = make(map[string]*quic.Conn)
+		}
+		p.conns[address] = conn
+	}
+	p.mu.Unlock()
+	call.finish(conn, err)
+	return conn, err
+}
+
+func (p *quicPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for address, conn := range p.conns {
+		errs = append(errs, conn.CloseWithError(doqNoError, ""))
+		delete(p.conns, address)
+	}
+	return errors.Join(errs...)
+}
+
+// replaySafe - 0-RTT で送信してよいクエリかどうか (RFC 9250 4.5)
+func replaySafe(query *dns.Packet) bool {
+	return query.Opcode == dns.OpcodeQuery
+}
+
+func (c *Client) exchangeQUIC(ctx context.Context, address string, sendPacket *dns.Packet) (*dns.Packet, error) {
+	conn, err := c.quicPool.get(ctx, address, c.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if !replaySafe(sendPacket) {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-ctx.Done():
+			return nil, netError(ctx, "quic handshake", ctx.Err())
+		}
+	}
+
+	// RFC 9250 4.2.1: the ID must be 0 since every query has its own stream
+	query := *sendPacket
+	query.Id = 0
+	sendBuf, err := query.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("encode send packet: %w", err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, netError(ctx, "open stream", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+	})
+	defer stop()
+
+	if err := dns.WriteStreamMessage(stream, sendBuf); err != nil {
+		return nil, netError(ctx, "write send packet", err)
+	}
+	// the client must indicate that no more data follows on the stream
+	if err := stream.Close(); err != nil {
+		return nil, netError(ctx, "close stream", err)
+	}
+
+	recvBuf, err := dns.ReadStreamMessage(stream)
+	if err != nil {
+		return nil, netError(ctx, "read receive packet", err)
+	}
+	recvPacket, err := dns.DecodePacket(recvBuf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if err := validateResponse(&query, recvPacket); err != nil {
+		return nil, err
+	}
+	return recvPacket, nil
+}
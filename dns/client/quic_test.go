@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/quic-go/quic-go"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startQUICServer - 1 ストリームにつき 1 クエリに応答する DoQ サーバーを起動する
+func startQUICServer(t *testing.T, cert tls.Certificate) (string, *atomic.Int32, *atomic.Int32) {
+	t.Helper()
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{doqALPN},
+	}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	var accepted, used0RTT atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			if conn.ConnectionState().Used0RTT {
+				used0RTT.Add(1)
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						buf, err := dns.ReadStreamMessage(stream)
+						if err != nil {
+							t.Errorf("failed to read the packet: %v", err)
+							return
+						}
+						query, err := dns.DecodePacket(buf)
+						if err != nil {
+							t.Errorf("failed to decode the packet: %v", err)
+							return
+						}
+						if query.Id != 0 {
+							t.Errorf("Id: want 0, got %d", query.Id)
+						}
+						res, err := answerFor(query).Encode()
+						if err != nil {
+							t.Errorf("failed to encode the packet: %v", err)
+							return
+						}
+						_ = dns.WriteStreamMessage(stream, res)
+					}()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted, &used0RTT
+}
+
+func TestClient_Resolve_QUIC(t *testing.T) {
+	// ARRANGE
+	cert, pool := newTestCertificate(t)
+	address, accepted, used0RTT := startQUICServer(t, cert)
+	c := New(Config{
+		Servers:   []string{address},
+		Transport: TransportQUIC,
+		TLSConfig: &TLSConfig{ServerName: "dns.test", RootCAs: pool},
+		Timeout:   5 * time.Second,
+	})
+	defer c.Close()
+
+	// ACT
+	var answers []*dns.ResourceRecord
+	for _, name := range []string{"a.test.", "b.test."} {
+		received, err := c.ResolveContext(context.Background(), name, dns.ResourceTypeA)
+		if err != nil {
+			t.Fatalf("ResolveContext(%s): unexpected error: %v", name, err)
+		}
+		answers = append(answers, received.Answers...)
+	}
+
+	// ASSERT
+	if len(answers) != 2 || answers[0].Name != "a.test." || answers[1].Name != "b.test." {
+		t.Errorf("answers: got %v", answers)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("connections: want 1, got %d", n)
+	}
+
+	t.Run("0-RTT on resumption", func(t *testing.T) {
+		// ARRANGE
+		_ = c.quicPool.close()
+
+		// ACT
+		_, err := c.ResolveContext(context.Background(), "a.test.", dns.ResourceTypeA)
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("ResolveContext: unexpected error: %v", err)
+		}
+		if n := used0RTT.Load(); n != 1 {
+			t.Errorf("0-RTT connections: want 1, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultResolvConfPath は resolv.conf の既定の場所
+	DefaultResolvConfPath = "/etc/resolv.conf"
+
+	// limits of glibc (resolv.h)
+	maxNameservers = 3
+	maxSearch      = 6
+	maxNDots       = 15
+	maxTimeout     = 30 * time.Second
+	maxAttempts    = 5
+)
+
+// ResolvConf is the resolver configuration read from resolv.conf(5).
+type ResolvConf struct {
+	Nameservers []string
+	// Search is the search list. The domain and search keywords both set
+	// it, and the last one in the file wins.
+	Search []string
+	// NDots is the number of dots a name needs to be tried as is before
+	// the search list.
+	NDots int
+	// Timeout is the wait for each nameserver.
+	Timeout time.Duration
+	// Attempts is the number of rounds over all nameservers.
+	Attempts int
+	Rotate   bool
+	EDNS0    bool
+}
+
+// defaultResolvConf - 設定がないときの glibc の既定値
+func defaultResolvConf() *ResolvConf {
+	return &ResolvConf{
+		NDots:    1,
+		Timeout:  5 * time.Second,
+		Attempts: 2,
+	}
+}
+
+// LoadResolvConf - path の resolv.conf を読み込む
+func LoadResolvConf(path string) (*ResolvConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return ParseResolvConf(f)
+}
+
+// ParseResolvConf - resolv.conf の形式を解析する
+//
+// Unknown keywords and options are ignored and values out of range are
+// clamped, as glibc does. Without any nameserver it falls back to the
+// local one.
+func ParseResolvConf(r io.Reader) (*ResolvConf, error) {
+	conf := defaultResolvConf()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(conf.Nameservers) < maxNameservers {
+				conf.Nameservers = append(conf.Nameservers, fields[1])
+			}
+		case "domain":
+			conf.Search = []string{fields[1]}
+		case "search":
+			conf.Search = fields[1:min(len(fields), maxSearch+1)]
+		case "options":
+			for _, option := range fields[1:] {
+				conf.parseOption(option)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read resolv.conf: %w", err)
+	}
+	if len(conf.Nameservers) == 0 {
+		conf.Nameservers = []string{"127.0.0.1"}
+	}
+	return conf, nil
+}
+
+func (c *ResolvConf) parseOption(option string) {
+	name, value, _ := strings.Cut(option, ":")
+	switch name {
+	case "ndots":
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			c.NDots = min(n, maxNDots)
+		}
+	case "timeout":
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+			c.Timeout = min(time.Duration(n)*time.Second, maxTimeout)
+		}
+	case "attempts":
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+			c.Attempts = min(n, maxAttempts)
+		}
+	case "rotate":
+		c.Rotate = true
+	case "edns0":
+		c.EDNS0 = true
+	}
+}
+
+// Config - resolv.conf の設定を反映した Config を返す
+func (c *ResolvConf) Config() Config {
+	config := Config{
+		Servers: c.Nameservers,
+		Search:  c.Search,
+		NDots:   c.NDots,
+		Timeout: c.Timeout,
+		Retries: c.Attempts - 1,
+		EDNS0:   c.EDNS0,
+	}
+	if c.Rotate {
+		config.Strategy = StrategyRoundRobin
+	}
+	return config
+}
+
+// SearchNames - 検索リストで展開した、問い合わせる名前の順序を返す
+//
+// As in glibc, a fully qualified name is tried alone, a name with at least
+// ndots dots is tried as is before the search list, and any other name
+// after it.
+func SearchNames(name string, search []string, ndots int) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	var names []string
+	for _, domain := range search {
+		names = append(names, name+"."+strings.TrimSuffix(domain, ".")+".")
+	}
+	if strings.Count(name, ".") >= ndots {
+		return append([]string{name + "."}, names...)
+	}
+	return append(names, name+".")
+}
@@ -0,0 +1,253 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	cases := []struct {
+		label string
+		input string
+		want  *ResolvConf
+	}{
+		{
+			label: "ok/empty",
+			input: "",
+			want:  &ResolvConf{Nameservers: []string{"127.0.0.1"}, NDots: 1, Timeout: 5 * time.Second, Attempts: 2},
+		},
+		{
+			label: "ok/full",
+			input: strings.Join([]string{
+				"# generated by NetworkManager",
+				"nameserver 192.0.2.1",
+				"nameserver 2001:db8::1 ; secondary",
+				"search corp.example.com example.com",
+				"options ndots:2 timeout:3 attempts:4 rotate edns0 unknown:1",
+			}, "\n"),
+			want: &ResolvConf{
+				Nameservers: []string{"192.0.2.1", "2001:db8::1"},
+				Search:      []string{"corp.example.com", "example.com"},
+				NDots:       2,
+				Timeout:     3 * time.Second,
+				Attempts:    4,
+				Rotate:      true,
+				EDNS0:       true,
+			},
+		},
+		{
+			label: "ok/last-of-domain-and-search-wins",
+			input: "search a.example b.example\ndomain c.example\nnameserver 192.0.2.1",
+			want:  &ResolvConf{Nameservers: []string{"192.0.2.1"}, Search: []string{"c.example"}, NDots: 1, Timeout: 5 * time.Second, Attempts: 2},
+		},
+		{
+			label: "ok/clamped",
+			input: "nameserver 192.0.2.1\nnameserver 192.0.2.2\nnameserver 192.0.2.3\nnameserver 192.0.2.4\n" +
+				"search a b c d e f g\noptions ndots:20 timeout:60 attempts:9 timeout:0",
+			want: &ResolvConf{
+				Nameservers: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+				Search:      []string{"a", "b", "c", "d", "e", "f"},
+				NDots:       15,
+				Timeout:     30 * time.Second,
+				Attempts:    5,
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ACT
+			got, err := ParseResolvConf(strings.NewReader(tc.input))
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseResolvConf: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResolvConf_Config(t *testing.T) {
+	// ARRANGE
+	conf := &ResolvConf{Nameservers: []string{"192.0.2.1"}, Search: []string{"example.com"}, NDots: 2, Timeout: 3 * time.Second, Attempts: 3, Rotate: true, EDNS0: true}
+
+	// ACT
+	got := conf.Config()
+
+	// ASSERT
+	want := Config{
+		Servers:  []string{"192.0.2.1"},
+		Strategy: StrategyRoundRobin,
+		Search:   []string{"example.com"},
+		NDots:    2,
+		Timeout:  3 * time.Second,
+		Retries:  2,
+		EDNS0:    true,
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })); diff != "" {
+		t.Errorf("Config: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestSearchNames(t *testing.T) {
+	search := []string{"corp.example.com", "example.com."}
+	cases := []struct {
+		label string
+		name  string
+		ndots int
+		want  []string
+	}{
+		{label: "fqdn", name: "www.example.org.", ndots: 1, want: []string{"www.example.org."}},
+		{label: "enough-dots", name: "www.example", ndots: 1, want: []string{"www.example.", "www.example.corp.example.com.", "www.example.example.com."}},
+		{label: "too-few-dots", name: "www", ndots: 1, want: []string{"www.corp.example.com.", "www.example.com.", "www."}},
+		{label: "ndots-2", name: "www.example", ndots: 2, want: []string{"www.example.corp.example.com.", "www.example.example.com.", "www.example."}},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			got := SearchNames(tc.name, search, tc.ndots)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("SearchNames(%q): mismatch(-want, +got):\n%s", tc.name, diff)
+			}
+		})
+	}
+}
+
+// startUDPServer は handler で応答する UDP サーバーを起動し、受信した名前を記録する
+func startUDPServer(t *testing.T, handler func(query *dns.Packet) *dns.Packet) (string, func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	var mu sync.Mutex
+	var names []string
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.DecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			names = append(names, query.Questions[0].Qname)
+			mu.Unlock()
+			res := handler(query)
+			if res == nil {
+				// no answer, so the client times out
+				continue
+			}
+			res.Id = query.Id
+			res.QR = dns.QRResponse
+			res.Questions = query.Questions
+			sendBuf, err := res.Encode()
+			if err != nil {
+				t.Errorf("failed to encode the response: %v", err)
+				return
+			}
+			_, _ = conn.WriteTo(sendBuf, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), names...)
+	}
+}
+
+func TestClient_ResolveContext_search(t *testing.T) {
+	address, received := startUDPServer(t, func(query *dns.Packet) *dns.Packet {
+		q := query.Questions[0]
+		switch q.Qname {
+		case "db.example.com.":
+			return &dns.Packet{Answers: []*dns.ResourceRecord{
+				{Name: q.Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 10}}},
+			}}
+		case "mail.corp.example.com.":
+			// the name exists without the type
+			return &dns.Packet{}
+		case "web.corp.example.com.", "down.corp.example.com.":
+			return &dns.Packet{RCode: dns.RCodeServerFailure}
+		case "web.example.com.", "lost.example.com.":
+			return &dns.Packet{Answers: []*dns.ResourceRecord{
+				{Name: q.Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 11}}},
+			}}
+		case "lost.corp.example.com.":
+			return nil
+		default:
+			return &dns.Packet{RCode: dns.RCodeNameError}
+		}
+	})
+	cases := []struct {
+		label     string
+		name      string
+		wantRCode int
+		wantNames []string
+	}{
+		{label: "found-in-second-domain", name: "db", wantRCode: dns.RCodeNoError, wantNames: []string{"db.corp.example.com.", "db.example.com."}},
+		{label: "nodata-is-kept", name: "mail", wantRCode: dns.RCodeNoError, wantNames: []string{"mail.corp.example.com.", "mail.example.com.", "mail."}},
+		{label: "nxdomain", name: "nope", wantRCode: dns.RCodeNameError, wantNames: []string{"nope.corp.example.com.", "nope.example.com.", "nope."}},
+		{label: "fqdn", name: "db.", wantRCode: dns.RCodeNameError, wantNames: []string{"db."}},
+		{label: "servfail-moves-on", name: "web", wantRCode: dns.RCodeNoError, wantNames: []string{"web.corp.example.com.", "web.example.com."}},
+		{label: "timeout-moves-on", name: "lost", wantRCode: dns.RCodeNoError, wantNames: []string{"lost.corp.example.com.", "lost.example.com."}},
+		{label: "servfail-beats-nxdomain", name: "down", wantRCode: dns.RCodeServerFailure, wantNames: []string{"down.corp.example.com.", "down.example.com.", "down."}},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			c := New(Config{Servers: []string{address}, Search: []string{"corp.example.com", "example.com"}, NDots: 1, Timeout: 50 * time.Millisecond})
+			before := len(received())
+
+			// ACT
+			got, err := c.ResolveContext(context.Background(), tc.name, dns.ResourceTypeA)
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.RCode != tc.wantRCode {
+				t.Errorf("RCode: want %d, got %d", tc.wantRCode, got.RCode)
+			}
+			if diff := cmp.Diff(tc.wantNames, received()[before:]); diff != "" {
+				t.Errorf("queried names: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClient_LookupContext_searchError(t *testing.T) {
+	// ARRANGE
+	address, _ := startUDPServer(t, func(query *dns.Packet) *dns.Packet {
+		if query.Questions[0].Qname == "lost.corp.example.com." {
+			return nil
+		}
+		return &dns.Packet{RCode: dns.RCodeNameError}
+	})
+	c := New(Config{Servers: []string{address}, Search: []string{"corp.example.com", "example.com"}, NDots: 1, Timeout: 50 * time.Millisecond})
+
+	// ACT
+	_, err := c.LookupContext(context.Background(), "lost", dns.ResourceTypeA)
+
+	// ASSERT
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("LookupContext: want the error of the first candidate, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// ErrPinMismatch is returned when no certificate of the upstream matches the SPKI pins.
+var ErrPinMismatch = errors.New("no certificate matches the SPKI pins")
+
+// TLSConfig configures the encrypted transports.
+type TLSConfig struct {
+	// ServerName is used to verify the certificate of the upstream.
+	// Defaults to the host of the upstream address.
+	ServerName string
+	// RootCAs verifies the certificate chain. Nil uses the system roots.
+	RootCAs *x509.CertPool
+	// SPKIPins is a set of base64 encoded SHA-256 digests of a
+	// SubjectPublicKeyInfo. When set, at least one certificate presented by
+	// the upstream must match one of them, in addition to the chain check.
+	SPKIPins []string
+}
+
+// SPKIPin - 証明書の SubjectPublicKeyInfo から SPKI ピンを計算する
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// tlsClientConfig - upstream 接続用の tls.Config を組み立てる
+func (c *TLSConfig) tlsClientConfig(address string, nextProtos []string) *tls.Config {
+	serverName := c.ServerName
+	if serverName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			serverName = host
+		}
+	}
+	config := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    c.RootCAs,
+		NextProtos: nextProtos,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(c.SPKIPins) > 0 {
+		pins := c.SPKIPins
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if slices.Contains(pins, SPKIPin(cert)) {
+					return nil
+				}
+			}
+			return fmt.Errorf("server=%s: %w", serverName, ErrPinMismatch)
+		}
+	}
+	return config
+}
+
+// tlsPool は upstream ごとに TLS セッションを使い回す
+type tlsPool struct {
+	mu      sync.Mutex
+	conns   map[string]*pipelineConn
+	dialing map[string]*dialCall[*pipelineConn]
+}
+
+// get - 利用可能なセッションを返す。なければ dial で新しく接続する
+func (p *tlsPool) get(ctx context.Context, address string, dial func(context.Context) (net.Conn, error)) (*pipelineConn, error) {
+	p.mu.Lock()
+	if conn, ok := p.conns[address]; ok && !conn.closed() {
+		p.mu.Unlock()
+		return conn, nil
+	}
+	if call, ok := p.dialing[address]; ok {
+		p.mu.Unlock()
+		return call.wait(ctx)
+	}
+	call := newDialCall[*pipelineConn]()
+	if p.dialing == nil {
+		p.dialing = make(map[string]*dialCall[*pipelineConn])
+	}
+	p.dialing[address] = call
+	p.mu.Unlock()
+
+	conn, err := dial(ctx)
+	var pc *pipelineConn
+	p.mu.Lock()
+	delete(p.dialing, address)
+	if err == nil {
+		if p.conns == nil {
+			p.conns = make(map[string]*pipelineConn)
+		}
+		pc = newPipelineConn(conn)
+		p.conns[address] = pc
+	}
+	p.mu.Unlock()
+	call.finish(pc, err)
+	return pc, err
+}
+
+func (p *tlsPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for address, conn := range p.conns {
+		errs = append(errs, conn.close(net.ErrClosed))
+		delete(p.conns, address)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Client) dialTLS(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := c.dialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, netError(ctx, "dial", err)
+	}
+	tlsConn := tls.Client(conn, c.tlsConfig.tlsClientConfig(address, []string{"dot"}))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		if errors.Is(err, ErrPinMismatch) {
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		return nil, netError(ctx, "tls handshake", err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCertificate - 127.0.0.1 と dns.test 用の自己署名証明書を生成する
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// answerFor - テスト用の権威サーバーとして、名前ごとに異なる A レコードを返す
+func answerFor(query *dns.Packet) *dns.Packet {
+	addresses := map[string][]byte{
+		"a.test.": {10, 0, 0, 1},
+		"b.test.": {10, 0, 0, 2},
+	}
+	q := query.Questions[0]
+	response := &dns.Packet{
+		Id:        query.Id,
+		QR:        dns.QRResponse,
+		RD:        query.RD,
+		Questions: query.Questions,
+	}
+	if addr, ok := addresses[q.Qname]; ok {
+		response.Answers = []*dns.ResourceRecord{
+			{Name: q.Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: addr}},
+		}
+	} else {
+		response.RCode = dns.RCodeNameError
+	}
+	return response
+}
+
+// startTLSServer - batch 件のクエリを受け取ってから逆順に応答する DoT サーバーを起動する
+func startTLSServer(t *testing.T, cert tls.Certificate, batch int) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					var queries []*dns.Packet
+					for len(queries) < batch {
+						buf, err := dns.ReadStreamMessage(conn)
+						if err != nil {
+							return
+						}
+						query, err := dns.DecodePacket(buf)
+						if err != nil {
+							t.Errorf("failed to decode the packet: %v", err)
+							return
+						}
+						queries = append(queries, query)
+					}
+					for i := len(queries) - 1; i >= 0; i-- {
+						buf, err := answerFor(queries[i]).Encode()
+						if err != nil {
+							t.Errorf("failed to encode the packet: %v", err)
+							return
+						}
+						if err := dns.WriteStreamMessage(conn, buf); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestClient_Resolve_TLS_pipelining(t *testing.T) {
+	// ARRANGE
+	cert, pool := newTestCertificate(t)
+	address, accepted := startTLSServer(t, cert, 2)
+	c := New(Config{
+		Servers:   []string{address},
+		Transport: TransportTLS,
+		TLSConfig: &TLSConfig{ServerName: "dns.test", RootCAs: pool},
+		Timeout:   5 * time.Second,
+	})
+	defer c.Close()
+
+	// ACT
+	var wg sync.WaitGroup
+	results := make(map[string]*dns.Packet)
+	var mu sync.Mutex
+	for _, name := range []string{"a.test.", "b.test."} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			received, err := c.ResolveContext(context.Background(), name, dns.ResourceTypeA)
+			if err != nil {
+				t.Errorf("ResolveContext(%s): unexpected error: %v", name, err)
+				return
+			}
+			mu.Lock()
+			results[name] = received
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// ASSERT
+	for name, want := range map[string]byte{"a.test.": 1, "b.test.": 2} {
+		received, ok := results[name]
+		if !ok {
+			continue
+		}
+		if len(received.Answers) != 1 || received.Answers[0].RData.(*dns.AData).Address[3] != want {
+			t.Errorf("%s: got unexpected answers %v", name, received.Answers)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("connections: want 1, got %d", n)
+	}
+}
+
+func TestClient_Resolve_TLS_pins(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	address, _ := startTLSServer(t, cert, 1)
+
+	cases := []struct {
+		label   string
+		pins    []string
+		wantErr error
+	}{
+		{
+			label: "ok/matching-pin",
+			pins:  []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SPKIPin(cert.Leaf)},
+		},
+		{
+			label:   "Err/no-matching-pin",
+			pins:    []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+			wantErr: ErrPinMismatch,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			c := New(Config{
+				Servers:   []string{address},
+				Transport: TransportTLS,
+				TLSConfig: &TLSConfig{RootCAs: pool, SPKIPins: tc.pins},
+			})
+			defer c.Close()
+
+			// ACT
+			_, err := c.Resolve("a.test.", dns.ResourceTypeA)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("err: want %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestClient_exchangeTLS_slowUpstream(t *testing.T) {
+	// ARRANGE
+	// the first upstream accepts the connection but never completes the handshake
+	hanging, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer hanging.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := hanging.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	cert, pool := newTestCertificate(t)
+	address, _ := startTLSServer(t, cert, 1)
+	c := New(Config{
+		Transport: TransportTLS,
+		TLSConfig: &TLSConfig{ServerName: "dns.test", RootCAs: pool},
+	})
+	defer c.Close()
+	query := &dns.Packet{
+		Id:        1,
+		RD:        true,
+		Questions: []*dns.Question{{Qname: "a.test.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+	}
+
+	slowCtx, cancelSlow := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelSlow()
+	go func() { _, _ = c.exchangeTLS(slowCtx, hanging.Addr().String(), query) }()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the hanging upstream was not dialed")
+	}
+
+	// ACT
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	received, err := c.exchangeTLS(ctx, address, query)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("exchangeTLS: unexpected error: %v", err)
+	}
+	if len(received.Answers) != 1 {
+		t.Errorf("answers: want 1, got %d", len(received.Answers))
+	}
+}
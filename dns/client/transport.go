@@ -0,0 +1,59 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Transport selects how queries are carried to the upstreams.
+type Transport int
+
+const (
+	// TransportUDP sends queries over UDP and retries over TCP when the answer is truncated.
+	TransportUDP Transport = iota
+	// TransportTCP sends every query over TCP.
+	TransportTCP
+	// TransportTLS sends queries over DNS-over-TLS (RFC 7858).
+	TransportTLS
+	// TransportHTTPS sends queries over DNS-over-HTTPS (RFC 8484).
+	// The upstreams are URL templates such as "https://dns.google/dns-query{?dns}".
+	TransportHTTPS
+	// TransportQUIC sends queries over DNS-over-QUIC (RFC 9250).
+	// It dials its own UDP socket, so DialFunc is not used.
+	TransportQUIC
+)
+
+var transportNames = map[string]Transport{
+	"udp":   TransportUDP,
+	"tcp":   TransportTCP,
+	"tls":   TransportTLS,
+	"https": TransportHTTPS,
+	"quic":  TransportQUIC,
+}
+
+func (t Transport) String() string {
+	for name, transport := range transportNames {
+		if transport == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(t))
+}
+
+// defaultPort - トランスポートごとの既定のポート番号
+func (t Transport) defaultPort() int {
+	switch t {
+	case TransportTLS, TransportQUIC:
+		return 853
+	case TransportHTTPS:
+		return 443
+	default:
+		return 53
+	}
+}
+
+// TransportFromName - 名前からトランスポートを取得する
+func TransportFromName(name string) (Transport, bool) {
+	transport, ok := transportNames[strings.ToLower(name)]
+	return transport, ok
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides the order in which upstreams are tried for a query.
+type Strategy int
+
+const (
+	// StrategySequential tries the upstreams in the configured order.
+	StrategySequential Strategy = iota
+	// StrategyRoundRobin starts each query at the next upstream in turn.
+	StrategyRoundRobin
+	// StrategyRandom starts each query at a random upstream.
+	StrategyRandom
+	// StrategyFastest tries the upstream with the lowest average latency first.
+	StrategyFastest
+)
+
+var strategyNames = map[string]Strategy{
+	"sequential":  StrategySequential,
+	"round-robin": StrategyRoundRobin,
+	"random":      StrategyRandom,
+	"fastest":     StrategyFastest,
+}
+
+func (s Strategy) String() string {
+	for name, strategy := range strategyNames {
+		if strategy == s {
+			return name
+		}
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(s))
+}
+
+// StrategyFromName - 名前から選択方式を取得する
+func StrategyFromName(name string) (Strategy, bool) {
+	strategy, ok := strategyNames[strings.ToLower(name)]
+	return strategy, ok
+}
+
+const (
+	// ewmaWeight は新しい計測値の重み
+	ewmaWeight = 0.3
+	// unhealthyThreshold 回連続で失敗した upstream は後回しにする
+	unhealthyThreshold = 3
+)
+
+// Upstream はクエリの送信先と、その健全性を保持する
+type Upstream struct {
+	// Address is the host:port of the upstream.
+	Address string
+
+	mu                  sync.Mutex
+	successes           uint64
+	failures            uint64
+	consecutiveFailures int
+	latency             time.Duration
+	lastError           error
+	// caseMismatches counts the responses in a row that did not echo the
+	// case of a randomised query name.
+	caseMismatches int
+	// caseProbed is when 0x20 was last tried after it had been disabled.
+	caseProbed time.Time
+}
+
+// UpstreamStats is a snapshot of the health of an upstream.
+type UpstreamStats struct {
+	Address   string
+	Successes uint64
+	Failures  uint64
+	// Latency is the exponentially weighted moving average of the round-trip time.
+	Latency   time.Duration
+	Healthy   bool
+	LastError error
+	// PreservesCase is false once the upstream was found to change the case
+	// of query names, which disables the 0x20 randomisation for it.
+	PreservesCase bool
+}
+
+func (u *Upstream) Stats() UpstreamStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return UpstreamStats{
+		Address:   u.Address,
+		Successes: u.successes,
+		Failures:  u.failures,
+		Latency:   u.latency,
+		Healthy:   u.consecutiveFailures < unhealthyThreshold,
+		LastError: u.lastError,
+
+		PreservesCase: u.caseMismatches < caseMismatchThreshold,
+	}
+}
+
+func (u *Upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.consecutiveFailures < unhealthyThreshold
+}
+
+func (u *Upstream) averageLatency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latency
+}
+
+func (u *Upstream) recordSuccess(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.successes++
+	u.consecutiveFailures = 0
+	u.updateLatency(rtt)
+}
+
+func (u *Upstream) recordFailure(rtt time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	u.consecutiveFailures++
+	u.lastError = err
+	// a failure costs at least as much as the time we waited for it
+	u.updateLatency(rtt)
+}
+
+func (u *Upstream) updateLatency(rtt time.Duration) {
+	if u.latency == 0 {
+		u.latency = rtt
+		return
+	}
+	u.latency = time.Duration(ewmaWeight*float64(rtt) + (1-ewmaWeight)*float64(u.latency))
+}
+
+// upstreamSet は選択方式に従って upstream の試行順を決める
+type upstreamSet struct {
+	upstreams []*Upstream
+	strategy  Strategy
+	next      atomic.Uint64
+}
+
+func (s *upstreamSet) order() []*Upstream {
+	n := len(s.upstreams)
+	ordered := make([]*Upstream, 0, n)
+	switch s.strategy {
+	case StrategyRoundRobin:
+		start := int(s.next.Add(1)-1) % n
+		ordered = append(ordered, s.upstreams[start:]...)
+		ordered = append(ordered, s.upstreams[:start]...)
+	case StrategyRandom:
+		start := rand.Intn(n)
+		ordered = append(ordered, s.upstreams[start:]...)
+		ordered = append(ordered, s.upstreams[:start]...)
+	case StrategyFastest:
+		// take a snapshot so that concurrent updates do not disturb the sort
+		latencies := make(map[*Upstream]time.Duration, n)
+		for _, u := range s.upstreams {
+			latencies[u] = u.averageLatency()
+		}
+		ordered = append(ordered, s.upstreams...)
+		// upstreams without a measurement come first so that every one gets measured
+		slices.SortStableFunc(ordered, func(a, b *Upstream) int {
+			return cmp.Compare(latencies[a], latencies[b])
+		})
+	default:
+		ordered = append(ordered, s.upstreams...)
+	}
+
+	// unhealthy upstreams are only tried after all healthy ones
+	healthy := make(map[*Upstream]bool, n)
+	for _, u := range s.upstreams {
+		healthy[u] = u.healthy()
+	}
+	slices.SortStableFunc(ordered, func(a, b *Upstream) int {
+		ha, hb := healthy[a], healthy[b]
+		switch {
+		case ha == hb:
+			return 0
+		case ha:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return ordered
+}
+
+// ParseUpstream - "host", "host:port", "[v6]:port" や IPv6 リテラルを host:port に正規化する
+func ParseUpstream(s string, defaultPort int) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("invalid upstream: empty address")
+	}
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid upstream %q: invalid port: %w", s, err)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid upstream %q: %w", s, err)
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(defaultPort)), nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+	"time"
+)
+
+func TestParseUpstream(t *testing.T) {
+	cases := []struct {
+		label   string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{label: "ok/ipv4", input: "8.8.8.8", want: "8.8.8.8:53"},
+		{label: "ok/ipv4-with-port", input: "8.8.8.8:5353", want: "8.8.8.8:5353"},
+		{label: "ok/ipv6", input: "2001:4860:4860::8888", want: "[2001:4860:4860::8888]:53"},
+		{label: "ok/ipv6-bracketed", input: "[::1]", want: "[::1]:53"},
+		{label: "ok/ipv6-with-port", input: "[::1]:5353", want: "[::1]:5353"},
+		{label: "ok/hostname", input: "dns.google", want: "dns.google:53"},
+		{label: "Err/empty", input: "", wantErr: true},
+		{label: "Err/invalid-port", input: "8.8.8.8:dns", wantErr: true},
+		{label: "Err/invalid-ipv6", input: "2001:zz::1", wantErr: true},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			got, err := ParseUpstream(tc.input, 53)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseUpstream(%q): unexpected error: %v", tc.input, err)
+			}
+			if got != tc.want {
+				t.Errorf("ParseUpstream(%q): want %q, got %q", tc.input, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamSet_order(t *testing.T) {
+	newSet := func(strategy Strategy) *upstreamSet {
+		return &upstreamSet{
+			strategy: strategy,
+			upstreams: []*Upstream{
+				{Address: "a:53"},
+				{Address: "b:53"},
+				{Address: "c:53"},
+			},
+		}
+	}
+	addresses := func(upstreams []*Upstream) []string {
+		var dest []string
+		for _, u := range upstreams {
+			dest = append(dest, u.Address)
+		}
+		return dest
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		s := newSet(StrategySequential)
+		for i := 0; i < 2; i++ {
+			if diff := cmp.Diff([]string{"a:53", "b:53", "c:53"}, addresses(s.order())); diff != "" {
+				t.Errorf("order: mismatch(-want, +got):\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("round-robin", func(t *testing.T) {
+		s := newSet(StrategyRoundRobin)
+		want := [][]string{
+			{"a:53", "b:53", "c:53"},
+			{"b:53", "c:53", "a:53"},
+			{"c:53", "a:53", "b:53"},
+			{"a:53", "b:53", "c:53"},
+		}
+		for _, w := range want {
+			if diff := cmp.Diff(w, addresses(s.order())); diff != "" {
+				t.Errorf("order: mismatch(-want, +got):\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		s := newSet(StrategyRandom)
+		if got := s.order(); len(got) != 3 {
+			t.Errorf("order: want 3 upstreams, got %d", len(got))
+		}
+	})
+
+	t.Run("fastest", func(t *testing.T) {
+		s := newSet(StrategyFastest)
+		s.upstreams[0].recordSuccess(30 * time.Millisecond)
+		s.upstreams[1].recordSuccess(10 * time.Millisecond)
+		s.upstreams[2].recordSuccess(20 * time.Millisecond)
+		if diff := cmp.Diff([]string{"b:53", "c:53", "a:53"}, addresses(s.order())); diff != "" {
+			t.Errorf("order: mismatch(-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unhealthy upstreams come last", func(t *testing.T) {
+		s := newSet(StrategySequential)
+		for i := 0; i < unhealthyThreshold; i++ {
+			s.upstreams[0].recordFailure(time.Second, errors.New("timeout"))
+		}
+		if diff := cmp.Diff([]string{"b:53", "c:53", "a:53"}, addresses(s.order())); diff != "" {
+			t.Errorf("order: mismatch(-want, +got):\n%s", diff)
+		}
+		if s.upstreams[0].Stats().Healthy {
+			t.Errorf("Healthy: want false, got true")
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"strings"
+)
+
+// ErrUnexpectedResponse is returned for a response that does not belong to
+// the query it was read for.
+var ErrUnexpectedResponse = errors.New("unexpected response")
+
+// newID - 推測されにくいトランザクション ID を生成する
+func newID() uint16 {
+	var b [2]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// checkResponseID - デコード前に受信データの ID を確認する
+func checkResponseID(query *dns.Packet, buf []byte) error {
+	if len(buf) < 2 {
+		return fmt.Errorf("%w: too short (length=%d)", ErrUnexpectedResponse, len(buf))
+	}
+	if id := binary.BigEndian.Uint16(buf); id != query.Id {
+		return fmt.Errorf("%w: id mismatch (want=%d got=%d)", ErrUnexpectedResponse, query.Id, id)
+	}
+	return nil
+}
+
+// validateResponse - 応答がクエリに対応するものか検証する
+func validateResponse(query *dns.Packet, response *dns.Packet) error {
+	if response.Id != query.Id {
+		return fmt.Errorf("%w: id mismatch (want=%d got=%d)", ErrUnexpectedResponse, query.Id, response.Id)
+	}
+	if response.QR != dns.QRResponse {
+		return fmt.Errorf("%w: QR is not set", ErrUnexpectedResponse)
+	}
+	if len(response.Questions) != len(query.Questions) {
+		return fmt.Errorf("%w: question count mismatch (want=%d got=%d)", ErrUnexpectedResponse, len(query.Questions), len(response.Questions))
+	}
+	for i, q := range query.Questions {
+		r := response.Questions[i]
+		if !strings.EqualFold(dns.Fqdn(q.Qname), dns.Fqdn(r.Qname)) || q.Qtype != r.Qtype || q.Qclass != r.Qclass {
+			return fmt.Errorf("%w: question mismatch (want=%s %v %v got=%s %v %v)", ErrUnexpectedResponse, q.Qname, q.Qtype, q.Qclass, r.Qname, r.Qtype, r.Qclass)
+		}
+	}
+	return checkClientSubnet(query, response)
+}
+
+// checkClientSubnet - 応答の ECS がクエリのものと同じサブネットか確認する (RFC 7871 section 7.3)
+//
+// A response without ECS is fine; the server just does not support it.
+func checkClientSubnet(query *dns.Packet, response *dns.Packet) error {
+	queryEDNS, responseEDNS := query.EDNS(), response.EDNS()
+	if queryEDNS == nil || responseEDNS == nil {
+		return nil
+	}
+	sent, err := queryEDNS.ClientSubnet()
+	if err != nil || sent == nil {
+		return nil
+	}
+	received, err := responseEDNS.ClientSubnet()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnexpectedResponse, err)
+	}
+	if received != nil && received.Prefix != sent.Prefix {
+		return fmt.Errorf("%w: client subnet mismatch (want=%v got=%v)", ErrUnexpectedResponse, sent.Prefix, received.Prefix)
+	}
+	return nil
+}
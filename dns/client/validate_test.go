@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	"net/netip"
+	"testing"
+)
+
+func TestValidateResponse(t *testing.T) {
+	query := &dns.Packet{
+		Id: 1234,
+		QR: dns.QRQuery,
+		Questions: []*dns.Question{
+			{Qname: "google.com", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN},
+		},
+	}
+	cases := []struct {
+		label    string
+		response *dns.Packet
+		wantErr  error
+	}{
+		{
+			label: "ok",
+			response: &dns.Packet{
+				Id: 1234,
+				QR: dns.QRResponse,
+				Questions: []*dns.Question{
+					{Qname: "GOOGLE.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN},
+				},
+			},
+		},
+		{
+			label: "Err/id-mismatch",
+			response: &dns.Packet{
+				Id:        4321,
+				QR:        dns.QRResponse,
+				Questions: query.Questions,
+			},
+			wantErr: ErrUnexpectedResponse,
+		},
+		{
+			label: "Err/not-a-response",
+			response: &dns.Packet{
+				Id:        1234,
+				QR:        dns.QRQuery,
+				Questions: query.Questions,
+			},
+			wantErr: ErrUnexpectedResponse,
+		},
+		{
+			label: "Err/no-question",
+			response: &dns.Packet{
+				Id: 1234,
+				QR: dns.QRResponse,
+			},
+			wantErr: ErrUnexpectedResponse,
+		},
+		{
+			label: "Err/type-mismatch",
+			response: &dns.Packet{
+				Id: 1234,
+				QR: dns.QRResponse,
+				Questions: []*dns.Question{
+					{Qname: "google.com.", Qtype: dns.ResourceTypeAAAA, Qclass: dns.ClassIN},
+				},
+			},
+			wantErr: ErrUnexpectedResponse,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ACT
+			err := validateResponse(query, tc.response)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("validateResponse: want %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateResponse_clientSubnet(t *testing.T) {
+	withSubnet := func(packet *dns.Packet, data []byte) *dns.Packet {
+		edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+		if data != nil {
+			edns.SetOption(dns.EDNSOptionClientSubnet, data)
+		}
+		packet.SetEDNS(edns)
+		return packet
+	}
+	questions := []*dns.Question{{Qname: "www.example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}}
+	query := withSubnet(&dns.Packet{Id: 1234, QR: dns.QRQuery, Questions: questions},
+		dns.NewClientSubnet(netip.MustParsePrefix("192.0.2.0/24")).Bytes())
+	cases := []struct {
+		label   string
+		data    []byte
+		wantErr error
+	}{
+		{
+			label: "ok/scoped",
+			data:  []byte{0, 1, 24, 16, 192, 0, 2},
+		},
+		{
+			label: "ok/not-supported",
+		},
+		{
+			label:   "Err/other-subnet",
+			data:    []byte{0, 1, 24, 24, 192, 0, 3},
+			wantErr: ErrUnexpectedResponse,
+		},
+		{
+			label:   "Err/malformed",
+			data:    []byte{0, 1, 24},
+			wantErr: ErrUnexpectedResponse,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			response := withSubnet(&dns.Packet{Id: 1234, QR: dns.QRResponse, Questions: questions}, tc.data)
+
+			// ACT
+			err := validateResponse(query, response)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("validateResponse: want %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
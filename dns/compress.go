@@ -0,0 +1,147 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// maxCompressionOffset is the largest offset a 14-bit pointer can refer to.
+const maxCompressionOffset = 0x3fff
+
+// compressor - メッセージ中に書いた名前の位置を覚え、後の名前をポインターで短くする (RFC 1035 section 4.1.4)
+//
+// Names are matched case-sensitively, so that every name keeps the case it
+// was given, which matters to clients randomising the case of the query name.
+type compressor struct {
+	offsets map[string]int
+}
+
+func newCompressor() *compressor {
+	return &compressor{offsets: make(map[string]int)}
+}
+
+// appendName - メッセージ buf に name を書き加える。既に書いた名前と同じ末尾はポインターにする
+func (c *compressor) appendName(buf []byte, name string) ([]byte, error) {
+	if name == "" || name == "." {
+		return append(buf, 0), nil
+	}
+	name = strings.TrimSuffix(name, ".")
+	for name != "" {
+		if offset, ok := c.offsets[name]; ok {
+			return binary.BigEndian.AppendUint16(buf, 0xc000|uint16(offset)), nil
+		}
+		label, rest, _ := strings.Cut(name, ".")
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid label length(label=%q, length=%d): %w", label, len(label), ErrInvalidDomain)
+		}
+		if len(buf) <= maxCompressionOffset {
+			c.offsets[name] = len(buf)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+		name = rest
+	}
+	return append(buf, 0), nil
+}
+
+// compressibleRData は RDATA 中の名前を圧縮してよい RData
+//
+// RFC 3597 section 4 allows it only for the types defined in RFC 1035.
+type compressibleRData interface {
+	RData
+	// appendCompressed appends RDLENGTH followed by RDATA to the message in buf.
+	appendCompressed(buf []byte, c *compressor) ([]byte, error)
+}
+
+// appendWithLength - appendRData が書き加えた RDATA の前に RDLENGTH を付ける
+func appendWithLength(buf []byte, appendRData func(buf []byte) ([]byte, error)) ([]byte, error) {
+	start := len(buf)
+	buf, err := appendRData(append(buf, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(buf[start:], uint16(len(buf)-start-2))
+	return buf, nil
+}
+
+func (d *NSData) appendCompressed(buf []byte, c *compressor) ([]byte, error) {
+	return appendWithLength(buf, func(buf []byte) ([]byte, error) {
+		return c.appendName(buf, d.Host)
+	})
+}
+
+func (d *CNAMEData) appendCompressed(buf []byte, c *compressor) ([]byte, error) {
+	return appendWithLength(buf, func(buf []byte) ([]byte, error) {
+		return c.appendName(buf, d.Target)
+	})
+}
+
+func (d *PTRData) appendCompressed(buf []byte, c *compressor) ([]byte, error) {
+	return appendWithLength(buf, func(buf []byte) ([]byte, error) {
+		return c.appendName(buf, d.Host)
+	})
+}
+
+func (d *MXData) appendCompressed(buf []byte, c *compressor) ([]byte, error) {
+	return appendWithLength(buf, func(buf []byte) ([]byte, error) {
+		return c.appendName(binary.BigEndian.AppendUint16(buf, d.Preference), d.Exchange)
+	})
+}
+
+func (s *SOAData) appendCompressed(buf []byte, c *compressor) ([]byte, error) {
+	return appendWithLength(buf, func(buf []byte) ([]byte, error) {
+		buf, err := c.appendName(buf, s.MName)
+		if err != nil {
+			return nil, fmt.Errorf("MNAME: %w", err)
+		}
+		if buf, err = c.appendName(buf, s.RName); err != nil {
+			return nil, fmt.Errorf("RNAME: %w", err)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, s.Serial)
+		buf = binary.BigEndian.AppendUint32(buf, s.Refresh)
+		buf = binary.BigEndian.AppendUint32(buf, s.Retry)
+		buf = binary.BigEndian.AppendUint32(buf, s.Expire)
+		return binary.BigEndian.AppendUint32(buf, s.Minttl), nil
+	})
+}
+
+var (
+	_ compressibleRData = (*NSData)(nil)
+	_ compressibleRData = (*CNAMEData)(nil)
+	_ compressibleRData = (*PTRData)(nil)
+	_ compressibleRData = (*MXData)(nil)
+	_ compressibleRData = (*SOAData)(nil)
+)
+
+// appendTo - メッセージ buf に名前を圧縮した質問を書き加える
+func (q *Question) appendTo(buf []byte, c *compressor) ([]byte, error) {
+	buf, err := c.appendName(buf, q.Qname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode domain: %w", err)
+	}
+	buf = append(buf, q.Qtype.Bytes()...)
+	return append(buf, q.Qclass.Bytes()...), nil
+}
+
+// appendTo - メッセージ buf に名前を圧縮したリソースレコードを書き加える
+func (rr *ResourceRecord) appendTo(buf []byte, c *compressor) ([]byte, error) {
+	buf, err := c.appendName(buf, rr.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode domain: %w", err)
+	}
+	buf = append(buf, rr.RData.ResourceType().Bytes()...)
+	buf = append(buf, rr.Class.Bytes()...)
+	buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+	if rdata, ok := rr.RData.(compressibleRData); ok {
+		if buf, err = rdata.appendCompressed(buf, c); err != nil {
+			return nil, fmt.Errorf("failed to encode rdata (type=%v): %w", rr.RData.ResourceType(), err)
+		}
+		return buf, nil
+	}
+	rdata, err := rr.RData.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode rdata (type=%v): %w", rr.RData.ResourceType(), err)
+	}
+	return append(buf, rdata...), nil
+}
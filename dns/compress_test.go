@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestPacket_Encode_compressionRoundTrip(t *testing.T) {
+	cases := []struct {
+		label string
+		input *Packet
+	}{
+		{
+			label: "ok/rfc1035-types",
+			input: &Packet{
+				Id: 1,
+				QR: QRResponse,
+				Questions: []*Question{
+					{Qname: "example.com.", Qtype: ResourceTypeMX, Qclass: ClassIN},
+				},
+				Answers: []*ResourceRecord{
+					{Name: "example.com.", Class: ClassIN, TTL: 60, RData: &MXData{Preference: 10, Exchange: "mail.example.com."}},
+				},
+				Authorities: []*ResourceRecord{
+					{Name: "example.com.", Class: ClassIN, TTL: 60, RData: &NSData{Host: "ns1.example.com."}},
+					{Name: "example.com.", Class: ClassIN, TTL: 60, RData: &SOAData{MName: "ns1.example.com.", RName: "hostmaster.example.com.", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minttl: 5}},
+				},
+				Additions: []*ResourceRecord{
+					{Name: "mail.example.com.", Class: ClassIN, TTL: 60, RData: &AData{Address: []byte{192, 0, 2, 1}}},
+				},
+			},
+		},
+		{
+			label: "ok/case-preserved",
+			input: &Packet{
+				Id: 2,
+				QR: QRResponse,
+				Questions: []*Question{
+					{Qname: "wWw.ExAmple.com.", Qtype: ResourceTypeA, Qclass: ClassIN},
+				},
+				Answers: []*ResourceRecord{
+					{Name: "www.example.com.", Class: ClassIN, TTL: 60, RData: &AData{Address: []byte{192, 0, 2, 1}}},
+				},
+			},
+		},
+		{
+			label: "ok/srv-uncompressed",
+			input: &Packet{
+				Id: 3,
+				QR: QRResponse,
+				Questions: []*Question{
+					{Qname: "_sip._udp.example.com.", Qtype: ResourceTypeSRV, Qclass: ClassIN},
+				},
+				Answers: []*ResourceRecord{
+					{Name: "_sip._udp.example.com.", Class: ClassIN, TTL: 60, RData: &SRVData{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com."}},
+				},
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ACT
+			buf, err := tc.input.Encode()
+			if err != nil {
+				t.Fatalf("Encode: unexpected error: %v", err)
+			}
+			got, err := DecodePacket(buf)
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("DecodePacket: unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.input, got); diff != "" {
+				t.Errorf("packet: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -206,6 +206,30 @@ func decodeResourceRecord(sc *Scanner) (*ResourceRecord, error) {
 }
 
 func decodeRData(sc *Scanner, rrType ResourceType, rdLength uint16) (RData, error) {
+	start := sc.Position()
+	if !sc.HasSpace(int(rdLength)) {
+		return nil, fmt.Errorf("rdata overrun (type=%v rdLength=%d)", rrType, rdLength)
+	}
+	rdata, err := decodeRDataBody(sc, rrType, rdLength)
+	if err != nil {
+		return nil, err
+	}
+	if n := sc.Position() - start; n != int(rdLength) {
+		return nil, fmt.Errorf("rdata length mismatch (type=%v rdLength=%d read=%d)", rrType, rdLength, n)
+	}
+	return rdata, nil
+}
+
+func decodeRDataBody(sc *Scanner, rrType ResourceType, rdLength uint16) (RData, error) {
+	end := sc.Position() + int(rdLength)
+	// readRest reads the remaining bytes of the RDATA
+	readRest := func() ([]byte, error) {
+		n := end - sc.Position()
+		if n < 0 {
+			return nil, fmt.Errorf("rdata overrun (type=%v rdLength=%d)", rrType, rdLength)
+		}
+		return sc.ReadBytes(n)
+	}
 	decodeString := func() ([]byte, error) {
 		size, err := sc.ReadByte()
 		if err != nil {
@@ -217,7 +241,8 @@ func decodeRData(sc *Scanner, rrType ResourceType, rdLength uint16) (RData, erro
 		return sc.ReadBytes(int(size))
 	}
 
-	if rrType == ResourceTypeA {
+	switch rrType {
+	case ResourceTypeA:
 		addr, err := sc.ReadBytes(4)
 		if err != nil {
 			return nil, err
@@ -225,7 +250,84 @@ func decodeRData(sc *Scanner, rrType ResourceType, rdLength uint16) (RData, erro
 		return &AData{
 			Address: addr,
 		}, nil
-	} else if rrType == ResourceTypeTXT {
+	case ResourceTypeAAAA:
+		addr, err := sc.ReadBytes(16)
+		if err != nil {
+			return nil, err
+		}
+		return &AAAAData{
+			Address: addr,
+		}, nil
+	case ResourceTypeNS:
+		host, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		return &NSData{
+			Host: host,
+		}, nil
+	case ResourceTypeCNAME:
+		target, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		return &CNAMEData{
+			Target: target,
+		}, nil
+	case ResourceTypeDNAME:
+		// the target of a DNAME must not be compressed, but accepting it is harmless
+		target, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		return &DNAMEData{
+			Target: target,
+		}, nil
+	case ResourceTypePTR:
+		host, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		return &PTRData{
+			Host: host,
+		}, nil
+	case ResourceTypeMX:
+		preference, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		exchange, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		return &MXData{
+			Preference: preference,
+			Exchange:   exchange,
+		}, nil
+	case ResourceTypeSRV:
+		priority, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		weight, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		port, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		target, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		return &SRVData{
+			Priority: priority,
+			Weight:   weight,
+			Port:     port,
+			Target:   target,
+		}, nil
+	case ResourceTypeTXT:
 		nRead := uint16(0)
 		buf := make([]byte, 0, rdLength)
 		for nRead < rdLength {
@@ -239,7 +341,7 @@ func decodeRData(sc *Scanner, rrType ResourceType, rdLength uint16) (RData, erro
 		return &TXTData{
 			Text: string(buf),
 		}, nil
-	} else if rrType == ResourceTypeSOA {
+	case ResourceTypeSOA:
 		mname, err := decodeDomain(sc)
 		if err != nil {
 			return nil, err
@@ -277,7 +379,149 @@ func decodeRData(sc *Scanner, rrType ResourceType, rdLength uint16) (RData, erro
 			Expire:  expire,
 			Minttl:  minimum,
 		}, nil
-	} else {
-		return nil, fmt.Errorf("invalid resource type (type=%d)", rrType)
+	case ResourceTypeOPT:
+		return decodeOPTData(sc, rdLength)
+	case ResourceTypeDNSKEY:
+		flags, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		header, err := sc.ReadBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readRest()
+		if err != nil {
+			return nil, err
+		}
+		return &DNSKEYData{
+			Flags:     flags,
+			Protocol:  header[0],
+			Algorithm: header[1],
+			PublicKey: key,
+		}, nil
+	case ResourceTypeDS:
+		keyTag, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		header, err := sc.ReadBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := readRest()
+		if err != nil {
+			return nil, err
+		}
+		return &DSData{
+			KeyTag:     keyTag,
+			Algorithm:  header[0],
+			DigestType: header[1],
+			Digest:     digest,
+		}, nil
+	case ResourceTypeRRSIG:
+		typeCovered, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		header, err := sc.ReadBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		originalTTL, err := sc.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		expiration, err := sc.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		inception, err := sc.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		keyTag, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		signer, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := readRest()
+		if err != nil {
+			return nil, err
+		}
+		return &RRSIGData{
+			TypeCovered: ResourceType(typeCovered),
+			Algorithm:   header[0],
+			Labels:      header[1],
+			OriginalTTL: originalTTL,
+			Expiration:  expiration,
+			Inception:   inception,
+			KeyTag:      keyTag,
+			SignerName:  signer,
+			Signature:   signature,
+		}, nil
+	case ResourceTypeNSEC:
+		next, err := decodeDomain(sc)
+		if err != nil {
+			return nil, err
+		}
+		bitmap, err := readRest()
+		if err != nil {
+			return nil, err
+		}
+		types, err := decodeTypeBitmap(bitmap)
+		if err != nil {
+			return nil, err
+		}
+		return &NSECData{
+			NextDomain: next,
+			Types:      types,
+		}, nil
+	case ResourceTypeNSEC3:
+		header, err := sc.ReadBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		iterations, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		salt, err := decodeString()
+		if err != nil {
+			return nil, err
+		}
+		next, err := decodeString()
+		if err != nil {
+			return nil, err
+		}
+		bitmap, err := readRest()
+		if err != nil {
+			return nil, err
+		}
+		types, err := decodeTypeBitmap(bitmap)
+		if err != nil {
+			return nil, err
+		}
+		return &NSEC3Data{
+			HashAlgorithm: header[0],
+			Flags:         header[1],
+			Iterations:    iterations,
+			Salt:          salt,
+			NextHashed:    next,
+			Types:         types,
+		}, nil
+	default:
+		// keep the types we do not understand as opaque bytes (RFC 3597)
+		data, err := sc.ReadBytes(int(rdLength))
+		if err != nil {
+			return nil, err
+		}
+		return &RawData{
+			Type:  rrType,
+			RData: data,
+		}, nil
 	}
 }
@@ -197,7 +197,7 @@ func TestDecodeResourceRecord(t *testing.T) {
 					// TTL
 					0, 0, 0, 60,
 					// RDATA LENGTH
-					0, 80,
+					0, 58,
 				},
 				// RDATA
 				// - MNAME = ns1.google.com.
@@ -230,6 +230,121 @@ func TestDecodeResourceRecord(t *testing.T) {
 				},
 			},
 		},
+		{
+			label: "AAAA Record",
+			input: []byte{
+				// NAME
+				6, 'g', 'o', 'o', 'g', 'l', 'e', 3, 'c', 'o', 'm', 0,
+				// TYPE = AAAA(28)
+				0, 28,
+				// CLASS = IN(1)
+				0, 1,
+				// TTL
+				0, 0, 0, 60,
+				// RDATA LENGTH
+				0, 16,
+				// RDATA = 2001:db8::1
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+			want: ResourceRecord{
+				Name:  "google.com.",
+				Class: 1,
+				TTL:   60,
+				RData: &AAAAData{Address: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+			},
+		},
+		{
+			label: "NS Record",
+			input: []byte{
+				// NAME
+				6, 'g', 'o', 'o', 'g', 'l', 'e', 3, 'c', 'o', 'm', 0,
+				// TYPE = NS(2)
+				0, 2,
+				// CLASS = IN(1)
+				0, 1,
+				// TTL
+				0, 0, 0, 60,
+				// RDATA LENGTH
+				0, 6,
+				// RDATA = ns1 + pointer to google.com.
+				3, 'n', 's', '1', 0xc0, 0,
+			},
+			want: ResourceRecord{
+				Name:  "google.com.",
+				Class: 1,
+				TTL:   60,
+				RData: &NSData{Host: "ns1.google.com."},
+			},
+		},
+		{
+			label: "MX Record",
+			input: []byte{
+				// NAME
+				6, 'g', 'o', 'o', 'g', 'l', 'e', 3, 'c', 'o', 'm', 0,
+				// TYPE = MX(15)
+				0, 15,
+				// CLASS = IN(1)
+				0, 1,
+				// TTL
+				0, 0, 0, 60,
+				// RDATA LENGTH
+				0, 9,
+				// RDATA = preference 10 + smtp + pointer to google.com.
+				0, 10, 4, 's', 'm', 't', 'p', 0xc0, 0,
+			},
+			want: ResourceRecord{
+				Name:  "google.com.",
+				Class: 1,
+				TTL:   60,
+				RData: &MXData{Preference: 10, Exchange: "smtp.google.com."},
+			},
+		},
+		{
+			label: "SRV Record",
+			input: []byte{
+				// NAME
+				6, 'g', 'o', 'o', 'g', 'l', 'e', 3, 'c', 'o', 'm', 0,
+				// TYPE = SRV(33)
+				0, 33,
+				// CLASS = IN(1)
+				0, 1,
+				// TTL
+				0, 0, 0, 60,
+				// RDATA LENGTH
+				0, 12,
+				// RDATA = priority 1, weight 5, port 5060 + sip + pointer to google.com.
+				0, 1, 0, 5, 0x13, 0xc4, 3, 's', 'i', 'p', 0xc0, 0,
+			},
+			want: ResourceRecord{
+				Name:  "google.com.",
+				Class: 1,
+				TTL:   60,
+				RData: &SRVData{Priority: 1, Weight: 5, Port: 5060, Target: "sip.google.com."},
+			},
+		},
+		{
+			label: "Unknown Record",
+			input: []byte{
+				// NAME
+				0,
+				// TYPE = 65280
+				0xff, 0,
+				// CLASS = IN(1)
+				0, 1,
+				// TTL
+				0, 0, 0, 60,
+				// RDATA LENGTH
+				0, 3,
+				// RDATA
+				1, 2, 3,
+			},
+			want: ResourceRecord{
+				Name:  "",
+				Class: 1,
+				TTL:   60,
+				RData: &RawData{Type: 0xff00, RData: []byte{1, 2, 3}},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		tc := tc
@@ -247,3 +362,23 @@ func TestDecodeResourceRecord(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeResourceRecord_lengthMismatch(t *testing.T) {
+	input := []byte{
+		// NAME
+		0,
+		// TYPE = A(1)
+		0, 1,
+		// CLASS = IN(1)
+		0, 1,
+		// TTL
+		0, 0, 0, 60,
+		// RDATA LENGTH = 5
+		0, 5,
+		// RDATA
+		1, 2, 3, 4, 5,
+	}
+	if _, err := decodeResourceRecord(NewScanner(input)); err == nil {
+		t.Errorf("decodeResourceRecord: want an error, got nil")
+	}
+}
@@ -0,0 +1,307 @@
+package dns
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ResourceTypeDS         ResourceType = 43
+	ResourceTypeRRSIG      ResourceType = 46
+	ResourceTypeNSEC       ResourceType = 47
+	ResourceTypeDNSKEY     ResourceType = 48
+	ResourceTypeNSEC3      ResourceType = 50
+	ResourceTypeNSEC3PARAM ResourceType = 51
+)
+
+// DNSSEC algorithm numbers (RFC 8624)
+const (
+	AlgorithmRSASHA256       uint8 = 8
+	AlgorithmRSASHA512       uint8 = 10
+	AlgorithmECDSAP256SHA256 uint8 = 13
+	AlgorithmECDSAP384SHA384 uint8 = 14
+	AlgorithmED25519         uint8 = 15
+)
+
+// DS digest types
+const (
+	DigestSHA1   uint8 = 1
+	DigestSHA256 uint8 = 2
+	DigestSHA384 uint8 = 4
+)
+
+const (
+	// DNSKEYFlagZone marks a key that may sign the zone (RFC 4034 section 2.1.1).
+	DNSKEYFlagZone uint16 = 0x0100
+	// DNSKEYFlagSEP marks a key signing key.
+	DNSKEYFlagSEP uint16 = 0x0001
+	// DNSKEYFlagRevoke marks a revoked key (RFC 5011).
+	DNSKEYFlagRevoke uint16 = 0x0080
+
+	// NSEC3FlagOptOut marks an NSEC3 that may skip insecure delegations (RFC 5155).
+	NSEC3FlagOptOut uint8 = 0x01
+)
+
+// base32Hex is the encoding of NSEC3 owner names (RFC 4648 section 7).
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type DNSKEYData struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (d *DNSKEYData) ResourceType() ResourceType {
+	return ResourceTypeDNSKEY
+}
+
+func (d *DNSKEYData) Bytes() ([]byte, error) {
+	buf := binary.BigEndian.AppendUint16(nil, d.Flags)
+	buf = append(buf, d.Protocol, d.Algorithm)
+	buf = append(buf, d.PublicKey...)
+	return withLength(buf)
+}
+
+func (d *DNSKEYData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Flags, d.Protocol, d.Algorithm, base64.StdEncoding.EncodeToString(d.PublicKey))
+}
+
+// KeyTag - 鍵を識別するタグを計算する (RFC 4034 Appendix B)
+func (d *DNSKEYData) KeyTag() uint16 {
+	rdata, _ := d.Bytes()
+	var acc uint32
+	for i, b := range rdata[2:] {
+		if i%2 == 0 {
+			acc += uint32(b) << 8
+		} else {
+			acc += uint32(b)
+		}
+	}
+	acc += acc >> 16
+	return uint16(acc)
+}
+
+var _ RData = (*DNSKEYData)(nil)
+
+type DSData struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (d *DSData) ResourceType() ResourceType {
+	return ResourceTypeDS
+}
+
+func (d *DSData) Bytes() ([]byte, error) {
+	buf := binary.BigEndian.AppendUint16(nil, d.KeyTag)
+	buf = append(buf, d.Algorithm, d.DigestType)
+	buf = append(buf, d.Digest...)
+	return withLength(buf)
+}
+
+func (d *DSData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, strings.ToUpper(hex.EncodeToString(d.Digest)))
+}
+
+var _ RData = (*DSData)(nil)
+
+type RRSIGData struct {
+	TypeCovered ResourceType
+	Algorithm   uint8
+	// Labels is the number of labels of the owner name, not counting a
+	// leading wildcard.
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+func (d *RRSIGData) ResourceType() ResourceType {
+	return ResourceTypeRRSIG
+}
+
+// SignedFields - 署名対象となる、Signature を除いた RDATA (RFC 4034 section 3.1.8.1)
+func (d *RRSIGData) SignedFields() ([]byte, error) {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(d.TypeCovered))
+	buf = append(buf, d.Algorithm, d.Labels)
+	buf = binary.BigEndian.AppendUint32(buf, d.OriginalTTL)
+	buf = binary.BigEndian.AppendUint32(buf, d.Expiration)
+	buf = binary.BigEndian.AppendUint32(buf, d.Inception)
+	buf = binary.BigEndian.AppendUint16(buf, d.KeyTag)
+	signer, err := encodeDomain(strings.ToLower(d.SignerName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signer name: %w", err)
+	}
+	return append(buf, signer...), nil
+}
+
+func (d *RRSIGData) Bytes() ([]byte, error) {
+	buf, err := d.SignedFields()
+	if err != nil {
+		return nil, err
+	}
+	return withLength(append(buf, d.Signature...))
+}
+
+func (d *RRSIGData) String() string {
+	return fmt.Sprintf("%v %d %d %d %s %s %d %s %s",
+		d.TypeCovered, d.Algorithm, d.Labels, d.OriginalTTL,
+		formatSignatureTime(d.Expiration), formatSignatureTime(d.Inception),
+		d.KeyTag, d.SignerName, base64.StdEncoding.EncodeToString(d.Signature))
+}
+
+func formatSignatureTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+var _ RData = (*RRSIGData)(nil)
+
+type NSECData struct {
+	NextDomain string
+	Types      []ResourceType
+}
+
+func (d *NSECData) ResourceType() ResourceType {
+	return ResourceTypeNSEC
+}
+
+func (d *NSECData) Bytes() ([]byte, error) {
+	next, err := encodeDomain(d.NextDomain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode next domain: %w", err)
+	}
+	return withLength(append(next, encodeTypeBitmap(d.Types)...))
+}
+
+func (d *NSECData) String() string {
+	return fmt.Sprintf("%s %s", d.NextDomain, formatTypes(d.Types))
+}
+
+// HasType - ビットマップに t が含まれるか
+func (d *NSECData) HasType(t ResourceType) bool {
+	return hasType(d.Types, t)
+}
+
+var _ RData = (*NSECData)(nil)
+
+type NSEC3Data struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	// NextHashed is the raw hash of the next owner name.
+	NextHashed []byte
+	Types      []ResourceType
+}
+
+func (d *NSEC3Data) ResourceType() ResourceType {
+	return ResourceTypeNSEC3
+}
+
+func (d *NSEC3Data) Bytes() ([]byte, error) {
+	buf := []byte{d.HashAlgorithm, d.Flags}
+	buf = binary.BigEndian.AppendUint16(buf, d.Iterations)
+	buf = append(buf, byte(len(d.Salt)))
+	buf = append(buf, d.Salt...)
+	buf = append(buf, byte(len(d.NextHashed)))
+	buf = append(buf, d.NextHashed...)
+	return withLength(append(buf, encodeTypeBitmap(d.Types)...))
+}
+
+func (d *NSEC3Data) String() string {
+	salt := "-"
+	if len(d.Salt) > 0 {
+		salt = strings.ToUpper(hex.EncodeToString(d.Salt))
+	}
+	return fmt.Sprintf("%d %d %d %s %s %s", d.HashAlgorithm, d.Flags, d.Iterations, salt,
+		base32Hex.EncodeToString(d.NextHashed), formatTypes(d.Types))
+}
+
+// HasType - ビットマップに t が含まれるか
+func (d *NSEC3Data) HasType(t ResourceType) bool {
+	return hasType(d.Types, t)
+}
+
+var _ RData = (*NSEC3Data)(nil)
+
+// EncodeNSEC3Hash - NSEC3 のオーナー名に使うハッシュの表記
+func EncodeNSEC3Hash(hash []byte) string {
+	return strings.ToLower(base32Hex.EncodeToString(hash))
+}
+
+// DecodeNSEC3Hash - NSEC3 のオーナー名の先頭ラベルをハッシュに戻す
+func DecodeNSEC3Hash(label string) ([]byte, error) {
+	return base32Hex.DecodeString(strings.ToUpper(label))
+}
+
+// encodeTypeBitmap - タイプの一覧をウィンドウ形式のビットマップにする (RFC 4034 section 4.1.2)
+func encodeTypeBitmap(types []ResourceType) []byte {
+	sorted := append([]ResourceType(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var buf []byte
+	for i := 0; i < len(sorted); {
+		window := byte(sorted[i] >> 8)
+		var bitmap [32]byte
+		length := 0
+		for ; i < len(sorted) && byte(sorted[i]>>8) == window; i++ {
+			low := byte(sorted[i])
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		buf = append(buf, window, byte(length))
+		buf = append(buf, bitmap[:length]...)
+	}
+	return buf
+}
+
+func decodeTypeBitmap(data []byte) ([]ResourceType, error) {
+	var types []ResourceType
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated type bitmap")
+		}
+		window, length := data[0], int(data[1])
+		if length == 0 || length > 32 || len(data) < 2+length {
+			return nil, fmt.Errorf("invalid type bitmap length %d", length)
+		}
+		for i, b := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, ResourceType(uint16(window)<<8|uint16(i*8+bit)))
+				}
+			}
+		}
+		data = data[2+length:]
+	}
+	return types, nil
+}
+
+func hasType(types []ResourceType, t ResourceType) bool {
+	for _, candidate := range types {
+		if candidate == t {
+			return true
+		}
+	}
+	return false
+}
+
+func formatTypes(types []ResourceType) string {
+	var parts []string
+	for _, t := range types {
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, " ")
+}
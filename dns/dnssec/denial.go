@@ -0,0 +1,281 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"strings"
+)
+
+var ErrNoDenial = errors.New("missing proof of non-existence")
+
+// wildcardOf - name の直下のワイルドカード名を返す
+func wildcardOf(name string) string {
+	name = dns.CanonicalName(name)
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// commonAncestor - a と b に共通する最も深い祖先を返す
+func commonAncestor(a, b string) string {
+	n := min(dns.CountLabels(a), dns.CountLabels(b))
+	for ; n > 0; n-- {
+		if dns.CanonicalName(dns.ParentLabels(a, n)) == dns.CanonicalName(dns.ParentLabels(b, n)) {
+			break
+		}
+	}
+	return dns.ParentLabels(a, n)
+}
+
+// NSEC3Hash - NSEC3 のハッシュを計算する (RFC 5155 section 5)
+func NSEC3Hash(name string, salt []byte, iterations uint16) ([]byte, error) {
+	wire, err := dns.CanonicalWireName(name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.Sum(append(wire, salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return h[:], nil
+}
+
+// denial - 検証済みの NSEC と NSEC3 から不存在を証明する
+type denial struct {
+	nsec  []*dns.ResourceRecord
+	nsec3 []*dns.ResourceRecord
+}
+
+func (d *denial) empty() bool {
+	return len(d.nsec) == 0 && len(d.nsec3) == 0
+}
+
+// nsecAt - オーナー名が name の NSEC を返す
+func (d *denial) nsecAt(name string) *dns.NSECData {
+	for _, rr := range d.nsec {
+		if dns.CanonicalName(rr.Name) == dns.CanonicalName(name) {
+			return rr.RData.(*dns.NSECData)
+		}
+	}
+	return nil
+}
+
+// nsecCovering - name をオーナー名と次の名前の間に含む NSEC を返す
+func (d *denial) nsecCovering(name string) *dns.ResourceRecord {
+	for _, rr := range d.nsec {
+		next := rr.RData.(*dns.NSECData).NextDomain
+		if dns.CompareNames(rr.Name, next) < 0 {
+			if dns.CompareNames(rr.Name, name) < 0 && dns.CompareNames(name, next) < 0 {
+				return rr
+			}
+			continue
+		}
+		// the last NSEC of the zone points back at the apex
+		if dns.CompareNames(rr.Name, name) < 0 || dns.CompareNames(name, next) < 0 {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsec3Hashes - NSEC3 のオーナー名のハッシュと、その NSEC3 のパラメータで計算した name のハッシュを返す
+func nsec3Hashes(rr *dns.ResourceRecord, name string) (owner, hashed []byte, ok bool) {
+	data := rr.RData.(*dns.NSEC3Data)
+	label, zone, _ := strings.Cut(dns.CanonicalName(rr.Name), ".")
+	if data.HashAlgorithm != 1 || !dns.IsSubDomain(name, zone) {
+		return nil, nil, false
+	}
+	owner, err := dns.DecodeNSEC3Hash(label)
+	if err != nil {
+		return nil, nil, false
+	}
+	hashed, err = NSEC3Hash(name, data.Salt, data.Iterations)
+	if err != nil {
+		return nil, nil, false
+	}
+	return owner, hashed, true
+}
+
+// nsec3Matching - name のハッシュと一致する NSEC3 を返す
+func (d *denial) nsec3Matching(name string) *dns.NSEC3Data {
+	for _, rr := range d.nsec3 {
+		owner, hashed, ok := nsec3Hashes(rr, name)
+		if ok && bytes.Equal(owner, hashed) {
+			return rr.RData.(*dns.NSEC3Data)
+		}
+	}
+	return nil
+}
+
+// nsec3Covering - name のハッシュを間に含む NSEC3 を返す
+func (d *denial) nsec3Covering(name string) *dns.NSEC3Data {
+	for _, rr := range d.nsec3 {
+		owner, hashed, ok := nsec3Hashes(rr, name)
+		if !ok {
+			continue
+		}
+		data := rr.RData.(*dns.NSEC3Data)
+		next := data.NextHashed
+		if bytes.Compare(owner, next) < 0 {
+			if bytes.Compare(owner, hashed) < 0 && bytes.Compare(hashed, next) < 0 {
+				return data
+			}
+			continue
+		}
+		if bytes.Compare(owner, hashed) < 0 || bytes.Compare(hashed, next) < 0 {
+			return data
+		}
+	}
+	return nil
+}
+
+// closestEncloser - NSEC3 による最近接エンクロージャの証明 (RFC 5155 section 8.3)
+//
+// It returns the closest encloser and the NSEC3 covering the next closer name.
+func (d *denial) closestEncloser(name string) (string, *dns.NSEC3Data, error) {
+	for n := dns.CountLabels(name) - 1; n >= 0; n-- {
+		encloser := dns.ParentLabels(name, n)
+		if d.nsec3Matching(encloser) == nil {
+			continue
+		}
+		nextCloser := dns.ParentLabels(name, n+1)
+		covering := d.nsec3Covering(nextCloser)
+		if covering == nil {
+			return "", nil, fmt.Errorf("%w: no NSEC3 covers next closer name %s", ErrNoDenial, nextCloser)
+		}
+		return encloser, covering, nil
+	}
+	return "", nil, fmt.Errorf("%w: no closest encloser of %s", ErrNoDenial, name)
+}
+
+// proveNXDomain - name とそれを生成しうるワイルドカードが存在しないことを証明する
+func (d *denial) proveNXDomain(name string) error {
+	if len(d.nsec) > 0 {
+		covering := d.nsecCovering(name)
+		if covering == nil {
+			return fmt.Errorf("%w: no NSEC covers %s", ErrNoDenial, name)
+		}
+		encloser := commonAncestor(name, covering.Name)
+		if other := commonAncestor(name, covering.RData.(*dns.NSECData).NextDomain); dns.CountLabels(other) > dns.CountLabels(encloser) {
+			encloser = other
+		}
+		wildcard := wildcardOf(encloser)
+		if d.nsecAt(wildcard) != nil || d.nsecCovering(wildcard) == nil {
+			return fmt.Errorf("%w: no NSEC denies wildcard %s", ErrNoDenial, wildcard)
+		}
+		return nil
+	}
+	if len(d.nsec3) > 0 {
+		encloser, _, err := d.closestEncloser(name)
+		if err != nil {
+			return err
+		}
+		if wildcard := wildcardOf(encloser); d.nsec3Covering(wildcard) == nil {
+			return fmt.Errorf("%w: no NSEC3 denies wildcard %s", ErrNoDenial, wildcard)
+		}
+		return nil
+	}
+	return ErrNoDenial
+}
+
+// proveNoData - name に qtype のレコードがないことを証明する
+func (d *denial) proveNoData(name string, qtype dns.ResourceType) error {
+	hasType := func(types []dns.ResourceType) error {
+		for _, t := range types {
+			if t == qtype || t == dns.ResourceTypeCNAME {
+				return fmt.Errorf("%w: the bitmap of %s has %v", ErrNoDenial, name, t)
+			}
+		}
+		return nil
+	}
+
+	if len(d.nsec) > 0 {
+		if at := d.nsecAt(name); at != nil {
+			return hasType(at.Types)
+		}
+		covering := d.nsecCovering(name)
+		if covering == nil {
+			return fmt.Errorf("%w: no NSEC matches %s", ErrNoDenial, name)
+		}
+		// an empty non-terminal sits right before its descendants
+		// (RFC 4035 section 3.1.3.2)
+		if dns.IsSubDomain(covering.RData.(*dns.NSECData).NextDomain, name) {
+			return nil
+		}
+		// otherwise the answer comes from a wildcard without the type
+		encloser := commonAncestor(name, covering.Name)
+		if wildcard := d.nsecAt(wildcardOf(encloser)); wildcard != nil {
+			return hasType(wildcard.Types)
+		}
+		return fmt.Errorf("%w: no NSEC matches %s", ErrNoDenial, name)
+	}
+	if len(d.nsec3) > 0 {
+		if at := d.nsec3Matching(name); at != nil {
+			return hasType(at.Types)
+		}
+		encloser, covering, err := d.closestEncloser(name)
+		if err != nil {
+			return err
+		}
+		if qtype == dns.ResourceTypeDS && covering.Flags&dns.NSEC3FlagOptOut != 0 {
+			// an unsigned delegation may hide behind an opt-out span
+			// (RFC 5155 section 8.6)
+			return nil
+		}
+		if wildcard := d.nsec3Matching(wildcardOf(encloser)); wildcard != nil {
+			return hasType(wildcard.Types)
+		}
+		return fmt.Errorf("%w: no NSEC3 matches %s", ErrNoDenial, name)
+	}
+	return ErrNoDenial
+}
+
+// proveNoDS - DS がないことを証明し、name が署名のない委任かどうかを返す
+//
+// A name that is no delegation at all is reported as false with no error,
+// so that the chain of trust simply continues below it.
+func (d *denial) proveNoDS(name string) (bool, error) {
+	delegation := func(types []dns.ResourceType) (bool, error) {
+		for _, t := range types {
+			if t == dns.ResourceTypeDS {
+				return false, fmt.Errorf("%w: the bitmap of %s has DS", ErrNoDenial, name)
+			}
+		}
+		isCut := false
+		for _, t := range types {
+			if t == dns.ResourceTypeSOA {
+				// the apex of a child zone can not prove the absence of DS
+				return false, fmt.Errorf("%w: denial of DS %s comes from the child zone", ErrNoDenial, name)
+			}
+			if t == dns.ResourceTypeNS {
+				isCut = true
+			}
+		}
+		return isCut, nil
+	}
+
+	if len(d.nsec) > 0 {
+		if at := d.nsecAt(name); at != nil {
+			return delegation(at.Types)
+		}
+		if d.nsecCovering(name) != nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: no NSEC matches %s", ErrNoDenial, name)
+	}
+	if len(d.nsec3) > 0 {
+		if at := d.nsec3Matching(name); at != nil {
+			return delegation(at.Types)
+		}
+		_, covering, err := d.closestEncloser(name)
+		if err != nil {
+			return false, err
+		}
+		return covering.Flags&dns.NSEC3FlagOptOut != 0, nil
+	}
+	return false, ErrNoDenial
+}
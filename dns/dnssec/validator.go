@@ -0,0 +1,566 @@
+// Package dnssec validates answers against the DNSSEC chain of trust.
+package dnssec
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrNoTrustedKey     = errors.New("no trusted key")
+	ErrUnexpectedRCode  = errors.New("unexpected rcode")
+)
+
+// Status is the outcome of a validation (RFC 4033 section 5).
+type Status int
+
+const (
+	// StatusIndeterminate means that the validation could not be done.
+	StatusIndeterminate Status = iota
+	// StatusInsecure means that an unsigned delegation is proven above the answer.
+	StatusInsecure
+	// StatusSecure means that the answer is signed by the chain of trust.
+	StatusSecure
+	// StatusBogus means that the answer should have been signed but is not
+	// correctly signed.
+	StatusBogus
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusIndeterminate:
+		return "Indeterminate"
+	case StatusInsecure:
+		return "Insecure"
+	case StatusSecure:
+		return "Secure"
+	case StatusBogus:
+		return "Bogus"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(s))
+	}
+}
+
+// ValidationError - 検証に失敗した段階とその理由
+type ValidationError struct {
+	// Step names the RRset being validated, such as "DNSKEY example.com.".
+	Step string
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("validate %s: %v", e.Step, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func stepError(name string, rrType dns.ResourceType, err error) error {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return err
+	}
+	return &ValidationError{Step: fmt.Sprintf("%v %s", rrType, dns.CanonicalName(name)), Err: err}
+}
+
+// Result is a response together with its validation status.
+type Result struct {
+	Status Status
+	Packet *dns.Packet
+	// Err tells why the answer is Bogus or Indeterminate.
+	Err error
+}
+
+// RootTrustAnchors are the DS records of the root KSK-2017 and KSK-2024.
+var RootTrustAnchors = []*dns.DSData{
+	{KeyTag: 20326, Algorithm: dns.AlgorithmRSASHA256, DigestType: dns.DigestSHA256, Digest: mustHex("E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D")},
+	{KeyTag: 38696, Algorithm: dns.AlgorithmRSASHA256, DigestType: dns.DigestSHA256, Digest: mustHex("683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16")},
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Validator - client.Client の上で応答を DNSSEC で検証する
+type Validator struct {
+	client       client.Exchanger
+	trustAnchors []*dns.DSData
+	now          func() time.Time
+}
+
+type Config struct {
+	// Client sends the queries. The upstream must be a recursive resolver.
+	Client client.Exchanger
+	// TrustAnchors are the DS records of the root zone. Defaults to RootTrustAnchors.
+	TrustAnchors []*dns.DSData
+	// Now returns the time to check the signature validity against.
+	Now func() time.Time
+}
+
+func New(config Config) *Validator {
+	if config.Client == nil {
+		config.Client = client.New(client.Config{})
+	}
+	if len(config.TrustAnchors) == 0 {
+		config.TrustAnchors = RootTrustAnchors
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &Validator{
+		client:       config.Client,
+		trustAnchors: config.TrustAnchors,
+		now:          config.Now,
+	}
+}
+
+// ValidateContext - name と resourceType を問い合わせ、応答を検証する
+//
+// The returned error is only set when the query itself fails; validation
+// failures are reported by Result.Status and Result.Err.
+func (v *Validator) ValidateContext(ctx context.Context, name string, resourceType dns.ResourceType) (*Result, error) {
+	s := &session{validator: v, ctx: ctx, now: v.now(), cuts: make(map[string]*cut)}
+	res, err := s.query(name, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.validate(dns.Fqdn(name), resourceType, res)
+	if err != nil {
+		log.Debugf("DNSSEC validation of %s %v: %v: %v", name, resourceType, status, err)
+	}
+	return &Result{Status: status, Packet: res, Err: err}, nil
+}
+
+// cut is a zone cut found while building the chain of trust.
+type cut struct {
+	zone string
+	// keys are the validated DNSKEYs of the zone. They are nil below an
+	// unsigned delegation.
+	keys []*dns.DNSKEYData
+}
+
+// session - 1 回の検証で使う、検証済みの鍵のキャッシュ
+type session struct {
+	validator *Validator
+	ctx       context.Context
+	now       time.Time
+	// cuts holds the closest enclosing zone of the names looked up so far.
+	cuts map[string]*cut
+}
+
+// query - DO を立て、検証を自分で行うために CD を立てて問い合わせる
+func (s *session) query(name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+	query := &dns.Packet{
+		QR:     dns.QRQuery,
+		Opcode: dns.OpcodeQuery,
+		RD:     true,
+		CD:     true,
+		Questions: []*dns.Question{
+			{Qname: name, Qtype: resourceType, Qclass: dns.ClassIN},
+		},
+	}
+	query.SetEDNS(&dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize, DO: true})
+	received, err := s.validator.client.ExchangeContext(s.ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query %s %v: %w", name, resourceType, err)
+	}
+	return received.Packet, nil
+}
+
+// rrset is the records sharing an owner name and a type, with their signatures.
+type rrset struct {
+	name    string
+	rrType  dns.ResourceType
+	records []*dns.ResourceRecord
+	sigs    []*dns.RRSIGData
+}
+
+// groupRRsets - セクションを RRset にまとめ、RRSIG を対応する RRset に付ける
+func groupRRsets(section []*dns.ResourceRecord) []*rrset {
+	var sets []*rrset
+	find := func(name string, rrType dns.ResourceType) *rrset {
+		for _, set := range sets {
+			if set.name == dns.CanonicalName(name) && set.rrType == rrType {
+				return set
+			}
+		}
+		set := &rrset{name: dns.CanonicalName(name), rrType: rrType}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range section {
+		if sig, ok := rr.RData.(*dns.RRSIGData); ok {
+			set := find(rr.Name, sig.TypeCovered)
+			set.sigs = append(set.sigs, sig)
+			continue
+		}
+		if rr.RData.ResourceType() == dns.ResourceTypeOPT {
+			continue
+		}
+		set := find(rr.Name, rr.RData.ResourceType())
+		set.records = append(set.records, rr)
+	}
+	// drop the signatures without records
+	result := sets[:0]
+	for _, set := range sets {
+		if len(set.records) > 0 {
+			result = append(result, set)
+		}
+	}
+	return result
+}
+
+// validate - 応答の各 RRset と不存在の証明を検証する
+func (s *session) validate(qname string, qtype dns.ResourceType, res *dns.Packet) (Status, error) {
+	if res.RCode != dns.RCodeNoError && res.RCode != dns.RCodeNameError {
+		return StatusIndeterminate, fmt.Errorf("%w: %d", ErrUnexpectedRCode, res.RCode)
+	}
+
+	status := StatusSecure
+	answers := groupRRsets(res.Answers)
+	for _, set := range answers {
+		if set.rrType == dns.ResourceTypeCNAME && len(set.sigs) == 0 && synthesizedFromDNAME(set, answers) {
+			// the CNAME synthesized from a DNAME is covered by the DNAME signature
+			continue
+		}
+		setStatus, err := s.validateRRset(set)
+		if err != nil {
+			return setStatus, err
+		}
+		if setStatus == StatusSecure {
+			if err := s.checkWildcard(set, res); err != nil {
+				return StatusBogus, stepError(set.name, set.rrType, err)
+			}
+		}
+		status = combine(status, setStatus)
+	}
+
+	target, records, err := (&dns.AliasChain{}).Follow(res.Answers, qname, qtype)
+	if err != nil {
+		return StatusBogus, stepError(qname, qtype, err)
+	}
+	if records != nil && res.RCode == dns.RCodeNoError {
+		return status, nil
+	}
+
+	// the answer is negative, so the authority section has to prove it
+	negativeStatus, err := s.validateDenial(target, qtype, res)
+	return combine(status, negativeStatus), err
+}
+
+// validateDenial - NXDOMAIN か NODATA の証明を検証する
+func (s *session) validateDenial(name string, qtype dns.ResourceType, res *dns.Packet) (Status, error) {
+	d := &denial{}
+	status := StatusSecure
+	signed := false
+	for _, set := range groupRRsets(res.Authorities) {
+		if set.rrType != dns.ResourceTypeSOA && set.rrType != dns.ResourceTypeNSEC && set.rrType != dns.ResourceTypeNSEC3 {
+			continue
+		}
+		if len(set.sigs) > 0 {
+			signed = true
+		}
+		setStatus, err := s.validateRRset(set)
+		if err != nil {
+			return setStatus, err
+		}
+		status = combine(status, setStatus)
+		switch set.rrType {
+		case dns.ResourceTypeNSEC:
+			d.nsec = append(d.nsec, set.records...)
+		case dns.ResourceTypeNSEC3:
+			d.nsec3 = append(d.nsec3, set.records...)
+		}
+	}
+
+	if !signed {
+		// with no signature at all, the zone has to be proven unsigned
+		c, err := s.closestCut(name)
+		if err != nil {
+			return StatusBogus, err
+		}
+		if c.keys == nil {
+			return StatusInsecure, nil
+		}
+		return StatusBogus, stepError(name, qtype, fmt.Errorf("%w: unsigned negative answer from signed zone %s", ErrMissingSignature, c.zone))
+	}
+	if status != StatusSecure {
+		return status, nil
+	}
+
+	var err error
+	if res.RCode == dns.RCodeNameError {
+		err = d.proveNXDomain(name)
+	} else {
+		err = d.proveNoData(name, qtype)
+	}
+	if err != nil {
+		return StatusBogus, stepError(name, qtype, err)
+	}
+	return StatusSecure, nil
+}
+
+// validateRRset - RRset の署名を、署名者までの信頼の連鎖とともに検証する
+func (s *session) validateRRset(set *rrset) (Status, error) {
+	if len(set.sigs) == 0 {
+		c, err := s.closestCut(set.name)
+		if err != nil {
+			return StatusBogus, err
+		}
+		if c.keys == nil {
+			return StatusInsecure, nil
+		}
+		return StatusBogus, stepError(set.name, set.rrType, fmt.Errorf("%w: zone %s is signed", ErrMissingSignature, c.zone))
+	}
+
+	signer := dns.CanonicalName(set.sigs[0].SignerName)
+	if !dns.IsSubDomain(set.name, signer) {
+		return StatusBogus, stepError(set.name, set.rrType, fmt.Errorf("%w: signer %s is not an ancestor", ErrInvalidSignature, signer))
+	}
+	c, err := s.closestCut(signer)
+	if err != nil {
+		return StatusBogus, err
+	}
+	if c.keys == nil {
+		return StatusInsecure, nil
+	}
+	if c.zone != signer {
+		return StatusBogus, stepError(set.name, set.rrType, fmt.Errorf("%w: signer %s is not a zone, closest is %s", ErrNoTrustedKey, signer, c.zone))
+	}
+	if err := s.verify(set, signer, c.keys); err != nil {
+		return StatusBogus, stepError(set.name, set.rrType, err)
+	}
+	return StatusSecure, nil
+}
+
+// verify - signer の鍵のどれかによる正しい署名があるかを調べる
+func (s *session) verify(set *rrset, signer string, keys []*dns.DNSKEYData) error {
+	var lastErr error = fmt.Errorf("%w: no signature by %s", ErrMissingSignature, signer)
+	for _, sig := range set.sigs {
+		if dns.CanonicalName(sig.SignerName) != signer || !SupportedAlgorithm(sig.Algorithm) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			err := Verify(set.records, sig, key, s.now)
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// checkWildcard - ワイルドカードから生成された RRset なら、元の名前が存在しないことを確かめる
+func (s *session) checkWildcard(set *rrset, res *dns.Packet) error {
+	sig := set.sigs[0]
+	if dns.CountLabels(set.name) <= int(sig.Labels) {
+		return nil
+	}
+	d := &denial{}
+	for _, auth := range groupRRsets(res.Authorities) {
+		if _, err := s.validateRRset(auth); err != nil {
+			continue
+		}
+		switch auth.rrType {
+		case dns.ResourceTypeNSEC:
+			d.nsec = append(d.nsec, auth.records...)
+		case dns.ResourceTypeNSEC3:
+			d.nsec3 = append(d.nsec3, auth.records...)
+		}
+	}
+	if d.nsecCovering(set.name) != nil {
+		return nil
+	}
+	nextCloser := dns.ParentLabels(set.name, int(sig.Labels)+1)
+	if d.nsec3Covering(nextCloser) != nil {
+		return nil
+	}
+	return fmt.Errorf("%w: wildcard expansion of %s", ErrNoDenial, set.name)
+}
+
+// closestCut - name を含む最も深いゾーンを、ルートから信頼の連鎖をたどって求める
+//
+// Every ancestor of name is asked for its DS. A signed DS continues the
+// chain, a proven unsigned delegation ends it as insecure, and a proven
+// absence of delegation moves on to the next label.
+func (s *session) closestCut(name string) (*cut, error) {
+	name = dns.CanonicalName(name)
+	if c, ok := s.cuts[name]; ok {
+		return c, nil
+	}
+
+	var c *cut
+	if name == "." {
+		keys, err := s.dnskeys(".", s.validator.trustAnchors, nil)
+		if err != nil {
+			return nil, err
+		}
+		c = &cut{zone: ".", keys: keys}
+	} else {
+		parent, err := s.closestCut(dns.ParentLabels(name, dns.CountLabels(name)-1))
+		if err != nil {
+			return nil, err
+		}
+		c, err = s.delegation(parent, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.cuts[name] = c
+	return c, nil
+}
+
+// delegation - parent の配下にある name が委任かどうかを DS で調べる
+func (s *session) delegation(parent *cut, name string) (*cut, error) {
+	if parent.keys == nil {
+		return parent, nil
+	}
+	res, err := s.query(name, dns.ResourceTypeDS)
+	if err != nil {
+		return nil, stepError(name, dns.ResourceTypeDS, err)
+	}
+	if res.RCode != dns.RCodeNoError && res.RCode != dns.RCodeNameError {
+		return nil, stepError(name, dns.ResourceTypeDS, fmt.Errorf("%w: %d", ErrUnexpectedRCode, res.RCode))
+	}
+
+	for _, set := range groupRRsets(res.Answers) {
+		if set.rrType != dns.ResourceTypeDS || set.name != name {
+			continue
+		}
+		if err := s.verify(set, parent.zone, parent.keys); err != nil {
+			return nil, stepError(name, dns.ResourceTypeDS, err)
+		}
+		var dsSet []*dns.DSData
+		for _, rr := range set.records {
+			dsSet = append(dsSet, rr.RData.(*dns.DSData))
+		}
+		keys, err := s.dnskeys(name, dsSet, parent)
+		if err != nil {
+			return nil, err
+		}
+		return &cut{zone: name, keys: keys}, nil
+	}
+
+	// no DS, so the parent has to prove it
+	d := &denial{}
+	for _, set := range groupRRsets(res.Authorities) {
+		if set.rrType != dns.ResourceTypeNSEC && set.rrType != dns.ResourceTypeNSEC3 {
+			continue
+		}
+		if err := s.verify(set, parent.zone, parent.keys); err != nil {
+			return nil, stepError(name, dns.ResourceTypeDS, err)
+		}
+		if set.rrType == dns.ResourceTypeNSEC {
+			d.nsec = append(d.nsec, set.records...)
+		} else {
+			d.nsec3 = append(d.nsec3, set.records...)
+		}
+	}
+	insecure, err := d.proveNoDS(name)
+	if err != nil {
+		return nil, stepError(name, dns.ResourceTypeDS, err)
+	}
+	if insecure {
+		log.Debugf("Insecure delegation: %s", name)
+		return &cut{zone: name}, nil
+	}
+	return parent, nil
+}
+
+// dnskeys - zone の DNSKEY を取得し、DS と一致する鍵による自己署名を検証する
+//
+// A zone whose DS only names unsupported algorithms is treated as unsigned
+// (RFC 4035 section 5.2), which is reported by nil keys.
+func (s *session) dnskeys(zone string, dsSet []*dns.DSData, parent *cut) ([]*dns.DNSKEYData, error) {
+	supported := false
+	for _, ds := range dsSet {
+		if SupportedAlgorithm(ds.Algorithm) {
+			supported = true
+		}
+	}
+	if !supported {
+		if parent == nil {
+			return nil, stepError(zone, dns.ResourceTypeDNSKEY, fmt.Errorf("%w: no supported trust anchor", ErrNoTrustedKey))
+		}
+		return nil, nil
+	}
+
+	res, err := s.query(zone, dns.ResourceTypeDNSKEY)
+	if err != nil {
+		return nil, stepError(zone, dns.ResourceTypeDNSKEY, err)
+	}
+	for _, set := range groupRRsets(res.Answers) {
+		if set.rrType != dns.ResourceTypeDNSKEY || set.name != zone {
+			continue
+		}
+		var keys, entry []*dns.DNSKEYData
+		for _, rr := range set.records {
+			key := rr.RData.(*dns.DNSKEYData)
+			keys = append(keys, key)
+			if key.Flags&dns.DNSKEYFlagRevoke == 0 && matchDS(zone, key, dsSet) {
+				entry = append(entry, key)
+			}
+		}
+		if len(entry) == 0 {
+			return nil, stepError(zone, dns.ResourceTypeDNSKEY, fmt.Errorf("%w: no DNSKEY matches the DS", ErrNoTrustedKey))
+		}
+		if err := s.verify(set, zone, entry); err != nil {
+			return nil, stepError(zone, dns.ResourceTypeDNSKEY, err)
+		}
+		return keys, nil
+	}
+	return nil, stepError(zone, dns.ResourceTypeDNSKEY, fmt.Errorf("%w: no DNSKEY in the answer", ErrNoTrustedKey))
+}
+
+// synthesizedFromDNAME - CNAME が応答中の DNAME から合成されたものかどうか
+func synthesizedFromDNAME(set *rrset, answers []*rrset) bool {
+	target := set.records[0].RData.(*dns.CNAMEData).Target
+	for _, other := range answers {
+		if other.rrType != dns.ResourceTypeDNAME || !dns.IsSubDomain(set.name, other.name) || set.name == other.name {
+			continue
+		}
+		dname := other.records[0].RData.(*dns.DNAMEData).Target
+		prefix := strings.TrimSuffix(set.name, other.name)
+		if dns.CanonicalName(prefix+dns.CanonicalName(dname)) == dns.CanonicalName(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// combine - 複数の RRset の状態をまとめる。最も弱い状態が全体の状態になる
+func combine(a, b Status) Status {
+	rank := func(s Status) int {
+		switch s {
+		case StatusSecure:
+			return 3
+		case StatusInsecure:
+			return 2
+		case StatusIndeterminate:
+			return 1
+		default:
+			return 0
+		}
+	}
+	if rank(a) < rank(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,370 @@
+package dnssec
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey は署名に使う鍵
+type testKey struct {
+	dnskey  *dns.DNSKEYData
+	private crypto.PrivateKey
+}
+
+func newTestKey(t *testing.T, algorithm uint8) *testKey {
+	t.Helper()
+	key := &testKey{dnskey: &dns.DNSKEYData{Flags: dns.DNSKEYFlagZone | dns.DNSKEYFlagSEP, Protocol: 3, Algorithm: algorithm}}
+	switch algorithm {
+	case dns.AlgorithmECDSAP256SHA256:
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.private = private
+		key.dnskey.PublicKey = append(private.X.FillBytes(make([]byte, 32)), private.Y.FillBytes(make([]byte, 32))...)
+	case dns.AlgorithmRSASHA256:
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.private = private
+		exponent := binary.BigEndian.AppendUint32(nil, uint32(private.E))
+		exponent = bytes.TrimLeft(exponent, "\x00")
+		key.dnskey.PublicKey = append(append([]byte{byte(len(exponent))}, exponent...), private.N.Bytes()...)
+	case dns.AlgorithmED25519:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.private = private
+		key.dnskey.PublicKey = public
+	default:
+		t.Fatalf("unsupported algorithm %d", algorithm)
+	}
+	return key
+}
+
+// signingWindow は署名の有効期間
+var (
+	signedAt  = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt = signedAt.Add(30 * 24 * time.Hour)
+)
+
+// sign は rrset に対する RRSIG レコードを作る
+func (k *testKey) sign(t *testing.T, zone string, rrset ...*dns.ResourceRecord) *dns.ResourceRecord {
+	t.Helper()
+	owner := rrset[0].Name
+	labels := dns.CountLabels(owner)
+	if strings.HasPrefix(owner, "*.") {
+		labels--
+	}
+	sig := &dns.RRSIGData{
+		TypeCovered: rrset[0].RData.ResourceType(),
+		Algorithm:   k.dnskey.Algorithm,
+		Labels:      uint8(labels),
+		OriginalTTL: rrset[0].TTL,
+		Expiration:  uint32(expiresAt.Unix()),
+		Inception:   uint32(signedAt.Unix()),
+		KeyTag:      k.dnskey.KeyTag(),
+		SignerName:  zone,
+	}
+	data, err := SignedData(rrset, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch private := k.private.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		sig.Signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case ed25519.PrivateKey:
+		sig.Signature = ed25519.Sign(private, data)
+	}
+	return &dns.ResourceRecord{Name: owner, Class: dns.ClassIN, TTL: rrset[0].TTL, RData: sig}
+}
+
+func (k *testKey) ds(t *testing.T, zone string) *dns.DSData {
+	t.Helper()
+	ds, err := ComputeDS(zone, k.dnskey, dns.DigestSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func record(name string, rdata dns.RData) *dns.ResourceRecord {
+	return &dns.ResourceRecord{Name: name, Class: dns.ClassIN, TTL: 3600, RData: rdata}
+}
+
+// signed は rrset とその RRSIG を並べる
+func signed(t *testing.T, key *testKey, zone string, rrset ...*dns.ResourceRecord) []*dns.ResourceRecord {
+	return append(rrset, key.sign(t, zone, rrset...))
+}
+
+// nsec3Chain は names のハッシュを並べた NSEC3 のチェーンを作る
+func nsec3Chain(t *testing.T, key *testKey, zone string, names map[string][]dns.ResourceType) []*dns.ResourceRecord {
+	t.Helper()
+	type hashed struct {
+		hash  []byte
+		types []dns.ResourceType
+	}
+	var hashes []hashed
+	for name, types := range names {
+		h, err := NSEC3Hash(name, []byte{0xab}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hashed{hash: h, types: types})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i].hash, hashes[j].hash) < 0 })
+	var records []*dns.ResourceRecord
+	for i, h := range hashes {
+		next := hashes[(i+1)%len(hashes)].hash
+		rr := record(dns.EncodeNSEC3Hash(h.hash)+"."+zone, &dns.NSEC3Data{
+			HashAlgorithm: 1, Iterations: 1, Salt: []byte{0xab}, NextHashed: next, Types: h.types,
+		})
+		records = append(records, signed(t, key, zone, rr)...)
+	}
+	return records
+}
+
+// fixture は署名済みのゾーン階層に答える Exchanger
+//
+//	.                 ECDSA P-256
+//	example.          RSA/SHA-256, NSEC
+//	sub.example.      Ed25519, NSEC3
+//	insecure.example. unsigned delegation
+type fixture struct {
+	t         *testing.T
+	root      *testKey
+	responses map[string]*dns.Packet
+}
+
+func (f *fixture) ExchangeContext(_ context.Context, query *dns.Packet) (*client.Response, error) {
+	q := query.Questions[0]
+	if edns := query.EDNS(); edns == nil || !edns.DO || !query.CD {
+		f.t.Errorf("query %s %v: DO and CD must be set", q.Qname, q.Qtype)
+	}
+	res, ok := f.responses[dns.CanonicalName(q.Qname)+" "+q.Qtype.String()]
+	if !ok {
+		f.t.Errorf("unexpected query %s %v", q.Qname, q.Qtype)
+		res = &dns.Packet{RCode: dns.RCodeServerFailure}
+	}
+	copied := *res
+	copied.Id = query.Id
+	copied.QR = dns.QRResponse
+	copied.Questions = query.Questions
+	return &client.Response{Packet: &copied}, nil
+}
+
+func (f *fixture) set(name string, rrType dns.ResourceType, res *dns.Packet) {
+	f.responses[name+" "+rrType.String()] = res
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	root := newTestKey(t, dns.AlgorithmECDSAP256SHA256)
+	example := newTestKey(t, dns.AlgorithmRSASHA256)
+	sub := newTestKey(t, dns.AlgorithmED25519)
+	f := &fixture{t: t, root: root, responses: make(map[string]*dns.Packet)}
+
+	// .
+	f.set(".", dns.ResourceTypeDNSKEY, &dns.Packet{Answers: signed(t, root, ".", record(".", root.dnskey))})
+	f.set("example.", dns.ResourceTypeDS, &dns.Packet{Answers: signed(t, root, ".", record("example.", example.ds(t, "example.")))})
+
+	// example.
+	exampleSOA := signed(t, example, "example.", record("example.", &dns.SOAData{MName: "ns.example.", RName: "admin.example.", Serial: 1, Minttl: 300}))
+	apexNSEC := signed(t, example, "example.", record("example.", &dns.NSECData{NextDomain: "alias.example.", Types: []dns.ResourceType{
+		dns.ResourceTypeNS, dns.ResourceTypeSOA, dns.ResourceTypeRRSIG, dns.ResourceTypeNSEC, dns.ResourceTypeDNSKEY,
+	}}))
+	insecureNSEC := signed(t, example, "example.", record("insecure.example.", &dns.NSECData{NextDomain: "sub.example.", Types: []dns.ResourceType{
+		dns.ResourceTypeNS, dns.ResourceTypeRRSIG, dns.ResourceTypeNSEC,
+	}}))
+	f.set("example.", dns.ResourceTypeDNSKEY, &dns.Packet{Answers: signed(t, example, "example.", record("example.", example.dnskey))})
+	f.set("sub.example.", dns.ResourceTypeDS, &dns.Packet{Answers: signed(t, example, "example.", record("sub.example.", sub.ds(t, "sub.example.")))})
+	f.set("insecure.example.", dns.ResourceTypeDS, &dns.Packet{Authorities: append(append([]*dns.ResourceRecord{}, exampleSOA...), insecureNSEC...)})
+	f.set("nope.example.", dns.ResourceTypeA, &dns.Packet{
+		RCode:       dns.RCodeNameError,
+		Authorities: append(append(append([]*dns.ResourceRecord{}, exampleSOA...), insecureNSEC...), apexNSEC...),
+	})
+	f.set("example.", dns.ResourceTypeTXT, &dns.Packet{Authorities: append(append([]*dns.ResourceRecord{}, exampleSOA...), apexNSEC...)})
+
+	// sub.example.
+	www := record("www.sub.example.", &dns.AData{Address: []byte{192, 0, 2, 1}})
+	f.set("sub.example.", dns.ResourceTypeDNSKEY, &dns.Packet{Answers: signed(t, sub, "sub.example.", record("sub.example.", sub.dnskey))})
+	f.set("www.sub.example.", dns.ResourceTypeA, &dns.Packet{Answers: signed(t, sub, "sub.example.", www)})
+	subSOA := signed(t, sub, "sub.example.", record("sub.example.", &dns.SOAData{MName: "ns.sub.example.", RName: "admin.sub.example.", Serial: 1, Minttl: 300}))
+	chain := nsec3Chain(t, sub, "sub.example.", map[string][]dns.ResourceType{
+		"sub.example.":        {dns.ResourceTypeSOA, dns.ResourceTypeNS, dns.ResourceTypeDNSKEY, dns.ResourceTypeRRSIG},
+		"www.sub.example.":    {dns.ResourceTypeA, dns.ResourceTypeRRSIG},
+		"wild.sub.example.":   {},
+		"*.wild.sub.example.": {dns.ResourceTypeA, dns.ResourceTypeRRSIG},
+	})
+	negative := append(append([]*dns.ResourceRecord{}, subSOA...), chain...)
+	f.set("missing.sub.example.", dns.ResourceTypeA, &dns.Packet{RCode: dns.RCodeNameError, Authorities: negative})
+	f.set("www.sub.example.", dns.ResourceTypeTXT, &dns.Packet{Authorities: negative})
+	f.set("www.sub.example.", dns.ResourceTypeDS, &dns.Packet{Authorities: negative})
+	wildcard := record("*.wild.sub.example.", &dns.AData{Address: []byte{192, 0, 2, 9}})
+	wildcardSig := sub.sign(t, "sub.example.", wildcard)
+	expanded, expandedSig := *wildcard, *wildcardSig
+	expanded.Name, expandedSig.Name = "any.wild.sub.example.", "any.wild.sub.example."
+	f.set("any.wild.sub.example.", dns.ResourceTypeA, &dns.Packet{Answers: []*dns.ResourceRecord{&expanded, &expandedSig}, Authorities: chain})
+
+	// a CNAME in example. pointing into sub.example.
+	f.set("alias.example.", dns.ResourceTypeA, &dns.Packet{Answers: append(
+		signed(t, example, "example.", record("alias.example.", &dns.CNAMEData{Target: "www.sub.example."})),
+		signed(t, sub, "sub.example.", www)...,
+	)})
+
+	// insecure.example.
+	f.set("host.insecure.example.", dns.ResourceTypeA, &dns.Packet{Answers: []*dns.ResourceRecord{
+		record("host.insecure.example.", &dns.AData{Address: []byte{192, 0, 2, 2}}),
+	}})
+	return f
+}
+
+func TestValidator_ValidateContext(t *testing.T) {
+	f := newFixture(t)
+
+	// bogus answers
+	tampered := f.responses["www.sub.example. A"].Answers
+	tamperedA := *tampered[0]
+	tamperedA.RData = &dns.AData{Address: []byte{198, 51, 100, 1}}
+	f.set("tampered.sub.example.", dns.ResourceTypeA, &dns.Packet{Answers: []*dns.ResourceRecord{&tamperedA, tampered[1]}})
+	f.set("www.sub.example.", dns.ResourceTypeAAAA, &dns.Packet{Answers: []*dns.ResourceRecord{
+		record("www.sub.example.", &dns.AAAAData{Address: make([]byte, 16)}),
+	}})
+	f.set("servfail.example.", dns.ResourceTypeA, &dns.Packet{RCode: dns.RCodeServerFailure})
+
+	cases := []struct {
+		label        string
+		name         string
+		rrType       dns.ResourceType
+		now          time.Time
+		trustAnchors []*dns.DSData
+		want         Status
+		wantErr      error
+		wantStep     string
+	}{
+		{label: "Secure/answer", name: "www.sub.example.", rrType: dns.ResourceTypeA, want: StatusSecure},
+		{label: "Secure/cname-across-zones", name: "alias.example.", rrType: dns.ResourceTypeA, want: StatusSecure},
+		{label: "Secure/wildcard", name: "any.wild.sub.example.", rrType: dns.ResourceTypeA, want: StatusSecure},
+		{label: "Secure/nxdomain-nsec", name: "nope.example.", rrType: dns.ResourceTypeA, want: StatusSecure},
+		{label: "Secure/nodata-nsec", name: "example.", rrType: dns.ResourceTypeTXT, want: StatusSecure},
+		{label: "Secure/nxdomain-nsec3", name: "missing.sub.example.", rrType: dns.ResourceTypeA, want: StatusSecure},
+		{label: "Secure/nodata-nsec3", name: "www.sub.example.", rrType: dns.ResourceTypeTXT, want: StatusSecure},
+		{label: "Insecure/unsigned-delegation", name: "host.insecure.example.", rrType: dns.ResourceTypeA, want: StatusInsecure},
+		{
+			label: "Bogus/tampered", name: "tampered.sub.example.", rrType: dns.ResourceTypeA,
+			want: StatusBogus, wantErr: ErrInvalidSignature, wantStep: "A www.sub.example.",
+		},
+		{
+			label: "Bogus/missing-signature", name: "www.sub.example.", rrType: dns.ResourceTypeAAAA,
+			want: StatusBogus, wantErr: ErrMissingSignature, wantStep: "AAAA www.sub.example.",
+		},
+		{
+			label: "Bogus/expired", name: "www.sub.example.", rrType: dns.ResourceTypeA, now: expiresAt.Add(time.Hour),
+			want: StatusBogus, wantErr: ErrSignatureExpired, wantStep: "DNSKEY .",
+		},
+		{
+			label: "Bogus/wrong-trust-anchor", name: "www.sub.example.", rrType: dns.ResourceTypeA,
+			trustAnchors: []*dns.DSData{{KeyTag: 1, Algorithm: dns.AlgorithmECDSAP256SHA256, DigestType: dns.DigestSHA256, Digest: make([]byte, 32)}},
+			want:         StatusBogus, wantErr: ErrNoTrustedKey, wantStep: "DNSKEY .",
+		},
+		{label: "Indeterminate/servfail", name: "servfail.example.", rrType: dns.ResourceTypeA, want: StatusIndeterminate, wantErr: ErrUnexpectedRCode},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			now := tc.now
+			if now.IsZero() {
+				now = signedAt.Add(time.Hour)
+			}
+			trustAnchors := tc.trustAnchors
+			if trustAnchors == nil {
+				trustAnchors = []*dns.DSData{f.root.ds(t, ".")}
+			}
+			v := New(Config{Client: f, TrustAnchors: trustAnchors, Now: func() time.Time { return now }})
+
+			// ACT
+			result, err := v.ValidateContext(context.Background(), tc.name, tc.rrType)
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Status != tc.want {
+				t.Errorf("Status: want %v, got %v (%v)", tc.want, result.Status, result.Err)
+			}
+			if tc.wantErr == nil {
+				if result.Err != nil {
+					t.Errorf("Err: want nil, got %v", result.Err)
+				}
+				return
+			}
+			if !errors.Is(result.Err, tc.wantErr) {
+				t.Errorf("Err: want %v, got %v", tc.wantErr, result.Err)
+			}
+			var validationErr *ValidationError
+			if tc.wantStep != "" && (!errors.As(result.Err, &validationErr) || validationErr.Step != tc.wantStep) {
+				t.Errorf("Step: want %q, got %v", tc.wantStep, result.Err)
+			}
+		})
+	}
+}
+
+func TestDNSKEYData_KeyTag(t *testing.T) {
+	// the root KSK-2017 from the IANA trust anchor file
+	key := &dns.DNSKEYData{
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.AlgorithmRSASHA256,
+		PublicKey: mustBase64(t, "AwEAAaz/tAm8yTn4Mfeh5eyI96WSVexTBAvkMgJzkKTOiW1vkIbzxeF3+/4RgWOq7HrxRixHlFlExOLAJr5emLvN7SWXgnLh4+B5xQlNVz8Og8kvArMtNROxVQuCaSnIDdD5LKyWbRd2n9WGe2R8PzgCmr3EgVLrjyBxWezF0jLHwVN8efS3rCj/EWgvIWgb9tarpVUDK/b58Da+sqqls3eNbuv7pr+eoZG+SrDK6nWeL3c6H5Apxz7LjVc1uTIdsIXxuOLYA4/ilBmSVIzuDWfdRUfhHdY6+cn8HFRm+2hM8AnXGXws9555KrUB5qihylGa8subX2Nn6UwNR1AkUTV74bU="),
+	}
+
+	if got := key.KeyTag(); got != 20326 {
+		t.Errorf("KeyTag: want 20326, got %d", got)
+	}
+	ds, err := ComputeDS(".", key, dns.DigestSHA256)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(ds.Digest, RootTrustAnchors[0].Digest) {
+		t.Errorf("Digest: want %x, got %x", RootTrustAnchors[0].Digest, ds.Digest)
+	}
+}
+
+func mustBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,267 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	ErrInvalidSignature     = errors.New("invalid signature")
+	ErrSignatureExpired     = errors.New("signature expired")
+	ErrSignatureNotYetValid = errors.New("signature not yet valid")
+	ErrInvalidKey           = errors.New("invalid key")
+)
+
+// SupportedAlgorithm - 検証できるアルゴリズムかどうか
+func SupportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case dns.AlgorithmRSASHA256, dns.AlgorithmRSASHA512,
+		dns.AlgorithmECDSAP256SHA256, dns.AlgorithmECDSAP384SHA384,
+		dns.AlgorithmED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// ComputeDS - DNSKEY から DS のダイジェストを計算する (RFC 4034 section 5.1.4)
+func ComputeDS(owner string, key *dns.DNSKEYData, digestType uint8) (*dns.DSData, error) {
+	name, err := dns.CanonicalWireName(owner)
+	if err != nil {
+		return nil, err
+	}
+	rdata, err := key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	data := append(name, rdata[2:]...)
+
+	var digest []byte
+	switch digestType {
+	case dns.DigestSHA1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case dns.DigestSHA256:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case dns.DigestSHA384:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return nil, fmt.Errorf("%w: digest type %d", ErrUnsupportedAlgorithm, digestType)
+	}
+	return &dns.DSData{
+		KeyTag:     key.KeyTag(),
+		Algorithm:  key.Algorithm,
+		DigestType: digestType,
+		Digest:     digest,
+	}, nil
+}
+
+// matchDS - 鍵が DS のどれかと一致するか
+func matchDS(owner string, key *dns.DNSKEYData, dsSet []*dns.DSData) bool {
+	for _, ds := range dsSet {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		computed, err := ComputeDS(owner, key, ds.DigestType)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(computed.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignedData - RRSIG の署名対象となるバイト列を組み立てる (RFC 4034 section 3.1.8.1)
+//
+// The records are put in canonical form: lowercase owner names, the
+// original TTL, and the RDATA sorted with duplicates removed.
+func SignedData(rrset []*dns.ResourceRecord, sig *dns.RRSIGData) ([]byte, error) {
+	if len(rrset) == 0 {
+		return nil, errors.New("empty rrset")
+	}
+	data, err := sig.SignedFields()
+	if err != nil {
+		return nil, err
+	}
+
+	owner := dns.CanonicalName(rrset[0].Name)
+	if labels := dns.CountLabels(owner); labels > int(sig.Labels) {
+		// the records were expanded from a wildcard (RFC 4035 section 5.3.2)
+		owner = wildcardOf(dns.ParentLabels(owner, int(sig.Labels)))
+	} else if labels < int(sig.Labels) {
+		return nil, fmt.Errorf("%w: labels=%d exceeds owner %s", ErrInvalidSignature, sig.Labels, owner)
+	}
+
+	var records [][]byte
+	for _, rr := range rrset {
+		canonical := &dns.ResourceRecord{
+			Name:  owner,
+			Class: rr.Class,
+			TTL:   sig.OriginalTTL,
+			RData: canonicalRData(rr.RData),
+		}
+		wire, err := canonical.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, wire)
+	}
+	// every record shares the owner, type, class and TTL, so sorting the
+	// whole records sorts them by RDATA
+	sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i], records[j]) < 0 })
+	for i, wire := range records {
+		if i > 0 && bytes.Equal(wire, records[i-1]) {
+			continue
+		}
+		data = append(data, wire...)
+	}
+	return data, nil
+}
+
+// canonicalRData - RDATA 内の名前を小文字にする (RFC 4034 section 6.2, RFC 6840 section 5.1)
+func canonicalRData(rdata dns.RData) dns.RData {
+	switch d := rdata.(type) {
+	case *dns.NSData:
+		return &dns.NSData{Host: strings.ToLower(d.Host)}
+	case *dns.CNAMEData:
+		return &dns.CNAMEData{Target: strings.ToLower(d.Target)}
+	case *dns.PTRData:
+		return &dns.PTRData{Host: strings.ToLower(d.Host)}
+	case *dns.MXData:
+		return &dns.MXData{Preference: d.Preference, Exchange: strings.ToLower(d.Exchange)}
+	case *dns.SRVData:
+		srv := *d
+		srv.Target = strings.ToLower(d.Target)
+		return &srv
+	case *dns.DNAMEData:
+		return &dns.DNAMEData{Target: strings.ToLower(d.Target)}
+	case *dns.SOAData:
+		soa := *d
+		soa.MName = strings.ToLower(d.MName)
+		soa.RName = strings.ToLower(d.RName)
+		return &soa
+	case *dns.RRSIGData:
+		sig := *d
+		sig.SignerName = strings.ToLower(d.SignerName)
+		return &sig
+	default:
+		return rdata
+	}
+}
+
+// Verify - RRSIG が rrset に対する key の正しい署名かどうかを検証する
+func Verify(rrset []*dns.ResourceRecord, sig *dns.RRSIGData, key *dns.DNSKEYData, now time.Time) error {
+	if key.Flags&dns.DNSKEYFlagZone == 0 || key.Flags&dns.DNSKEYFlagRevoke != 0 {
+		return fmt.Errorf("%w: key %d may not sign the zone", ErrInvalidKey, key.KeyTag())
+	}
+	if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+		return fmt.Errorf("%w: key %d/%d does not match signature %d/%d",
+			ErrInvalidKey, key.KeyTag(), key.Algorithm, sig.KeyTag, sig.Algorithm)
+	}
+	if t := now.Unix(); t > int64(sig.Expiration) {
+		return fmt.Errorf("%w: at %s", ErrSignatureExpired, time.Unix(int64(sig.Expiration), 0).UTC())
+	} else if t < int64(sig.Inception) {
+		return fmt.Errorf("%w: until %s", ErrSignatureNotYetValid, time.Unix(int64(sig.Inception), 0).UTC())
+	}
+
+	data, err := SignedData(rrset, sig)
+	if err != nil {
+		return err
+	}
+	switch sig.Algorithm {
+	case dns.AlgorithmRSASHA256, dns.AlgorithmRSASHA512:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA256
+		if sig.Algorithm == dns.AlgorithmRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig.Signature); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+		}
+		return nil
+	case dns.AlgorithmECDSAP256SHA256, dns.AlgorithmECDSAP384SHA384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if sig.Algorithm == dns.AlgorithmECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+		size := curve.Params().BitSize / 8
+		if len(key.PublicKey) != 2*size {
+			return fmt.Errorf("%w: ECDSA key length %d", ErrInvalidKey, len(key.PublicKey))
+		}
+		if len(sig.Signature) != 2*size {
+			return fmt.Errorf("%w: ECDSA signature length %d", ErrInvalidSignature, len(sig.Signature))
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(sig.Signature[:size])
+		s := new(big.Int).SetBytes(sig.Signature[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case dns.AlgorithmED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("%w: Ed25519 key length %d", ErrInvalidKey, len(key.PublicKey))
+		}
+		if !ed25519.Verify(key.PublicKey, data, sig.Signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %d", ErrUnsupportedAlgorithm, sig.Algorithm)
+	}
+}
+
+// rsaPublicKey - DNSKEY の RSA 公開鍵を読み込む (RFC 3110 section 2)
+func rsaPublicKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 1 {
+		return nil, fmt.Errorf("%w: empty RSA key", ErrInvalidKey)
+	}
+	expLen, key := int(key[0]), key[1:]
+	if expLen == 0 {
+		if len(key) < 2 {
+			return nil, fmt.Errorf("%w: truncated RSA key", ErrInvalidKey)
+		}
+		expLen, key = int(key[0])<<8|int(key[1]), key[2:]
+	}
+	if expLen > 4 || len(key) <= expLen {
+		return nil, fmt.Errorf("%w: RSA exponent length %d", ErrInvalidKey, expLen)
+	}
+	exponent := 0
+	for _, b := range key[:expLen] {
+		exponent = exponent<<8 | int(b)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(key[expLen:]),
+		E: exponent,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package dns
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestDecodePacket_dnssecRecords(t *testing.T) {
+	// ARRANGE
+	answers := []*ResourceRecord{
+		{Name: "example.com.", Class: ClassIN, TTL: 3600, RData: &DNSKEYData{Flags: 257, Protocol: 3, Algorithm: AlgorithmED25519, PublicKey: []byte{1, 2, 3, 4}}},
+		{Name: "example.com.", Class: ClassIN, TTL: 3600, RData: &DSData{KeyTag: 12345, Algorithm: AlgorithmED25519, DigestType: DigestSHA256, Digest: []byte{0xde, 0xad, 0xbe, 0xef}}},
+		{Name: "example.com.", Class: ClassIN, TTL: 3600, RData: &RRSIGData{
+			TypeCovered: ResourceTypeA, Algorithm: AlgorithmED25519, Labels: 2, OriginalTTL: 3600,
+			Expiration: 1700000000, Inception: 1690000000, KeyTag: 12345, SignerName: "example.com.", Signature: []byte{9, 8, 7},
+		}},
+		{Name: "example.com.", Class: ClassIN, TTL: 3600, RData: &NSECData{NextDomain: "www.example.com.", Types: []ResourceType{ResourceTypeA, ResourceTypeRRSIG, ResourceTypeNSEC, ResourceType(1234)}}},
+		{Name: "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.com.", Class: ClassIN, TTL: 3600, RData: &NSEC3Data{
+			HashAlgorithm: 1, Flags: NSEC3FlagOptOut, Iterations: 10, Salt: []byte{0xab, 0xcd}, NextHashed: make([]byte, 20), Types: []ResourceType{ResourceTypeNS},
+		}},
+	}
+	packet := &Packet{Id: 1, QR: QRResponse, Answers: answers}
+
+	// ACT
+	buf, err := packet.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoded, err := DecodePacket(buf)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(answers, decoded.Answers); diff != "" {
+		t.Errorf("Answers: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestCompareNames(t *testing.T) {
+	// the canonical order of RFC 4034 section 6.1
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example.", "a.z.example."}
+	for i := 1; i < len(names); i++ {
+		if got := CompareNames(names[i-1], names[i]); got >= 0 {
+			t.Errorf("CompareNames(%q, %q): want < 0, got %d", names[i-1], names[i], got)
+		}
+	}
+}
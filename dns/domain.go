@@ -3,6 +3,8 @@ package dns
 import (
 	"errors"
 	"fmt"
+	"net/netip"
+	"strconv"
 	"strings"
 )
 
@@ -44,20 +46,21 @@ func decodeDomain(sc *Scanner) (string, error) {
 		}
 		visited[pos] = struct{}{}
 		var domain string
-		ptr, err := getPointer(pos)
-		if err == nil {
-			// compression
-			domain, _, err = getName(ptr)
-			if err != nil {
+		start := pos
+		for {
+			ptr, err := getPointer(pos)
+			if err == nil {
+				// compression: the rest of the name is at ptr
+				suffix, _, err := getName(ptr)
+				if err != nil {
+					return "", 0, err
+				}
+				return domain + suffix, pos + 2 - start, nil
+			} else if !errors.Is(err, ErrNotPointer) {
+				// invalid format
 				return "", 0, err
 			}
-			return domain, 2, err
-		} else if !errors.Is(err, ErrNotPointer) {
-			// invalid format
-			return "", 0, err
-		}
 
-		for {
 			partLength, err := sc.PeekAt(pos)
 			if err != nil {
 				return "", 0, ErrInvalidDomain
@@ -73,7 +76,7 @@ func decodeDomain(sc *Scanner) (string, error) {
 			domain += string(part) + "."
 			pos += int(partLength)
 		}
-		return domain, len(domain) + 1, nil
+		return domain, pos - start, nil
 	}
 
 	domain, sz, err := getName(sc.Position())
@@ -134,3 +137,101 @@ func encodeDomain(domain string) ([]byte, error) {
 	buf = append(buf, 0)
 	return buf, nil
 }
+
+// Fqdn - 末尾にドットを付けた完全修飾ドメイン名を返す
+func Fqdn(domain string) string {
+	if strings.HasSuffix(domain, ".") {
+		return domain
+	}
+	return domain + "."
+}
+
+// CanonicalName - 比較用に小文字の完全修飾ドメイン名を返す
+func CanonicalName(domain string) string {
+	return strings.ToLower(Fqdn(domain))
+}
+
+// IsSubDomain - name が zone 自身かその配下にあるかどうか
+func IsSubDomain(name, zone string) bool {
+	name, zone = CanonicalName(name), CanonicalName(zone)
+	if zone == "." {
+		return true
+	}
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// CountLabels - ルートを除いたラベルの数を返す
+func CountLabels(domain string) int {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return 0
+	}
+	return strings.Count(domain, ".") + 1
+}
+
+// ParentLabels - name の末尾 n ラベルからなるドメイン名を返す
+func ParentLabels(name string, n int) string {
+	labels := strings.Split(strings.TrimSuffix(Fqdn(name), "."), ".")
+	if n <= 0 || labels[0] == "" {
+		return "."
+	}
+	if n > len(labels) {
+		n = len(labels)
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// CanonicalWireName - 小文字にした非圧縮のワイヤー形式の名前を返す (RFC 4034 section 6.2)
+func CanonicalWireName(domain string) ([]byte, error) {
+	return encodeDomain(CanonicalName(domain))
+}
+
+// CompareNames - 名前を DNSSEC の正規順序で比較する (RFC 4034 section 6.1)
+//
+// Names are compared label by label from the rightmost one, ignoring case.
+func CompareNames(a, b string) int {
+	la := splitLabels(CanonicalName(a))
+	lb := splitLabels(CanonicalName(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func splitLabels(fqdn string) []string {
+	if fqdn == "." {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+}
+
+// ReverseName - アドレスの逆引き用の名前 (in-addr.arpa か ip6.arpa) を返す
+//
+// An IPv4-mapped IPv6 address is looked up as IPv4. It returns an empty
+// string for an invalid address.
+func ReverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	var b strings.Builder
+	switch {
+	case addr.Is4():
+		octets := addr.As4()
+		for i := len(octets) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(octets[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+	case addr.Is6():
+		const hexDigits = "0123456789abcdef"
+		octets := addr.As16()
+		for i := len(octets) - 1; i >= 0; i-- {
+			b.WriteByte(hexDigits[octets[i]&0x0f])
+			b.WriteByte('.')
+			b.WriteByte(hexDigits[octets[i]>>4])
+			b.WriteByte('.')
+		}
+		b.WriteString("ip6.arpa.")
+	}
+	return b.String()
+}
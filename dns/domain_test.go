@@ -3,6 +3,7 @@ package dns
 import (
 	"bytes"
 	"errors"
+	"net/netip"
 	"testing"
 )
 
@@ -152,3 +153,59 @@ func TestEncodeDomain(t *testing.T) {
 		})
 	}
 }
+
+func TestIsSubDomain(t *testing.T) {
+	cases := []struct {
+		name string
+		zone string
+		want bool
+	}{
+		{name: "www.example.com.", zone: "example.com.", want: true},
+		{name: "WWW.Example.COM", zone: "example.com.", want: true},
+		{name: "example.com.", zone: "example.com", want: true},
+		{name: "example.com.", zone: ".", want: true},
+		{name: "badexample.com.", zone: "example.com.", want: false},
+		{name: "com.", zone: "example.com.", want: false},
+	}
+	for _, tc := range cases {
+		if got := IsSubDomain(tc.name, tc.zone); got != tc.want {
+			t.Errorf("IsSubDomain(%q, %q): want %v, got %v", tc.name, tc.zone, tc.want, got)
+		}
+	}
+}
+
+func TestParentLabels(t *testing.T) {
+	cases := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{name: "www.example.com.", n: 1, want: "com."},
+		{name: "www.example.com", n: 2, want: "example.com."},
+		{name: "www.example.com.", n: 3, want: "www.example.com."},
+		{name: "www.example.com.", n: 5, want: "www.example.com."},
+		{name: "www.example.com.", n: 0, want: "."},
+		{name: ".", n: 1, want: "."},
+	}
+	for _, tc := range cases {
+		if got := ParentLabels(tc.name, tc.n); got != tc.want {
+			t.Errorf("ParentLabels(%q, %d): want %q, got %q", tc.name, tc.n, tc.want, got)
+		}
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	cases := []struct {
+		addr string
+		want string
+	}{
+		{addr: "192.0.2.1", want: "1.2.0.192.in-addr.arpa."},
+		{addr: "::ffff:192.0.2.1", want: "1.2.0.192.in-addr.arpa."},
+		{addr: "2001:db8::567:89ab", want: "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, tc := range cases {
+		if got := ReverseName(netip.MustParseAddr(tc.addr)); got != tc.want {
+			t.Errorf("ReverseName(%s): want %q, got %q", tc.addr, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// address families of the ECS option (IANA Address Family Numbers)
+const (
+	ecsFamilyIPv4 = 1
+	ecsFamilyIPv6 = 2
+)
+
+var ErrInvalidClientSubnet = errors.New("invalid client subnet option")
+
+// ClientSubnet - EDNS Client Subnet オプション (RFC 7871)
+type ClientSubnet struct {
+	// Prefix is the client address masked to SOURCE PREFIX-LENGTH.
+	Prefix netip.Prefix
+	// Scope is SCOPE PREFIX-LENGTH, the part of the address an answer
+	// depends on. It is set by servers and must be 0 in queries.
+	Scope uint8
+}
+
+// NewClientSubnet - prefix のアドレスを prefix 長でマスクしたオプションを作る
+//
+// An IPv4-mapped IPv6 address is sent as IPv4.
+func NewClientSubnet(prefix netip.Prefix) *ClientSubnet {
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() {
+		addr, bits = addr.Unmap(), max(bits-96, 0)
+	}
+	return &ClientSubnet{Prefix: netip.PrefixFrom(addr, bits).Masked()}
+}
+
+// Bytes - オプションのデータ部を返す
+func (s *ClientSubnet) Bytes() []byte {
+	family := uint16(ecsFamilyIPv6)
+	if s.Prefix.Addr().Is4() {
+		family = ecsFamilyIPv4
+	}
+	buf := binary.BigEndian.AppendUint16(nil, family)
+	buf = append(buf, byte(s.Prefix.Bits()), s.Scope)
+	// only the octets covered by the source prefix are sent
+	addr := s.Prefix.Masked().Addr().AsSlice()
+	return append(buf, addr[:(s.Prefix.Bits()+7)/8]...)
+}
+
+func (s *ClientSubnet) String() string {
+	return fmt.Sprintf("%v/%d", s.Prefix, s.Scope)
+}
+
+// ParseClientSubnet - ECS オプションのデータ部を解析する (RFC 7871 section 6)
+func ParseClientSubnet(data []byte) (*ClientSubnet, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: length=%d", ErrInvalidClientSubnet, len(data))
+	}
+	family, source, scope := binary.BigEndian.Uint16(data), int(data[2]), data[3]
+	var addr []byte
+	switch family {
+	case ecsFamilyIPv4:
+		addr = make([]byte, 4)
+	case ecsFamilyIPv6:
+		addr = make([]byte, 16)
+	default:
+		return nil, fmt.Errorf("%w: family=%d", ErrInvalidClientSubnet, family)
+	}
+	if source > len(addr)*8 || int(scope) > len(addr)*8 {
+		return nil, fmt.Errorf("%w: source=%d scope=%d", ErrInvalidClientSubnet, source, scope)
+	}
+	if len(data)-4 != (source+7)/8 {
+		return nil, fmt.Errorf("%w: address length=%d for source=%d", ErrInvalidClientSubnet, len(data)-4, source)
+	}
+	copy(addr, data[4:])
+	ip, _ := netip.AddrFromSlice(addr)
+	prefix := netip.PrefixFrom(ip, source)
+	if prefix.Masked() != prefix {
+		return nil, fmt.Errorf("%w: %v has bits beyond the source prefix", ErrInvalidClientSubnet, ip)
+	}
+	return &ClientSubnet{Prefix: prefix, Scope: scope}, nil
+}
+
+// ClientSubnet - ECS オプションを返す。なければ nil
+func (e *EDNS) ClientSubnet() (*ClientSubnet, error) {
+	option := e.Option(EDNSOptionClientSubnet)
+	if option == nil {
+		return nil, nil
+	}
+	return ParseClientSubnet(option.Data)
+}
+
+// SetClientSubnet - ECS オプションを置き換える。subnet が nil なら取り除く
+func (e *EDNS) SetClientSubnet(subnet *ClientSubnet) {
+	if subnet == nil {
+		e.SetOption(EDNSOptionClientSubnet, nil)
+		return
+	}
+	e.SetOption(EDNSOptionClientSubnet, subnet.Bytes())
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"net/netip"
+	"testing"
+)
+
+func TestClientSubnet_Bytes(t *testing.T) {
+	cases := []struct {
+		label  string
+		prefix string
+		scope  uint8
+		want   []byte
+	}{
+		{
+			label:  "ok/ipv4",
+			prefix: "192.0.2.77/24",
+			want:   []byte{0, 1, 24, 0, 192, 0, 2},
+		},
+		{
+			label:  "ok/ipv4-partial-octet",
+			prefix: "198.51.100.255/20",
+			scope:  16,
+			want:   []byte{0, 1, 20, 16, 198, 51, 96},
+		},
+		{
+			label:  "ok/ipv6",
+			prefix: "2001:db8:1:2ff::1/56",
+			want:   []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 2},
+		},
+		{
+			label:  "ok/ipv4-mapped",
+			prefix: "::ffff:192.0.2.1/120",
+			want:   []byte{0, 1, 24, 0, 192, 0, 2},
+		},
+		{
+			label:  "ok/zero-prefix",
+			prefix: "0.0.0.0/0",
+			want:   []byte{0, 1, 0, 0},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			subnet := NewClientSubnet(netip.MustParsePrefix(tc.prefix))
+			subnet.Scope = tc.scope
+
+			// ACT
+			got := subnet.Bytes()
+
+			// ASSERT
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Bytes: mismatch(-want, +got):\n%s", diff)
+			}
+			parsed, err := ParseClientSubnet(got)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if parsed.Prefix != subnet.Prefix || parsed.Scope != tc.scope {
+				t.Errorf("ParseClientSubnet: want %v, got %v", subnet, parsed)
+			}
+		})
+	}
+}
+
+func TestParseClientSubnet(t *testing.T) {
+	cases := []struct {
+		label   string
+		data    []byte
+		wantErr error
+	}{
+		{
+			label:   "Err/too-short",
+			data:    []byte{0, 1, 24},
+			wantErr: ErrInvalidClientSubnet,
+		},
+		{
+			label:   "Err/unknown-family",
+			data:    []byte{0, 3, 0, 0},
+			wantErr: ErrInvalidClientSubnet,
+		},
+		{
+			label:   "Err/source-too-long",
+			data:    []byte{0, 1, 33, 0, 192, 0, 2, 1, 0},
+			wantErr: ErrInvalidClientSubnet,
+		},
+		{
+			label:   "Err/extra-address-octet",
+			data:    []byte{0, 1, 24, 0, 192, 0, 2, 0},
+			wantErr: ErrInvalidClientSubnet,
+		},
+		{
+			label:   "Err/bits-beyond-source",
+			data:    []byte{0, 1, 20, 0, 198, 51, 100},
+			wantErr: ErrInvalidClientSubnet,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ACT
+			_, err := ParseClientSubnet(tc.data)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("ParseClientSubnet: want %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEDNS_ClientSubnet_roundTrip(t *testing.T) {
+	// ARRANGE
+	packet := &Packet{Id: 1, QR: QRQuery, Questions: []*Question{{Qname: "www.example.com.", Qtype: ResourceTypeA, Qclass: ClassIN}}}
+	edns := &EDNS{UDPSize: DefaultEDNSUDPSize}
+	edns.SetClientSubnet(NewClientSubnet(netip.MustParsePrefix("192.0.2.0/24")))
+	packet.SetEDNS(edns)
+	buf, err := packet.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// ACT
+	decoded, err := DecodePacket(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := decoded.EDNS().ClientSubnet()
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got == nil || got.String() != "192.0.2.0/24/0" {
+		t.Errorf("ClientSubnet: want 192.0.2.0/24/0, got %v", got)
+	}
+}
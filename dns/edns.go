@@ -0,0 +1,175 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// EDNS(0) option codes (RFC 6891 section 6.1.2)
+const (
+	EDNSOptionClientSubnet uint16 = 8
+	EDNSOptionKeepalive    uint16 = 11
+	EDNSOptionPadding      uint16 = 12
+)
+
+const (
+	// DefaultEDNSUDPSize is the payload size advertised when none is given.
+	// It is the value agreed on at DNS Flag Day 2020.
+	DefaultEDNSUDPSize = 1232
+	// MinEDNSUDPSize is the smallest payload size a requestor may advertise
+	// (RFC 6891 section 6.2.5).
+	MinEDNSUDPSize = 512
+
+	ednsFlagDO = 1 << 15
+)
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPTData - OPT 疑似レコードの RDATA
+type OPTData struct {
+	Options []*EDNSOption
+}
+
+func (d *OPTData) ResourceType() ResourceType {
+	return ResourceTypeOPT
+}
+
+func (d *OPTData) Bytes() ([]byte, error) {
+	var buf []byte
+	for _, option := range d.Options {
+		if len(option.Data) > MaxMessageLength {
+			return nil, fmt.Errorf("%w: option %d length=%d", ErrMessageTooLong, option.Code, len(option.Data))
+		}
+		buf = binary.BigEndian.AppendUint16(buf, option.Code)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(option.Data)))
+		buf = append(buf, option.Data...)
+	}
+	return withLength(buf)
+}
+
+func (d *OPTData) String() string {
+	var parts []string
+	for _, option := range d.Options {
+		parts = append(parts, fmt.Sprintf("%d:%x", option.Code, option.Data))
+	}
+	return strings.Join(parts, " ")
+}
+
+var _ RData = (*OPTData)(nil)
+
+func decodeOPTData(sc *Scanner, rdLength uint16) (*OPTData, error) {
+	data := &OPTData{}
+	end := sc.Position() + int(rdLength)
+	for sc.Position() < end {
+		code, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		length, err := sc.ReadUint16()
+		if err != nil {
+			return nil, err
+		}
+		if sc.Position()+int(length) > end {
+			return nil, fmt.Errorf("option %d overruns rdata (length=%d)", code, length)
+		}
+		value, err := sc.ReadBytes(int(length))
+		if err != nil {
+			return nil, err
+		}
+		data.Options = append(data.Options, &EDNSOption{Code: code, Data: value})
+	}
+	return data, nil
+}
+
+// EDNS - OPT 疑似レコードの内容 (RFC 6891)
+//
+// In the OPT record, CLASS carries UDPSize and TTL carries the extended
+// RCODE, the version and the flags.
+type EDNS struct {
+	// UDPSize is the largest UDP payload the sender can receive.
+	UDPSize       uint16
+	ExtendedRCode uint8
+	Version       uint8
+	// DO - DNSSEC OK
+	DO      bool
+	Options []*EDNSOption
+}
+
+// Option - code のオプションを返す。なければ nil
+func (e *EDNS) Option(code uint16) *EDNSOption {
+	for _, option := range e.Options {
+		if option.Code == code {
+			return option
+		}
+	}
+	return nil
+}
+
+// SetOption - code のオプションを置き換える。data が nil なら取り除く
+func (e *EDNS) SetOption(code uint16, data []byte) {
+	options := make([]*EDNSOption, 0, len(e.Options)+1)
+	for _, option := range e.Options {
+		if option.Code != code {
+			options = append(options, option)
+		}
+	}
+	if data != nil {
+		options = append(options, &EDNSOption{Code: code, Data: data})
+	}
+	e.Options = options
+}
+
+// record - EDNS を OPT レコードにする
+func (e *EDNS) record() *ResourceRecord {
+	ttl := uint32(e.ExtendedRCode)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= ednsFlagDO
+	}
+	return &ResourceRecord{
+		Name:  ".",
+		Class: Class(e.UDPSize),
+		TTL:   ttl,
+		RData: &OPTData{Options: e.Options},
+	}
+}
+
+// EDNS - additional セクションの OPT レコードを返す。なければ nil
+func (p *Packet) EDNS() *EDNS {
+	for _, rr := range p.Additions {
+		opt, ok := rr.RData.(*OPTData)
+		if !ok {
+			continue
+		}
+		return &EDNS{
+			UDPSize:       uint16(rr.Class),
+			ExtendedRCode: uint8(rr.TTL >> 24),
+			Version:       uint8(rr.TTL >> 16),
+			DO:            rr.TTL&ednsFlagDO != 0,
+			Options:       opt.Options,
+		}
+	}
+	return nil
+}
+
+// SetEDNS - OPT レコードを置き換える。edns が nil なら取り除く
+//
+// The additional section is copied, so packets sharing it are not affected.
+func (p *Packet) SetEDNS(edns *EDNS) {
+	additions := make([]*ResourceRecord, 0, len(p.Additions)+1)
+	for _, rr := range p.Additions {
+		if rr.RData.ResourceType() != ResourceTypeOPT {
+			additions = append(additions, rr)
+		}
+	}
+	if edns != nil {
+		additions = append(additions, edns.record())
+	}
+	if len(additions) == 0 {
+		additions = nil
+	}
+	p.Additions = additions
+}
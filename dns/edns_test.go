@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestPacket_EDNS_roundTrip(t *testing.T) {
+	// ARRANGE
+	packet := &Packet{
+		Id:        4660,
+		QR:        QRQuery,
+		RD:        true,
+		Questions: []*Question{{Qname: "example.com.", Qtype: ResourceTypeA, Qclass: ClassIN}},
+	}
+	want := &EDNS{
+		UDPSize: 1232,
+		Version: 0,
+		DO:      true,
+		Options: []*EDNSOption{
+			{Code: EDNSOptionClientSubnet, Data: []byte{0, 1, 24, 0, 192, 0, 2}},
+			{Code: EDNSOptionPadding, Data: []byte{}},
+		},
+	}
+	packet.SetEDNS(want)
+
+	// ACT
+	buf, err := packet.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoded, err := DecodePacket(buf)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, decoded.EDNS()); diff != "" {
+		t.Errorf("EDNS: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestPacket_SetEDNS(t *testing.T) {
+	// ARRANGE
+	glue := &ResourceRecord{Name: "ns.example.com.", Class: ClassIN, TTL: 300, RData: &AData{Address: []byte{192, 0, 2, 1}}}
+	packet := &Packet{Additions: []*ResourceRecord{glue}}
+	packet.SetEDNS(&EDNS{UDPSize: 4096})
+
+	// ACT
+	packet.SetEDNS(&EDNS{UDPSize: 1232, DO: true})
+
+	// ASSERT
+	if len(packet.Additions) != 2 {
+		t.Fatalf("Additions: want 2 records, got %d", len(packet.Additions))
+	}
+	if edns := packet.EDNS(); edns.UDPSize != 1232 || !edns.DO {
+		t.Errorf("EDNS: want UDPSize=1232 DO=true, got %+v", edns)
+	}
+	packet.SetEDNS(nil)
+	if diff := cmp.Diff([]*ResourceRecord{glue}, packet.Additions); diff != "" {
+		t.Errorf("Additions: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestEDNS_SetOption(t *testing.T) {
+	edns := &EDNS{Options: []*EDNSOption{{Code: EDNSOptionKeepalive, Data: []byte{0, 10}}}}
+
+	edns.SetOption(EDNSOptionKeepalive, []byte{0, 20})
+	if got := edns.Option(EDNSOptionKeepalive); got == nil || got.Data[1] != 20 {
+		t.Errorf("Option: want replaced option, got %+v", got)
+	}
+	edns.SetOption(EDNSOptionKeepalive, nil)
+	if got := edns.Option(EDNSOptionKeepalive); got != nil {
+		t.Errorf("Option: want nil, got %+v", got)
+	}
+}
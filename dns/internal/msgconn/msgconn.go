@@ -0,0 +1,228 @@
+// Package msgconn provides an in-memory net.Conn that answers the DNS
+// messages written to it, for code that expects to dial a DNS server.
+package msgconn
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultBuffer = 16
+
+// RespondFunc - 書き込まれたメッセージ 1 つに答える
+//
+// It is called from Write with the message without its length prefix.
+// reply queues a response to be read and may be called later from another
+// goroutine, or never to let the reader time out. ctx is cancelled once the
+// conn is closed. An error fails the Write.
+type RespondFunc func(ctx context.Context, msg []byte, reply func(res []byte)) error
+
+type Config struct {
+	// Network is "udp" or "tcp". Messages are length-prefixed over "tcp".
+	Network string
+	// Address is the remote address, and LocalAddress the local one.
+	Address      string
+	LocalAddress string
+	// Respond answers the messages.
+	Respond RespondFunc
+	// Buffer is the number of responses waiting to be read before reply
+	// blocks. Defaults to 16.
+	Buffer int
+}
+
+// Addr は Conn のアドレス
+type Addr struct {
+	network string
+	address string
+}
+
+func (a Addr) Network() string { return a.network }
+func (a Addr) String() string  { return a.address }
+
+// Conn は書き込まれたメッセージに RespondFunc で答え、応答を読み出させる net.Conn
+type Conn struct {
+	stream    bool
+	remote    Addr
+	local     Addr
+	respond   RespondFunc
+	ctx       context.Context
+	cancel    context.CancelFunc
+	responses chan []byte
+
+	mu           sync.Mutex
+	written      Splitter
+	unread       []byte // the rest of a response partially read from a stream
+	readDeadline time.Time
+}
+
+// New - ctx が終わるか Close されるまで使える Conn を返す
+func New(ctx context.Context, config Config) *Conn {
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream := IsStream(config.Network)
+	return &Conn{
+		stream:    stream,
+		remote:    Addr{network: config.Network, address: config.Address},
+		local:     Addr{network: config.Network, address: config.LocalAddress},
+		respond:   config.Respond,
+		ctx:       ctx,
+		cancel:    cancel,
+		responses: make(chan []byte, config.Buffer),
+		written:   Splitter{Stream: stream},
+	}
+}
+
+// IsStream - network が長さプレフィックス付きのメッセージを流すか
+func IsStream(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
+
+// Splitter - 書き込まれたバイト列から DNS メッセージを取り出す
+//
+// A datagram is one message. Over a stream the messages are length-prefixed
+// and may arrive in pieces, so the incomplete rest is kept for the next
+// Split. A Splitter is not safe for concurrent use.
+type Splitter struct {
+	Stream bool
+
+	rest []byte // the incomplete message of a stream
+}
+
+// Split - 完全なメッセージを長さプレフィックスなしで返す
+func (s *Splitter) Split(b []byte) [][]byte {
+	if !s.Stream {
+		return [][]byte{append([]byte(nil), b...)}
+	}
+	s.rest = append(s.rest, b...)
+	var messages [][]byte
+	for len(s.rest) >= 2 {
+		size := int(binary.BigEndian.Uint16(s.rest))
+		if len(s.rest) < 2+size {
+			break
+		}
+		messages = append(messages, append([]byte(nil), s.rest[2:2+size]...))
+		s.rest = s.rest[2+size:]
+	}
+	return messages
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	c.mu.Lock()
+	messages := c.written.Split(b)
+	c.mu.Unlock()
+	for _, msg := range messages {
+		if err := c.respond(c.ctx, msg, c.reply); err != nil {
+			return 0, c.opError("write", err)
+		}
+	}
+	return len(b), nil
+}
+
+// reply - 応答を読み出し待ちに積む。閉じられていれば捨てる
+func (c *Conn) reply(res []byte) {
+	if c.stream {
+		res = append(binary.BigEndian.AppendUint16(nil, uint16(len(res))), res...)
+	}
+	select {
+	case c.responses <- res:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.unread) > 0 {
+		n := copy(b, c.unread)
+		c.unread = c.unread[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case msg := <-c.responses:
+		n := copy(b, msg)
+		if c.stream {
+			c.mu.Lock()
+			c.unread = msg[n:]
+			c.mu.Unlock()
+		}
+		// a datagram that does not fit is truncated, as with a socket
+		return n, nil
+	case <-timeout:
+		return 0, c.opError("read", os.ErrDeadlineExceeded)
+	case <-c.ctx.Done():
+		return 0, c.opError("read", net.ErrClosed)
+	}
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.remote.network, Addr: c.remote, Err: err}
+}
+
+func (c *Conn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline - 書き込みはブロックしないので何もしない
+func (c *Conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// PacketConn は datagram 向けに net.PacketConn も実装する
+//
+// net.Resolver tells datagram connections apart by net.PacketConn.
+type PacketConn struct {
+	*Conn
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.remote, err
+}
+
+func (c *PacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+var (
+	_ net.Conn       = (*Conn)(nil)
+	_ net.PacketConn = (*PacketConn)(nil)
+)
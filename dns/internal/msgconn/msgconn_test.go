@@ -0,0 +1,145 @@
+package msgconn
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func echo(_ context.Context, msg []byte, reply func([]byte)) error {
+	reply(msg)
+	return nil
+}
+
+func TestSplitter_Split(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream bool
+		writes [][]byte
+		want   [][]byte
+	}{
+		{
+			name:   "datagram",
+			writes: [][]byte{{1, 2, 3}},
+			want:   [][]byte{{1, 2, 3}},
+		},
+		{
+			name:   "stream of two messages",
+			stream: true,
+			writes: [][]byte{{0, 1, 'a', 0, 2, 'b', 'c'}},
+			want:   [][]byte{{'a'}, {'b', 'c'}},
+		},
+		{
+			name:   "stream in pieces",
+			stream: true,
+			writes: [][]byte{{0}, {2, 'a'}, {'b', 0}},
+			want:   [][]byte{{'a', 'b'}},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// ARRANGE
+			s := Splitter{Stream: tc.stream}
+
+			// ACT
+			var got [][]byte
+			for _, b := range tc.writes {
+				got = append(got, s.Split(b)...)
+			}
+
+			// ASSERT
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Split() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConn_Read_stream(t *testing.T) {
+	// ARRANGE
+	conn := New(context.Background(), Config{Network: "tcp", Respond: echo})
+	defer func() { _ = conn.Close() }()
+
+	// ACT
+	if _, err := conn.Write([]byte{0, 2, 'a'}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := conn.Write([]byte{'b'}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	var got []byte
+	buf := make([]byte, 3)
+	for len(got) < 4 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+
+	// ASSERT
+	if diff := cmp.Diff([]byte{0, 2, 'a', 'b'}, got); diff != "" {
+		t.Errorf("Read() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConn_errors(t *testing.T) {
+	failed := errors.New("failed")
+	cases := []struct {
+		name    string
+		respond RespondFunc
+		act     func(conn *Conn) error
+		want    error
+	}{
+		{
+			name:    "respond fails the write",
+			respond: func(context.Context, []byte, func([]byte)) error { return failed },
+			act: func(conn *Conn) error {
+				_, err := conn.Write([]byte{1})
+				return err
+			},
+			want: failed,
+		},
+		{
+			name:    "read past the deadline",
+			respond: func(context.Context, []byte, func([]byte)) error { return nil },
+			act: func(conn *Conn) error {
+				_ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+				_, err := conn.Read(make([]byte, 1))
+				return err
+			},
+			want: os.ErrDeadlineExceeded,
+		},
+		{
+			name:    "write after close",
+			respond: echo,
+			act: func(conn *Conn) error {
+				_ = conn.Close()
+				_, err := conn.Write([]byte{1})
+				return err
+			},
+			want: net.ErrClosed,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// ARRANGE
+			conn := New(context.Background(), Config{Network: "udp", Respond: tc.respond})
+			defer func() { _ = conn.Close() }()
+
+			// ACT
+			err := tc.act(conn)
+
+			// ASSERT
+			if !errors.Is(err, tc.want) {
+				t.Errorf("error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
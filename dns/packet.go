@@ -1,7 +1,6 @@
 package dns
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -172,26 +171,31 @@ func (p *Packet) Encode() ([]byte, error) {
 		return buf
 	}
 
-	var buf bytes.Buffer
-	buf.Write(encodeBase())
-
+	// names are compressed against the ones written before them
+	c := newCompressor()
+	buf := encodeBase()
 	for _, q := range p.Questions {
-		qBuf, err := q.Bytes()
-		if err != nil {
+		var err error
+		if buf, err = q.appendTo(buf, c); err != nil {
 			return nil, fmt.Errorf("failed to encode the question: %w", err)
 		}
-
-		buf.Write(qBuf)
 	}
 
-	for _, rr := range p.Answers {
-		rrBuf, err := rr.Bytes()
-		if err != nil {
-			return nil, fmt.Errorf("failed to encode the answer: %w", err)
+	sections := []struct {
+		name    string
+		records []*ResourceRecord
+	}{
+		{"answer", p.Answers},
+		{"authority", p.Authorities},
+		{"additional", p.Additions},
+	}
+	for _, section := range sections {
+		for _, rr := range section.records {
+			var err error
+			if buf, err = rr.appendTo(buf, c); err != nil {
+				return nil, fmt.Errorf("failed to encode the %s: %w", section.name, err)
+			}
 		}
-
-		buf.Write(rrBuf)
 	}
-
-	return buf.Bytes(), nil
+	return buf, nil
 }
@@ -32,6 +32,26 @@ func TestPacket_Encode_success(t *testing.T) {
 				0x12, 0x34, 1, 0, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 				6, 'g', 'o', 'o', 'g', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1},
 		},
+		{
+			label: "compressed",
+			input: &Packet{
+				Id: 4660,
+				QR: QRResponse,
+				Questions: []*Question{
+					{Qname: "google.com.", Qtype: ResourceTypeCNAME, Qclass: ClassIN},
+				},
+				Answers: []*ResourceRecord{
+					{Name: "google.com.", Class: ClassIN, TTL: 60, RData: &CNAMEData{Target: "www.google.com."}},
+				},
+			},
+			want: []byte{
+				0x12, 0x34, 0x80, 0, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+				6, 'g', 'o', 'o', 'g', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 3, 0, 1,
+				// the owner name points to the question at offset 12
+				0xc0, 12, 0, 3, 0, 1, 0, 0, 0, 60,
+				// and the target only spells out its first label
+				0, 6, 3, 'w', 'w', 'w', 0xc0, 12},
+		},
 	}
 	for _, tc := range cases {
 		tc := tc
@@ -0,0 +1,133 @@
+package replay
+
+import (
+	"encoding/binary"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/internal/msgconn"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// Recorder - 本物の upstream との通信を記録する DialFunc を提供する
+type Recorder struct {
+	dial func(network, address string) (net.Conn, error)
+
+	mu        sync.Mutex
+	exchanges []*Exchange
+}
+
+type RecorderConfig struct {
+	// Dial connects to the real upstreams. Defaults to net.Dial.
+	Dial func(network, address string) (net.Conn, error)
+}
+
+func NewRecorder(config RecorderConfig) *Recorder {
+	if config.Dial == nil {
+		config.Dial = net.Dial
+	}
+	return &Recorder{dial: config.Dial}
+}
+
+// Dial - client.Config.DialFunc に渡す。接続を流れるメッセージを記録する
+func (r *Recorder) Dial(network, address string) (net.Conn, error) {
+	conn, err := r.dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{
+		Conn:     conn,
+		recorder: r,
+		network:  network,
+		address:  address,
+		pending:  map[uint16]pendingQuery{},
+		written:  msgconn.Splitter{Stream: msgconn.IsStream(network)},
+		received: msgconn.Splitter{Stream: msgconn.IsStream(network)},
+	}, nil
+}
+
+// Exchanges - これまでに記録した通信を返す
+func (r *Recorder) Exchanges() []*Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Exchange(nil), r.exchanges...)
+}
+
+// Save - 記録した通信をフィクスチャファイルに書き込む
+func (r *Recorder) Save(path string) error {
+	return Save(path, r.Exchanges())
+}
+
+func (r *Recorder) add(e *Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges = append(r.exchanges, e)
+}
+
+type pendingQuery struct {
+	query  []byte
+	packet *dns.Packet
+	sent   time.Time
+}
+
+// recordingConn は書き込まれたクエリと読み出された応答を ID で対応付ける
+type recordingConn struct {
+	net.Conn
+	recorder *Recorder
+	network  string
+	address  string
+
+	mu       sync.Mutex
+	pending  map[uint16]pendingQuery
+	written  msgconn.Splitter
+	received msgconn.Splitter
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	messages := c.written.Split(b)
+	now := time.Now()
+	for _, msg := range messages {
+		packet, err := dns.DecodePacket(msg)
+		if err != nil {
+			log.Debugf("recorder: skip undecodable query: %v", err)
+			continue
+		}
+		c.pending[packet.Id] = pendingQuery{query: msg, packet: packet, sent: now}
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 {
+		return n, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := c.received.Split(b[:n])
+	now := time.Now()
+	for _, msg := range messages {
+		if len(msg) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(msg)
+		q, ok := c.pending[id]
+		if !ok {
+			continue
+		}
+		delete(c.pending, id)
+		c.recorder.add(&Exchange{
+			Network:  c.network,
+			Address:  c.address,
+			Question: questionKey(q.packet),
+			Query:    q.query,
+			Response: msg,
+			RTT:      now.Sub(q.sent),
+		})
+	}
+	return n, err
+}
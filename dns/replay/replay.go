@@ -0,0 +1,70 @@
+// Package replay records the exchanges of a client with its upstreams to a
+// fixture file and answers later queries from it, so that tests can run
+// offline and deterministically.
+//
+// Both sides plug into client.Config.DialFunc and see plain DNS messages,
+// so only the UDP and TCP transports can be recorded; the encrypted
+// transports would record TLS records instead.
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotRecorded is returned when a replayed query has no recorded exchange.
+var ErrNotRecorded = errors.New("no recorded exchange")
+
+// Exchange is a query and the response an upstream sent to it.
+type Exchange struct {
+	// Network is "udp" or "tcp", and Address is the upstream dialed.
+	Network string `json:"network"`
+	Address string `json:"address"`
+	// Question is the question of Query, such as "example.com. A IN".
+	// Queries are matched with it on replay.
+	Question string `json:"question"`
+	// Query and Response are the messages without the length prefix of TCP.
+	Query    []byte `json:"query"`
+	Response []byte `json:"response"`
+	// RTT is the time from the query being written to the response being read.
+	RTT time.Duration `json:"rtt"`
+}
+
+// Load - フィクスチャファイルを読み込む
+func Load(path string) ([]*Exchange, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read fixture: %w", err)
+	}
+	var exchanges []*Exchange
+	if err := json.Unmarshal(b, &exchanges); err != nil {
+		return nil, fmt.Errorf("parse fixture %s: %w", path, err)
+	}
+	return exchanges, nil
+}
+
+// Save - フィクスチャファイルに書き込む
+func Save(path string, exchanges []*Exchange) error {
+	b, err := json.MarshalIndent(exchanges, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode fixture: %w", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write fixture: %w", err)
+	}
+	return nil
+}
+
+// questionKey - 照合に使う質問の表記を返す。名前の大文字小文字は区別しない
+func questionKey(packet *dns.Packet) string {
+	keys := make([]string, len(packet.Questions))
+	for i, q := range packet.Questions {
+		keys[i] = fmt.Sprintf("%s %v %v", dns.CanonicalName(q.Qname), q.Qtype, q.Qclass)
+	}
+	return strings.Join(keys, ", ")
+}
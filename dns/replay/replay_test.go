@@ -0,0 +1,217 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answer は名前に応じた応答を作る。big. で始まる名前は UDP では切り詰める
+func answer(query *dns.Packet, stream bool) *dns.Packet {
+	q := query.Questions[0]
+	res := &dns.Packet{Id: query.Id, QR: dns.QRResponse, RD: query.RD, RA: true, Questions: query.Questions}
+	switch {
+	case strings.HasPrefix(q.Qname, "big.") && !stream:
+		res.TC = true
+	case strings.HasPrefix(q.Qname, "big."):
+		for i := 0; i < 20; i++ {
+			res.Answers = append(res.Answers, &dns.ResourceRecord{Name: q.Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.TXTData{Text: strings.Repeat("x", 50)}})
+		}
+	default:
+		res.Answers = []*dns.ResourceRecord{{Name: q.Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}}}
+	}
+	return res
+}
+
+// startServer は UDP と TCP で同じポートを待ち受ける upstream を起動する
+func startServer(t *testing.T) (string, func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		_ = listener.Close()
+		t.Skipf("can not listen on the same UDP port: %v", err)
+	}
+	stop := func() {
+		_ = listener.Close()
+		_ = conn.Close()
+	}
+	t.Cleanup(stop)
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := dns.DecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			res, _ := answer(query, false).Encode()
+			_, _ = conn.WriteTo(res, addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = c.Close() }()
+				msg, err := dns.ReadStreamMessage(c)
+				if err != nil {
+					return
+				}
+				query, err := dns.DecodePacket(msg)
+				if err != nil {
+					return
+				}
+				res, _ := answer(query, true).Encode()
+				_ = dns.WriteStreamMessage(c, res)
+			}()
+		}
+	}()
+	return listener.Addr().String(), stop
+}
+
+func TestReplayer_Dial(t *testing.T) {
+	// ARRANGE
+	address, stop := startServer(t)
+	recorder := NewRecorder(RecorderConfig{})
+	recording := client.New(client.Config{Servers: []string{address}, DialFunc: recorder.Dial})
+	questions := []struct {
+		name  string
+		qtype dns.ResourceType
+	}{
+		{"www.example.com.", dns.ResourceTypeA},
+		{"big.example.com.", dns.ResourceTypeTXT},
+	}
+	var recorded []*client.Response
+	for _, q := range questions {
+		received, err := recording.ExchangeContext(context.Background(), &dns.Packet{
+			QR:        dns.QRQuery,
+			RD:        true,
+			Questions: []*dns.Question{{Qname: q.name, Qtype: q.qtype, Qclass: dns.ClassIN}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		recorded = append(recorded, received)
+	}
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	if err := recorder.Save(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stop()
+
+	exchanges, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	replayer := NewReplayer(ReplayerConfig{Exchanges: exchanges})
+	replaying := client.New(client.Config{Servers: []string{address}, DialFunc: replayer.Dial, Timeout: time.Second})
+
+	for i, q := range questions {
+		t.Run(q.name, func(t *testing.T) {
+			// ACT
+			received, err := replaying.ExchangeContext(context.Background(), &dns.Packet{
+				QR:        dns.QRQuery,
+				RD:        true,
+				Questions: []*dns.Question{{Qname: strings.ToUpper(q.name), Qtype: q.qtype, Qclass: dns.ClassIN}},
+			})
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if received.Network != recorded[i].Network {
+				t.Errorf("Network: want %q, got %q", recorded[i].Network, received.Network)
+			}
+			if diff := cmp.Diff(recorded[i].Packet.Answers, received.Packet.Answers); diff != "" {
+				t.Errorf("Answers: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("Err/not-recorded", func(t *testing.T) {
+		// ACT
+		_, err := replaying.ExchangeContext(context.Background(), &dns.Packet{
+			QR:        dns.QRQuery,
+			RD:        true,
+			Questions: []*dns.Question{{Qname: "missing.example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+		})
+
+		// ASSERT
+		if !errors.Is(err, ErrNotRecorded) {
+			t.Errorf("err: want %v, got %v", ErrNotRecorded, err)
+		}
+	})
+}
+
+func TestRecorder_Exchanges(t *testing.T) {
+	// ARRANGE
+	address, _ := startServer(t)
+	recorder := NewRecorder(RecorderConfig{})
+	c := client.New(client.Config{Servers: []string{address}, DialFunc: recorder.Dial})
+
+	// ACT
+	_, err := c.ExchangeContext(context.Background(), &dns.Packet{
+		QR:        dns.QRQuery,
+		RD:        true,
+		Questions: []*dns.Question{{Qname: "big.example.com.", Qtype: dns.ResourceTypeTXT, Qclass: dns.ClassIN}},
+	})
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, e := range recorder.Exchanges() {
+		got = append(got, e.Network+" "+e.Question)
+		if e.Address != address {
+			t.Errorf("Address: want %q, got %q", address, e.Address)
+		}
+	}
+	want := []string{"udp big.example.com. TXT IN", "tcp big.example.com. TXT IN"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("exchanges: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestReplayer_lookup(t *testing.T) {
+	// ARRANGE
+	r := NewReplayer(ReplayerConfig{Exchanges: []*Exchange{
+		{Network: "udp", Question: "a. A IN", Address: "first"},
+		{Network: "udp", Question: "a. A IN", Address: "second"},
+		{Network: "tcp", Question: "a. A IN", Address: "stream"},
+	}})
+
+	// ACT
+	var got []string
+	for _, network := range []string{"udp", "udp", "udp", "tcp", "tcp4"} {
+		e, ok := r.lookup("a. A IN", network)
+		if !ok {
+			t.Fatalf("lookup: no exchange for %s", network)
+		}
+		got = append(got, e.Address)
+	}
+
+	// ASSERT
+	want := []string{"first", "second", "second", "stream", "stream"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("lookup: mismatch(-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,115 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/internal/msgconn"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replayer - 記録した応答で答える DialFunc を提供する
+type Replayer struct {
+	realtime bool
+
+	mu        sync.Mutex
+	exchanges map[string][]*Exchange
+	// next is the index of the exchange to answer with next, per question
+	// and network
+	next map[string]int
+}
+
+type ReplayerConfig struct {
+	// Exchanges are the recorded exchanges, usually read with Load.
+	Exchanges []*Exchange
+	// Realtime delays each response by its recorded RTT. By default the
+	// responses are ready at once.
+	Realtime bool
+}
+
+func NewReplayer(config ReplayerConfig) *Replayer {
+	r := &Replayer{
+		realtime:  config.Realtime,
+		exchanges: make(map[string][]*Exchange),
+		next:      make(map[string]int),
+	}
+	for _, e := range config.Exchanges {
+		r.exchanges[e.Question] = append(r.exchanges[e.Question], e)
+	}
+	return r
+}
+
+// Dial - client.Config.DialFunc に渡す。address は無視して記録から答える
+func (r *Replayer) Dial(network, address string) (net.Conn, error) {
+	return msgconn.New(context.Background(), msgconn.Config{
+		Network:      network,
+		Address:      address,
+		LocalAddress: "replay",
+		Respond: func(_ context.Context, msg []byte, reply func([]byte)) error {
+			res, e, err := r.respond(msg, network)
+			if err != nil {
+				return err
+			}
+			if !r.realtime {
+				reply(res)
+				return nil
+			}
+			time.AfterFunc(e.RTT, func() { reply(res) })
+			return nil
+		},
+	}), nil
+}
+
+// lookup - 質問に対応する通信を返す
+//
+// Exchanges recorded over the same network are preferred. Repeated queries
+// get the recorded responses in order, and the last one once they run out,
+// so that a recorded retry is replayed as a retry.
+func (r *Replayer) lookup(question, network string) (*Exchange, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	candidates := r.exchanges[question]
+	var matched []*Exchange
+	for _, e := range candidates {
+		if msgconn.IsStream(e.Network) == msgconn.IsStream(network) {
+			matched = append(matched, e)
+		}
+	}
+	if len(matched) == 0 {
+		matched = candidates
+	}
+	if len(matched) == 0 {
+		return nil, false
+	}
+	key := question + "/" + network
+	i := min(r.next[key], len(matched)-1)
+	r.next[key] = i + 1
+	return matched[i], true
+}
+
+// respond - 記録した応答をクエリの ID と質問に合わせて組み立てる
+func (r *Replayer) respond(msg []byte, network string) ([]byte, *Exchange, error) {
+	query, err := dns.DecodePacket(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode query: %w", err)
+	}
+	question := questionKey(query)
+	e, ok := r.lookup(question, network)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotRecorded, question)
+	}
+	res, err := dns.DecodePacket(e.Response)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode recorded response of %s: %w", question, err)
+	}
+	// the ID is random and the case of the name may be randomised too
+	res.Id = query.Id
+	res.Questions = query.Questions
+	buf, err := res.Encode()
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode recorded response of %s: %w", question, err)
+	}
+	return buf, e, nil
+}
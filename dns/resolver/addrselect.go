@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// policy は RFC 6724 section 2.1 の既定のポリシーテーブルの 1 行
+type policy struct {
+	prefix     netip.Prefix
+	precedence int
+	label      int
+}
+
+// policyTable is ordered from the longest prefix so that the first match wins.
+var policyTable = []policy{
+	{netip.MustParsePrefix("::1/128"), 50, 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35, 4},
+	{netip.MustParsePrefix("::/96"), 1, 3},
+	{netip.MustParsePrefix("2001::/32"), 5, 5},
+	{netip.MustParsePrefix("2002::/16"), 30, 2},
+	{netip.MustParsePrefix("3ffe::/16"), 1, 12},
+	{netip.MustParsePrefix("fec0::/10"), 1, 11},
+	{netip.MustParsePrefix("fc00::/7"), 3, 13},
+	{netip.MustParsePrefix("::/0"), 40, 1},
+}
+
+func classify(addr netip.Addr) policy {
+	// IPv4 addresses are looked up as IPv4-mapped IPv6 addresses
+	addr = netip.AddrFrom16(addr.As16())
+	for _, p := range policyTable {
+		if p.prefix.Contains(addr) {
+			return p
+		}
+	}
+	return policyTable[len(policyTable)-1]
+}
+
+// scope values of RFC 4291 section 2.7
+const (
+	scopeLinkLocal = 0x2
+	scopeSiteLocal = 0x5
+	scopeGlobal    = 0xe
+)
+
+func scope(addr netip.Addr) int {
+	addr = addr.Unmap()
+	switch {
+	case addr.IsMulticast() && addr.Is6():
+		return int(addr.As16()[1] & 0x0f)
+	case addr.IsLoopback(), addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast():
+		// 127.0.0.0/8 and 169.254.0.0/16 count as link-local too (RFC 6724 section 3.2)
+		return scopeLinkLocal
+	case addr.Is6() && netip.MustParsePrefix("fec0::/10").Contains(addr):
+		return scopeSiteLocal
+	default:
+		return scopeGlobal
+	}
+}
+
+// commonPrefixLen - IPv6 アドレスの先頭 64 ビットのうち一致するビット数を返す
+func commonPrefixLen(a, b netip.Addr) int {
+	a16, b16 := a.As16(), b.As16()
+	n := 0
+	for i := 0; i < 8; i++ {
+		x := a16[i] ^ b16[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// sourceAddr - dst に送信するときに使われる送信元アドレスを返す
+//
+// Connecting a UDP socket picks the source without sending any packet.
+var sourceAddr = func(dst netip.Addr) (netip.Addr, bool) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	defer func() { _ = conn.Close() }()
+	src := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	return src.Unmap(), src.IsValid()
+}
+
+// sortAddrs - 宛先アドレスを RFC 6724 section 6 の規則で並べる
+//
+// Rules 3, 4 and 7 need information about the interfaces that is not
+// available here and are skipped.
+func sortAddrs(addrs []netip.Addr) {
+	type candidate struct {
+		dst, src netip.Addr
+		hasSrc   bool
+		policy   policy
+		scope    int
+	}
+	candidates := make([]candidate, len(addrs))
+	for i, dst := range addrs {
+		src, ok := sourceAddr(dst)
+		candidates[i] = candidate{dst: dst, src: src, hasSrc: ok, policy: classify(dst), scope: scope(dst)}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		// rule 1: avoid unusable destinations
+		if a.hasSrc != b.hasSrc {
+			return a.hasSrc
+		}
+		if a.hasSrc {
+			// rule 2: prefer matching scope
+			if ma, mb := a.scope == scope(a.src), b.scope == scope(b.src); ma != mb {
+				return ma
+			}
+			// rule 5: prefer matching label
+			if ma, mb := a.policy.label == classify(a.src).label, b.policy.label == classify(b.src).label; ma != mb {
+				return ma
+			}
+		}
+		// rule 6: prefer higher precedence
+		if a.policy.precedence != b.policy.precedence {
+			return a.policy.precedence > b.policy.precedence
+		}
+		// rule 8: prefer smaller scope
+		if a.scope != b.scope {
+			return a.scope < b.scope
+		}
+		// rule 9: use the longest matching prefix, only for IPv6 as the
+		// standard library does, since it would defeat round robin over IPv4
+		if a.hasSrc && b.hasSrc && a.dst.Is6() && b.dst.Is6() {
+			if la, lb := commonPrefixLen(a.dst, a.src), commonPrefixLen(b.dst, b.src); la != lb {
+				return la > lb
+			}
+		}
+		// rule 10: otherwise keep the order
+		return false
+	})
+	for i, c := range candidates {
+		addrs[i] = c.dst
+	}
+}
@@ -0,0 +1,62 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+)
+
+// Querier は 1 つの名前とタイプを問い合わせる。client.Client と Resolver が実装する
+type Querier interface {
+	ResolveContext(ctx context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error)
+}
+
+// Answer is the result of a lookup that followed CNAME and DNAME records.
+type Answer struct {
+	// Name is the canonical name the chain ended at.
+	Name string
+	// Chain holds the CNAME and DNAME records in the order they were followed.
+	Chain []*dns.ResourceRecord
+	// Records is the RRset of the requested type at Name. It is empty for NXDOMAIN and NODATA.
+	Records []*dns.ResourceRecord
+	// RCode is the response code for Name.
+	RCode int
+	// Packet is the last response that was received.
+	Packet *dns.Packet
+}
+
+// Lookup - 別名をたどりながら問い合わせ、別名の連鎖と最終的な RRset を返す
+//
+// Upstreams often return the whole chain in one answer, so a new query is
+// only sent when the answer stops before the final RRset.
+func Lookup(ctx context.Context, querier Querier, name string, resourceType dns.ResourceType, maxChain int) (*Answer, error) {
+	chain := &dns.AliasChain{Max: maxChain}
+	current := dns.Fqdn(name)
+	for {
+		received, err := querier.ResolveContext(ctx, current, resourceType)
+		if err != nil {
+			return nil, err
+		}
+
+		target, rrset, err := chain.Follow(received.Answers, current, resourceType)
+		if err != nil {
+			return nil, fmt.Errorf("lookup name=%v resourceType=%v: %w", name, resourceType, err)
+		}
+		// a CNAME or DNAME query is answered by the alias itself
+		if rrset != nil || target == current || resourceType == dns.ResourceTypeCNAME || resourceType == dns.ResourceTypeDNAME {
+			return &Answer{
+				Name:    target,
+				Chain:   chain.Records,
+				Records: rrset,
+				RCode:   received.RCode,
+				Packet:  received,
+			}, nil
+		}
+		current = target
+	}
+}
+
+// LookupContext - ルートから反復問い合わせし、別名の連鎖をたどる
+func (r *Resolver) LookupContext(ctx context.Context, name string, resourceType dns.ResourceType) (*Answer, error) {
+	return Lookup(ctx, r, name, resourceType, r.maxChain)
+}
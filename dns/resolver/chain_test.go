@@ -0,0 +1,98 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"testing"
+)
+
+// stubQuerier は名前ごとに決まった応答を返す
+type stubQuerier map[string][]*dns.ResourceRecord
+
+func (q stubQuerier) ResolveContext(_ context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+	answers, ok := q[name]
+	if !ok {
+		return nil, errors.New("unexpected query: " + name)
+	}
+	res := &dns.Packet{
+		QR:        dns.QRResponse,
+		Questions: []*dns.Question{{Qname: name, Qtype: resourceType, Qclass: dns.ClassIN}},
+		Answers:   answers,
+	}
+	if answers == nil {
+		res.RCode = dns.RCodeNameError
+	}
+	return res, nil
+}
+
+func TestLookup(t *testing.T) {
+	cname := func(owner, target string) *dns.ResourceRecord {
+		return &dns.ResourceRecord{Name: owner, Class: dns.ClassIN, TTL: 60, RData: &dns.CNAMEData{Target: target}}
+	}
+	a := &dns.ResourceRecord{Name: "c.example.org.", Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}}
+
+	t.Run("ok/chain-across-responses", func(t *testing.T) {
+		// ARRANGE
+		querier := stubQuerier{
+			"a.example.com.": {cname("a.example.com.", "b.example.net.")},
+			"b.example.net.": {cname("b.example.net.", "c.example.org."), a},
+		}
+
+		// ACT
+		answer, err := Lookup(context.Background(), querier, "a.example.com", dns.ResourceTypeA, 0)
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := &Answer{
+			Name:    "c.example.org.",
+			Chain:   []*dns.ResourceRecord{cname("a.example.com.", "b.example.net."), cname("b.example.net.", "c.example.org.")},
+			Records: []*dns.ResourceRecord{a},
+		}
+		if diff := cmp.Diff(want, answer, cmpIgnorePacket); diff != "" {
+			t.Errorf("answer: mismatch(-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ok/dangling-alias", func(t *testing.T) {
+		// ARRANGE
+		querier := stubQuerier{
+			"a.example.com.":    {cname("a.example.com.", "gone.example.net.")},
+			"gone.example.net.": nil,
+		}
+
+		// ACT
+		answer, err := Lookup(context.Background(), querier, "a.example.com", dns.ResourceTypeA, 0)
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if answer.Name != "gone.example.net." || answer.RCode != dns.RCodeNameError || len(answer.Chain) != 1 {
+			t.Errorf("answer: got %+v", answer)
+		}
+	})
+
+	t.Run("Err/loop-across-responses", func(t *testing.T) {
+		// ARRANGE
+		querier := stubQuerier{
+			"a.example.com.": {cname("a.example.com.", "b.example.net.")},
+			"b.example.net.": {cname("b.example.net.", "a.example.com.")},
+		}
+
+		// ACT
+		_, err := Lookup(context.Background(), querier, "a.example.com", dns.ResourceTypeA, 0)
+
+		// ASSERT
+		if !errors.Is(err, dns.ErrAliasLoop) {
+			t.Errorf("err: want %v, got %v", dns.ErrAliasLoop, err)
+		}
+	})
+}
+
+var cmpIgnorePacket = cmp.FilterPath(func(p cmp.Path) bool {
+	return p.Last().String() == ".Packet"
+}, cmp.Ignore())
@@ -0,0 +1,215 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"math/rand"
+	"net/netip"
+	"sort"
+)
+
+var (
+	// ErrNotFound is returned when the name does not exist or has no record of the type.
+	ErrNotFound = errors.New("no such host")
+	// ErrServerMisbehaving is returned when the answer has an error code other than NXDOMAIN.
+	ErrServerMisbehaving = errors.New("server misbehaving")
+)
+
+// lookupRecords - 別名をたどって name の rrType の RRset を返す
+func lookupRecords(ctx context.Context, querier Querier, name string, rrType dns.ResourceType) (*Answer, error) {
+	answer, err := Lookup(ctx, querier, name, rrType, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case answer.RCode == dns.RCodeNameError:
+		return nil, fmt.Errorf("lookup %s: %w", name, ErrNotFound)
+	case answer.RCode != dns.RCodeNoError:
+		return nil, fmt.Errorf("lookup %s: %w (rcode=%d)", name, ErrServerMisbehaving, answer.RCode)
+	case len(answer.Records) == 0:
+		return nil, fmt.Errorf("lookup %s %v: %w", name, rrType, ErrNotFound)
+	}
+	return answer, nil
+}
+
+// LookupHost - host のアドレスを文字列で返す
+func LookupHost(ctx context.Context, querier Querier, host string) ([]string, error) {
+	addrs, err := LookupIP(ctx, querier, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	dest := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		dest = append(dest, addr.String())
+	}
+	return dest, nil
+}
+
+// LookupIP - host の A と AAAA を並行して問い合わせ、RFC 6724 の優先順で返す
+//
+// network is "ip", "ip4" or "ip6" as in net.Resolver.LookupNetIP. An
+// address literal is returned as is. The lookup succeeds when either family
+// has an address.
+func LookupIP(ctx context.Context, querier Querier, network string, host string) ([]netip.Addr, error) {
+	var rrTypes []dns.ResourceType
+	switch network {
+	case "ip":
+		rrTypes = []dns.ResourceType{dns.ResourceTypeA, dns.ResourceTypeAAAA}
+	case "ip4":
+		rrTypes = []dns.ResourceType{dns.ResourceTypeA}
+	case "ip6":
+		rrTypes = []dns.ResourceType{dns.ResourceTypeAAAA}
+	default:
+		return nil, fmt.Errorf("lookup %s: unsupported network %q", host, network)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	results := make([]chan result, len(rrTypes))
+	for i, rrType := range rrTypes {
+		results[i] = make(chan result, 1)
+		go func(ch chan<- result) {
+			answer, err := lookupRecords(ctx, querier, host, rrType)
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			var addrs []netip.Addr
+			for _, rr := range answer.Records {
+				var addr netip.Addr
+				switch rdata := rr.RData.(type) {
+				case *dns.AData:
+					addr, _ = netip.AddrFromSlice(rdata.Address)
+				case *dns.AAAAData:
+					addr, _ = netip.AddrFromSlice(rdata.Address)
+				}
+				if addr.IsValid() {
+					addrs = append(addrs, addr)
+				}
+			}
+			ch <- result{addrs: addrs}
+		}(results[i])
+	}
+
+	var addrs []netip.Addr
+	var errs []error
+	for _, ch := range results {
+		r := <-ch
+		addrs = append(addrs, r.addrs...)
+		if r.err != nil {
+			errs = append(errs, r.err)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	sortAddrs(addrs)
+	return addrs, nil
+}
+
+// LookupMX - name の MX を優先度の順に返す
+//
+// Records of the same preference are shuffled to spread the load.
+func LookupMX(ctx context.Context, querier Querier, name string) ([]*dns.MXData, error) {
+	answer, err := lookupRecords(ctx, querier, name, dns.ResourceTypeMX)
+	if err != nil {
+		return nil, err
+	}
+	var dest []*dns.MXData
+	for _, rr := range answer.Records {
+		dest = append(dest, rr.RData.(*dns.MXData))
+	}
+	rand.Shuffle(len(dest), func(i, j int) { dest[i], dest[j] = dest[j], dest[i] })
+	sort.SliceStable(dest, func(i, j int) bool { return dest[i].Preference < dest[j].Preference })
+	return dest, nil
+}
+
+// LookupSRV - _service._proto.name の SRV を RFC 2782 の順序で返す
+//
+// When both service and proto are empty, name is looked up directly. The
+// returned cname is the name the records were found at.
+func LookupSRV(ctx context.Context, querier Querier, service, proto, name string) (string, []*dns.SRVData, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	answer, err := lookupRecords(ctx, querier, target, dns.ResourceTypeSRV)
+	if err != nil {
+		return "", nil, err
+	}
+	var dest []*dns.SRVData
+	for _, rr := range answer.Records {
+		dest = append(dest, rr.RData.(*dns.SRVData))
+	}
+	orderSRV(dest, rand.Intn)
+	return answer.Name, dest, nil
+}
+
+// orderSRV - 優先度の順に並べ、同じ優先度の中では重みに比例した確率で選ぶ (RFC 2782)
+func orderSRV(records []*dns.SRVData, intn func(int) int) {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && records[end].Priority == records[start].Priority {
+			end++
+		}
+		group := records[start:end]
+		// records of weight zero come first so that they have a small
+		// chance of being picked
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Weight == 0 && group[j].Weight != 0 })
+		for i := range group {
+			total := 0
+			for _, rr := range group[i:] {
+				total += int(rr.Weight)
+			}
+			pick := intn(total + 1)
+			sum := 0
+			for j, rr := range group[i:] {
+				sum += int(rr.Weight)
+				if sum >= pick {
+					// move the pick forward, keeping the order of the rest
+					copy(group[i+1:i+j+1], group[i:i+j])
+					group[i] = rr
+					break
+				}
+			}
+		}
+		start = end
+	}
+}
+
+// LookupTXT - name の TXT を返す
+func LookupTXT(ctx context.Context, querier Querier, name string) ([]string, error) {
+	answer, err := lookupRecords(ctx, querier, name, dns.ResourceTypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var dest []string
+	for _, rr := range answer.Records {
+		dest = append(dest, rr.RData.(*dns.TXTData).Text)
+	}
+	return dest, nil
+}
+
+// LookupAddr - addr を逆引きし、名前の一覧を返す
+func LookupAddr(ctx context.Context, querier Querier, addr netip.Addr) ([]string, error) {
+	if !addr.IsValid() {
+		return nil, fmt.Errorf("lookup %v: invalid address", addr)
+	}
+	answer, err := lookupRecords(ctx, querier, dns.ReverseName(addr), dns.ResourceTypePTR)
+	if err != nil {
+		return nil, err
+	}
+	var dest []string
+	for _, rr := range answer.Records {
+		dest = append(dest, dns.Fqdn(rr.RData.(*dns.PTRData).Host))
+	}
+	return dest, nil
+}
@@ -0,0 +1,256 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"net/netip"
+	"testing"
+)
+
+// typedQuerier は名前とタイプごとに決まった応答を返す。登録のない名前は NXDOMAIN
+type typedQuerier map[string][]*dns.ResourceRecord
+
+func (q typedQuerier) ResolveContext(_ context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+	res := &dns.Packet{
+		QR:        dns.QRResponse,
+		Questions: []*dns.Question{{Qname: name, Qtype: resourceType, Qclass: dns.ClassIN}},
+	}
+	answers, ok := q[name+" "+resourceType.String()]
+	if !ok {
+		res.RCode = dns.RCodeNameError
+	}
+	res.Answers = answers
+	return res, nil
+}
+
+func rr(name string, rdata dns.RData) *dns.ResourceRecord {
+	return &dns.ResourceRecord{Name: name, Class: dns.ClassIN, TTL: 60, RData: rdata}
+}
+
+// stubSources は宛先アドレスの種類ごとに送信元を決める
+func stubSources(t *testing.T, v4, v6 string) {
+	t.Helper()
+	original := sourceAddr
+	t.Cleanup(func() { sourceAddr = original })
+	sourceAddr = func(dst netip.Addr) (netip.Addr, bool) {
+		src := v6
+		if dst.Is4() {
+			src = v4
+		}
+		if src == "" {
+			return netip.Addr{}, false
+		}
+		return netip.MustParseAddr(src), true
+	}
+}
+
+func TestLookupIP(t *testing.T) {
+	querier := typedQuerier{
+		"dual.example.com. A":    {rr("dual.example.com.", &dns.AData{Address: []byte{192, 0, 2, 1}})},
+		"dual.example.com. AAAA": {rr("dual.example.com.", &dns.AAAAData{Address: netip.MustParseAddr("2001:db8::1").AsSlice()})},
+		"v4.example.com. A":      {rr("v4.example.com.", &dns.AData{Address: []byte{192, 0, 2, 2}})},
+		"v4.example.com. AAAA":   {},
+	}
+	cases := []struct {
+		label   string
+		network string
+		host    string
+		v4, v6  string
+		want    []netip.Addr
+		wantErr error
+	}{
+		{label: "ok/ipv6-preferred", network: "ip", host: "dual.example.com.", v4: "192.0.2.100", v6: "2001:db8::100",
+			want: []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}},
+		{label: "ok/ipv6-unreachable", network: "ip", host: "dual.example.com.", v4: "192.0.2.100",
+			want: []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}},
+		{label: "ok/ip4-only", network: "ip4", host: "dual.example.com.", v4: "192.0.2.100",
+			want: []netip.Addr{netip.MustParseAddr("192.0.2.1")}},
+		{label: "ok/one-family-nodata", network: "ip", host: "v4.example.com.", v4: "192.0.2.100", v6: "2001:db8::100",
+			want: []netip.Addr{netip.MustParseAddr("192.0.2.2")}},
+		{label: "ok/literal", network: "ip", host: "2001:db8::5", want: []netip.Addr{netip.MustParseAddr("2001:db8::5")}},
+		{label: "Err/nxdomain", network: "ip", host: "missing.example.com.", wantErr: ErrNotFound},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			stubSources(t, tc.v4, tc.v6)
+
+			// ACT
+			got, err := LookupIP(context.Background(), querier, tc.network, tc.host)
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err: want %v, got %v", tc.wantErr, err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+				t.Errorf("LookupIP: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSortAddrs(t *testing.T) {
+	// ARRANGE
+	stubSources(t, "192.0.2.100", "2001:db8:1::100")
+	addrs := []netip.Addr{
+		netip.MustParseAddr("198.51.100.1"),
+		netip.MustParseAddr("2001:db8:2::1"),
+		netip.MustParseAddr("2001:db8:1::1"),
+	}
+
+	// ACT
+	sortAddrs(addrs)
+
+	// ASSERT
+	want := []netip.Addr{
+		// the longer prefix shared with the source wins
+		netip.MustParseAddr("2001:db8:1::1"),
+		netip.MustParseAddr("2001:db8:2::1"),
+		// IPv4 has a lower precedence
+		netip.MustParseAddr("198.51.100.1"),
+	}
+	if diff := cmp.Diff(want, addrs, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("sortAddrs: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestLookupMX(t *testing.T) {
+	// ARRANGE
+	querier := typedQuerier{
+		"example.com. MX": {
+			rr("example.com.", &dns.MXData{Preference: 20, Exchange: "backup.example.com."}),
+			rr("example.com.", &dns.MXData{Preference: 10, Exchange: "mx1.example.com."}),
+			rr("example.com.", &dns.MXData{Preference: 30, Exchange: "last.example.com."}),
+		},
+	}
+
+	// ACT
+	got, err := LookupMX(context.Background(), querier, "example.com.")
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var preferences []uint16
+	for _, mx := range got {
+		preferences = append(preferences, mx.Preference)
+	}
+	if diff := cmp.Diff([]uint16{10, 20, 30}, preferences); diff != "" {
+		t.Errorf("preferences: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	// ARRANGE
+	querier := typedQuerier{
+		"_sip._udp.example.com. SRV": {
+			rr("_sip._udp.example.com.", &dns.SRVData{Priority: 20, Weight: 0, Port: 5060, Target: "backup.example.com."}),
+			rr("_sip._udp.example.com.", &dns.SRVData{Priority: 10, Weight: 60, Port: 5060, Target: "a.example.com."}),
+		},
+	}
+
+	// ACT
+	cname, got, err := LookupSRV(context.Background(), querier, "sip", "udp", "example.com.")
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cname != "_sip._udp.example.com." {
+		t.Errorf("cname: want %q, got %q", "_sip._udp.example.com.", cname)
+	}
+	if len(got) != 2 || got[0].Target != "a.example.com." || got[1].Target != "backup.example.com." {
+		t.Errorf("records: want a.example.com. then backup.example.com., got %v", got)
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := func() []*dns.SRVData {
+		return []*dns.SRVData{
+			{Priority: 10, Weight: 10, Target: "a."},
+			{Priority: 10, Weight: 0, Target: "zero."},
+			{Priority: 10, Weight: 30, Target: "b."},
+			{Priority: 5, Weight: 0, Target: "first."},
+		}
+	}
+	cases := []struct {
+		label string
+		// picks are the random numbers drawn in order
+		picks []int
+		want  []string
+	}{
+		// the running sums are zero.=0, a.=10, b.=40
+		{label: "pick-zero-weight", picks: []int{0, 0, 0, 0}, want: []string{"first.", "zero.", "a.", "b."}},
+		{label: "pick-by-weight", picks: []int{0, 35, 0, 0}, want: []string{"first.", "b.", "zero.", "a."}},
+		{label: "pick-first-positive", picks: []int{0, 1, 20, 0}, want: []string{"first.", "a.", "b.", "zero."}},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			got := records()
+			picks := tc.picks
+
+			// ACT
+			orderSRV(got, func(n int) int {
+				pick := picks[0]
+				picks = picks[1:]
+				if pick >= n {
+					t.Fatalf("pick %d out of range %d", pick, n)
+				}
+				return pick
+			})
+
+			// ASSERT
+			var targets []string
+			for _, srv := range got {
+				targets = append(targets, srv.Target)
+			}
+			if diff := cmp.Diff(tc.want, targets); diff != "" {
+				t.Errorf("order: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLookupTXT(t *testing.T) {
+	// ARRANGE
+	querier := typedQuerier{
+		"example.com. TXT": {rr("example.com.", &dns.TXTData{Text: "v=spf1 -all"})},
+	}
+
+	// ACT
+	got, err := LookupTXT(context.Background(), querier, "example.com.")
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"v=spf1 -all"}, got); diff != "" {
+		t.Errorf("LookupTXT: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestLookupAddr(t *testing.T) {
+	// ARRANGE
+	querier := typedQuerier{
+		"1.2.0.192.in-addr.arpa. PTR": {rr("1.2.0.192.in-addr.arpa.", &dns.PTRData{Host: "host.example.com."})},
+	}
+
+	// ACT
+	got, err := LookupAddr(context.Background(), querier, netip.MustParseAddr("192.0.2.1"))
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"host.example.com."}, got); diff != "" {
+		t.Errorf("LookupAddr: mismatch(-want, +got):\n%s", diff)
+	}
+	if _, err := LookupAddr(context.Background(), querier, netip.MustParseAddr("192.0.2.2")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("err: want %v, got %v", ErrNotFound, err)
+	}
+}
@@ -0,0 +1,353 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+var (
+	// ErrMaxDepth is returned when nested lookups of name server addresses go too deep.
+	ErrMaxDepth = errors.New("maximum depth exceeded")
+	// ErrMaxQueries is returned when a resolution sends too many queries.
+	ErrMaxQueries = errors.New("maximum number of queries exceeded")
+	// ErrLoop is returned when a referral or a name server lookup leads back to itself.
+	ErrLoop = errors.New("delegation loop")
+	// ErrLameDelegation is returned when no server of a zone answers authoritatively.
+	ErrLameDelegation = errors.New("lame delegation")
+	// ErrNoReachableServer is returned when no server of a zone could be reached.
+	ErrNoReachableServer = errors.New("no reachable server")
+)
+
+// DefaultRootHints are the IPv4 addresses of the root servers a.root-servers.net to m.root-servers.net.
+var DefaultRootHints = []string{
+	"198.41.0.4",
+	"170.247.170.2",
+	"192.33.4.12",
+	"199.7.91.13",
+	"192.203.230.10",
+	"192.5.5.241",
+	"192.112.36.4",
+	"198.97.190.53",
+	"192.36.148.17",
+	"192.58.128.30",
+	"193.0.14.129",
+	"199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	defaultMaxDepth   = 8
+	defaultMaxQueries = 100
+)
+
+// Resolver はルートから委任をたどって名前解決する反復リゾルバ
+type Resolver struct {
+	rootHints  []string
+	client     *client.Client
+	maxDepth   int
+	maxQueries int
+	maxChain   int
+	minimise   bool
+}
+
+type Config struct {
+	// RootHints are the addresses of the root servers. Defaults to DefaultRootHints.
+	RootHints []string
+	// Client sends the queries to the authoritative servers.
+	Client *client.Client
+	// MaxDepth limits how deeply the addresses of glueless name servers are chased.
+	MaxDepth int
+	// MaxQueries limits the number of queries sent for a single resolution.
+	MaxQueries int
+	// MaxChain limits the number of CNAME and DNAME records LookupContext follows.
+	MaxChain int
+	// DisableQNAMEMinimisation sends the full query name to every server.
+	DisableQNAMEMinimisation bool
+}
+
+func New(config Config) *Resolver {
+	if len(config.RootHints) == 0 {
+		config.RootHints = DefaultRootHints
+	}
+	if config.Client == nil {
+		config.Client = client.New(client.Config{
+			Timeout: 2 * time.Second,
+		})
+	}
+	if config.MaxDepth == 0 {
+		config.MaxDepth = defaultMaxDepth
+	}
+	if config.MaxQueries == 0 {
+		config.MaxQueries = defaultMaxQueries
+	}
+
+	var rootHints []string
+	for _, hint := range config.RootHints {
+		address, err := client.ParseUpstream(hint, 53)
+		if err != nil {
+			log.Warnf("root hint=%q: %v", hint, err)
+			continue
+		}
+		rootHints = append(rootHints, address)
+	}
+
+	return &Resolver{
+		rootHints:  rootHints,
+		client:     config.Client,
+		maxDepth:   config.MaxDepth,
+		maxQueries: config.MaxQueries,
+		maxChain:   config.MaxChain,
+		minimise:   !config.DisableQNAMEMinimisation,
+	}
+}
+
+// state は 1 回の名前解決で共有される状態
+type state struct {
+	queries int
+	// resolving は解決中の名前とタイプ。循環の検出に使う
+	resolving map[string]struct{}
+}
+
+// delegation はあるゾーンの権威サーバーの集合
+type delegation struct {
+	zone string
+	// servers はアドレスが分かっているサーバー
+	servers []string
+	// glueless はアドレスを別途解決する必要があるサーバー名
+	glueless []string
+}
+
+func (r *Resolver) Resolve(name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+	return r.ResolveContext(context.Background(), name, resourceType)
+}
+
+// ResolveContext - ルートヒントから反復問い合わせで名前解決する
+func (r *Resolver) ResolveContext(ctx context.Context, name string, resourceType dns.ResourceType) (*dns.Packet, error) {
+	st := &state{resolving: make(map[string]struct{})}
+	received, err := r.resolve(ctx, st, dns.Fqdn(name), resourceType, 0)
+	if err != nil {
+		return nil, fmt.Errorf("resolve name=%v resourceType=%v: %w", name, resourceType, err)
+	}
+	return received, nil
+}
+
+func (r *Resolver) resolve(ctx context.Context, st *state, qname string, qtype dns.ResourceType, depth int) (*dns.Packet, error) {
+	if depth >= r.maxDepth {
+		return nil, fmt.Errorf("%w: depth=%d", ErrMaxDepth, depth)
+	}
+	key := fmt.Sprintf("%s/%v", dns.CanonicalName(qname), qtype)
+	if _, ok := st.resolving[key]; ok {
+		return nil, fmt.Errorf("%w: %s %v depends on itself", ErrLoop, qname, qtype)
+	}
+	st.resolving[key] = struct{}{}
+	defer delete(st.resolving, key)
+
+	d := &delegation{zone: ".", servers: r.rootHints}
+	visited := map[string]struct{}{".": {}}
+	labels := dns.CountLabels(qname)
+	// asked は QNAME minimisation で次に問い合わせるラベル数
+	asked := 1
+	for {
+		sendName, sendType := qname, qtype
+		minimised := r.minimise && asked < labels
+		if minimised {
+			// RFC 9156 3: hide the original type behind A
+			sendName, sendType = dns.ParentLabels(qname, asked), dns.ResourceTypeA
+		}
+
+		received, err := r.queryZone(ctx, st, d, sendName, sendType, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		if cut, hosts := referral(received, d.zone, sendName); cut != "" {
+			if _, ok := visited[cut]; ok {
+				return nil, fmt.Errorf("%w: referral to %s again", ErrLoop, cut)
+			}
+			visited[cut] = struct{}{}
+			log.Debugf("referral from %s to %s for %s", d.zone, cut, qname)
+			d = newDelegation(received, d.zone, cut, hosts)
+			asked = dns.CountLabels(cut) + 1
+			continue
+		}
+
+		if minimised {
+			if received.RCode == dns.RCodeNameError {
+				// RFC 8020: nothing exists below a name that does not exist
+				return &dns.Packet{
+					Id:          received.Id,
+					QR:          dns.QRResponse,
+					AA:          received.AA,
+					RCode:       dns.RCodeNameError,
+					Questions:   []*dns.Question{{Qname: qname, Qtype: qtype, Qclass: dns.ClassIN}},
+					Authorities: received.Authorities,
+				}, nil
+			}
+			// no zone cut at sendName, so ask the same servers one label deeper
+			asked++
+			continue
+		}
+		return received, nil
+	}
+}
+
+// queryZone - ゾーンの権威サーバーに順に問い合わせ、最初の有効な応答を返す
+func (r *Resolver) queryZone(ctx context.Context, st *state, d *delegation, name string, rrType dns.ResourceType, depth int) (*dns.Packet, error) {
+	query := &dns.Packet{
+		QR:     dns.QRQuery,
+		Opcode: dns.OpcodeQuery,
+		Questions: []*dns.Question{
+			{Qname: name, Qtype: rrType, Qclass: dns.ClassIN},
+		},
+	}
+
+	lame := 0
+	var lastErr error
+	tryServers := func(servers []string) (*dns.Packet, error) {
+		for _, server := range servers {
+			if st.queries >= r.maxQueries {
+				return nil, fmt.Errorf("%w: limit=%d", ErrMaxQueries, r.maxQueries)
+			}
+			st.queries++
+			received, err := r.client.ExchangeServer(ctx, server, query)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				log.Debugf("zone=%s server=%s: %v", d.zone, server, err)
+				lastErr = err
+				continue
+			}
+			if isLame(received.Packet, d.zone, name) {
+				log.Debugf("zone=%s server=%s: lame response rcode=%d", d.zone, server, received.Packet.RCode)
+				lame++
+				continue
+			}
+			return received.Packet, nil
+		}
+		return nil, nil
+	}
+
+	if received, err := tryServers(d.servers); received != nil || err != nil {
+		return received, err
+	}
+	for _, host := range d.glueless {
+		servers, err := r.lookupAddresses(ctx, st, host, depth+1)
+		if err != nil {
+			if errors.Is(err, ErrMaxQueries) || errors.Is(err, ErrMaxDepth) || ctx.Err() != nil {
+				return nil, err
+			}
+			log.Debugf("zone=%s: failed to resolve name server %s: %v", d.zone, host, err)
+			lastErr = err
+			continue
+		}
+		if received, err := tryServers(servers); received != nil || err != nil {
+			return received, err
+		}
+	}
+
+	switch {
+	case lastErr != nil && errors.Is(lastErr, ErrLoop):
+		return nil, lastErr
+	case lame > 0:
+		return nil, fmt.Errorf("%w: zone=%s", ErrLameDelegation, d.zone)
+	case lastErr != nil:
+		return nil, fmt.Errorf("%w: zone=%s: %w", ErrNoReachableServer, d.zone, lastErr)
+	default:
+		return nil, fmt.Errorf("%w: zone=%s", ErrNoReachableServer, d.zone)
+	}
+}
+
+// lookupAddresses - グルーのないネームサーバーのアドレスを解決する
+func (r *Resolver) lookupAddresses(ctx context.Context, st *state, host string, depth int) ([]string, error) {
+	received, err := r.resolve(ctx, st, host, dns.ResourceTypeA, depth)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, rr := range received.Answers {
+		if a, ok := rr.RData.(*dns.AData); ok {
+			servers = append(servers, net.JoinHostPort(a.String(), "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%w: name server %s has no address", ErrNoReachableServer, host)
+	}
+	return servers, nil
+}
+
+// referral - 応答が zone より深いゾーンへの委任であれば、そのゾーン名と NS を返す
+func referral(res *dns.Packet, zone string, name string) (string, []string) {
+	if res.RCode != dns.RCodeNoError || len(res.Answers) > 0 {
+		return "", nil
+	}
+	var cut string
+	var hosts []string
+	for _, rr := range res.Authorities {
+		ns, ok := rr.RData.(*dns.NSData)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(rr.Name)
+		if owner == dns.CanonicalName(zone) || !dns.IsSubDomain(owner, zone) || !dns.IsSubDomain(name, owner) {
+			// upward or sideways referrals are not progress
+			continue
+		}
+		if cut != "" && cut != owner {
+			continue
+		}
+		cut = owner
+		hosts = append(hosts, dns.CanonicalName(ns.Host))
+	}
+	return cut, hosts
+}
+
+// newDelegation - 委任先のサーバーをグルーから組み立てる
+//
+// Glue is only trusted for names inside the zone of the server that sent
+// it, so a server cannot inject addresses for names it is not authoritative for.
+func newDelegation(res *dns.Packet, parent string, cut string, hosts []string) *delegation {
+	d := &delegation{zone: cut}
+	for _, host := range hosts {
+		var servers []string
+		if dns.IsSubDomain(host, parent) {
+			for _, rr := range res.Additions {
+				if dns.CanonicalName(rr.Name) != host {
+					continue
+				}
+				switch data := rr.RData.(type) {
+				case *dns.AData:
+					servers = append(servers, net.JoinHostPort(data.String(), "53"))
+				case *dns.AAAAData:
+					servers = append(servers, net.JoinHostPort(data.String(), "53"))
+				}
+			}
+		}
+		if len(servers) == 0 {
+			d.glueless = append(d.glueless, host)
+			continue
+		}
+		d.servers = append(d.servers, servers...)
+	}
+	return d
+}
+
+// isLame - 問い合わせたゾーンについて権威を持たない応答かどうか
+func isLame(res *dns.Packet, zone string, name string) bool {
+	if res.RCode != dns.RCodeNoError && res.RCode != dns.RCodeNameError {
+		return true
+	}
+	if res.AA {
+		return false
+	}
+	if cut, _ := referral(res, zone, name); cut != "" {
+		return false
+	}
+	return true
+}
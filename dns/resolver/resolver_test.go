@@ -0,0 +1,266 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeZone はテスト用の権威ゾーン
+type fakeZone struct {
+	origin  string
+	records []*dns.ResourceRecord
+}
+
+// fakeServer はテスト用の権威サーバー。refuse の場合はすべて REFUSED を返す
+type fakeServer struct {
+	zones  []*fakeZone
+	refuse bool
+}
+
+func (s *fakeServer) answer(query *dns.Packet) *dns.Packet {
+	q := query.Questions[0]
+	name := dns.CanonicalName(q.Qname)
+	res := &dns.Packet{
+		Id:        query.Id,
+		QR:        dns.QRResponse,
+		Questions: query.Questions,
+	}
+	var zone *fakeZone
+	for _, z := range s.zones {
+		if dns.IsSubDomain(name, z.origin) && (zone == nil || len(z.origin) > len(zone.origin)) {
+			zone = z
+		}
+	}
+	if s.refuse || zone == nil {
+		res.RCode = dns.RCodeRefused
+		return res
+	}
+
+	// delegation to a child zone
+	for _, rr := range zone.records {
+		owner := dns.CanonicalName(rr.Name)
+		if _, ok := rr.RData.(*dns.NSData); !ok || owner == zone.origin || !dns.IsSubDomain(name, owner) {
+			continue
+		}
+		for _, ns := range zone.records {
+			if dns.CanonicalName(ns.Name) != owner {
+				continue
+			}
+			res.Authorities = append(res.Authorities, ns)
+			for _, glue := range zone.records {
+				if _, ok := glue.RData.(*dns.AData); ok && glue.Name == ns.RData.(*dns.NSData).Host {
+					res.Additions = append(res.Additions, glue)
+				}
+			}
+		}
+		return res
+	}
+
+	res.AA = true
+	exists := false
+	for _, rr := range zone.records {
+		owner := dns.CanonicalName(rr.Name)
+		if dns.IsSubDomain(owner, name) {
+			exists = true
+		}
+		if owner == name && (rr.RData.ResourceType() == q.Qtype || rr.RData.ResourceType() == dns.ResourceTypeCNAME) {
+			res.Answers = append(res.Answers, rr)
+		}
+	}
+	if len(res.Answers) == 0 {
+		if !exists {
+			res.RCode = dns.RCodeNameError
+		}
+		res.Authorities = []*dns.ResourceRecord{
+			{Name: zone.origin, Class: dns.ClassIN, TTL: 300, RData: &dns.SOAData{MName: "ns." + zone.origin, RName: "admin." + zone.origin, Minttl: 300}},
+		}
+	}
+	return res
+}
+
+type sentQuery struct {
+	Server string
+	Name   string
+	Type   dns.ResourceType
+}
+
+// fakeNetwork は net.Pipe で fakeServer をつなぐ
+type fakeNetwork struct {
+	t       *testing.T
+	servers map[string]*fakeServer
+	mu      sync.Mutex
+	sent    []sentQuery
+}
+
+func (n *fakeNetwork) dial(network string, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	server, ok := n.servers[host]
+	if !ok {
+		return nil, fmt.Errorf("no route to %s", address)
+	}
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		var buf [1024]byte
+		size, err := serverConn.Read(buf[:])
+		if err != nil {
+			return
+		}
+		query, err := dns.DecodePacket(buf[:size])
+		if err != nil {
+			n.t.Errorf("failed to decode the packet: %v", err)
+			return
+		}
+		if query.RD {
+			n.t.Errorf("RD: want false, got true")
+		}
+		n.mu.Lock()
+		n.sent = append(n.sent, sentQuery{Server: host, Name: query.Questions[0].Qname, Type: query.Questions[0].Qtype})
+		n.mu.Unlock()
+		res, err := server.answer(query).Encode()
+		if err != nil {
+			n.t.Errorf("failed to encode the packet: %v", err)
+			return
+		}
+		_, _ = serverConn.Write(res)
+	}()
+	return clientConn, nil
+}
+
+func ns(owner, host string) *dns.ResourceRecord {
+	return &dns.ResourceRecord{Name: owner, Class: dns.ClassIN, TTL: 3600, RData: &dns.NSData{Host: host}}
+}
+
+func a(owner string, addr ...byte) *dns.ResourceRecord {
+	return &dns.ResourceRecord{Name: owner, Class: dns.ClassIN, TTL: 3600, RData: &dns.AData{Address: addr}}
+}
+
+func newFakeNetwork(t *testing.T) *fakeNetwork {
+	return &fakeNetwork{
+		t: t,
+		servers: map[string]*fakeServer{
+			"192.0.2.1": {zones: []*fakeZone{{origin: ".", records: []*dns.ResourceRecord{
+				ns("com.", "ns.com."), a("ns.com.", 192, 0, 2, 2),
+				ns("net.", "ns.net."), a("ns.net.", 192, 0, 2, 4),
+				// the name server of loop. lives in loop. and has no glue
+				ns("loop.", "ns.loop."),
+			}}}},
+			"192.0.2.2": {zones: []*fakeZone{{origin: "com.", records: []*dns.ResourceRecord{
+				ns("example.com.", "ns1.example.com."), a("ns1.example.com.", 192, 0, 2, 3),
+				ns("lame.com.", "ns.lame.com."), a("ns.lame.com.", 192, 0, 2, 5),
+				ns("halflame.com.", "ns.lame.com."), ns("halflame.com.", "ns1.example.com."),
+			}}}},
+			"192.0.2.4": {zones: []*fakeZone{{origin: "net.", records: []*dns.ResourceRecord{
+				// out of bailiwick and therefore glueless
+				ns("example.net.", "ns1.example.com."),
+			}}}},
+			"192.0.2.3": {zones: []*fakeZone{
+				{origin: "example.com.", records: []*dns.ResourceRecord{
+					ns("example.com.", "ns1.example.com."),
+					a("ns1.example.com.", 192, 0, 2, 3),
+					a("www.example.com.", 192, 0, 2, 80),
+				}},
+				{origin: "example.net.", records: []*dns.ResourceRecord{
+					a("www.example.net.", 192, 0, 2, 81),
+				}},
+				{origin: "halflame.com.", records: []*dns.ResourceRecord{
+					a("www.halflame.com.", 192, 0, 2, 82),
+				}},
+			}},
+			"192.0.2.5": {refuse: true},
+		},
+	}
+}
+
+func newTestResolver(network *fakeNetwork, config Config) *Resolver {
+	config.RootHints = []string{"192.0.2.1"}
+	config.Client = client.New(client.Config{DialFunc: network.dial})
+	return New(config)
+}
+
+func TestResolver_ResolveContext(t *testing.T) {
+	cases := []struct {
+		label     string
+		name      string
+		config    Config
+		wantRCode int
+		wantAddr  []byte
+		wantErr   error
+	}{
+		{label: "ok/glue", name: "www.example.com", wantAddr: []byte{192, 0, 2, 80}},
+		{label: "ok/without-minimisation", name: "www.example.com", config: Config{DisableQNAMEMinimisation: true}, wantAddr: []byte{192, 0, 2, 80}},
+		{label: "ok/glueless", name: "www.example.net", wantAddr: []byte{192, 0, 2, 81}},
+		{label: "ok/one-lame-server", name: "www.halflame.com", wantAddr: []byte{192, 0, 2, 82}},
+		{label: "ok/nxdomain", name: "nothing.example.com", wantRCode: dns.RCodeNameError},
+		{label: "ok/nxdomain-minimised", name: "a.b.nothing.example.com", wantRCode: dns.RCodeNameError},
+		{label: "Err/loop", name: "www.loop", wantErr: ErrLoop},
+		{label: "Err/lame", name: "www.lame.com", wantErr: ErrLameDelegation},
+		{label: "Err/max-queries", name: "www.example.com", config: Config{MaxQueries: 2}, wantErr: ErrMaxQueries},
+		{label: "Err/max-depth", name: "www.example.net", config: Config{MaxDepth: 1}, wantErr: ErrMaxDepth},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			r := newTestResolver(newFakeNetwork(t), tc.config)
+
+			// ACT
+			received, err := r.ResolveContext(context.Background(), tc.name, dns.ResourceTypeA)
+
+			// ASSERT
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("err: want %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if received.RCode != tc.wantRCode {
+				t.Errorf("RCode: want %d, got %d", tc.wantRCode, received.RCode)
+			}
+			if tc.wantAddr == nil {
+				return
+			}
+			if len(received.Answers) != 1 {
+				t.Fatalf("answers: want 1, got %v", received.Answers)
+			}
+			if diff := cmp.Diff(&dns.AData{Address: tc.wantAddr}, received.Answers[0].RData); diff != "" {
+				t.Errorf("answer: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResolver_QNAMEMinimisation(t *testing.T) {
+	// ARRANGE
+	network := newFakeNetwork(t)
+	r := newTestResolver(network, Config{})
+
+	// ACT
+	_, err := r.ResolveContext(context.Background(), "www.example.com", dns.ResourceTypeTXT)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []sentQuery{
+		{Server: "192.0.2.1", Name: "com.", Type: dns.ResourceTypeA},
+		{Server: "192.0.2.2", Name: "example.com.", Type: dns.ResourceTypeA},
+		{Server: "192.0.2.3", Name: "www.example.com.", Type: dns.ResourceTypeTXT},
+	}
+	if diff := cmp.Diff(want, network.sent); diff != "" {
+		t.Errorf("queries: mismatch(-want, +got):\n%s", diff)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net/netip"
 	"strconv"
 	"strings"
 )
@@ -15,8 +16,13 @@ const (
 	ResourceTypeNS    ResourceType = 2
 	ResourceTypeCNAME ResourceType = 3
 	ResourceTypeSOA   ResourceType = 6
+	ResourceTypePTR   ResourceType = 12
+	ResourceTypeMX    ResourceType = 15
 	ResourceTypeTXT   ResourceType = 16
 	ResourceTypeAAAA  ResourceType = 28
+	ResourceTypeSRV   ResourceType = 33
+	ResourceTypeDNAME ResourceType = 39
+	ResourceTypeOPT   ResourceType = 41
 )
 
 func (r ResourceType) Bytes() []byte {
@@ -26,16 +32,12 @@ func (r ResourceType) Bytes() []byte {
 }
 
 func (r ResourceType) String() string {
-	switch r {
-	case ResourceTypeA:
-		return "A"
-	case ResourceTypeTXT:
-		return "TXT"
-	case ResourceTypeAAAA:
-		return "AAAA"
-	default:
-		return fmt.Sprintf("UNKNOWN(%d)", r)
+	for name, rrType := range resourceNameMap {
+		if rrType == r {
+			return name
+		}
 	}
+	return fmt.Sprintf("UNKNOWN(%d)", r)
 }
 
 var resourceNameMap = map[string]ResourceType{
@@ -43,8 +45,20 @@ var resourceNameMap = map[string]ResourceType{
 	"NS":    ResourceTypeNS,
 	"CNAME": ResourceTypeCNAME,
 	"SOA":   ResourceTypeSOA,
+	"PTR":   ResourceTypePTR,
+	"MX":    ResourceTypeMX,
 	"TXT":   ResourceTypeTXT,
 	"AAAA":  ResourceTypeAAAA,
+	"SRV":   ResourceTypeSRV,
+	"DNAME": ResourceTypeDNAME,
+	"OPT":   ResourceTypeOPT,
+
+	"DS":         ResourceTypeDS,
+	"RRSIG":      ResourceTypeRRSIG,
+	"NSEC":       ResourceTypeNSEC,
+	"DNSKEY":     ResourceTypeDNSKEY,
+	"NSEC3":      ResourceTypeNSEC3,
+	"NSEC3PARAM": ResourceTypeNSEC3PARAM,
 }
 
 func ResourceTypeFromName(name string) (ResourceType, bool) {
@@ -65,11 +79,15 @@ func (rr *ResourceRecord) Bytes() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode domain: %w", err)
 	}
+	rdata, err := rr.RData.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode rdata (type=%v): %w", rr.RData.ResourceType(), err)
+	}
 	buf.Write(name)
 	buf.Write(rr.RData.ResourceType().Bytes())
 	buf.Write(rr.Class.Bytes())
 	buf.Write(binary.BigEndian.AppendUint32(nil, rr.TTL))
-	buf.Write(rr.RData.Bytes())
+	buf.Write(rdata)
 	return buf.Bytes(), nil
 }
 
@@ -87,10 +105,21 @@ func (rr *ResourceRecord) String() string {
 
 type RData interface {
 	ResourceType() ResourceType
-	Bytes() []byte
+	// Bytes returns RDLENGTH followed by RDATA.
+	Bytes() ([]byte, error)
 	String() string
 }
 
+// withLength - RDATA の前に RDLENGTH を付ける
+func withLength(rdata []byte) ([]byte, error) {
+	if len(rdata) > MaxMessageLength {
+		return nil, fmt.Errorf("%w: rdata length=%d", ErrMessageTooLong, len(rdata))
+	}
+	buf := make([]byte, 0, len(rdata)+2)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rdata)))
+	return append(buf, rdata...), nil
+}
+
 type AData struct {
 	Address []byte
 }
@@ -99,11 +128,8 @@ func (d *AData) ResourceType() ResourceType {
 	return ResourceTypeA
 }
 
-func (d *AData) Bytes() []byte {
-	var buf []byte
-	buf = binary.BigEndian.AppendUint16(buf, uint16(len(d.Address)))
-	buf = append(buf, d.Address...)
-	return buf
+func (d *AData) Bytes() ([]byte, error) {
+	return withLength(d.Address)
 }
 
 func (d *AData) String() string {
@@ -130,25 +156,26 @@ func (s *SOAData) ResourceType() ResourceType {
 	return ResourceTypeSOA
 }
 
-func (s *SOAData) Bytes() []byte {
-	var buf []byte
-	mNameSize := len(s.MName)
-	buf = append(buf, byte(mNameSize))
-	buf = append(buf, []byte(s.MName)...)
-	rNameSize := len(s.RName)
-	buf = append(buf, byte(rNameSize))
-	buf = append(buf, []byte(s.RName)...)
+func (s *SOAData) Bytes() ([]byte, error) {
+	mname, err := encodeDomain(s.MName)
+	if err != nil {
+		return nil, fmt.Errorf("MNAME: %w", err)
+	}
+	rname, err := encodeDomain(s.RName)
+	if err != nil {
+		return nil, fmt.Errorf("RNAME: %w", err)
+	}
+	buf := append(mname, rname...)
 	buf = binary.BigEndian.AppendUint32(buf, s.Serial)
 	buf = binary.BigEndian.AppendUint32(buf, s.Refresh)
 	buf = binary.BigEndian.AppendUint32(buf, s.Retry)
 	buf = binary.BigEndian.AppendUint32(buf, s.Expire)
 	buf = binary.BigEndian.AppendUint32(buf, s.Minttl)
-	return buf
+	return withLength(buf)
 }
 
 func (s *SOAData) String() string {
-	//TODO implement me
-	panic("implement me")
+	return fmt.Sprintf("%s %s %d %d %d %d %d", s.MName, s.RName, s.Serial, s.Refresh, s.Retry, s.Expire, s.Minttl)
 }
 
 var _ RData = (*SOAData)(nil)
@@ -161,11 +188,18 @@ func (d *TXTData) ResourceType() ResourceType {
 	return ResourceTypeTXT
 }
 
-func (d *TXTData) Bytes() []byte {
+func (d *TXTData) Bytes() ([]byte, error) {
+	// split the text into <character-string>s of at most 255 bytes
 	var buf []byte
-	buf = binary.BigEndian.AppendUint16(buf, uint16(len(d.Text)))
-	buf = append(buf, []byte(d.Text)...)
-	return buf
+	text := []byte(d.Text)
+	for len(text) > 255 {
+		buf = append(buf, 255)
+		buf = append(buf, text[:255]...)
+		text = text[255:]
+	}
+	buf = append(buf, byte(len(text)))
+	buf = append(buf, text...)
+	return withLength(buf)
 }
 
 func (d *TXTData) String() string {
@@ -183,11 +217,8 @@ func (d *RawData) ResourceType() ResourceType {
 	return d.Type
 }
 
-func (d *RawData) Bytes() []byte {
-	var buf []byte
-	buf = binary.BigEndian.AppendUint16(buf, uint16(len(d.RData)))
-	buf = append(buf, d.RData...)
-	return buf
+func (d *RawData) Bytes() ([]byte, error) {
+	return withLength(d.RData)
 }
 
 func (d *RawData) String() string {
@@ -199,3 +230,166 @@ func (d *RawData) String() string {
 }
 
 var _ RData = (*RawData)(nil)
+
+type AAAAData struct {
+	Address []byte
+}
+
+func (d *AAAAData) ResourceType() ResourceType {
+	return ResourceTypeAAAA
+}
+
+func (d *AAAAData) Bytes() ([]byte, error) {
+	return withLength(d.Address)
+}
+
+func (d *AAAAData) String() string {
+	addr, ok := netip.AddrFromSlice(d.Address)
+	if !ok {
+		return fmt.Sprintf("%v", d.Address)
+	}
+	return addr.String()
+}
+
+var _ RData = (*AAAAData)(nil)
+
+type NSData struct {
+	Host string
+}
+
+func (d *NSData) ResourceType() ResourceType {
+	return ResourceTypeNS
+}
+
+func (d *NSData) Bytes() ([]byte, error) {
+	host, err := encodeDomain(d.Host)
+	if err != nil {
+		return nil, err
+	}
+	return withLength(host)
+}
+
+func (d *NSData) String() string {
+	return d.Host
+}
+
+var _ RData = (*NSData)(nil)
+
+type CNAMEData struct {
+	Target string
+}
+
+func (d *CNAMEData) ResourceType() ResourceType {
+	return ResourceTypeCNAME
+}
+
+func (d *CNAMEData) Bytes() ([]byte, error) {
+	target, err := encodeDomain(d.Target)
+	if err != nil {
+		return nil, err
+	}
+	return withLength(target)
+}
+
+func (d *CNAMEData) String() string {
+	return d.Target
+}
+
+var _ RData = (*CNAMEData)(nil)
+
+// DNAMEData - See RFC 6672 for details.
+type DNAMEData struct {
+	Target string
+}
+
+func (d *DNAMEData) ResourceType() ResourceType {
+	return ResourceTypeDNAME
+}
+
+func (d *DNAMEData) Bytes() ([]byte, error) {
+	target, err := encodeDomain(d.Target)
+	if err != nil {
+		return nil, err
+	}
+	return withLength(target)
+}
+
+func (d *DNAMEData) String() string {
+	return d.Target
+}
+
+var _ RData = (*DNAMEData)(nil)
+
+type PTRData struct {
+	Host string
+}
+
+func (d *PTRData) ResourceType() ResourceType {
+	return ResourceTypePTR
+}
+
+func (d *PTRData) Bytes() ([]byte, error) {
+	host, err := encodeDomain(d.Host)
+	if err != nil {
+		return nil, err
+	}
+	return withLength(host)
+}
+
+func (d *PTRData) String() string {
+	return d.Host
+}
+
+var _ RData = (*PTRData)(nil)
+
+type MXData struct {
+	Preference uint16
+	Exchange   string
+}
+
+func (d *MXData) ResourceType() ResourceType {
+	return ResourceTypeMX
+}
+
+func (d *MXData) Bytes() ([]byte, error) {
+	exchange, err := encodeDomain(d.Exchange)
+	if err != nil {
+		return nil, err
+	}
+	return withLength(append(binary.BigEndian.AppendUint16(nil, d.Preference), exchange...))
+}
+
+func (d *MXData) String() string {
+	return fmt.Sprintf("%d %s", d.Preference, d.Exchange)
+}
+
+var _ RData = (*MXData)(nil)
+
+// SRVData - See RFC 2782 for details.
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (d *SRVData) ResourceType() ResourceType {
+	return ResourceTypeSRV
+}
+
+func (d *SRVData) Bytes() ([]byte, error) {
+	target, err := encodeDomain(d.Target)
+	if err != nil {
+		return nil, err
+	}
+	buf := binary.BigEndian.AppendUint16(nil, d.Priority)
+	buf = binary.BigEndian.AppendUint16(buf, d.Weight)
+	buf = binary.BigEndian.AppendUint16(buf, d.Port)
+	return withLength(append(buf, target...))
+}
+
+func (d *SRVData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Priority, d.Weight, d.Port, d.Target)
+}
+
+var _ RData = (*SRVData)(nil)
@@ -90,7 +90,7 @@ func (s *Scanner) Peek() (byte, error) {
 }
 
 func (s *Scanner) PeekAt(pos int) (byte, error) {
-	if s.IsValidPosition(s.pos) {
+	if s.IsValidPosition(pos) {
 		return s.buf[pos], nil
 	}
 	return 0, ErrInvalidPosition
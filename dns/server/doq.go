@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/quic-go/quic-go"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// RFC 9250 4.3 のエラーコード
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.ApplicationErrorCode = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// quicCloseDelay is how long Shutdown keeps a connection open after its last
+// response. QUIC does not tell when the response was acknowledged, and
+// closing the connection at once may drop it.
+const quicCloseDelay = 500 * time.Millisecond
+
+// StartQUIC - DNS-over-QUIC (RFC 9250) のリスナーだけを起動する
+//
+// Start opens the listener along with UDP and TCP when TLSConfig is set;
+// StartQUIC serves DNS-over-QUIC alone. Cancelling ctx stops the server like
+// Stop.
+func (s *Server) StartQUIC(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", s.quicAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start QUIC server: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = s.Stop() })
+	defer stop()
+	return s.ServeQUIC(conn)
+}
+
+// ServeQUIC - conn で DNS-over-QUIC のクエリを受け付ける
+//
+// The connections share conn, so ServeQUIC returns only after all of them
+// were closed.
+func (s *Server) ServeQUIC(conn net.PacketConn) error {
+	if s.tlsConfig == nil {
+		return errors.New("failed to start QUIC server: TLSConfig is required")
+	}
+	tlsConfig := s.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+	tlsConfig.MinVersion = tls.VersionTLS13
+
+	ln, err := quic.ListenEarly(conn, tlsConfig, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		return fmt.Errorf("failed to start QUIC server: %w", err)
+	}
+	// counted for as long as it runs, so that the connections can be added
+	// while Shutdown waits
+	s.serving.Add(1)
+	defer s.serving.Done()
+	s.mu.Lock()
+	s.quicListener = ln
+	closing := s.closing.Load()
+	s.mu.Unlock()
+	if closing {
+		// Shutdown or Stop ran before the listener was stored
+		_ = ln.Close()
+	}
+	var conns sync.WaitGroup
+	defer func() {
+		_ = ln.Close()
+		conns.Wait()
+	}()
+	log.Printf("Started DNS Server on QUIC %s.", conn.LocalAddr())
+
+	for {
+		qconn, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return ErrServerClosed
+			}
+			s.closeQUICConns(doqInternalError)
+			return fmt.Errorf("failed to accept QUIC connection: %w", err)
+		}
+		if !s.trackQUICConn(qconn) {
+			// accepted just before the listener was closed
+			_ = qconn.CloseWithError(doqNoError, "")
+			continue
+		}
+		conns.Add(1)
+		s.serving.Add(1)
+		go func() {
+			defer conns.Done()
+			s.handleQUICConn(qconn)
+		}()
+	}
+}
+
+// trackQUICConn - 止まっていなければ conn を登録する
+func (s *Server) trackQUICConn(conn *quic.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	s.quicConns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackQUICConn(conn *quic.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.quicConns, conn)
+}
+
+// closeQUICConns - 全ての QUIC 接続を code で閉じる
+func (s *Server) closeQUICConns(code quic.ApplicationErrorCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.quicConns {
+		_ = conn.CloseWithError(code, "")
+	}
+}
+
+// handleQUICConn - 止まるまでストリームを受け付け、受け付けたクエリに答えてから接続を閉じる
+func (s *Server) handleQUICConn(conn *quic.Conn) {
+	ctx, cancel := context.WithCancel(s.baseCtx)
+	stop := context.AfterFunc(conn.Context(), cancel)
+	var streams sync.WaitGroup
+	defer func() {
+		// answer what was already received before closing
+		streams.Wait()
+		if s.baseCtx.Err() == nil {
+			select {
+			case <-conn.Context().Done():
+			case <-s.baseCtx.Done():
+			case <-time.After(quicCloseDelay):
+			}
+		}
+		stop()
+		cancel()
+		_ = conn.CloseWithError(doqNoError, "")
+		s.untrackQUICConn(conn)
+		s.serving.Done()
+	}()
+
+	for {
+		// acceptCtx is done once Shutdown or Stop was called
+		stream, err := conn.AcceptStream(s.acceptCtx)
+		if err != nil {
+			// the client closed the connection, or the server is stopping
+			return
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			s.handleQUICStream(ctx, conn, stream)
+		}()
+	}
+}
+
+func (s *Server) handleQUICStream(ctx context.Context, conn *quic.Conn, stream *quic.Stream) {
+	defer func() { _ = stream.Close() }()
+
+	rxBuf, err := dns.ReadStreamMessage(stream)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Errorf("Failed to read QUIC stream: %v", err)
+		}
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	rxPacket, err := dns.DecodePacket(rxBuf)
+	if err != nil {
+		log.Errorf("Failed to decode packet: %v", err)
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	if rxPacket.Id != 0 {
+		// RFC 9250 4.2.1: a non-zero ID is a protocol error
+		_ = conn.CloseWithError(doqProtocolError, "message ID must be 0")
+		return
+	}
+	if rxPacket.Opcode != dns.OpcodeQuery {
+		// only plain queries are safe to answer before the handshake
+		// confirms that the data was not replayed (RFC 9250 4.5)
+		select {
+		case <-conn.HandshakeComplete():
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	s.handler.ServeDNS(ctx, &quicResponseWriter{conn: conn, stream: stream}, rxPacket)
+}
+
+// quicResponseWriter は応答をクエリと同じストリームで返す
+type quicResponseWriter struct {
+	conn    *quic.Conn
+	stream  *quic.Stream
+	written bool
+}
+
+func (w *quicResponseWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func (w *quicResponseWriter) Network() string {
+	return "quic"
+}
+
+// WriteMsg - 1 つのストリームで返せる応答は 1 つだけ (RFC 9250 4.2)
+func (w *quicResponseWriter) WriteMsg(res *dns.Packet) error {
+	if w.written {
+		return errors.New("a response was already written to the stream")
+	}
+	w.written = true
+	txBuf, err := res.Encode()
+	if err != nil {
+		return fmt.Errorf("encode response: %w", err)
+	}
+	if err := dns.WriteStreamMessage(w.stream, txBuf); err != nil {
+		return fmt.Errorf("write QUIC stream: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"github.com/quic-go/quic-go"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestCertificate - 127.0.0.1 用の自己署名証明書を生成する
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// newUpstream - net.Pipe で常に同じ A レコードを返す upstream のクライアントを作る
+func newUpstream(t *testing.T) *client.Client {
+	t.Helper()
+	return client.New(client.Config{
+		DialFunc: func(network string, address string) (net.Conn, error) {
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				defer serverConn.Close()
+				var buf [1024]byte
+				n, err := serverConn.Read(buf[:])
+				if err != nil {
+					return
+				}
+				query, err := dns.DecodePacket(buf[:n])
+				if err != nil {
+					t.Errorf("failed to decode the packet: %v", err)
+					return
+				}
+				res, err := (&dns.Packet{
+					Id:        query.Id,
+					QR:        dns.QRResponse,
+					RD:        query.RD,
+					RA:        true,
+					Questions: query.Questions,
+					Answers: []*dns.ResourceRecord{
+						{
+							Name:  query.Questions[0].Qname,
+							Class: dns.ClassIN,
+							TTL:   300,
+							RData: &dns.AData{Address: []byte{192, 0, 2, 1}},
+						},
+					},
+				}).Encode()
+				if err != nil {
+					t.Errorf("failed to encode the packet: %v", err)
+					return
+				}
+				_, _ = serverConn.Write(res)
+			}()
+			return clientConn, nil
+		},
+	})
+}
+
+func TestServer_ServeQUIC(t *testing.T) {
+	// ARRANGE
+	cert, pool := newTestCertificate(t)
+	s := NewServer(ServerConfig{
+		Client:    newUpstream(t),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go func() { _ = s.ServeQUIC(conn) }()
+
+	c := client.New(client.Config{
+		Servers:   []string{conn.LocalAddr().String()},
+		Transport: client.TransportQUIC,
+		TLSConfig: &client.TLSConfig{RootCAs: pool},
+		Timeout:   5 * time.Second,
+	})
+	defer c.Close()
+
+	// ACT
+	received, err := c.ResolveContext(context.Background(), "www.example.com", dns.ResourceTypeA)
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("ResolveContext: unexpected error: %v", err)
+	}
+	want := []*dns.ResourceRecord{
+		{
+			Name:  "www.example.com.",
+			Class: dns.ClassIN,
+			TTL:   300,
+			RData: &dns.AData{Address: []byte{192, 0, 2, 1}},
+		},
+	}
+	if diff := cmp.Diff(want, received.Answers); diff != "" {
+		t.Errorf("answers: mismatch(-want, +got):\n%s", diff)
+	}
+	if !received.RA {
+		t.Errorf("RA: want true, got false")
+	}
+}
+
+// startQUICServer - handler で答える DoQ サーバーを起動し、接続したクライアントを返す。ServeQUIC の戻り値は返すチャネルに届く
+func startQUICServer(t *testing.T, handler Handler) (*Server, *quic.Conn, <-chan error) {
+	t.Helper()
+	cert, pool := newTestCertificate(t)
+	s := NewServer(ServerConfig{Handler: handler, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	serveErrs := make(chan error, 1)
+	go func() { serveErrs <- s.ServeQUIC(conn) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qconn, err := quic.DialAddr(ctx, conn.LocalAddr().String(), &tls.Config{RootCAs: pool, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = qconn.CloseWithError(doqNoError, "") })
+	return s, qconn, serveErrs
+}
+
+// sendQUICQuery - 新しいストリームでクエリを送る
+func sendQUICQuery(t *testing.T, conn *quic.Conn) *quic.Stream {
+	t.Helper()
+	stream, err := conn.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	query := newTestQuery("www.example.com.")
+	query.Id = 0
+	buf, err := query.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode query: %v", err)
+	}
+	if err := dns.WriteStreamMessage(stream, buf); err != nil {
+		t.Fatalf("failed to write query: %v", err)
+	}
+	_ = stream.Close()
+	return stream
+}
+
+// closeCode - conn が閉じられるのを待ち、相手のアプリケーションエラーコードを返す
+func closeCode(t *testing.T, conn *quic.Conn) quic.ApplicationErrorCode {
+	t.Helper()
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection was not closed")
+	}
+	var appErr *quic.ApplicationError
+	if !errors.As(context.Cause(conn.Context()), &appErr) || !appErr.Remote {
+		t.Fatalf("want an application error from the server, got %v", context.Cause(conn.Context()))
+	}
+	return appErr.ErrorCode
+}
+
+func TestServer_Shutdown_QUIC(t *testing.T) {
+	// ARRANGE
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	s, conn, serveErrs := startQUICServer(t, blockingHandler(entered, release))
+	stream := sendQUICQuery(t, conn)
+	<-entered
+
+	// ACT
+	shutdownErrs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErrs <- s.Shutdown(ctx)
+	}()
+
+	// ASSERT
+	select {
+	case err := <-shutdownErrs:
+		t.Fatalf("Shutdown returned before the query was answered: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := conn.OpenStreamSync(context.Background()); err != nil {
+		t.Fatalf("the connection was closed before the query was answered: %v", err)
+	}
+	close(release)
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := dns.ReadStreamMessage(stream)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if _, err := dns.DecodePacket(res); err != nil {
+		t.Errorf("failed to decode response: %v", err)
+	}
+	if code := closeCode(t, conn); code != doqNoError {
+		t.Errorf("close code: want DOQ_NO_ERROR, got %#x", code)
+	}
+	if err := <-shutdownErrs; err != nil {
+		t.Errorf("Shutdown: unexpected error: %v", err)
+	}
+	if err := <-serveErrs; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ServeQUIC: want ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServer_Shutdown_QUIC_deadline(t *testing.T) {
+	// ARRANGE
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	s, conn, serveErrs := startQUICServer(t, blockingHandler(entered, release))
+	sendQUICQuery(t, conn)
+	<-entered
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// ACT
+	err := s.Shutdown(ctx)
+
+	// ASSERT
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown: want DeadlineExceeded, got %v", err)
+	}
+	if code := closeCode(t, conn); code != doqNoError {
+		t.Errorf("close code: want DOQ_NO_ERROR, got %#x", code)
+	}
+	select {
+	case err := <-serveErrs:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ServeQUIC: want ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("ServeQUIC did not return")
+	}
+}
+
+func TestServer_Start_QUIC(t *testing.T) {
+	// ARRANGE
+	cert, pool := newTestCertificate(t)
+	quicAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	s := NewServer(ServerConfig{
+		Ip:        "127.0.0.1",
+		Port:      freePort(t),
+		QUICAddr:  quicAddr,
+		Handler:   nameHandler(1),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	startErrs := startServer(t, s)
+	c := client.New(client.Config{
+		Servers:   []string{quicAddr},
+		Transport: client.TransportQUIC,
+		TLSConfig: &client.TLSConfig{RootCAs: pool},
+		Timeout:   5 * time.Second,
+	})
+	defer c.Close()
+
+	// ACT
+	received, err := c.ResolveContext(context.Background(), "www.example.com", dns.ResourceTypeA)
+	_ = c.Close()
+	shutdownErr := s.Shutdown(context.Background())
+
+	// ASSERT
+	if err != nil {
+		t.Fatalf("ResolveContext: unexpected error: %v", err)
+	}
+	if len(received.Answers) != 1 {
+		t.Errorf("answers: want 1, got %v", received.Answers)
+	}
+	if shutdownErr != nil {
+		t.Errorf("Shutdown: unexpected error: %v", shutdownErr)
+	}
+	if err := <-startErrs; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Start: want ErrServerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ClientSubnetMode decides what the server forwards as EDNS Client Subnet
+// (RFC 7871).
+type ClientSubnetMode int
+
+const (
+	// ClientSubnetStrip forwards no client subnet at all.
+	ClientSubnetStrip ClientSubnetMode = iota
+	// ClientSubnetPass forwards the option sent by the client as it is.
+	ClientSubnetPass
+	// ClientSubnetAdd forwards the option sent by the client, or else the
+	// subnet of the address the query came from.
+	ClientSubnetAdd
+)
+
+const (
+	// defaultClientSubnetIPv4Bits and defaultClientSubnetIPv6Bits are the
+	// source prefixes recommended by RFC 7871 section 11.1.
+	defaultClientSubnetIPv4Bits = 24
+	defaultClientSubnetIPv6Bits = 56
+)
+
+var clientSubnetModeNames = map[string]ClientSubnetMode{
+	"strip": ClientSubnetStrip,
+	"pass":  ClientSubnetPass,
+	"add":   ClientSubnetAdd,
+}
+
+func (m ClientSubnetMode) String() string {
+	for name, mode := range clientSubnetModeNames {
+		if mode == m {
+			return name
+		}
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(m))
+}
+
+// ClientSubnetModeFromName - 名前から ECS の扱いを取得する
+func ClientSubnetModeFromName(name string) (ClientSubnetMode, bool) {
+	mode, ok := clientSubnetModeNames[strings.ToLower(name)]
+	return mode, ok
+}
+
+// forwardSubnet - upstream に転送する ECS を決める。nil なら付けない
+func (f *Forwarder) forwardSubnet(received *dns.ClientSubnet, remote net.Addr) *dns.ClientSubnet {
+	switch f.clientSubnet {
+	case ClientSubnetPass:
+		return received
+	case ClientSubnetAdd:
+		if received != nil {
+			return received
+		}
+		addr, ok := remoteAddr(remote)
+		if !ok {
+			return nil
+		}
+		bits := f.clientSubnetIPv6Bits
+		if addr.Is4() {
+			bits = f.clientSubnetIPv4Bits
+		}
+		return dns.NewClientSubnet(netip.PrefixFrom(addr, bits))
+	default:
+		return nil
+	}
+}
+
+// echoSubnet - クライアントに返す ECS を決める (RFC 7871 section 7.2.1)
+//
+// The option sent by the client is echoed with the scope of the answer,
+// which never exceeds the source prefix of the client.
+func (f *Forwarder) echoSubnet(received *dns.ClientSubnet, res *dns.Packet) *dns.ClientSubnet {
+	if received == nil || f.clientSubnet == ClientSubnetStrip {
+		return nil
+	}
+	echo := &dns.ClientSubnet{Prefix: received.Prefix}
+	if res == nil {
+		return echo
+	}
+	if edns := res.EDNS(); edns != nil {
+		if subnet, err := edns.ClientSubnet(); err == nil && subnet != nil {
+			echo.Scope = min(subnet.Scope, uint8(received.Prefix.Bits()))
+		}
+	}
+	return echo
+}
+
+// remoteAddr - クエリの送信元の IP アドレスを取り出す
+func remoteAddr(remote net.Addr) (netip.Addr, bool) {
+	var addrPort netip.AddrPort
+	switch a := remote.(type) {
+	case *net.UDPAddr:
+		addrPort = a.AddrPort()
+	case *net.TCPAddr:
+		addrPort = a.AddrPort()
+	default:
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), addrPort.Addr().IsValid()
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// subnetUpstream は受け取った ECS を記録し、scope を付けて返す
+type subnetUpstream struct {
+	scope    uint8
+	received *dns.ClientSubnet
+}
+
+func (u *subnetUpstream) ExchangeContext(_ context.Context, query *dns.Packet) (*client.Response, error) {
+	res := &dns.Packet{
+		Id:        query.Id,
+		QR:        dns.QRResponse,
+		RA:        true,
+		Questions: query.Questions,
+		Answers: []*dns.ResourceRecord{
+			{Name: "www.example.com.", Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}},
+		},
+	}
+	u.received = nil
+	if edns := query.EDNS(); edns != nil {
+		subnet, err := edns.ClientSubnet()
+		if err != nil {
+			return nil, err
+		}
+		u.received = subnet
+		if subnet != nil {
+			echo := *subnet
+			echo.Scope = u.scope
+			resEDNS := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+			resEDNS.SetClientSubnet(&echo)
+			res.SetEDNS(resEDNS)
+		}
+	}
+	return &client.Response{Packet: res, Upstream: "192.0.2.53:53", Network: "udp"}, nil
+}
+
+func TestForwarder_ServeDNS_clientSubnet(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 5353}
+	cases := []struct {
+		label string
+		mode  ClientSubnetMode
+		// subnet is the ECS sent by the client; empty sends none
+		subnet      string
+		remote      net.Addr
+		scope       uint8
+		wantForward string
+		wantEcho    *dns.ClientSubnet
+	}{
+		{
+			label:  "ok/strip",
+			mode:   ClientSubnetStrip,
+			subnet: "192.0.2.0/24",
+			remote: remote,
+			scope:  24,
+		},
+		{
+			label:       "ok/pass",
+			mode:        ClientSubnetPass,
+			subnet:      "192.0.2.0/24",
+			remote:      remote,
+			scope:       16,
+			wantForward: "192.0.2.0/24",
+			wantEcho:    &dns.ClientSubnet{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Scope: 16},
+		},
+		{
+			label:  "ok/pass-without-ecs",
+			mode:   ClientSubnetPass,
+			remote: remote,
+		},
+		{
+			label:       "ok/add-from-remote",
+			mode:        ClientSubnetAdd,
+			remote:      remote,
+			scope:       24,
+			wantForward: "198.51.100.0/24",
+		},
+		{
+			label:       "ok/add-from-remote-ipv6",
+			mode:        ClientSubnetAdd,
+			remote:      &net.UDPAddr{IP: net.ParseIP("2001:db8:1:2ff::1"), Port: 5353},
+			wantForward: "2001:db8:1:200::/56",
+		},
+		{
+			label:       "ok/add-keeps-client-ecs",
+			mode:        ClientSubnetAdd,
+			subnet:      "192.0.2.0/24",
+			remote:      remote,
+			scope:       32,
+			wantForward: "192.0.2.0/24",
+			// the scope never exceeds the source prefix
+			wantEcho: &dns.ClientSubnet{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Scope: 24},
+		},
+		{
+			label: "ok/add-without-remote",
+			mode:  ClientSubnetAdd,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			upstream := &subnetUpstream{scope: tc.scope}
+			s := NewServer(ServerConfig{Client: upstream, ClientSubnet: tc.mode})
+			query := &dns.Packet{
+				Id:        1234,
+				QR:        dns.QRQuery,
+				RD:        true,
+				Questions: []*dns.Question{{Qname: "www.example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+			}
+			edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+			if tc.subnet != "" {
+				edns.SetClientSubnet(dns.NewClientSubnet(netip.MustParsePrefix(tc.subnet)))
+			}
+			query.SetEDNS(edns)
+
+			// ACT
+			res := serveQuery(s.handler, query, tc.remote)
+
+			// ASSERT
+			if res.RCode != dns.RCodeNoError {
+				t.Fatalf("RCode: want %d, got %d", dns.RCodeNoError, res.RCode)
+			}
+			var forwarded string
+			if upstream.received != nil {
+				forwarded = upstream.received.Prefix.String()
+			}
+			if forwarded != tc.wantForward {
+				t.Errorf("forwarded subnet: want %q, got %q", tc.wantForward, forwarded)
+			}
+			echo, err := res.EDNS().ClientSubnet()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantEcho, echo, cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })); diff != "" {
+				t.Errorf("echoed subnet: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestForwarder_ServeDNS_malformedClientSubnet(t *testing.T) {
+	// ARRANGE
+	upstream := &subnetUpstream{}
+	s := NewServer(ServerConfig{Client: upstream, ClientSubnet: ClientSubnetPass})
+	query := &dns.Packet{
+		Id:        1234,
+		QR:        dns.QRQuery,
+		RD:        true,
+		Questions: []*dns.Question{{Qname: "www.example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+	}
+	edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+	// a /24 with four address octets
+	edns.SetOption(dns.EDNSOptionClientSubnet, []byte{0, 1, 24, 0, 192, 0, 2, 1})
+	query.SetEDNS(edns)
+
+	// ACT
+	res := serveQuery(s.handler, query, nil)
+
+	// ASSERT
+	if res.RCode != dns.RCodeFormatError {
+		t.Errorf("RCode: want %d, got %d", dns.RCodeFormatError, res.RCode)
+	}
+}
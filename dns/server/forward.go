@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// Forwarder - クエリを upstream に転送するハンドラー
+type Forwarder struct {
+	client               client.Exchanger
+	clientSubnet         ClientSubnetMode
+	clientSubnetIPv4Bits int
+	clientSubnetIPv6Bits int
+}
+
+type ForwarderConfig struct {
+	// Client answers the forwarded queries. It may be a *client.Client or a
+	// layer wrapping one.
+	Client client.Exchanger
+	// ClientSubnet decides what is forwarded as EDNS Client Subnet.
+	// Defaults to ClientSubnetStrip.
+	ClientSubnet ClientSubnetMode
+	// ClientSubnetIPv4Bits and ClientSubnetIPv6Bits are the source prefixes
+	// ClientSubnetAdd derives from the address of the client. Default to 24
+	// and 56.
+	ClientSubnetIPv4Bits int
+	ClientSubnetIPv6Bits int
+}
+
+func NewForwarder(config ForwarderConfig) *Forwarder {
+	if config.Client == nil {
+		config.Client = client.NewCoalescer(client.New(client.Config{}))
+	}
+	if config.ClientSubnetIPv4Bits <= 0 || config.ClientSubnetIPv4Bits > 32 {
+		config.ClientSubnetIPv4Bits = defaultClientSubnetIPv4Bits
+	}
+	if config.ClientSubnetIPv6Bits <= 0 || config.ClientSubnetIPv6Bits > 128 {
+		config.ClientSubnetIPv6Bits = defaultClientSubnetIPv6Bits
+	}
+	return &Forwarder{
+		client:               config.Client,
+		clientSubnet:         config.ClientSubnet,
+		clientSubnetIPv4Bits: config.ClientSubnetIPv4Bits,
+		clientSubnetIPv6Bits: config.ClientSubnetIPv6Bits,
+	}
+}
+
+// ServeDNS - クエリを upstream に転送し、クライアントへの応答を組み立てる
+//
+// Queries without exactly one question are answered with FORMERR, as the
+// Forwarder may be used without a ServeMux in front of it.
+func (f *Forwarder) ServeDNS(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+	if len(r.Questions) != 1 {
+		writeRCode(w, r, dns.RCodeFormatError)
+		return
+	}
+	txPacket := NewResponse(r)
+	rxEDNS := r.EDNS()
+	var rxSubnet *dns.ClientSubnet
+	if rxEDNS != nil {
+		var err error
+		if rxSubnet, err = rxEDNS.ClientSubnet(); err != nil {
+			// RFC 7871 section 7.1.2
+			log.Debugf("Malformed client subnet from %v: %v", w.RemoteAddr(), err)
+			txPacket.RCode = dns.RCodeFormatError
+			writeMsg(w, txPacket)
+			return
+		}
+	}
+
+	query := &dns.Packet{
+		QR:        dns.QRQuery,
+		Opcode:    r.Opcode,
+		RD:        r.RD,
+		CD:        r.CD,
+		Questions: r.Questions,
+	}
+	if rxEDNS != nil {
+		// OPT is hop-by-hop, so only the DO bit is passed on
+		query.SetEDNS(&dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize, DO: rxEDNS.DO})
+	}
+	if subnet := f.forwardSubnet(rxSubnet, w.RemoteAddr()); subnet != nil {
+		edns := query.EDNS()
+		if edns == nil {
+			edns = &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize}
+		}
+		edns.SetClientSubnet(&dns.ClientSubnet{Prefix: subnet.Prefix})
+		query.SetEDNS(edns)
+	}
+	received, err := f.client.ExchangeContext(ctx, query)
+	if err != nil {
+		log.Errorf("Failed to resolve records: %v", err)
+		txPacket.RCode = dns.RCodeServerFailure
+		writeMsg(w, withEDNS(txPacket, rxEDNS, f.echoSubnet(rxSubnet, nil)))
+		return
+	}
+
+	question := r.Questions[0]
+	log.Infof("Resolved %s %v via %s.", question.Qname, question.Qtype, received.Upstream)
+	// AA is left cleared, as a forwarded answer is not authoritative
+	txPacket.AD = received.Packet.AD
+	txPacket.RCode = received.Packet.RCode
+	txPacket.Answers = received.Packet.Answers
+	txPacket.Authorities = received.Packet.Authorities
+	txPacket.Additions = received.Packet.Additions
+	writeMsg(w, withEDNS(txPacket, rxEDNS, f.echoSubnet(rxSubnet, received.Packet)))
+}
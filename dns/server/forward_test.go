@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"testing"
+)
+
+// authoritativeUpstream は AA を立てて答える
+type authoritativeUpstream struct{}
+
+func (authoritativeUpstream) ExchangeContext(_ context.Context, query *dns.Packet) (*client.Response, error) {
+	res := &dns.Packet{
+		Id:        query.Id,
+		QR:        dns.QRResponse,
+		AA:        true,
+		Questions: query.Questions,
+		Answers: []*dns.ResourceRecord{
+			{Name: "www.example.com.", Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}},
+		},
+	}
+	return &client.Response{Packet: res, Upstream: "192.0.2.53:53", Network: "udp"}, nil
+}
+
+func TestForwarder_ServeDNS_notAuthoritative(t *testing.T) {
+	// ARRANGE
+	f := NewForwarder(ForwarderConfig{Client: authoritativeUpstream{}})
+
+	// ACT
+	res := serveQuery(f, newTestQuery("www.example.com."), nil)
+
+	// ASSERT
+	if res.AA {
+		t.Errorf("AA: want false, got true")
+	}
+	if len(res.Answers) != 1 {
+		t.Errorf("Answers: want 1, got %d", len(res.Answers))
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+)
+
+// ResponseWriter - ハンドラーが応答を書き込む先
+type ResponseWriter interface {
+	// RemoteAddr is the address the query came from. It may be nil when
+	// the transport does not know it.
+	RemoteAddr() net.Addr
+	// Network is the transport the query came in on, such as "udp" or "quic".
+	Network() string
+	// WriteMsg encodes and sends the response.
+	WriteMsg(res *dns.Packet) error
+}
+
+// Handler - クエリに応答するもの
+//
+// ServeDNS should write a single response with WriteMsg. A handler that
+// writes none leaves the client to time out, which is how a query is
+// dropped.
+type Handler interface {
+	ServeDNS(ctx context.Context, w ResponseWriter, r *dns.Packet)
+}
+
+// HandlerFunc は関数を Handler として使う
+type HandlerFunc func(ctx context.Context, w ResponseWriter, r *dns.Packet)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+	f(ctx, w, r)
+}
+
+// Middleware wraps a handler to add behaviour before or after it.
+type Middleware func(next Handler) Handler
+
+// Chain - h を middlewares で包む。最初の middleware が最も外側になる
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// NewResponse - クエリへの応答の骨組みを作る
+//
+// The response has no records, and an OPT record only if the query has one.
+func NewResponse(r *dns.Packet) *dns.Packet {
+	res := &dns.Packet{
+		Id:        r.Id,
+		QR:        dns.QRResponse,
+		Opcode:    r.Opcode,
+		RD:        r.RD,
+		RA:        true,
+		CD:        r.CD,
+		Questions: r.Questions,
+	}
+	return withEDNS(res, r.EDNS(), nil)
+}
+
+// writeRCode - rcode だけの応答を書き込む
+func writeRCode(w ResponseWriter, r *dns.Packet, rcode int) {
+	res := NewResponse(r)
+	res.RCode = rcode
+	writeMsg(w, res)
+}
+
+// writeMsg - 応答を書き込み、失敗すればログに残す
+func writeMsg(w ResponseWriter, res *dns.Packet) {
+	if err := w.WriteMsg(res); err != nil {
+		logWriteError(w, err)
+	}
+}
+
+// withEDNS - クライアントが EDNS を使っていれば、応答に自身の OPT レコードを付ける
+//
+// subnet is the client subnet option echoed to the client, if any.
+func withEDNS(txPacket *dns.Packet, rxEDNS *dns.EDNS, subnet *dns.ClientSubnet) *dns.Packet {
+	if rxEDNS == nil {
+		txPacket.SetEDNS(nil)
+		return txPacket
+	}
+	edns := &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize, DO: rxEDNS.DO}
+	if subnet != nil {
+		edns.SetClientSubnet(subnet)
+	}
+	txPacket.SetEDNS(edns)
+	return txPacket
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"testing"
+)
+
+// captureWriter は書き込まれた応答を保持する ResponseWriter
+type captureWriter struct {
+	remote net.Addr
+	res    *dns.Packet
+}
+
+func (w *captureWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *captureWriter) Network() string      { return "udp" }
+
+func (w *captureWriter) WriteMsg(res *dns.Packet) error {
+	w.res = res
+	return nil
+}
+
+// serveQuery - h にクエリを渡し、書き込まれた応答を返す。書き込まれなければ nil
+func serveQuery(h Handler, query *dns.Packet, remote net.Addr) *dns.Packet {
+	w := &captureWriter{remote: remote}
+	h.ServeDNS(context.Background(), w, query)
+	return w.res
+}
+
+func newTestQuery(name string) *dns.Packet {
+	return &dns.Packet{
+		Id:        1234,
+		QR:        dns.QRQuery,
+		RD:        true,
+		Questions: []*dns.Question{{Qname: name, Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+	}
+}
+
+// nameHandler は Answers の数で自身を名乗るハンドラーを返す
+func nameHandler(answers int) Handler {
+	return HandlerFunc(func(_ context.Context, w ResponseWriter, r *dns.Packet) {
+		res := NewResponse(r)
+		for i := 0; i < answers; i++ {
+			res.Answers = append(res.Answers, &dns.ResourceRecord{Name: r.Questions[0].Qname, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, byte(i)}}})
+		}
+		_ = w.WriteMsg(res)
+	})
+}
+
+func TestServeMux_ServeDNS(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("example.com", nameHandler(1))
+	mux.Handle("sub.EXAMPLE.com.", nameHandler(2))
+	mux.Handle("example.net.", nameHandler(3))
+
+	cases := []struct {
+		label       string
+		query       *dns.Packet
+		wantRCode   int
+		wantAnswers int
+	}{
+		{
+			label:       "ok/zone-apex",
+			query:       newTestQuery("example.com."),
+			wantAnswers: 1,
+		},
+		{
+			label:       "ok/longest-match",
+			query:       newTestQuery("www.Sub.example.com."),
+			wantAnswers: 2,
+		},
+		{
+			label:       "ok/below-zone",
+			query:       newTestQuery("a.b.example.net"),
+			wantAnswers: 3,
+		},
+		{
+			label:     "Err/no-zone",
+			query:     newTestQuery("example.org."),
+			wantRCode: dns.RCodeRefused,
+		},
+		{
+			label:     "Err/suffix-is-not-a-zone",
+			query:     newTestQuery("notexample.com."),
+			wantRCode: dns.RCodeRefused,
+		},
+		{
+			label:     "Err/no-question",
+			query:     &dns.Packet{Id: 1234, QR: dns.QRQuery},
+			wantRCode: dns.RCodeFormatError,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ACT
+			res := serveQuery(mux, tc.query, nil)
+
+			// ASSERT
+			if res == nil {
+				t.Fatalf("no response was written")
+			}
+			if res.Id != tc.query.Id {
+				t.Errorf("Id: want %d, got %d", tc.query.Id, res.Id)
+			}
+			if res.RCode != tc.wantRCode {
+				t.Errorf("RCode: want %d, got %d", tc.wantRCode, res.RCode)
+			}
+			if len(res.Answers) != tc.wantAnswers {
+				t.Errorf("answers: want %d, got %d", tc.wantAnswers, len(res.Answers))
+			}
+		})
+	}
+}
+
+func TestServeMux_Handler_root(t *testing.T) {
+	// ARRANGE
+	mux := NewServeMux()
+	root := nameHandler(1)
+	mux.Handle(".", root)
+	mux.Handle("example.com.", nameHandler(2))
+
+	// ACT
+	res := serveQuery(mux, newTestQuery("www.example.org."), nil)
+
+	// ASSERT
+	if len(res.Answers) != 1 {
+		t.Errorf("answers: want the root handler, got %d answers", len(res.Answers))
+	}
+}
+
+func TestChain(t *testing.T) {
+	// ARRANGE
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+				order = append(order, name+" in")
+				next.ServeDNS(ctx, w, r)
+				order = append(order, name+" out")
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(_ context.Context, w ResponseWriter, r *dns.Packet) {
+		order = append(order, "handler")
+		_ = w.WriteMsg(NewResponse(r))
+	}), trace("outer"), trace("inner"))
+
+	// ACT
+	serveQuery(h, newTestQuery("www.example.com."), nil)
+
+	// ASSERT
+	want := []string{"outer in", "inner in", "handler", "inner out", "outer out"}
+	if diff := cmp.Diff(want, order); diff != "" {
+		t.Errorf("order: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	h := Chain(nameHandler(1), Logging(), Blocklist([]string{"ads.example.com", "tracker.example."}))
+	cases := []struct {
+		label     string
+		qname     string
+		wantRCode int
+	}{
+		{
+			label:     "blocked/exact",
+			qname:     "ads.example.com.",
+			wantRCode: dns.RCodeNameError,
+		},
+		{
+			label:     "blocked/subdomain",
+			qname:     "x.y.TRACKER.example.",
+			wantRCode: dns.RCodeNameError,
+		},
+		{
+			label:     "ok/parent",
+			qname:     "example.com.",
+			wantRCode: dns.RCodeNoError,
+		},
+		{
+			label:     "ok/sibling",
+			qname:     "notads.example.com.",
+			wantRCode: dns.RCodeNoError,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ACT
+			res := serveQuery(h, newTestQuery(tc.qname), nil)
+
+			// ASSERT
+			if res.RCode != tc.wantRCode {
+				t.Errorf("RCode: want %d, got %d", tc.wantRCode, res.RCode)
+			}
+		})
+	}
+}
+
+func TestHandlers_ServeDNS_questionCount(t *testing.T) {
+	handlers := []struct {
+		label   string
+		handler Handler
+	}{
+		{label: "forwarder", handler: NewForwarder(ForwarderConfig{Client: &subnetUpstream{}})},
+		{label: "authoritative", handler: NewAuthoritative([]*Zone{{Origin: "example.com."}})},
+	}
+	question := &dns.Question{Qname: "www.example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}
+	cases := []struct {
+		label     string
+		questions []*dns.Question
+	}{
+		{label: "Err/no-question", questions: nil},
+		{label: "Err/two-questions", questions: []*dns.Question{question, question}},
+	}
+	for _, h := range handlers {
+		for _, tc := range cases {
+			h, tc := h, tc
+			t.Run(h.label+"/"+tc.label, func(t *testing.T) {
+				// ARRANGE
+				query := &dns.Packet{Id: 1234, QR: dns.QRQuery, Questions: tc.questions}
+
+				// ACT
+				res := serveQuery(h.handler, query, nil)
+
+				// ASSERT
+				if res == nil {
+					t.Fatalf("no response")
+				}
+				if res.RCode != dns.RCodeFormatError {
+					t.Errorf("RCode: want %d, got %d", dns.RCodeFormatError, res.RCode)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Logging - クエリごとに送信元、質問、RCODE と所要時間をログに残す
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+			start := time.Now()
+			rw := &recordingWriter{ResponseWriter: w}
+			next.ServeDNS(ctx, rw, r)
+			question := "-"
+			if len(r.Questions) > 0 {
+				question = r.Questions[0].Qname + " " + r.Questions[0].Qtype.String()
+			}
+			if rw.res == nil {
+				log.Infof("%v %s %s dropped in %v", w.RemoteAddr(), w.Network(), question, time.Since(start))
+				return
+			}
+			log.Infof("%v %s %s rcode=%d answers=%d in %v", w.RemoteAddr(), w.Network(), question, rw.res.RCode, len(rw.res.Answers), time.Since(start))
+		})
+	}
+}
+
+// Blocklist - domains とその配下の名前に NXDOMAIN で答え、それ以外を next に渡す
+func Blocklist(domains []string) Middleware {
+	blocked := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		blocked[dns.CanonicalName(domain)] = true
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+			if len(r.Questions) == 1 && isBlocked(blocked, r.Questions[0].Qname) {
+				log.Debugf("Blocked %s for %v", r.Questions[0].Qname, w.RemoteAddr())
+				writeRCode(w, r, dns.RCodeNameError)
+				return
+			}
+			next.ServeDNS(ctx, w, r)
+		})
+	}
+}
+
+// isBlocked - name かその親のいずれかが blocked にあるかどうか
+func isBlocked(blocked map[string]bool, name string) bool {
+	zone := dns.CanonicalName(name)
+	for zone != "." {
+		if blocked[zone] {
+			return true
+		}
+		zone = parentZone(zone)
+	}
+	return blocked["."]
+}
+
+// recordingWriter は書き込まれた応答を覚えておく ResponseWriter
+type recordingWriter struct {
+	ResponseWriter
+	res *dns.Packet
+}
+
+func (w *recordingWriter) WriteMsg(res *dns.Packet) error {
+	w.res = res
+	return w.ResponseWriter.WriteMsg(res)
+}
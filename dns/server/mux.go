@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"github.com/niioka/dnsbox/dns"
+	"sync"
+)
+
+// ServeMux - 質問の名前で振り分けるハンドラー
+//
+// A handler registered for a zone gets the queries for the zone and every
+// name below it, and the longest matching zone wins. Register a handler for
+// "." to catch every other name.
+type ServeMux struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: make(map[string]Handler)}
+}
+
+// Handle - zone とその配下の名前のハンドラーを登録する。同じゾーンなら置き換える
+func (m *ServeMux) Handle(zone string, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[dns.CanonicalName(zone)] = h
+}
+
+func (m *ServeMux) HandleFunc(zone string, f func(ctx context.Context, w ResponseWriter, r *dns.Packet)) {
+	m.Handle(zone, HandlerFunc(f))
+}
+
+// HandleRemove - zone のハンドラーを取り除く
+func (m *ServeMux) HandleRemove(zone string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handlers, dns.CanonicalName(zone))
+}
+
+// Handler - name に最も長く一致するゾーンのハンドラーを返す。なければ nil
+func (m *ServeMux) Handler(name string) Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// walk up from the name itself, so that the first hit is the longest
+	zone := dns.CanonicalName(name)
+	for {
+		if h, ok := m.handlers[zone]; ok {
+			return h
+		}
+		if zone == "." {
+			return nil
+		}
+		zone = parentZone(zone)
+	}
+}
+
+// ServeDNS - 質問が 1 つでなければ FORMERR、担当のハンドラーがなければ REFUSED を返す
+func (m *ServeMux) ServeDNS(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+	if len(r.Questions) != 1 {
+		writeRCode(w, r, dns.RCodeFormatError)
+		return
+	}
+	h := m.Handler(r.Questions[0].Qname)
+	if h == nil {
+		writeRCode(w, r, dns.RCodeRefused)
+		return
+	}
+	h.ServeDNS(ctx, w, r)
+}
+
+// parentZone - 先頭のラベルを取り除いた名前を返す
+func parentZone(name string) string {
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '.' {
+			return name[i+1:]
+		}
+	}
+	return "."
+}
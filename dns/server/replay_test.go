@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"github.com/niioka/dnsbox/dns/client"
+	"github.com/niioka/dnsbox/dns/replay"
+	"testing"
+)
+
+func TestForwarder_ServeDNS_replayed(t *testing.T) {
+	// ARRANGE
+	exchanges, err := replay.Load("testdata/forward.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	replayer := replay.NewReplayer(replay.ReplayerConfig{Exchanges: exchanges})
+	s := NewServer(ServerConfig{Client: client.New(client.Config{Servers: []string{"192.0.2.53:53"}, DialFunc: replayer.Dial})})
+	query := &dns.Packet{
+		Id:        1234,
+		QR:        dns.QRQuery,
+		RD:        true,
+		Questions: []*dns.Question{{Qname: "www.example.com.", Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+	}
+
+	// ACT
+	res := serveQuery(s.handler, query, nil)
+
+	// ASSERT
+	if res.Id != query.Id || res.RCode != dns.RCodeNoError {
+		t.Fatalf("response: want Id=%d NOERROR, got Id=%d RCode=%d", query.Id, res.Id, res.RCode)
+	}
+	want := []*dns.ResourceRecord{
+		{Name: "www.example.com.", Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, 1}}},
+	}
+	if diff := cmp.Diff(want, res.Answers); diff != "" {
+		t.Errorf("answers: mismatch(-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+import (
+	"syscall"
+)
+
+// reusePortControl - SO_REUSEPORT のないプラットフォームではエラーにする
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return errReusePortUnsupported
+}
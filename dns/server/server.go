@@ -1,25 +1,131 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/niioka/dnsbox/dns"
 	"github.com/niioka/dnsbox/dns/client"
+	"github.com/quic-go/quic-go"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	ip     net.IP
-	port   int
-	conn   net.Conn
-	client *client.Client
+	ip        net.IP
+	port      int
+	quicAddr  string
+	tlsConfig *tls.Config
+	handler   Handler
+
+	maxUDPSize int
+	reusePort  int
+	workers    int
+	queue      chan udpRequest
+	bufPool    sync.Pool
+	// startWorkers starts the worker pool with the first UDP socket
+	startWorkers sync.Once
+	dropped      atomic.Uint64
+	oversized    atomic.Uint64
+
+	tcpIdleTimeout  time.Duration
+	tcpReadTimeout  time.Duration
+	tcpWriteTimeout time.Duration
+	maxTCPConns     int
+
+	// baseCtx is passed to the handlers and cancelled once the server stopped
+	baseCtx context.Context
+	cancel  context.CancelFunc
+	// acceptCtx is cancelled once the server stops taking new queries; the
+	// DNS-over-QUIC connections accept streams until then
+	acceptCtx     context.Context
+	stopAccepting context.CancelFunc
+	ready         chan struct{}
+	started       atomic.Bool
+	closing       atomic.Bool
+	// serving counts the loops reading queries, and inflight the queries
+	// read but not answered yet
+	serving  sync.WaitGroup
+	inflight sync.WaitGroup
+
+	mu           sync.Mutex
+	quicListener *quic.EarlyListener
+	udpConns     []*net.UDPConn
+	tcpListener  net.Listener
+	tcpConns     map[net.Conn]struct{}
+	quicConns    map[*quic.Conn]struct{}
 }
 
 type ServerConfig struct {
-	Ip     string
-	Port   int
-	Client *client.Client
+	Ip   string
+	Port int
+	// Handler answers the queries. By default Zones are answered
+	// authoritatively and other names are forwarded to Client.
+	Handler Handler
+	// Client forwards the queries outside Zones. It may be a *client.Client
+	// or a layer wrapping one. It is ignored when Handler is set.
+	Client client.Exchanger
+	// QUICAddr is the address of the DNS-over-QUIC listener. Defaults to
+	// ":853". Start opens it when TLSConfig is set.
+	QUICAddr string
+	// TLSConfig holds the certificate of the encrypted listeners.
+	TLSConfig *tls.Config
+	// Zones are answered authoritatively instead of being forwarded. It is
+	// ignored when Handler is set.
+	Zones []*Zone
+	// ClientSubnet decides what is forwarded as EDNS Client Subnet.
+	// Defaults to ClientSubnetStrip. It is ignored when Handler is set.
+	ClientSubnet ClientSubnetMode
+	// ClientSubnetIPv4Bits and ClientSubnetIPv6Bits are the source prefixes
+	// ClientSubnetAdd derives from the address of the client. See
+	// ForwarderConfig.
+	ClientSubnetIPv4Bits int
+	ClientSubnetIPv6Bits int
+	// TCPIdleTimeout closes a TCP connection that sent no query for this
+	// long. It is also announced by EDNS TCP keepalive. Defaults to 10s.
+	TCPIdleTimeout time.Duration
+	// TCPReadTimeout bounds the time to read a query once it started to
+	// arrive. Defaults to 2s.
+	TCPReadTimeout time.Duration
+	// TCPWriteTimeout bounds the time to write a response. The connection is
+	// closed when it passes. Defaults to 2s.
+	TCPWriteTimeout time.Duration
+	// MaxTCPConnections is the number of TCP connections served at once.
+	// Connections beyond it are closed right away. Defaults to 256.
+	MaxTCPConnections int
+	// MaxUDPSize is the largest UDP message accepted or sent, and the payload
+	// size advertised by EDNS. Larger queries are dropped, and larger
+	// responses are cut down. Defaults to 1232, the DNS flag day 2020 value.
+	MaxUDPSize int
+	// Workers is the number of UDP queries answered at once. Defaults to 256.
+	Workers int
+	// QueueSize is the number of UDP queries waiting for a worker. Queries
+	// beyond it are dropped and counted in ServerStats. Defaults to 1024.
+	QueueSize int
+	// ReusePort opens this many UDP sockets on the same port with
+	// SO_REUSEPORT, so that the kernel spreads the queries across them.
+	// Defaults to 1, a single socket without the option.
+	ReusePort int
+}
+
+// ErrServerClosed is returned by Start and the Serve methods once the server
+// was shut down or stopped.
+var ErrServerClosed = errors.New("dns: server closed")
+
+// ErrServerStarted is returned by Start when the server was started before.
+var ErrServerStarted = errors.New("dns: server already started")
+
+// ServerStats - サーバーの統計
+type ServerStats struct {
+	// Dropped is the number of UDP queries dropped because the queue was full.
+	Dropped uint64
+	// Oversized is the number of UDP queries dropped for exceeding MaxUDPSize.
+	Oversized uint64
 }
 
 func NewServer(config ServerConfig) *Server {
@@ -29,66 +135,295 @@ func NewServer(config ServerConfig) *Server {
 	if config.Port == 0 {
 		config.Port = 53
 	}
-	if config.Client == nil {
-		config.Client = client.New(client.Config{
-			Server: "8.8.8.8",
-		})
+	if config.QUICAddr == "" {
+		config.QUICAddr = ":853"
+	}
+	if config.Handler == nil {
+		config.Handler = defaultHandler(config)
+	}
+	if config.TCPIdleTimeout <= 0 {
+		config.TCPIdleTimeout = defaultTCPIdleTimeout
+	}
+	if config.TCPReadTimeout <= 0 {
+		config.TCPReadTimeout = defaultTCPReadTimeout
+	}
+	if config.TCPWriteTimeout <= 0 {
+		config.TCPWriteTimeout = defaultTCPWriteTimeout
+	}
+	if config.MaxTCPConnections <= 0 {
+		config.MaxTCPConnections = defaultMaxTCPConns
+	}
+	if config.MaxUDPSize < dns.MinEDNSUDPSize || config.MaxUDPSize > dns.MaxMessageLength {
+		config.MaxUDPSize = dns.DefaultEDNSUDPSize
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultWorkers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
 	}
-	return &Server{
-		ip:     net.ParseIP(config.Ip),
-		port:   config.Port,
-		client: config.Client,
+	if config.ReusePort <= 0 {
+		config.ReusePort = 1
 	}
+	s := &Server{
+		ip:              net.ParseIP(config.Ip),
+		port:            config.Port,
+		quicAddr:        config.QUICAddr,
+		tlsConfig:       config.TLSConfig,
+		handler:         config.Handler,
+		tcpIdleTimeout:  config.TCPIdleTimeout,
+		tcpReadTimeout:  config.TCPReadTimeout,
+		tcpWriteTimeout: config.TCPWriteTimeout,
+		maxTCPConns:     config.MaxTCPConnections,
+		tcpConns:        make(map[net.Conn]struct{}),
+		quicConns:       make(map[*quic.Conn]struct{}),
+		maxUDPSize:      config.MaxUDPSize,
+		reusePort:       config.ReusePort,
+		workers:         config.Workers,
+		queue:           make(chan udpRequest, config.QueueSize),
+		ready:           make(chan struct{}),
+	}
+	s.baseCtx, s.cancel = context.WithCancel(context.Background())
+	s.acceptCtx, s.stopAccepting = context.WithCancel(context.Background())
+	s.bufPool.New = func() any {
+		// one spare byte tells an oversized datagram from one of the exact size
+		buf := make([]byte, s.maxUDPSize+1)
+		return &buf
+	}
+	return s
+}
+
+// defaultHandler - Zones に権威を持って答え、それ以外を転送するハンドラーを組み立てる
+func defaultHandler(config ServerConfig) Handler {
+	mux := NewServeMux()
+	mux.Handle(".", NewForwarder(ForwarderConfig{
+		Client:               config.Client,
+		ClientSubnet:         config.ClientSubnet,
+		ClientSubnetIPv4Bits: config.ClientSubnetIPv4Bits,
+		ClientSubnetIPv6Bits: config.ClientSubnetIPv6Bits,
+	}))
+	NewAuthoritative(config.Zones).Register(mux)
+	return mux
 }
 
-func (s *Server) Start() error {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   s.ip,
-		Port: s.port,
-	})
+// Start - UDP と TCP の同じポートでクエリを受け付ける
+//
+// When TLSConfig is set, DNS-over-QUIC is served on QUICAddr as well. Start
+// returns ErrServerClosed once the server was shut down, or the first error
+// of a listener, which stops the others. Cancelling ctx stops the server
+// like Stop; use Shutdown to answer the queries in progress first. A server
+// is started only once.
+func (s *Server) Start(ctx context.Context) error {
+	if s.closing.Load() {
+		return ErrServerClosed
+	}
+	if !s.started.CompareAndSwap(false, true) {
+		return ErrServerStarted
+	}
+	addr := net.JoinHostPort(s.ip.String(), strconv.Itoa(s.port))
+	conns, err := listenUDP(addr, s.reusePort)
 	if err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
-	s.conn = conn
-	defer func() { _ = conn.Close() }()
-	log.Printf("Started DNS Server on UDP port 53.")
+	closeConns := func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		closeConns()
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+	var quicConn net.PacketConn
+	if s.tlsConfig != nil {
+		if quicConn, err = net.ListenPacket("udp", s.quicAddr); err != nil {
+			closeConns()
+			_ = ln.Close()
+			return fmt.Errorf("failed to start QUIC server: %w", err)
+		}
+	}
 
-	buf := make([]byte, 1024)
-	for {
-		rxPacket, err := s.readPacket(conn, buf)
-		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
-				return err
+	// registered before Ready, so that Shutdown and Stop find the sockets
+	// even when they are called before the goroutines run
+	for _, conn := range conns {
+		if !s.trackUDPConn(conn) {
+			closeConns()
+			_ = ln.Close()
+			if quicConn != nil {
+				_ = quicConn.Close()
 			}
-			log.Errorf("Failed to read packet: %v+", err)
-			continue
+			return ErrServerClosed
+		}
+	}
+	if !s.trackTCPListener(ln) {
+		_ = ln.Close()
+		if quicConn != nil {
+			_ = quicConn.Close()
 		}
+		return ErrServerClosed
+	}
+
+	// the listeners are counted here, so that Shutdown waits for them even
+	// when it is called before their goroutines run
+	listeners := len(conns) + 1
+	if quicConn != nil {
+		listeners++
+	}
+	s.serving.Add(listeners)
+	errs := make(chan error, listeners)
+	go func() {
+		defer s.serving.Done()
+		errs <- s.ServeTCP(ln)
+	}()
+	for _, conn := range conns {
+		go func() {
+			defer s.serving.Done()
+			errs <- s.ServeUDP(conn)
+		}()
+	}
+	if quicConn != nil {
+		go func() {
+			defer s.serving.Done()
+			defer func() { _ = quicConn.Close() }()
+			errs <- s.ServeQUIC(quicConn)
+		}()
+	}
+	close(s.ready)
+
+	select {
+	case err = <-errs:
+		if errors.Is(err, ErrServerClosed) {
+			// Shutdown or Stop takes care of the other listeners
+			return err
+		}
+		_ = s.Stop()
+		return err
+	case <-ctx.Done():
+		_ = s.Stop()
+		return ErrServerClosed
+	}
+}
+
+// Ready - Start がソケットを開き終えると閉じるチャネルを返す
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Shutdown - 新しいクエリの受け付けをやめ、受け付けたクエリに答え終えてから止める
+//
+// The sockets stay open until the queries read so far were answered, or ctx
+// is done, in which case the server is stopped at once and ctx.Err() is
+// returned. DNS-over-QUIC connections stop accepting streams and are closed
+// with DOQ_NO_ERROR once the queries on their open streams were answered.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing.Store(true)
+	quicListener, tcpListener, udpConns := s.quicListener, s.tcpListener, s.udpConns
+	tcpConns := make([]net.Conn, 0, len(s.tcpConns))
+	for conn := range s.tcpConns {
+		tcpConns = append(tcpConns, conn)
+	}
+	s.mu.Unlock()
+
+	// wake up the readers, which see closing and return
+	s.stopAccepting()
+	if quicListener != nil {
+		_ = quicListener.Close()
+	}
+	if tcpListener != nil {
+		_ = tcpListener.Close()
+	}
+	for _, conn := range udpConns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	for _, conn := range tcpConns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
 
-		go s.handlePacket(rxPacket)
+	drained := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		s.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return s.Stop()
+	case <-s.baseCtx.Done():
+		// stopped meanwhile, so the queued queries are never answered
+		return nil
+	case <-ctx.Done():
+		_ = s.Stop()
+		return ctx.Err()
 	}
 }
 
+// Stop - 全てのソケットをすぐに閉じる。答えている途中のクエリは捨てる
 func (s *Server) Stop() error {
-	return s.conn.Close()
+	s.mu.Lock()
+	// set under the lock, so that no QUIC connection is tracked after
+	// closeQUICConns
+	s.closing.Store(true)
+	quicListener, tcpListener, udpConns := s.quicListener, s.tcpListener, s.udpConns
+	s.mu.Unlock()
+	s.stopAccepting()
+	s.cancel()
+	if quicListener != nil {
+		_ = quicListener.Close()
+	}
+	if tcpListener != nil {
+		_ = tcpListener.Close()
+	}
+	s.closeTCPConns()
+	s.closeQUICConns(doqNoError)
+	var errs []error
+	for _, conn := range udpConns {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (s *Server) readPacket(conn *net.UDPConn, buf []byte) (*dns.Packet, error) {
-	n, _, err := conn.ReadFromUDP(buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from UDP: %w", err)
+// Stats - サーバーの統計を返す
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		Dropped:   s.dropped.Load(),
+		Oversized: s.oversized.Load(),
 	}
+}
+
+// udpResponseWriter は応答をクエリの送信元へのデータグラムで返す
+type udpResponseWriter struct {
+	conn  *net.UDPConn
+	addr  *net.UDPAddr
+	query *dns.Packet
+	// maxUDPSize is advertised in the OPT record and caps the response
+	maxUDPSize int
+}
 
-	input := buf[0:n]
-	return dns.DecodePacket(input)
+func (w *udpResponseWriter) RemoteAddr() net.Addr {
+	return w.addr
 }
 
-func (s *Server) handlePacket(rxPacket *dns.Packet) {
-	question := rxPacket.Questions[0]
-	records, err := s.client.Resolve(question.Qname, question.Qtype)
+func (w *udpResponseWriter) Network() string {
+	return "udp"
+}
+
+func (w *udpResponseWriter) WriteMsg(res *dns.Packet) error {
+	res = withUDPSize(res, w.maxUDPSize)
+	txBuf, err := fitResponse(res, udpPayloadSize(w.query, w.maxUDPSize))
 	if err != nil {
-		log.Errorf("Failed to resolve records: %v", err)
-		return
+		return err
+	}
+	if _, err := w.conn.WriteToUDP(txBuf, w.addr); err != nil {
+		return fmt.Errorf("write response: %w", err)
 	}
+	return nil
+}
 
-	log.Infof("Resolved %+v records.", records)
+// logWriteError - 応答を返せなかったことをログに残す
+func logWriteError(w ResponseWriter, err error) {
+	log.Errorf("Failed to respond to %v over %s: %v", w.RemoteAddr(), w.Network(), err)
 }
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freePort - 127.0.0.1 で UDP と TCP の両方が空いているポートを探す
+func freePort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		_ = conn.Close()
+		if err == nil {
+			_ = ln.Close()
+			return port
+		}
+	}
+	t.Fatalf("no free port")
+	return 0
+}
+
+// blockingHandler - release が閉じるまで答えないハンドラー。受け取ると entered に知らせる
+func blockingHandler(entered chan<- struct{}, release <-chan struct{}) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+		entered <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return
+		}
+		nameHandler(1).ServeDNS(ctx, w, r)
+	})
+}
+
+// startServer - s.Start を動かし、ソケットが開くのを待つ。Start の戻り値は返すチャネルに届く
+func startServer(t *testing.T, s *Server) <-chan error {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() { errs <- s.Start(context.Background()) }()
+	select {
+	case <-s.Ready():
+	case err := <-errs:
+		t.Fatalf("Start: unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Start: not ready")
+	}
+	return errs
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	cases := []struct {
+		label   string
+		network string
+	}{
+		{label: "ok/udp", network: "udp"},
+		{label: "ok/tcp", network: "tcp"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			entered, release := make(chan struct{}, 1), make(chan struct{})
+			port := freePort(t)
+			s := NewServer(ServerConfig{Ip: "127.0.0.1", Port: port, Handler: blockingHandler(entered, release)})
+			startErrs := startServer(t, s)
+			conn, err := net.Dial(tc.network, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+			query, err := newTestQuery("www.example.com.").Encode()
+			if err != nil {
+				t.Fatalf("failed to encode query: %v", err)
+			}
+			if tc.network == "tcp" {
+				err = dns.WriteStreamMessage(conn, query)
+			} else {
+				_, err = conn.Write(query)
+			}
+			if err != nil {
+				t.Fatalf("failed to write query: %v", err)
+			}
+			<-entered
+
+			// ACT
+			shutdownErrs := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				shutdownErrs <- s.Shutdown(ctx)
+			}()
+
+			// ASSERT
+			select {
+			case err := <-shutdownErrs:
+				t.Fatalf("Shutdown returned before the query was answered: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			close(release)
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var res []byte
+			if tc.network == "tcp" {
+				res, err = dns.ReadStreamMessage(conn)
+			} else {
+				res = make([]byte, dns.MaxMessageLength)
+				var n int
+				n, err = conn.Read(res)
+				res = res[:n]
+			}
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if _, err := dns.DecodePacket(res); err != nil {
+				t.Errorf("failed to decode response: %v", err)
+			}
+			if err := <-shutdownErrs; err != nil {
+				t.Errorf("Shutdown: unexpected error: %v", err)
+			}
+			if err := <-startErrs; !errors.Is(err, ErrServerClosed) {
+				t.Errorf("Start: want ErrServerClosed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_Shutdown_deadline(t *testing.T) {
+	// ARRANGE
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	port := freePort(t)
+	s := NewServer(ServerConfig{Ip: "127.0.0.1", Port: port, Handler: blockingHandler(entered, release)})
+	startServer(t, s)
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	query, _ := newTestQuery("www.example.com.").Encode()
+	_, _ = conn.Write(query)
+	<-entered
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// ACT
+	err = s.Shutdown(ctx)
+
+	// ASSERT
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown: want DeadlineExceeded, got %v", err)
+	}
+	if s.baseCtx.Err() == nil {
+		t.Errorf("the handlers were not cancelled")
+	}
+}
+
+func TestServer_Start_addressInUse(t *testing.T) {
+	// ARRANGE
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	s := NewServer(ServerConfig{Ip: "127.0.0.1", Port: conn.LocalAddr().(*net.UDPAddr).Port, Handler: nameHandler(1)})
+
+	// ACT
+	err = s.Start(context.Background())
+
+	// ASSERT
+	if err == nil || errors.Is(err, ErrServerClosed) {
+		t.Errorf("Start: want bind error, got %v", err)
+	}
+	select {
+	case <-s.Ready():
+		t.Errorf("Ready: closed although Start failed")
+	default:
+	}
+}
+
+func TestServer_Stop_notStarted(t *testing.T) {
+	// ARRANGE
+	s := NewServer(ServerConfig{Handler: nameHandler(1)})
+
+	// ACT
+	err := s.Stop()
+
+	// ASSERT
+	if err != nil {
+		t.Errorf("Stop: unexpected error: %v", err)
+	}
+}
+
+func TestServer_Shutdown_afterReady(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		// ARRANGE
+		s := NewServer(ServerConfig{Ip: "127.0.0.1", Port: freePort(t), Handler: nameHandler(1), ReusePort: 2})
+		startErrs := startServer(t, s)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		// ACT
+		err := s.Shutdown(ctx)
+		cancel()
+
+		// ASSERT
+		if err != nil {
+			t.Fatalf("Shutdown: unexpected error: %v", err)
+		}
+		select {
+		case err := <-startErrs:
+			if !errors.Is(err, ErrServerClosed) {
+				t.Errorf("Start: want ErrServerClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Start did not return")
+		}
+	}
+}
+
+func TestServer_Start_twice(t *testing.T) {
+	cases := []struct {
+		label string
+		// shutdown shuts the server down before it is started again
+		shutdown bool
+		wantErr  error
+	}{
+		{label: "Err/running", wantErr: ErrServerStarted},
+		{label: "Err/shut-down", shutdown: true, wantErr: ErrServerClosed},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			s := NewServer(ServerConfig{Ip: "127.0.0.1", Port: freePort(t), Handler: nameHandler(1)})
+			startServer(t, s)
+			defer s.Stop()
+			if tc.shutdown {
+				if err := s.Shutdown(context.Background()); err != nil {
+					t.Fatalf("Shutdown: unexpected error: %v", err)
+				}
+			}
+
+			// ACT
+			err := s.Start(context.Background())
+
+			// ASSERT
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Start: want %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTCPIdleTimeout is how long a connection may wait for its next
+	// query. RFC 7766 section 6.2.3 suggests seconds rather than minutes.
+	defaultTCPIdleTimeout = 10 * time.Second
+	// defaultTCPReadTimeout bounds the time to read a query once its length
+	// arrived, so that a slow client can not hold a connection forever.
+	defaultTCPReadTimeout = 2 * time.Second
+	// defaultTCPWriteTimeout bounds the time to write a response, so that a
+	// client that stops reading can not hold a connection forever.
+	defaultTCPWriteTimeout = 2 * time.Second
+	defaultMaxTCPConns     = 256
+	// maxTCPPipeline is how many queries of a connection are answered at once.
+	maxTCPPipeline = 32
+)
+
+// ServeTCP - ln で長さプレフィックス付きのクエリを受け付ける (RFC 7766)
+//
+// Queries pipelined on a connection are answered concurrently, and each
+// response is written as soon as it is ready, so they may come out of order.
+func (s *Server) ServeTCP(ln net.Listener) error {
+	if !s.trackTCPListener(ln) {
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	log.Printf("Started DNS Server on TCP %s.", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return fmt.Errorf("failed to accept TCP connection: %w", err)
+		}
+		if !s.trackTCPConn(conn) {
+			log.Warnf("Too many TCP connections, closing the one from %v", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		s.serving.Add(1)
+		go s.handleTCPConn(conn)
+	}
+}
+
+// trackTCPListener - 止まっていなければ ln を登録する
+func (s *Server) trackTCPListener(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	s.tcpListener = ln
+	return true
+}
+
+// trackTCPConn - 接続数が上限未満なら conn を登録する
+func (s *Server) trackTCPConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tcpConns) >= s.maxTCPConns {
+		return false
+	}
+	s.tcpConns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackTCPConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tcpConns, conn)
+}
+
+// closeTCPConns - 全ての TCP 接続を閉じる
+func (s *Server) closeTCPConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.tcpConns {
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) handleTCPConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(s.baseCtx)
+	var inflight sync.WaitGroup
+	defer func() {
+		// answer what was already read before closing
+		inflight.Wait()
+		cancel()
+		_ = conn.Close()
+		s.untrackTCPConn(conn)
+		s.serving.Done()
+	}()
+
+	w := &tcpConnWriter{conn: conn, timeout: s.tcpWriteTimeout}
+	pipeline := make(chan struct{}, maxTCPPipeline)
+	for {
+		msg, err := s.readTCPMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, ErrServerClosed) {
+				log.Debugf("Failed to read from TCP connection %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		rxPacket, err := dns.DecodePacket(msg)
+		if err != nil {
+			// the framing is intact, so the connection can still be used
+			log.Errorf("Failed to decode packet: %v", err)
+			continue
+		}
+
+		pipeline <- struct{}{}
+		inflight.Add(1)
+		go func() {
+			defer func() {
+				<-pipeline
+				inflight.Done()
+			}()
+			s.handler.ServeDNS(ctx, &tcpResponseWriter{conn: w, query: rxPacket, keepalive: s.tcpIdleTimeout, maxUDPSize: s.maxUDPSize}, rxPacket)
+		}()
+	}
+}
+
+// readTCPMessage - アイドルタイムアウトまで次のクエリを待ち、本体は読み込みタイムアウトまでに読む
+func (s *Server) readTCPMessage(conn net.Conn) ([]byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(s.tcpIdleTimeout))
+	// checked after the deadline was set, so that the one Shutdown sets
+	// can not be overwritten
+	if s.closing.Load() {
+		return nil, ErrServerClosed
+	}
+	var prefix [2]byte
+	if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(s.tcpReadTimeout))
+	msg := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, fmt.Errorf("read stream message: %w", err)
+	}
+	return msg, nil
+}
+
+// tcpConnWriter は並行して書き込まれる応答が混ざらないようにする
+type tcpConnWriter struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// write - 書き込みタイムアウトまでに msg を書く。失敗すれば接続を閉じる
+func (w *tcpConnWriter) write(msg []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_ = w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	if err := dns.WriteStreamMessage(w.conn, msg); err != nil {
+		// a message may have been cut off, which breaks the framing
+		_ = w.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// tcpResponseWriter は応答を同じ接続で返す
+type tcpResponseWriter struct {
+	conn      *tcpConnWriter
+	query     *dns.Packet
+	keepalive time.Duration
+	// maxUDPSize is advertised in the OPT record
+	maxUDPSize int
+}
+
+func (w *tcpResponseWriter) RemoteAddr() net.Addr {
+	return w.conn.conn.RemoteAddr()
+}
+
+func (w *tcpResponseWriter) Network() string {
+	return "tcp"
+}
+
+func (w *tcpResponseWriter) WriteMsg(res *dns.Packet) error {
+	txBuf, err := withKeepalive(withUDPSize(res, w.maxUDPSize), w.query, w.keepalive).Encode()
+	if err != nil {
+		return fmt.Errorf("encode response: %w", err)
+	}
+	return w.conn.write(txBuf)
+}
+
+// withKeepalive - クエリが edns-tcp-keepalive を含んでいれば、応答でアイドルタイムアウトを伝える (RFC 7828)
+func withKeepalive(res *dns.Packet, query *dns.Packet, idle time.Duration) *dns.Packet {
+	queryEDNS, resEDNS := query.EDNS(), res.EDNS()
+	if queryEDNS == nil || resEDNS == nil || queryEDNS.Option(dns.EDNSOptionKeepalive) == nil {
+		return res
+	}
+	// the timeout is in units of 100 milliseconds
+	timeout := min(idle/(100*time.Millisecond), 0xffff)
+	resEDNS.SetOption(dns.EDNSOptionKeepalive, binary.BigEndian.AppendUint16(nil, uint16(timeout)))
+	copied := *res
+	copied.SetEDNS(resEDNS)
+	return &copied
+}
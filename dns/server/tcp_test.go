@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPServer - 127.0.0.1 の空いているポートで s の TCP リスナーを起動する
+func startTCPServer(t *testing.T, config ServerConfig) (*Server, string) {
+	t.Helper()
+	s := NewServer(config)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = s.ServeTCP(ln) }()
+	t.Cleanup(func() { _ = s.Stop() })
+	return s, ln.Addr().String()
+}
+
+// exchangeTCP - conn でクエリを送り、応答を 1 つ読む
+func exchangeTCP(t *testing.T, conn net.Conn, query *dns.Packet) *dns.Packet {
+	t.Helper()
+	writeTCPQuery(t, conn, query)
+	return readTCPResponse(t, conn)
+}
+
+func writeTCPQuery(t *testing.T, conn net.Conn, query *dns.Packet) {
+	t.Helper()
+	buf, err := query.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode query: %v", err)
+	}
+	if err := dns.WriteStreamMessage(conn, buf); err != nil {
+		t.Fatalf("failed to write query: %v", err)
+	}
+}
+
+func readTCPResponse(t *testing.T, conn net.Conn) *dns.Packet {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := dns.ReadStreamMessage(conn)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	res, err := dns.DecodePacket(buf)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return res
+}
+
+func TestServer_ServeTCP_pipelined(t *testing.T) {
+	// ARRANGE
+	// slow.example. is answered after fast.example., although it was asked first
+	release := make(chan struct{})
+	mux := NewServeMux()
+	mux.HandleFunc("slow.example.", func(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+		<-release
+		nameHandler(2).ServeDNS(ctx, w, r)
+	})
+	mux.HandleFunc("fast.example.", func(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+		nameHandler(1).ServeDNS(ctx, w, r)
+		close(release)
+	})
+	_, addr := startTCPServer(t, ServerConfig{Handler: mux})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	slow, fast := newTestQuery("slow.example."), newTestQuery("fast.example.")
+	slow.Id, fast.Id = 1, 2
+
+	// ACT
+	writeTCPQuery(t, conn, slow)
+	writeTCPQuery(t, conn, fast)
+	first := readTCPResponse(t, conn)
+	second := readTCPResponse(t, conn)
+
+	// ASSERT
+	type response struct {
+		Id      uint16
+		Answers int
+	}
+	want := []response{{Id: 2, Answers: 1}, {Id: 1, Answers: 2}}
+	got := []response{{Id: first.Id, Answers: len(first.Answers)}, {Id: second.Id, Answers: len(second.Answers)}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("responses: mismatch(-want, +got):\n%s", diff)
+	}
+}
+
+func TestServer_ServeTCP_keepalive(t *testing.T) {
+	_, addr := startTCPServer(t, ServerConfig{Handler: nameHandler(1), TCPIdleTimeout: 30 * time.Second})
+
+	cases := []struct {
+		label string
+		edns  *dns.EDNS
+		want  *dns.EDNSOption
+	}{
+		{
+			label: "ok/keepalive",
+			edns: &dns.EDNS{
+				UDPSize: dns.DefaultEDNSUDPSize,
+				Options: []*dns.EDNSOption{{Code: dns.EDNSOptionKeepalive, Data: []byte{}}},
+			},
+			// 30 seconds in units of 100 milliseconds
+			want: &dns.EDNSOption{Code: dns.EDNSOptionKeepalive, Data: []byte{0x01, 0x2c}},
+		},
+		{
+			label: "ok/no-keepalive",
+			edns:  &dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+			query := newTestQuery("www.example.com.")
+			query.SetEDNS(tc.edns)
+
+			// ACT
+			res := exchangeTCP(t, conn, query)
+
+			// ASSERT
+			edns := res.EDNS()
+			if edns == nil {
+				t.Fatalf("EDNS: want OPT record, got nil")
+			}
+			if diff := cmp.Diff(tc.want, edns.Option(dns.EDNSOptionKeepalive)); diff != "" {
+				t.Errorf("keepalive: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServer_ServeTCP_maxConnections(t *testing.T) {
+	// ARRANGE
+	_, addr := startTCPServer(t, ServerConfig{Handler: nameHandler(1), MaxTCPConnections: 1})
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer first.Close()
+	// make sure the first connection is being served
+	exchangeTCP(t, first, newTestQuery("www.example.com."))
+
+	// ACT
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+
+	// ASSERT
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("second connection: want EOF, got %v", err)
+	}
+	res := exchangeTCP(t, first, newTestQuery("www.example.com."))
+	if len(res.Answers) != 1 {
+		t.Errorf("first connection: want 1 answer, got %d", len(res.Answers))
+	}
+}
+
+func TestServer_ServeTCP_idleTimeout(t *testing.T) {
+	// ARRANGE
+	_, addr := startTCPServer(t, ServerConfig{Handler: nameHandler(1), TCPIdleTimeout: 100 * time.Millisecond})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	exchangeTCP(t, conn, newTestQuery("www.example.com."))
+
+	// ACT
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+
+	// ASSERT
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("idle connection: want EOF, got %v", err)
+	}
+}
+
+func TestServer_ServeTCP_writeTimeout(t *testing.T) {
+	// ARRANGE
+	s, addr := startTCPServer(t, ServerConfig{Handler: nameHandler(3000), TCPWriteTimeout: 100 * time.Millisecond})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// ACT
+	// the responses fill the socket buffers, as none of them is read
+	for i := 0; i < 200; i++ {
+		writeTCPQuery(t, conn, newTestQuery("www.example.com."))
+	}
+
+	// ASSERT
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.tcpConns)
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the connection that stopped reading was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+)
+
+// udpPayloadSize - クライアントが UDP で受け取れる応答の大きさ (RFC 6891 section 6.2.5)
+//
+// A client without EDNS takes 512 bytes. Otherwise the size it advertised is
+// used, but never more than limit, the largest the server sends.
+func udpPayloadSize(query *dns.Packet, limit int) int {
+	edns := query.EDNS()
+	if edns == nil {
+		return dns.MinEDNSUDPSize
+	}
+	return min(max(int(edns.UDPSize), dns.MinEDNSUDPSize), limit)
+}
+
+// withUDPSize - OPT レコードで広告する UDP の大きさを size にした応答を返す
+func withUDPSize(res *dns.Packet, size int) *dns.Packet {
+	edns := res.EDNS()
+	if edns == nil || int(edns.UDPSize) == size {
+		return res
+	}
+	edns.UDPSize = uint16(size)
+	copied := *res
+	copied.SetEDNS(edns)
+	return &copied
+}
+
+// fitResponse - 応答を size バイト以内で符号化する (RFC 2181 section 9)
+//
+// Additional records are dropped first, from the last one, then the authority
+// section of a response that has answers. Only when the answer section itself
+// does not fit is TC set and every section emptied. The OPT record is always
+// kept.
+func fitResponse(res *dns.Packet, size int) ([]byte, error) {
+	buf, err := res.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("encode response: %w", err)
+	}
+	if len(buf) <= size {
+		return buf, nil
+	}
+
+	var additions, opt []*dns.ResourceRecord
+	for _, rr := range res.Additions {
+		if rr.RData.ResourceType() == dns.ResourceTypeOPT {
+			opt = append(opt, rr)
+		} else {
+			additions = append(additions, rr)
+		}
+	}
+	fitted := *res
+	encode := func() ([]byte, bool, error) {
+		buf, err := fitted.Encode()
+		if err != nil {
+			return nil, false, fmt.Errorf("encode response: %w", err)
+		}
+		return buf, len(buf) <= size, nil
+	}
+
+	for len(additions) > 0 {
+		additions = additions[:len(additions)-1]
+		fitted.Additions = append(additions[:len(additions):len(additions)], opt...)
+		if buf, ok, err := encode(); err != nil || ok {
+			return buf, err
+		}
+	}
+	if len(fitted.Answers) > 0 {
+		// a negative answer keeps its SOA, which tells how long to cache it
+		fitted.Authorities = nil
+		if buf, ok, err := encode(); err != nil || ok {
+			return buf, err
+		}
+	}
+
+	fitted.TC = true
+	fitted.Answers = nil
+	fitted.Authorities = nil
+	fitted.Additions = opt
+	buf, _, err = encode()
+	return buf, err
+}
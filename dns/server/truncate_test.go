@@ -0,0 +1,195 @@
+package server
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"testing"
+	"time"
+)
+
+// records - name の A レコードを n 個作る
+func records(name string, n int) []*dns.ResourceRecord {
+	rrs := make([]*dns.ResourceRecord, 0, n)
+	for i := 0; i < n; i++ {
+		rrs = append(rrs, &dns.ResourceRecord{Name: name, Class: dns.ClassIN, TTL: 60, RData: &dns.AData{Address: []byte{192, 0, 2, byte(i)}}})
+	}
+	return rrs
+}
+
+func newTestResponse(answers, authorities, additions int, edns bool) *dns.Packet {
+	res := NewResponse(newTestQuery("www.example.com."))
+	res.Answers = records("www.example.com.", answers)
+	res.Authorities = records("example.com.", authorities)
+	res.Additions = records("ns.example.com.", additions)
+	if edns {
+		res.SetEDNS(&dns.EDNS{UDPSize: dns.DefaultEDNSUDPSize})
+	}
+	return res
+}
+
+func TestUDPPayloadSize(t *testing.T) {
+	cases := []struct {
+		label string
+		edns  *dns.EDNS
+		want  int
+	}{
+		{label: "ok/no-edns", want: 512},
+		{label: "ok/advertised", edns: &dns.EDNS{UDPSize: 1000}, want: 1000},
+		{label: "ok/capped", edns: &dns.EDNS{UDPSize: 4096}, want: 1232},
+		{label: "ok/below-minimum", edns: &dns.EDNS{UDPSize: 100}, want: 512},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			query := newTestQuery("www.example.com.")
+			query.SetEDNS(tc.edns)
+
+			// ACT
+			got := udpPayloadSize(query, 1232)
+
+			// ASSERT
+			if got != tc.want {
+				t.Errorf("want %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFitResponse(t *testing.T) {
+	// summary は fitResponse が残したもの。Additions は OPT を数えない
+	type summary struct {
+		TC          bool
+		Answers     int
+		Authorities int
+		Additions   int
+		OPT         bool
+	}
+
+	cases := []struct {
+		label string
+		res   *dns.Packet
+		size  int
+		want  summary
+	}{
+		{
+			label: "ok/fits",
+			res:   newTestResponse(2, 1, 1, true),
+			size:  512,
+			want:  summary{Answers: 2, Authorities: 1, Additions: 1, OPT: true},
+		},
+		{
+			// 225 bytes up to the authority section and 11 for OPT leave room
+			// for 17 additional records: 19 bytes for the first one and 16 for
+			// each of the others once their names are compressed
+			label: "ok/drop-additional",
+			res:   newTestResponse(10, 2, 20, true),
+			size:  512,
+			want:  summary{Answers: 10, Authorities: 2, Additions: 17, OPT: true},
+		},
+		{
+			label: "ok/drop-authority",
+			res:   newTestResponse(20, 20, 5, true),
+			size:  512,
+			want:  summary{Answers: 20, OPT: true},
+		},
+		{
+			label: "ok/truncated",
+			res:   newTestResponse(40, 1, 1, true),
+			size:  512,
+			want:  summary{TC: true, OPT: true},
+		},
+		{
+			label: "ok/truncated-without-edns",
+			res:   newTestResponse(40, 0, 0, false),
+			size:  512,
+			want:  summary{TC: true},
+		},
+		{
+			label: "ok/negative-keeps-authority",
+			res:   newTestResponse(0, 40, 0, true),
+			size:  512,
+			want:  summary{TC: true, OPT: true},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ACT
+			buf, err := fitResponse(tc.res, tc.size)
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("fitResponse: unexpected error: %v", err)
+			}
+			if len(buf) > tc.size {
+				t.Errorf("size: want at most %d, got %d", tc.size, len(buf))
+			}
+			got, err := dns.DecodePacket(buf)
+			if err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			s := summary{
+				TC:          got.TC,
+				Answers:     len(got.Answers),
+				Authorities: len(got.Authorities),
+				Additions:   len(got.Additions),
+				OPT:         got.EDNS() != nil,
+			}
+			if s.OPT {
+				s.Additions--
+			}
+			if diff := cmp.Diff(tc.want, s); diff != "" {
+				t.Errorf("response: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServer_ServeUDP_truncated(t *testing.T) {
+	cases := []struct {
+		label       string
+		edns        *dns.EDNS
+		wantTC      bool
+		wantUDPSize uint16
+	}{
+		{
+			label:  "ok/no-edns",
+			wantTC: true,
+		},
+		{
+			label:       "ok/edns",
+			edns:        &dns.EDNS{UDPSize: 4096},
+			wantUDPSize: 1232,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			// 40 answers take about 700 bytes
+			_, conn := startUDPServer(t, ServerConfig{Handler: nameHandler(40)})
+			query := newTestQuery("www.example.com.")
+			query.SetEDNS(tc.edns)
+
+			// ACT
+			writeUDPQuery(t, conn, query)
+			res, err := readUDPResponse(conn, 5*time.Second)
+
+			// ASSERT
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if res.TC != tc.wantTC {
+				t.Errorf("TC: want %v, got %v", tc.wantTC, res.TC)
+			}
+			var udpSize uint16
+			if edns := res.EDNS(); edns != nil {
+				udpSize = edns.UDPSize
+			}
+			if udpSize != tc.wantUDPSize {
+				t.Errorf("UDP size: want %d, got %d", tc.wantUDPSize, udpSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/niioka/dnsbox/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"slices"
+)
+
+const (
+	// defaultWorkers is high because most queries wait for an upstream
+	// rather than for the CPU.
+	defaultWorkers   = 256
+	defaultQueueSize = 1024
+)
+
+// errReusePortUnsupported is returned when several sockets are asked for on a
+// platform without SO_REUSEPORT.
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// udpRequest は worker を待つクエリ
+type udpRequest struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+	// buf comes from bufPool and holds the query in its first n bytes
+	buf *[]byte
+	n   int
+}
+
+// ServeUDP - conn でクエリを受け付け、worker に渡す
+//
+// Several sockets may be served at once. They share the workers and the
+// queue; a query that finds the queue full is dropped. The socket is closed
+// by Shutdown or Stop, not when ServeUDP returns.
+func (s *Server) ServeUDP(conn *net.UDPConn) error {
+	if !s.trackUDPConn(conn) {
+		_ = conn.Close()
+		return ErrServerClosed
+	}
+	s.startWorkers.Do(func() {
+		for i := 0; i < s.workers; i++ {
+			go s.work()
+		}
+	})
+	log.Printf("Started DNS Server on UDP %s.", conn.LocalAddr())
+
+	for {
+		buf := s.bufPool.Get().(*[]byte)
+		n, addr, err := conn.ReadFromUDP(*buf)
+		if err != nil {
+			s.bufPool.Put(buf)
+			// the socket stays open for the responses while shutting down
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Errorf("Failed to read from UDP: %v", err)
+			continue
+		}
+		if n > s.maxUDPSize {
+			s.bufPool.Put(buf)
+			s.oversized.Add(1)
+			log.Debugf("Dropped a query of more than %d bytes from %v", s.maxUDPSize, addr)
+			continue
+		}
+
+		s.inflight.Add(1)
+		select {
+		case s.queue <- udpRequest{conn: conn, addr: addr, buf: buf, n: n}:
+		default:
+			s.inflight.Done()
+			s.bufPool.Put(buf)
+			s.dropped.Add(1)
+			log.Debugf("Dropped a query from %v, the queue is full", addr)
+		}
+	}
+}
+
+// trackUDPConn - 止まっていなければ conn を登録する。Start で登録済みなら何もしない
+func (s *Server) trackUDPConn(conn *net.UDPConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	if !slices.Contains(s.udpConns, conn) {
+		s.udpConns = append(s.udpConns, conn)
+	}
+	return true
+}
+
+// work - サーバーが止まるまでキューのクエリに答え続ける
+func (s *Server) work() {
+	for {
+		select {
+		case req := <-s.queue:
+			s.handleRequest(req)
+		case <-s.baseCtx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) handleRequest(req udpRequest) {
+	defer s.inflight.Done()
+	// the decoded packet may share memory with buf, so it is only reused
+	// once the handler returned
+	defer s.bufPool.Put(req.buf)
+	rxPacket, err := dns.DecodePacket((*req.buf)[:req.n])
+	if err != nil {
+		log.Errorf("Failed to decode packet: %v", err)
+		return
+	}
+	s.handler.ServeDNS(s.baseCtx, &udpResponseWriter{conn: req.conn, addr: req.addr, query: rxPacket, maxUDPSize: s.maxUDPSize}, rxPacket)
+}
+
+// listenUDP - addr で n 個の UDP ソケットを開く。2 つ以上なら SO_REUSEPORT を使う
+func listenUDP(addr string, n int) ([]*net.UDPConn, error) {
+	if n <= 1 {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+
+	conns := make([]*net.UDPConn, 0, n)
+	closeAll := func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	for len(conns) < n {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("listen with SO_REUSEPORT: %w", err)
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+		// the other sockets join the port the first one got, which matters
+		// when addr asked for any port
+		addr = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPServer - 127.0.0.1 の空いているポートで s の UDP ソケットを開き、接続済みのソケットを返す
+func startUDPServer(t *testing.T, config ServerConfig) (*Server, *net.UDPConn) {
+	t.Helper()
+	s := NewServer(config)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = s.ServeUDP(conn) }()
+	t.Cleanup(func() { _ = s.Stop() })
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return s, client
+}
+
+func writeUDPQuery(t *testing.T, conn *net.UDPConn, query *dns.Packet) {
+	t.Helper()
+	buf, err := query.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode query: %v", err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("failed to write query: %v", err)
+	}
+}
+
+func readUDPResponse(conn *net.UDPConn, timeout time.Duration) (*dns.Packet, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, dns.MaxMessageLength)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return dns.DecodePacket(buf[:n])
+}
+
+// paddedQuery - size バイト近くまで EDNS Padding で膨らませたクエリ
+func paddedQuery(size int) *dns.Packet {
+	query := newTestQuery("www.example.com.")
+	// EDNS option 12 is Padding (RFC 7830)
+	query.SetEDNS(&dns.EDNS{
+		UDPSize: dns.DefaultEDNSUDPSize,
+		Options: []*dns.EDNSOption{{Code: 12, Data: make([]byte, size)}},
+	})
+	return query
+}
+
+func TestServer_ServeUDP_size(t *testing.T) {
+	cases := []struct {
+		label         string
+		query         *dns.Packet
+		wantAnswered  bool
+		wantOversized uint64
+	}{
+		{
+			label:        "ok/larger-than-1024",
+			query:        paddedQuery(1100),
+			wantAnswered: true,
+		},
+		{
+			label:         "Err/oversized",
+			query:         paddedQuery(1300),
+			wantOversized: 1,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			s, conn := startUDPServer(t, ServerConfig{Handler: nameHandler(1)})
+
+			// ACT
+			writeUDPQuery(t, conn, tc.query)
+			res, err := readUDPResponse(conn, 500*time.Millisecond)
+
+			// ASSERT
+			if tc.wantAnswered && err != nil {
+				t.Fatalf("want response, got error: %v", err)
+			}
+			if !tc.wantAnswered && res != nil {
+				t.Errorf("want no response, got %v", res)
+			}
+			if diff := cmp.Diff(ServerStats{Oversized: tc.wantOversized}, s.Stats()); diff != "" {
+				t.Errorf("stats: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServer_ServeUDP_overload(t *testing.T) {
+	// ARRANGE
+	// the only worker is held by the first query, and one more waits in the queue
+	release := make(chan struct{})
+	blocking := HandlerFunc(func(ctx context.Context, w ResponseWriter, r *dns.Packet) {
+		<-release
+		nameHandler(1).ServeDNS(ctx, w, r)
+	})
+	s, conn := startUDPServer(t, ServerConfig{Handler: blocking, Workers: 1, QueueSize: 1})
+
+	// ACT
+	for i := 0; i < 5; i++ {
+		query := newTestQuery("www.example.com.")
+		query.Id = uint16(i)
+		writeUDPQuery(t, conn, query)
+		// let the worker take the first query before the queue fills
+		time.Sleep(20 * time.Millisecond)
+	}
+	stats := s.Stats()
+	close(release)
+	answered := 0
+	for {
+		if _, err := readUDPResponse(conn, 500*time.Millisecond); err != nil {
+			break
+		}
+		answered++
+	}
+
+	// ASSERT
+	if diff := cmp.Diff(ServerStats{Dropped: 3}, stats); diff != "" {
+		t.Errorf("stats: mismatch(-want, +got):\n%s", diff)
+	}
+	if answered != 2 {
+		t.Errorf("answered: want 2, got %d", answered)
+	}
+}
+
+func TestListenUDP_reusePort(t *testing.T) {
+	// ARRANGE & ACT
+	conns, err := listenUDP("127.0.0.1:0", 3)
+
+	// ASSERT
+	if errors.Is(err, errReusePortUnsupported) {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	if err != nil {
+		t.Fatalf("listenUDP: unexpected error: %v", err)
+	}
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	if len(conns) != 3 {
+		t.Fatalf("sockets: want 3, got %d", len(conns))
+	}
+	for _, conn := range conns[1:] {
+		if conn.LocalAddr().String() != conns[0].LocalAddr().String() {
+			t.Errorf("address: want %v, got %v", conns[0].LocalAddr(), conn.LocalAddr())
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/niioka/dnsbox/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Zone is a set of records the server answers for authoritatively.
+type Zone struct {
+	Origin  string
+	Records []*dns.ResourceRecord
+}
+
+// findZone - name を含むゾーンのうち最も深いものを返す
+func findZone(zones []*Zone, name string) *Zone {
+	var found *Zone
+	for _, zone := range zones {
+		if !dns.IsSubDomain(name, zone.Origin) {
+			continue
+		}
+		if found == nil || dns.CountLabels(zone.Origin) > dns.CountLabels(found.Origin) {
+			found = zone
+		}
+	}
+	return found
+}
+
+// soa - ゾーンの SOA レコードを返す
+func (z *Zone) soa() []*dns.ResourceRecord {
+	return dns.RRset(z.Records, z.Origin, dns.ResourceTypeSOA)
+}
+
+// exists - name にレコードがあるか、name の配下にレコードがあるか (empty non-terminal)
+func (z *Zone) exists(name string) bool {
+	for _, rr := range z.Records {
+		if dns.IsSubDomain(rr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegation - name がゾーン内の委任の配下にあれば、その NS レコードを返す
+func (z *Zone) delegation(name string) []*dns.ResourceRecord {
+	var found []*dns.ResourceRecord
+	for _, rr := range z.Records {
+		if rr.RData.ResourceType() != dns.ResourceTypeNS || dns.CanonicalName(rr.Name) == dns.CanonicalName(z.Origin) {
+			continue
+		}
+		if dns.IsSubDomain(name, rr.Name) {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
+
+// Authoritative - ゾーンのレコードから権威を持って答えるハンドラー
+type Authoritative struct {
+	zones []*Zone
+}
+
+// NewAuthoritative - zones に答えるハンドラーを作る
+//
+// Register it on a ServeMux for the origin of every zone, or use
+// Authoritative.Register.
+func NewAuthoritative(zones []*Zone) *Authoritative {
+	return &Authoritative{zones: zones}
+}
+
+// Register - 全てのゾーンの起点に自身を登録する
+func (a *Authoritative) Register(mux *ServeMux) {
+	for _, zone := range a.zones {
+		mux.Handle(zone.Origin, a)
+	}
+}
+
+// ServeDNS - 質問が 1 つでなければ FORMERR、担当するゾーンがなければ REFUSED を返す
+func (a *Authoritative) ServeDNS(_ context.Context, w ResponseWriter, r *dns.Packet) {
+	if len(r.Questions) != 1 {
+		writeRCode(w, r, dns.RCodeFormatError)
+		return
+	}
+	zone := findZone(a.zones, r.Questions[0].Qname)
+	if zone == nil {
+		writeRCode(w, r, dns.RCodeRefused)
+		return
+	}
+	var echo *dns.ClientSubnet
+	if edns := r.EDNS(); edns != nil {
+		if subnet, err := edns.ClientSubnet(); err == nil && subnet != nil {
+			// the answer is the same for every client (RFC 7871 section 7.2.2)
+			echo = &dns.ClientSubnet{Prefix: subnet.Prefix}
+		}
+	}
+	writeMsg(w, withEDNS(a.answer(zone, NewResponse(r)), r.EDNS(), echo))
+}
+
+// answer - 自身のゾーンから応答を組み立てる
+//
+// CNAME and DNAME records are followed as long as the chain stays in the
+// zones of this handler, so the client receives the whole chain at once
+// (RFC 1034 4.3.2).
+func (a *Authoritative) answer(zone *Zone, txPacket *dns.Packet) *dns.Packet {
+	question := txPacket.Questions[0]
+	txPacket.AA = true
+	chain := &dns.AliasChain{}
+	name := dns.Fqdn(question.Qname)
+	for {
+		if ns := zone.delegation(name); len(ns) > 0 {
+			// the name belongs to a child zone
+			if len(txPacket.Answers) == 0 {
+				txPacket.AA = false
+			}
+			txPacket.Authorities = ns
+			return txPacket
+		}
+
+		target, rrset, err := chain.Follow(zone.Records, name, question.Qtype)
+		txPacket.Answers = chain.Records
+		if err != nil {
+			log.Errorf("Failed to follow aliases of %s: %v", question.Qname, err)
+			if errors.Is(err, dns.ErrAliasLoop) || errors.Is(err, dns.ErrChainTooLong) {
+				txPacket.RCode = dns.RCodeServerFailure
+			}
+			return txPacket
+		}
+		if rrset != nil {
+			txPacket.Answers = append(txPacket.Answers, rrset...)
+			return txPacket
+		}
+		if target == name || question.Qtype == dns.ResourceTypeCNAME {
+			if !zone.exists(target) {
+				txPacket.RCode = dns.RCodeNameError
+			}
+			txPacket.Authorities = zone.soa()
+			return txPacket
+		}
+
+		// the chain continues in another zone; follow it only if it is ours
+		next := findZone(a.zones, target)
+		if next == nil {
+			return txPacket
+		}
+		zone, name = next, target
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/niioka/dnsbox/dns"
+	"testing"
+)
+
+func TestAuthoritative_ServeDNS(t *testing.T) {
+	rr := func(name string, rdata dns.RData) *dns.ResourceRecord {
+		return &dns.ResourceRecord{Name: name, Class: dns.ClassIN, TTL: 300, RData: rdata}
+	}
+	comSOA := rr("example.com.", &dns.SOAData{MName: "ns.example.com.", RName: "admin.example.com.", Serial: 1, Minttl: 60})
+	netSOA := rr("example.net.", &dns.SOAData{MName: "ns.example.net.", RName: "admin.example.net.", Serial: 1, Minttl: 60})
+	wwwCNAME := rr("www.example.com.", &dns.CNAMEData{Target: "web.example.net."})
+	webA := rr("web.example.net.", &dns.AData{Address: []byte{192, 0, 2, 1}})
+	aliasDNAME := rr("alias.example.com.", &dns.DNAMEData{Target: "example.net."})
+	loopA := rr("loop1.example.com.", &dns.CNAMEData{Target: "loop2.example.com."})
+	loopB := rr("loop2.example.com.", &dns.CNAMEData{Target: "loop1.example.com."})
+	subNS := rr("sub.example.com.", &dns.NSData{Host: "ns.sub.example.com."})
+	outCNAME := rr("out.example.com.", &dns.CNAMEData{Target: "elsewhere.example.org."})
+
+	s := NewServer(ServerConfig{
+		Zones: []*Zone{
+			{Origin: "example.com.", Records: []*dns.ResourceRecord{comSOA, wwwCNAME, aliasDNAME, loopA, loopB, subNS, outCNAME}},
+			{Origin: "example.net.", Records: []*dns.ResourceRecord{netSOA, webA}},
+		},
+	})
+
+	cases := []struct {
+		label           string
+		qname           string
+		wantAA          bool
+		wantRCode       int
+		wantAnswers     []*dns.ResourceRecord
+		wantAuthorities []*dns.ResourceRecord
+	}{
+		{
+			label:       "ok/cname-across-zones",
+			qname:       "www.example.com.",
+			wantAA:      true,
+			wantAnswers: []*dns.ResourceRecord{wwwCNAME, webA},
+		},
+		{
+			label:       "ok/dname",
+			qname:       "web.alias.example.com.",
+			wantAA:      true,
+			wantAnswers: []*dns.ResourceRecord{aliasDNAME, rr("web.alias.example.com.", &dns.CNAMEData{Target: "web.example.net."}), webA},
+		},
+		{
+			label:       "ok/chain-leaves-our-zones",
+			qname:       "out.example.com.",
+			wantAA:      true,
+			wantAnswers: []*dns.ResourceRecord{outCNAME},
+		},
+		{
+			label:           "ok/nxdomain",
+			qname:           "missing.example.com.",
+			wantAA:          true,
+			wantRCode:       dns.RCodeNameError,
+			wantAuthorities: []*dns.ResourceRecord{comSOA},
+		},
+		{
+			label:           "ok/referral",
+			qname:           "www.sub.example.com.",
+			wantAuthorities: []*dns.ResourceRecord{subNS},
+		},
+		{
+			label:       "Err/loop",
+			qname:       "loop1.example.com.",
+			wantAA:      true,
+			wantRCode:   dns.RCodeServerFailure,
+			wantAnswers: []*dns.ResourceRecord{loopA, loopB},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			query := &dns.Packet{
+				Id:        1234,
+				QR:        dns.QRQuery,
+				RD:        true,
+				Questions: []*dns.Question{{Qname: tc.qname, Qtype: dns.ResourceTypeA, Qclass: dns.ClassIN}},
+			}
+
+			// ACT
+			res := serveQuery(s.handler, query, nil)
+
+			// ASSERT
+			if res.AA != tc.wantAA {
+				t.Errorf("AA: want %v, got %v", tc.wantAA, res.AA)
+			}
+			if res.RCode != tc.wantRCode {
+				t.Errorf("RCode: want %d, got %d", tc.wantRCode, res.RCode)
+			}
+			if diff := cmp.Diff(tc.wantAnswers, res.Answers); diff != "" {
+				t.Errorf("answers: mismatch(-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantAuthorities, res.Authorities); diff != "" {
+				t.Errorf("authorities: mismatch(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MaxMessageLength is the largest message that fits in the 2-byte length
+// prefix used by stream transports (RFC 1035 4.2.2).
+const MaxMessageLength = math.MaxUint16
+
+var ErrMessageTooLong = errors.New("message too long")
+
+// WriteStreamMessage - 2バイトの長さプレフィックスを付けてメッセージを書き込む
+func WriteStreamMessage(w io.Writer, msg []byte) error {
+	if len(msg) > MaxMessageLength {
+		return fmt.Errorf("%w: length=%d", ErrMessageTooLong, len(msg))
+	}
+	// write the prefix and the message at once so that the peer never sees
+	// a length without its payload
+	buf := make([]byte, 0, len(msg)+2)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg)))
+	buf = append(buf, msg...)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("write stream message: %w", err)
+	}
+	return nil
+}
+
+// ReadStreamMessage - 2バイトの長さプレフィックス付きのメッセージを読み込む
+func ReadStreamMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("read stream message length: %w", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("read stream message: %w", err)
+	}
+	return msg, nil
+}
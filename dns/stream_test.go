@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestStreamMessage(t *testing.T) {
+	// ARRANGE
+	var buf bytes.Buffer
+	msg := []byte{0x12, 0x34, 1, 0}
+
+	// ACT
+	if err := WriteStreamMessage(&buf, msg); err != nil {
+		t.Fatalf("WriteStreamMessage: unexpected error: %v", err)
+	}
+
+	// ASSERT
+	if want := []byte{0, 4, 0x12, 0x34, 1, 0}; !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("written bytes: want %v, got %v", want, buf.Bytes())
+	}
+	got, err := ReadStreamMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadStreamMessage: unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("ReadStreamMessage: want %v, got %v", msg, got)
+	}
+}
+
+func TestReadStreamMessage_short(t *testing.T) {
+	_, err := ReadStreamMessage(bytes.NewReader([]byte{0, 4, 0x12}))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("want %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestWriteStreamMessage_tooLong(t *testing.T) {
+	err := WriteStreamMessage(io.Discard, make([]byte, MaxMessageLength+1))
+	if !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("want %v, got %v", ErrMessageTooLong, err)
+	}
+}
@@ -3,13 +3,18 @@ module github.com/niioka/dnsbox
 go 1.23.2
 
 require (
-	github.com/davecgh/go-spew v1.1.1
 	github.com/go-chi/chi/v5 v5.2.1
 	github.com/google/go-cmp v0.7.0
+	github.com/quic-go/quic-go v0.54.1
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/sys v0.32.0
 )
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
-	golang.org/x/sys v0.32.0 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )
@@ -1,47 +1,115 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"github.com/niioka/dnsbox/api"
+	"github.com/niioka/dnsbox/dns/cache"
+	"github.com/niioka/dnsbox/dns/client"
 	"github.com/niioka/dnsbox/dns/server"
+	"github.com/niioka/dnsbox/supervisor"
 	log "github.com/sirupsen/logrus"
-	"os"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
-	var wg sync.WaitGroup
+	upstreams := flag.String("upstream", "8.8.8.8:53", "Comma separated list of upstream DNS servers")
+	strategyName := flag.String("strategy", "sequential", "Upstream selection strategy (sequential, round-robin, random, fastest)")
+	cacheSize := flag.Int("cache-size", 10000, "Maximum number of cached responses")
+	minTTL := flag.Duration("cache-min-ttl", 0, "Minimum TTL of cached answers")
+	maxTTL := flag.Duration("cache-max-ttl", 24*time.Hour, "Maximum TTL of cached answers")
+	staleTTL := flag.Duration("serve-stale", 0, "How long expired answers may be served while the upstreams are unreachable")
+	prefetch := flag.Bool("prefetch", false, "Refresh popular cache entries before they expire")
+	randomizeCase := flag.Bool("randomize-case", false, "Randomise the case of query names to detect spoofed answers (0x20)")
+	ecsModeName := flag.String("ecs", "strip", "What to forward as EDNS Client Subnet (strip, pass, add)")
+	blocklist := flag.String("block", "", "Comma separated list of domains answered with NXDOMAIN, including their subdomains")
+	queryLog := flag.Bool("query-log", false, "Log every query with its rcode and duration")
+	tcpIdleTimeout := flag.Duration("tcp-idle-timeout", 10*time.Second, "How long an idle TCP connection is kept open")
+	maxTCPConns := flag.Int("max-tcp-conns", 256, "Maximum number of TCP connections served at once")
+	workers := flag.Int("workers", 256, "Number of UDP queries answered at once")
+	queueSize := flag.Int("queue-size", 1024, "Number of UDP queries waiting for a worker before new ones are dropped")
+	reusePort := flag.Int("reuseport", 1, "Number of UDP sockets opened with SO_REUSEPORT")
+	maxUDPSize := flag.Int("max-udp-size", 1232, "Largest UDP message accepted or sent, advertised by EDNS")
+	tlsCert := flag.String("tls-cert", "", "Certificate file of the DNS-over-QUIC listener, which is only started with one")
+	tlsKey := flag.String("tls-key", "", "Private key file of the DNS-over-QUIC listener")
+	quicAddr := flag.String("quic-addr", ":853", "Address of the DNS-over-QUIC listener")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long the servers get to finish the requests in progress when stopping")
+	flag.Parse()
 
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-
-	apiServer := api.New()
-	dnsServer := server.NewServer(server.ServerConfig{})
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		// Start DNS Server
-		if err := dnsServer.Start(); err != nil {
-			log.Errorf("failed to start DNS server: %v", err)
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		// Start API Server
-		err := apiServer.Start()
+	strategy, ok := client.StrategyFromName(*strategyName)
+	if !ok {
+		log.Fatalf("unsupported strategy: %s", *strategyName)
+	}
+	ecsMode, ok := server.ClientSubnetModeFromName(*ecsModeName)
+	if !ok {
+		log.Fatalf("unsupported ECS mode: %s", *ecsModeName)
+	}
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
 		if err != nil {
-			log.Errorf("failed to start API server: %v", err)
+			log.Fatalf("failed to load the TLS certificate: %v", err)
 		}
-	}()
-	// 終了を待機する
-	<-ch
-	log.Info("Shutting down...")
-	if err := apiServer.Stop(); err != nil {
-		log.Errorf("failed to stop API server: %v", err)
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
+	dnsClient := client.New(client.Config{
+		Servers:       strings.Split(*upstreams, ","),
+		Strategy:      strategy,
+		RandomizeCase: *randomizeCase,
+	})
+	dnsCache := cache.New(cache.Config{
+		// concurrent misses of the same name share one upstream query
+		Client:   client.NewCoalescer(dnsClient),
+		Size:     *cacheSize,
+		MinTTL:   *minTTL,
+		MaxTTL:   *maxTTL,
+		StaleTTL: *staleTTL,
+		Prefetch: *prefetch,
+	})
 
-	if err := dnsServer.Stop(); err != nil {
-		log.Errorf("failed to stop DNS Server: %v", err)
+	apiServer := api.New(api.Config{Client: dnsCache})
+	mux := server.NewServeMux()
+	mux.Handle(".", server.NewForwarder(server.ForwarderConfig{Client: dnsCache, ClientSubnet: ecsMode}))
+	var middlewares []server.Middleware
+	if *queryLog {
+		middlewares = append(middlewares, server.Logging())
+	}
+	if *blocklist != "" {
+		middlewares = append(middlewares, server.Blocklist(strings.Split(*blocklist, ",")))
+	}
+	dnsServer := server.NewServer(server.ServerConfig{
+		Handler:           server.Chain(mux, middlewares...),
+		TCPIdleTimeout:    *tcpIdleTimeout,
+		MaxTCPConnections: *maxTCPConns,
+		Workers:           *workers,
+		QueueSize:         *queueSize,
+		ReusePort:         *reusePort,
+		MaxUDPSize:        *maxUDPSize,
+		QUICAddr:          *quicAddr,
+		TLSConfig:         tlsConfig,
+	})
+
+	// 終了のシグナルか、いずれかのサーバーが止まるまで動かす
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	sv := supervisor.New(supervisor.Config{ShutdownTimeout: *shutdownTimeout})
+	sv.Add("DNS server", dnsServer)
+	sv.Add("API server", apiServer)
+	err := sv.Run(ctx)
+	// the servers are stopped, so the prefetches are the last upstream queries
+	closeCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := dnsCache.Close(closeCtx); err != nil {
+		log.Errorf("Failed to close the cache: %v", err)
+	}
+	if err := dnsClient.Close(); err != nil {
+		log.Errorf("Failed to close the upstream connections: %v", err)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 }
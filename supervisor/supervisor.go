@@ -0,0 +1,149 @@
+// Package supervisor runs several servers together and shuts them all down
+// when one of them fails or the program is asked to stop.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+// ErrStoppedUnexpectedly is reported for a service whose Start returned
+// before it was asked to shut down, without an error of its own.
+var ErrStoppedUnexpectedly = errors.New("stopped unexpectedly")
+
+// Service は Supervisor が動かすサーバー
+type Service interface {
+	// Start serves until the service is shut down or fails.
+	Start(ctx context.Context) error
+	// Shutdown stops the service, waiting for the work in progress until
+	// ctx is done.
+	Shutdown(ctx context.Context) error
+}
+
+// ReadyService は待ち受けを始めたことを知らせられる Service
+type ReadyService interface {
+	Service
+	// Ready returns a channel closed once the service accepts requests.
+	Ready() <-chan struct{}
+}
+
+type Supervisor struct {
+	shutdownTimeout time.Duration
+	names           []string
+	services        []Service
+	ready           chan struct{}
+}
+
+type Config struct {
+	// ShutdownTimeout bounds the time the services get to finish their
+	// work. Defaults to 10s.
+	ShutdownTimeout time.Duration
+}
+
+func New(config Config) *Supervisor {
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	return &Supervisor{
+		shutdownTimeout: config.ShutdownTimeout,
+		ready:           make(chan struct{}),
+	}
+}
+
+// Add - name という名前で service を加える。Run の前に呼ぶ
+func (s *Supervisor) Add(name string, service Service) {
+	s.names = append(s.names, name)
+	s.services = append(s.services, service)
+}
+
+// Ready - 全ての ReadyService が待ち受けを始めると閉じるチャネルを返す
+func (s *Supervisor) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// result は Start の戻り値
+type result struct {
+	name string
+	err  error
+}
+
+// Run - 全てのサービスを起動し、ctx が終わるかいずれかが止まるまで待つ
+//
+// Then every service is shut down within ShutdownTimeout. Run returns the
+// first service failing, wrapped with its name, or nil when ctx ended it.
+// Errors of the shutdown are logged.
+func (s *Supervisor) Run(ctx context.Context) error {
+	// the services keep running after ctx is done, until Shutdown stops them
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	results := make(chan result, len(s.services))
+	for i, service := range s.services {
+		go func() {
+			results <- result{name: s.names[i], err: service.Start(runCtx)}
+		}()
+	}
+	go s.waitReady(runCtx)
+
+	var fatal error
+	remaining := len(s.services)
+	select {
+	case <-ctx.Done():
+		log.Info("Shutting down...")
+	case r := <-results:
+		remaining--
+		if r.err == nil {
+			r.err = ErrStoppedUnexpectedly
+		}
+		fatal = fmt.Errorf("%s: %w", r.name, r.err)
+		log.Errorf("Shutting down, %v", fatal)
+	}
+
+	s.shutdown()
+	// Start returns once its service was shut down; the rest is not reported
+	cancel()
+	for ; remaining > 0; remaining-- {
+		<-results
+	}
+	return fatal
+}
+
+// shutdown - 全てのサービスを同時に止める
+func (s *Supervisor) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, service := range s.services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := service.Shutdown(ctx); err != nil {
+				log.Errorf("Failed to shut down %s: %v", s.names[i], err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// waitReady - 全ての ReadyService の準備ができたら ready を閉じる
+func (s *Supervisor) waitReady(ctx context.Context) {
+	for i, service := range s.services {
+		rs, ok := service.(ReadyService)
+		if !ok {
+			continue
+		}
+		select {
+		case <-rs.Ready():
+		case <-ctx.Done():
+			return
+		}
+		log.Infof("%s is ready.", s.names[i])
+	}
+	close(s.ready)
+}
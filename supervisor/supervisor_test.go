@@ -0,0 +1,114 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeService は Shutdown されるか startErr を返すまで動く Service
+type fakeService struct {
+	// fail makes Start return startErr once closed
+	fail     chan struct{}
+	startErr error
+	stopped  chan struct{}
+	shutdown atomic.Int32
+	ready    chan struct{}
+}
+
+func newFakeService() *fakeService {
+	return &fakeService{
+		fail:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		ready:   make(chan struct{}),
+	}
+}
+
+func (f *fakeService) Start(ctx context.Context) error {
+	close(f.ready)
+	select {
+	case <-f.fail:
+		return f.startErr
+	case <-f.stopped:
+		return errors.New("closed")
+	}
+}
+
+func (f *fakeService) Shutdown(ctx context.Context) error {
+	if f.shutdown.Add(1) == 1 {
+		close(f.stopped)
+	}
+	return nil
+}
+
+func (f *fakeService) Ready() <-chan struct{} {
+	return f.ready
+}
+
+func TestSupervisor_Run(t *testing.T) {
+	errBind := errors.New("address already in use")
+
+	cases := []struct {
+		label string
+		// act either cancels the context or makes the first service fail
+		act     func(cancel context.CancelFunc, first *fakeService)
+		wantErr error
+	}{
+		{
+			label:   "ok/cancelled",
+			act:     func(cancel context.CancelFunc, _ *fakeService) { cancel() },
+			wantErr: nil,
+		},
+		{
+			label: "Err/service-failed",
+			act: func(_ context.CancelFunc, first *fakeService) {
+				first.startErr = errBind
+				close(first.fail)
+			},
+			wantErr: errBind,
+		},
+		{
+			label:   "Err/service-returned",
+			act:     func(_ context.CancelFunc, first *fakeService) { close(first.fail) },
+			wantErr: ErrStoppedUnexpectedly,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.label, func(t *testing.T) {
+			// ARRANGE
+			first, second := newFakeService(), newFakeService()
+			sv := New(Config{ShutdownTimeout: time.Second})
+			sv.Add("first", first)
+			sv.Add("second", second)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs := make(chan error, 1)
+
+			// ACT
+			go func() { errs <- sv.Run(ctx) }()
+			select {
+			case <-sv.Ready():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Ready: not closed")
+			}
+			tc.act(cancel, first)
+
+			// ASSERT
+			var err error
+			select {
+			case err = <-errs:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Run did not return")
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Run: want %v, got %v", tc.wantErr, err)
+			}
+			if second.shutdown.Load() != 1 {
+				t.Errorf("second: want shut down once, got %d", second.shutdown.Load())
+			}
+		})
+	}
+}